@@ -19,6 +19,8 @@ type AircraftData struct {
 	fdb.Schedule // We might get this from a schedule lookup
 	NumMessagesSeen int64
 	Source string // Where this data was sourced
+	Receivers []string `json:",omitempty"` // Whose reports were fused into Msg (see Fusion)
+	Kinematics *Kinematics `json:",omitempty"` // Filtered position & velocity, for PredictedPosition
 }
 
 type Signatures struct {
@@ -39,6 +41,14 @@ func (s Signatures)TooManySignatures() bool {
 type Airspace struct {
 	Signatures `json:"-"`                  // What we've seen "recently"; for deduping
 	Aircraft map[adsb.IcaoId]AircraftData  // "what is in the sky right now"; for realtime serving
+
+	// If set, Decorate is called whenever an aircraft appears, or changes
+	// callsign; it can fill in the Airframe & Schedule (see package enrich).
+	Decorate func(ad *AircraftData)        `json:"-"`
+
+	// If set, reports from different receivers are combined (see Fusion).
+	Fusion *Fusion                         `json:"-"`
+	reports map[adsb.IcaoId][]*adsb.CompositeMsg // Recent ones, for fusing
 }
 func (a Airspace)Sizes() (int64,int64) {
 	return int64(len(a.Signatures.CurrMsgs) + len(a.Signatures.PrevMsgs)), int64(len(a.Aircraft))
@@ -70,6 +80,7 @@ func (a *Airspace)rollMsgs() {
 		age := time.Since(a.Aircraft[k].Msg.GeneratedTimestampUTC)
 		if age > DefaultMaxQuietTime {
 			delete(a.Aircraft, k)
+			delete(a.reports, k)
 		}
 	}
 }
@@ -121,6 +132,17 @@ func (a Airspace)String() string {
 	return str
 }
 
+// }}}
+// {{{ a.Snapshot
+
+// Snapshot returns a copy of just the aircraft, which can be handed off to
+// other goroutines (the Airspace itself isn't safe for concurrent use).
+func (a Airspace)Snapshot() *Airspace {
+	aircraft := make(map[adsb.IcaoId]AircraftData, len(a.Aircraft))
+	for k,v := range a.Aircraft { aircraft[k] = v }
+	return &Airspace{Aircraft: aircraft}
+}
+
 // }}}
 // {{{ a.Youngest
 
@@ -149,12 +171,33 @@ func (a *Airspace) MaybeUpdate(msgs []*adsb.CompositeMsg) []*adsb.CompositeMsg {
 
 	for _,msg := range msgs {
 		if a.thisIsNewContent(msg) {
-			numMsg := int64(0)
-			if _,exists := a.Aircraft[msg.Icao24]; exists==true {
-				numMsg = a.Aircraft[msg.Icao24].NumMessagesSeen
-			}
 			ret = append(ret,msg)
-			a.Aircraft[msg.Icao24] = AircraftData{Msg: msg, NumMessagesSeen: int64(numMsg+1)}
+
+			prev,exists := a.Aircraft[msg.Icao24]
+			m,receivers := msg, []string(nil)
+			if a.Fusion != nil {
+				if m,receivers = a.fuse(msg); m == nil && exists {
+					prev.NumMessagesSeen++ // Too old to improve on what we have
+					a.Aircraft[msg.Icao24] = prev
+					continue
+				} else if m == nil {
+					m = msg
+				}
+			}
+
+			ad := AircraftData{Msg: m, NumMessagesSeen: prev.NumMessagesSeen+1, Source: prev.Source}
+			ad.Receivers = receivers
+			ad.Kinematics = prev.Kinematics.Update(msg) // Each receiver's report, unfused
+			ad.Airframe = prev.Airframe // An airframe stays the same airframe ...
+
+			newCallsign := exists && m.Callsign != "" && m.Callsign != prev.Msg.Callsign
+			if !newCallsign {
+				ad.Schedule = prev.Schedule // ... but a new callsign is a new flight
+			}
+			if a.Decorate != nil && (!exists || newCallsign) {
+				a.Decorate(&ad)
+			}
+			a.Aircraft[msg.Icao24] = ad
 		}
 	}
 	
@@ -106,3 +106,30 @@ func TestCompleteAgeout(t *testing.T) {
 		t.Errorf("Repopulation of init msgs: expected %d new, got %d", len(msgs1), len(new))
 	}
 }
+
+func TestDecorate(t *testing.T) {
+	calls := map[adsb.IcaoId]int{}
+	a := Airspace{}
+	a.Decorate = func(ad *AircraftData) {
+		calls[ad.Msg.Icao24]++
+		ad.Registration = "N" + string(ad.Msg.Icao24)
+		ad.Schedule.ICAO = ad.Msg.Callsign[:3]
+	}
+
+	a.MaybeUpdate(msgs(bank1))
+	a.MaybeUpdate(msgs(bank3)) // Updates A81BD2 & A81BD3, same callsigns
+	for id,n := range calls {
+		if n != 1 { t.Errorf("%s: decorated %d times", id, n) }
+	}
+	if ad := a.Aircraft["A81BD3"]; ad.Registration != "NA81BD3" || ad.Schedule.ICAO != "JKL" {
+		t.Errorf("decoration lost on update: %+v", ad)
+	}
+
+	// A new callsign is a new flight; the airframe stays, but the schedule goes
+	a.Decorate = func(ad *AircraftData) { calls[ad.Msg.Icao24]++ }
+	m := msgs(strings.Replace(bank3, "JKL1234,36000,305,10,36.69804", "XYZ999,36000,305,10,36.71111", 1))
+	a.MaybeUpdate(m[3:])
+	if ad := a.Aircraft["A81BD3"]; calls["A81BD3"] != 2 || ad.Registration != "NA81BD3" || ad.Schedule.ICAO != "" {
+		t.Errorf("new callsign: %d calls, %+v", calls["A81BD3"], ad)
+	}
+}
@@ -0,0 +1,124 @@
+package airspace
+
+import(
+	"math"
+	"sort"
+	"time"
+
+	"github.com/skypies/adsb"
+	"github.com/skypies/geo"
+)
+
+// DefaultFusionWindow is how far apart reports can be, and still get fused.
+var DefaultFusionWindow = 2 * time.Second
+
+// Fusion, if set on an Airspace, has it combine the reports that different
+// receivers make of an aircraft, rather than taking whichever arrived
+// last. Of the reports within Window of the newest one:
+//   - the position comes from ADS-B if there is any, else MLAT; it is the
+//     newest one, smoothed with the others of the same kind (each moved
+//     forward along its track to the newest one's time, and weighted
+//     towards the more recent)
+//   - everything else (altitude, speed, callsign, ...) comes from the newest
+//     report that has it
+// AircraftData.Receivers lists the receivers whose reports were combined.
+// Fusion only changes the aircraft's state; MaybeUpdate still returns all
+// the new msgs, as they arrived.
+type Fusion struct {
+	Window time.Duration // Zero means DefaultFusionWindow
+}
+
+// {{{ a.fuse
+
+// fuse adds msg to the aircraft's recent reports, and returns the new best
+// estimate of its state, with the receivers behind it. If msg is too old
+// to make a difference, it returns nil.
+func (a *Airspace)fuse(msg *adsb.CompositeMsg) (*adsb.CompositeMsg, []string) {
+	w := a.Fusion.Window
+	if w <= 0 { w = DefaultFusionWindow }
+	if a.reports == nil { a.reports = map[adsb.IcaoId][]*adsb.CompositeMsg{} }
+
+	newest := msg.GeneratedTimestampUTC
+	for _,r := range a.reports[msg.Icao24] {
+		if r.GeneratedTimestampUTC.After(newest) { newest = r.GeneratedTimestampUTC }
+	}
+	if newest.Sub(msg.GeneratedTimestampUTC) > w { return nil, nil }
+
+	reports := make([]*adsb.CompositeMsg, 0, len(a.reports[msg.Icao24])+1)
+	for _,r := range append(a.reports[msg.Icao24], msg) {
+		if newest.Sub(r.GeneratedTimestampUTC) <= w { reports = append(reports, r) }
+	}
+	sort.Stable(adsb.CompositeMsgPtrByTimeAsc(reports))
+	a.reports[msg.Icao24] = reports
+
+	latest := func(ok func(m *adsb.CompositeMsg) bool) *adsb.CompositeMsg {
+		for i := len(reports)-1; i >= 0; i-- {
+			if ok(reports[i]) { return reports[i] }
+		}
+		return nil
+	}
+	hasPos := func(m *adsb.CompositeMsg) bool { return !m.Position.IsNil() }
+
+	base := latest(func(m *adsb.CompositeMsg) bool { return hasPos(m) && !m.IsMLAT() })
+	if base == nil { base = latest(hasPos) }
+	if base == nil { base = reports[len(reports)-1] }
+
+	fused := *base
+	if hasPos(base) { fused.Position = smoothPosition(reports, base, w) }
+
+	// The rest comes from the newest report that has it
+	var gotCallsign, gotSquawk, gotAltitude, gotVelocity bool
+	for i := len(reports)-1; i >= 0; i-- {
+		r := reports[i]
+		if !gotCallsign && r.Callsign != "" { fused.Callsign,gotCallsign = r.Callsign, true }
+		if !gotSquawk && r.Squawk != "" { fused.Squawk,gotSquawk = r.Squawk, true }
+		if !gotAltitude && r.Altitude != 0 { fused.Altitude,gotAltitude = r.Altitude, true }
+		if !gotVelocity && r.GroundSpeed != 0 { // Speed, track & vertical rate arrive together
+			fused.GroundSpeed,fused.Track,fused.VerticalRate = r.GroundSpeed, r.Track, r.VerticalRate
+			gotVelocity = true
+		}
+	}
+
+	seen := map[string]bool{}
+	receivers := []string{}
+	for _,r := range reports {
+		if !seen[r.ReceiverName] { receivers = append(receivers, r.ReceiverName) }
+		seen[r.ReceiverName] = true
+	}
+	sort.Strings(receivers)
+
+	return &fused, receivers
+}
+
+// }}}
+// {{{ smoothPosition
+
+// smoothPosition averages the positions of the reports from the same data
+// system as base, each moved forward to base's time (at its own speed &
+// track), and weighted by how recent it is.
+func smoothPosition(reports []*adsb.CompositeMsg, base *adsb.CompositeMsg, window time.Duration) geo.Latlong {
+	lat,long,total := 0.0, 0.0, 0.0
+	for _,r := range reports {
+		if r.Position.IsNil() || r.IsMLAT() != base.IsMLAT() { continue }
+
+		age := base.GeneratedTimestampUTC.Sub(r.GeneratedTimestampUTC)
+		pos := r.Position
+		if r.GroundSpeed > 0 && age > 0 {
+			// (Not MoveNM; geo converts NM to KM the wrong way round)
+			pos = pos.MoveKM(float64(r.Track), geo.NM2KM(float64(r.GroundSpeed) * age.Hours()))
+		}
+		weight := math.Exp(-2 * age.Seconds() / window.Seconds())
+		lat,long,total = lat + weight*pos.Lat, long + weight*pos.Long, total + weight
+	}
+	return geo.Latlong{Lat:lat/total, Long:long/total}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,111 @@
+package airspace
+
+import(
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/skypies/adsb"
+	"github.com/skypies/geo"
+)
+
+var tFusion = time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// report makes a msg from receiver rx, at tFusion+secs
+func report(rx, kind string, secs float64, lat, long float64, alt int64) *adsb.CompositeMsg {
+	return &adsb.CompositeMsg{
+		ReceiverName: rx,
+		Msg: adsb.Msg{
+			Type:                  kind,
+			Icao24:                "A81BD0",
+			GeneratedTimestampUTC: tFusion.Add(time.Duration(secs * float64(time.Second))),
+			Position:              geo.Latlong{Lat:lat, Long:long},
+			Altitude:              alt,
+		},
+	}
+}
+
+func TestFusionPrefersADSB(t *testing.T) {
+	a := NewAirspace()
+	a.Fusion = &Fusion{}
+
+	a.MaybeUpdate([]*adsb.CompositeMsg{
+		report("A", "MSG", 0, 37.0, -122.0, 10000),
+		report("B", "MLAT", 1, 37.5, -122.5, 10100),
+	})
+	ad := a.Aircraft["A81BD0"]
+	if ad.Msg.Position.Lat != 37.0 || ad.Msg.ReceiverName != "A" {
+		t.Errorf("MLAT position won over ADS-B: %s from %s", ad.Msg.Position, ad.Msg.ReceiverName)
+	}
+	if ad.Msg.Altitude != 10100 { t.Errorf("altitude %d; should be the newest", ad.Msg.Altitude) }
+	if !reflect.DeepEqual(ad.Receivers, []string{"A", "B"}) { t.Errorf("receivers %v", ad.Receivers) }
+	if ad.NumMessagesSeen != 2 { t.Errorf("%d msgs seen", ad.NumMessagesSeen) }
+
+	// Once the ADS-B report is out of the window, MLAT is all we have
+	a.MaybeUpdate([]*adsb.CompositeMsg{report("B", "MLAT", 2.5, 37.6, -122.6, 10200)})
+	ad = a.Aircraft["A81BD0"]
+	w := math.Exp(-1.5) // The two MLAT reports are 1.5s apart (and stationary)
+	if want := (37.5*w + 37.6) / (w + 1); math.Abs(ad.Msg.Position.Lat - want) > 1e-9 {
+		t.Errorf("smoothed MLAT position %s, wanted lat %f", ad.Msg.Position, want)
+	}
+	if !reflect.DeepEqual(ad.Receivers, []string{"B"}) { t.Errorf("receivers %v", ad.Receivers) }
+}
+
+func TestFusionNewestWins(t *testing.T) {
+	a := NewAirspace()
+	a.Fusion = &Fusion{Window:time.Second}
+
+	a.MaybeUpdate([]*adsb.CompositeMsg{report("A", "MSG", 5, 37.1, -122.0, 10000)})
+	first := a.Aircraft["A81BD0"].Msg
+
+	// Arriving late, from a slower receiver; too old to matter
+	new := a.MaybeUpdate([]*adsb.CompositeMsg{report("B", "MSG", 2, 37.0, -122.0, 9000)})
+	ad := a.Aircraft["A81BD0"]
+	if len(new) != 1 { t.Errorf("the old msg is still new content, for the tracks") }
+	if ad.Msg != first || ad.NumMessagesSeen != 2 {
+		t.Errorf("an old report changed things: %s, %d msgs", ad.Msg, ad.NumMessagesSeen)
+	}
+
+	// Late, but within the window: it's smoothed in, but the newest leads
+	a.MaybeUpdate([]*adsb.CompositeMsg{report("C", "MSG", 4.5, 37.02, -122.0, 9500)})
+	ad = a.Aircraft["A81BD0"]
+	if lat := ad.Msg.Position.Lat; lat <= 37.06 || lat >= 37.1 {
+		t.Errorf("smoothed lat %f; should be between, and nearer the newer", lat)
+	}
+	if ad.Msg.Altitude != 10000 || ad.Msg.ReceiverName != "A" { t.Errorf("newest didn't lead: %s", ad.Msg) }
+	if !reflect.DeepEqual(ad.Receivers, []string{"A", "C"}) { t.Errorf("receivers %v", ad.Receivers) }
+}
+
+func TestFusionDeadReckoning(t *testing.T) {
+	a := NewAirspace()
+	a.Fusion = &Fusion{}
+
+	// Due north at 360 knots is 0.1NM/s; two receivers agree, a second apart
+	r1 := report("A", "MSG", 0, 37.0, -122.0, 10000)
+	r1.GroundSpeed,r1.Track = 360, 0
+	r2 := report("B", "MSG", 1, 37.0, -122.0, 10000)
+	r2.Position = r1.Position.MoveKM(0, geo.NM2KM(0.1))
+	r2.Callsign = "UAL123"
+
+	a.MaybeUpdate([]*adsb.CompositeMsg{r1, r2})
+	ad := a.Aircraft["A81BD0"]
+	if d := ad.Msg.Position.DistNM(r2.Position); d > 0.001 {
+		t.Errorf("fused position %s is %.4fNM from where both reports put it", ad.Msg.Position, d)
+	}
+	if ad.Msg.GroundSpeed != 360 || ad.Msg.Callsign != "UAL123" {
+		t.Errorf("fields weren't merged: %s", ad.Msg)
+	}
+	if r1.Callsign != "" || r2.GroundSpeed != 0 { t.Errorf("the reports themselves were modified") }
+}
+
+func TestFusionOff(t *testing.T) {
+	a := NewAirspace()
+	a.MaybeUpdate([]*adsb.CompositeMsg{
+		report("A", "MSG", 0, 37.0, -122.0, 10000),
+		report("B", "MLAT", 1, 37.5, -122.5, 10100),
+	})
+	if ad := a.Aircraft["A81BD0"]; ad.Msg.ReceiverName != "B" || ad.Receivers != nil {
+		t.Errorf("without fusion, the last msg should win: %s, %v", ad.Msg, ad.Receivers)
+	}
+}
@@ -0,0 +1,306 @@
+package airspace
+
+import(
+	"math"
+	"time"
+
+	"github.com/skypies/adsb"
+	"github.com/skypies/geo"
+)
+
+// MaxPrediction is as far from its last update as we'll predict an
+// aircraft's position; beyond that, it's fiction.
+var MaxPrediction = time.Minute
+
+// Measurement & process noise, as standard deviations
+const(
+	sigmaPosADSB   = 30.0  // metres
+	sigmaPosMLAT   = 200.0 // metres
+	sigmaVelADSB   = 2.0   // m/s
+	sigmaVelMLAT   = 10.0  // m/s
+	sigmaAccel     = 3.0   // m/s^2, unmodelled turns and speed changes
+	sigmaAltitude  = 50.0  // feet, allowing for 100ft steps
+	sigmaVRate     = 2.0   // feet/s
+	sigmaVAccel    = 3.0   // feet/s^2
+
+	outlierPos     = 13.8  // Chi-squared, 2 degrees of freedom, 99.9%
+	outlierAlt     = 10.8  // ... and 1 degree of freedom
+	outlierStrikes = 3     // Outliers in a row before we start the filter afresh
+	recenterAt     = 50e3  // metres from Origin
+)
+
+const metresPerDegree = 6371e3 * math.Pi / 180
+const metresPerKnot = 1852.0 / 3600
+
+// Kinematics is a Kalman filter of an aircraft's position & velocity, fed
+// by its msgs. Horizontally, it's a constant-velocity model on a flat
+// plane around Origin (x east, y north); vertically, it tracks altitude &
+// vertical rate. A msg that doesn't fit the filter's predictions is an
+// outlier, and ignored; but a few in a row mean the filter has lost the
+// plot, so it starts again from there.
+//
+// Update returns a new Kinematics, rather than changing the old one, so
+// snapshots of the airspace can share them safely. Only the state survives
+// a trip through JSON or gob; a filter that's lost its covariances starts
+// afresh at its next update.
+type Kinematics struct {
+	Origin    geo.Latlong
+	Time      time.Time  // Of the latest msg we took in
+	X         [4]float64 // x, y (metres from Origin), and their rates (m/s)
+	Alt       [2]float64 // Altitude (feet), and vertical rate (feet/s)
+	Updates   int64
+	Outliers  int64      // Msgs whose position or altitude were ignored
+	Outlier   bool       // Whether the latest msg was one
+
+	p         [4][4]float64 // Covariance of X; all zero if we've no position yet
+	pAlt      [2][2]float64 // ... and of Alt
+	strikes   [2]int        // Outliers in a row, horizontal & vertical
+}
+
+// {{{ k.Update
+
+// Update returns the filter, updated with the msg. Msgs older than the
+// filter's latest are ignored (a Kalman filter can't go back in time). k
+// may be nil, for a new aircraft.
+func (k *Kinematics)Update(m *adsb.CompositeMsg) *Kinematics {
+	n := Kinematics{}
+	if k != nil {
+		if m.GeneratedTimestampUTC.Before(k.Time) { return k }
+		n = *k
+	}
+	n.Updates++
+
+	dt := 0.0
+	if !n.Time.IsZero() { dt = m.GeneratedTimestampUTC.Sub(n.Time).Seconds() }
+	n.Time = m.GeneratedTimestampUTC
+	n.predict(dt)
+
+	h,v := n.updateHorizontal(m), n.updateVertical(m)
+	for i,outlier := range []bool{h, v} {
+		if outlier { n.strikes[i]++ } else { n.strikes[i] = 0 }
+	}
+	if n.Outlier = h || v; n.Outlier {
+		n.Outliers++
+	}
+	return &n
+}
+
+// predict moves the state forward dt seconds, and grows the covariances
+// by the process noise.
+func (k *Kinematics)predict(dt float64) {
+	if dt <= 0 { return }
+	q3,q4 := dt*dt*dt/2, dt*dt*dt*dt/4
+
+	if k.p[0][0] > 0 {
+		k.X[0] += k.X[2] * dt
+		k.X[1] += k.X[3] * dt
+
+		// P = F P F' + Q, for F = [I dt.I; 0 I]
+		p := k.p
+		for i:=0; i<2; i++ {
+			for j:=0; j<4; j++ { p[i][j] += dt * p[i+2][j] }
+		}
+		for j:=0; j<2; j++ {
+			for i:=0; i<4; i++ { p[i][j] += dt * p[i][j+2] }
+		}
+		a := sigmaAccel * sigmaAccel
+		for i:=0; i<2; i++ {
+			p[i][i] += q4 * a
+			p[i][i+2] += q3 * a
+			p[i+2][i] += q3 * a
+			p[i+2][i+2] += dt * dt * a
+		}
+		k.p = p
+	}
+
+	if k.pAlt[0][0] > 0 {
+		k.Alt[0] += k.Alt[1] * dt
+		p := k.pAlt
+		p[0][0] += 2*dt*p[0][1] + dt*dt*p[1][1]
+		p[0][1] += dt * p[1][1]
+		p[1][0] = p[0][1]
+		a := sigmaVAccel * sigmaVAccel
+		p[0][0] += q4 * a
+		p[0][1] += q3 * a
+		p[1][0] += q3 * a
+		p[1][1] += dt * dt * a
+		k.pAlt = p
+	}
+}
+
+// }}}
+// {{{ k.updateHorizontal
+
+// updateHorizontal returns true if the msg's position was an outlier.
+func (k *Kinematics)updateHorizontal(m *adsb.CompositeMsg) bool {
+	sPos,sVel := sigmaPosADSB, sigmaVelADSB
+	if m.IsMLAT() { sPos,sVel = sigmaPosMLAT, sigmaVelMLAT }
+	hasPos := !m.Position.IsNil()
+	hasVel := m.GroundSpeed > 0
+	vx,vy := 0.0, 0.0
+	if hasVel {
+		rad := float64(m.Track) * math.Pi / 180
+		vx = float64(m.GroundSpeed) * metresPerKnot * math.Sin(rad)
+		vy = float64(m.GroundSpeed) * metresPerKnot * math.Cos(rad)
+	}
+
+	restart := k.strikes[0]+1 >= outlierStrikes // If this one's an outlier too
+	if k.p[0][0] == 0 || (hasPos && restart && k.misfit(m, sPos)) {
+		if !hasPos { return false }
+		// Start afresh, at this position
+		k.Origin = m.Position
+		k.X = [4]float64{0, 0, vx, vy}
+		k.p = [4][4]float64{}
+		k.p[0][0],k.p[1][1] = sPos*sPos, sPos*sPos
+		k.p[2][2],k.p[3][3] = 150*150, 150*150 // Anything up to Mach 1-ish
+		if hasVel { k.p[2][2],k.p[3][3] = sVel*sVel, sVel*sVel }
+		return false
+	}
+
+	if hasPos && k.misfit(m, sPos) { return true }
+	if hasPos {
+		x,y := k.toXY(m.Position)
+		k.update(0, x, sPos*sPos)
+		k.update(1, y, sPos*sPos)
+	}
+	if hasVel {
+		k.update(2, vx, sVel*sVel)
+		k.update(3, vy, sVel*sVel)
+	}
+
+	if math.Abs(k.X[0]) > recenterAt || math.Abs(k.X[1]) > recenterAt {
+		k.Origin = k.toLatlong(k.X[0], k.X[1]) // The flat plane is only good for so far
+		k.X[0],k.X[1] = 0, 0
+	}
+	return false
+}
+
+// misfit says whether the msg's position is an outlier, by its Mahalanobis
+// distance from where the filter expected it.
+func (k *Kinematics)misfit(m *adsb.CompositeMsg, sPos float64) bool {
+	x,y := k.toXY(m.Position)
+	dx,dy := x - k.X[0], y - k.X[1]
+	a,b,d := k.p[0][0] + sPos*sPos, k.p[0][1], k.p[1][1] + sPos*sPos
+	det := a*d - b*b
+	if det <= 0 { return false }
+	return (d*dx*dx - 2*b*dx*dy + a*dy*dy) / det > outlierPos
+}
+
+// update folds in a measurement z, with variance r, of the i'th state
+// variable. The measurements we get are independent, so doing them one at
+// a time is as good as doing them all at once.
+func (k *Kinematics)update(i int, z, r float64) {
+	s := k.p[i][i] + r
+	gain := [4]float64{}
+	for j:=0; j<4; j++ { gain[j] = k.p[j][i] / s }
+	innov := z - k.X[i]
+	row := k.p[i]
+	for j:=0; j<4; j++ {
+		k.X[j] += gain[j] * innov
+		for l:=0; l<4; l++ { k.p[j][l] -= gain[j] * row[l] }
+	}
+}
+
+// }}}
+// {{{ k.updateVertical
+
+// updateVertical returns true if the msg's altitude was an outlier.
+func (k *Kinematics)updateVertical(m *adsb.CompositeMsg) bool {
+	if m.Altitude == 0 { return false } // Unknown, most likely
+	hasRate := m.GroundSpeed > 0  // Vertical rate comes with the ground speed
+	rate := float64(m.VerticalRate) / 60
+
+	restart := k.strikes[1]+1 >= outlierStrikes
+	if k.pAlt[0][0] == 0 || (restart && k.misfitAlt(m)) {
+		k.Alt = [2]float64{float64(m.Altitude), rate}
+		k.pAlt = [2][2]float64{{sigmaAltitude*sigmaAltitude, 0}, {0, 50*50}}
+		if hasRate { k.pAlt[1][1] = sigmaVRate*sigmaVRate }
+		return false
+	}
+
+	if k.misfitAlt(m) { return true }
+	k.updateAlt(0, float64(m.Altitude), sigmaAltitude*sigmaAltitude)
+	if hasRate { k.updateAlt(1, rate, sigmaVRate*sigmaVRate) }
+	return false
+}
+
+func (k *Kinematics)misfitAlt(m *adsb.CompositeMsg) bool {
+	d := float64(m.Altitude) - k.Alt[0]
+	return d*d / (k.pAlt[0][0] + sigmaAltitude*sigmaAltitude) > outlierAlt
+}
+
+func (k *Kinematics)updateAlt(i int, z, r float64) {
+	s := k.pAlt[i][i] + r
+	g0,g1 := k.pAlt[0][i] / s, k.pAlt[1][i] / s
+	innov := z - k.Alt[i]
+	row := k.pAlt[i]
+	k.Alt[0] += g0 * innov
+	k.Alt[1] += g1 * innov
+	for l:=0; l<2; l++ {
+		k.pAlt[0][l] -= g0 * row[l]
+		k.pAlt[1][l] -= g1 * row[l]
+	}
+}
+
+// }}}
+// {{{ k.Predict
+
+// Predict returns where the filter thinks the aircraft is (or was) at the
+// given time, and at what altitude (zero, if it's no idea). If it's never
+// had a position, ok is false.
+func (k *Kinematics)Predict(at time.Time) (pos geo.Latlong, altitude int64, ok bool) {
+	if k == nil || k.Origin.IsNil() { return geo.Latlong{}, 0, false }
+	dt := at.Sub(k.Time).Seconds()
+	pos = k.toLatlong(k.X[0] + k.X[2]*dt, k.X[1] + k.X[3]*dt)
+	if k.Alt[0] != 0 { altitude = int64(math.Round(k.Alt[0] + k.Alt[1]*dt)) }
+	return pos, altitude, true
+}
+
+func (k *Kinematics)toXY(pos geo.Latlong) (float64, float64) {
+	cos := math.Cos(k.Origin.Lat * math.Pi / 180)
+	return (pos.Long - k.Origin.Long) * metresPerDegree * cos, (pos.Lat - k.Origin.Lat) * metresPerDegree
+}
+
+func (k *Kinematics)toLatlong(x, y float64) geo.Latlong {
+	cos := math.Cos(k.Origin.Lat * math.Pi / 180)
+	return geo.Latlong{Lat: k.Origin.Lat + y/metresPerDegree, Long: k.Origin.Long + x/(metresPerDegree*cos)}
+}
+
+// }}}
+
+// {{{ ad.PredictedPosition
+
+// PredictedPosition estimates where the aircraft is (or was) at the given
+// time, and at what altitude, from its Kinematics; for aircraft without
+// them, it dead-reckons from the latest msg, along its track at its ground
+// speed & vertical rate. ok is false if there's no position to go on, or
+// if the time is more than MaxPrediction from it.
+func (ad AircraftData)PredictedPosition(at time.Time) (pos geo.Latlong, altitude int64, ok bool) {
+	if k := ad.Kinematics; k != nil && !k.Origin.IsNil() {
+		if d := at.Sub(k.Time); d > MaxPrediction || d < -MaxPrediction { return geo.Latlong{}, 0, false }
+		return k.Predict(at)
+	}
+
+	m := ad.Msg
+	if m == nil || m.Position.IsNil() { return geo.Latlong{}, 0, false }
+	d := at.Sub(m.GeneratedTimestampUTC)
+	if d > MaxPrediction || d < -MaxPrediction { return geo.Latlong{}, 0, false }
+
+	pos = m.Position
+	if m.GroundSpeed > 0 {
+		pos = pos.MoveKM(float64(m.Track), geo.NM2KM(float64(m.GroundSpeed) * d.Hours())) // Not MoveNM; see fusion.go
+	}
+	altitude = m.Altitude
+	if m.Altitude != 0 { altitude += int64(math.Round(float64(m.VerticalRate) * d.Minutes())) }
+	return pos, altitude, true
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
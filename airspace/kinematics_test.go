@@ -0,0 +1,131 @@
+package airspace
+
+import(
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/skypies/adsb"
+	"github.com/skypies/geo"
+)
+
+// flight is an aircraft flying due east at 300 knots, climbing at 1200
+// feet/min; it reports every second.
+func flight(secs float64) *adsb.CompositeMsg {
+	start := geo.Latlong{Lat:37.0, Long:-122.0}
+	return &adsb.CompositeMsg{
+		ReceiverName: "A",
+		Msg: adsb.Msg{
+			Type:                  "MSG",
+			Icao24:                "A81BD0",
+			GeneratedTimestampUTC: tFusion.Add(time.Duration(secs * float64(time.Second))),
+			Position:              start.MoveKM(90, geo.NM2KM(300 * secs / 3600)),
+			Altitude:              10000 + int64(math.Round(20 * secs)),
+			GroundSpeed:           300,
+			Track:                 90,
+			VerticalRate:          1200,
+		},
+	}
+}
+
+func TestKinematicsPrediction(t *testing.T) {
+	var k *Kinematics
+	for i:=0; i<30; i++ {
+		k = k.Update(flight(float64(i)))
+	}
+	if k.Outliers != 0 || k.Updates != 30 { t.Errorf("%d updates, %d outliers", k.Updates, k.Outliers) }
+
+	// Between updates, and after the last
+	for _,secs := range []float64{12.5, 29, 35, 60} {
+		truth := flight(secs)
+		pos,alt,ok := k.Predict(truth.GeneratedTimestampUTC)
+		if !ok { t.Fatalf("no prediction") }
+		if d := pos.DistKM(truth.Position) * 1000; d > 20 {
+			t.Errorf("+%.1fs: predicted %s, %.0fm from where it is", secs, pos, d)
+		}
+		if d := alt - truth.Altitude; d > 10 || d < -10 {
+			t.Errorf("+%.1fs: predicted %df, it's at %df", secs, alt, truth.Altitude)
+		}
+	}
+
+	// Out of order; ignored
+	if k2 := k.Update(flight(10)); k2 != k { t.Errorf("an old msg changed the filter") }
+}
+
+func TestKinematicsOutliers(t *testing.T) {
+	var k *Kinematics
+	for i:=0; i<10; i++ {
+		k = k.Update(flight(float64(i)))
+	}
+
+	// A glitch, 5km north
+	bad := flight(10)
+	bad.Position = bad.Position.MoveKM(0, 5)
+	prev := k
+	k = k.Update(bad)
+	if !k.Outlier || k.Outliers != 1 { t.Errorf("glitch wasn't flagged: %+v", k) }
+	if prev.Outlier || prev.Outliers != 0 { t.Errorf("Update changed the previous filter") }
+	truth := flight(11)
+	k = k.Update(truth)
+	if k.Outlier { t.Errorf("good msg after the glitch was flagged") }
+	if pos,_,_ := k.Predict(truth.GeneratedTimestampUTC); pos.DistKM(truth.Position) > 0.05 {
+		t.Errorf("the glitch pulled the filter off course, to %s", pos)
+	}
+
+	// A bad altitude
+	bad = flight(12)
+	bad.Altitude += 3000
+	if k = k.Update(bad); !k.Outlier { t.Errorf("altitude glitch wasn't flagged") }
+
+	// But if it keeps on happening, the filter's the one that's wrong
+	for i:=13; i<16; i++ {
+		m := flight(float64(i))
+		m.Position = m.Position.MoveKM(0, 5)
+		k = k.Update(m)
+	}
+	if k.Outlier || k.Outliers != 4 { t.Errorf("filter didn't restart: %d outliers, latest %v", k.Outliers, k.Outlier) }
+	m := flight(16)
+	m.Position = m.Position.MoveKM(0, 5)
+	if pos,_,_ := k.Predict(m.GeneratedTimestampUTC); pos.DistKM(m.Position) > 0.1 {
+		t.Errorf("after restarting, predicted %s; wanted %s", pos, m.Position)
+	}
+}
+
+func TestPredictedPosition(t *testing.T) {
+	a := NewAirspace()
+	for i:=0; i<5; i++ {
+		a.MaybeUpdate([]*adsb.CompositeMsg{flight(float64(i))})
+	}
+	ad := a.Aircraft["A81BD0"]
+	truth := flight(10)
+	pos,alt,ok := ad.PredictedPosition(truth.GeneratedTimestampUTC)
+	if !ok || pos.DistKM(truth.Position) > 0.05 || alt < truth.Altitude-10 || alt > truth.Altitude+10 {
+		t.Errorf("predicted %s, %df (%v); wanted %s, %df", pos, alt, ok, truth.Position, truth.Altitude)
+	}
+	if _,_,ok := ad.PredictedPosition(truth.GeneratedTimestampUTC.Add(MaxPrediction)); ok {
+		t.Errorf("predicted too far ahead")
+	}
+
+	// Through JSON, the filter's state survives, but not its covariances
+	data,err := json.Marshal(a.Snapshot())
+	if err != nil { t.Fatal(err) }
+	back := Airspace{}
+	if err := json.Unmarshal(data, &back); err != nil { t.Fatal(err) }
+	ad2 := back.Aircraft["A81BD0"]
+	if pos2,_,_ := ad2.PredictedPosition(truth.GeneratedTimestampUTC); pos2.DistKM(pos) > 0.001 {
+		t.Errorf("after JSON, predicted %s; before, %s", pos2, pos)
+	}
+	if k := ad2.Kinematics.Update(flight(5)); k.Outlier || k.Origin != flight(5).Position {
+		t.Errorf("a filter from JSON should restart, not judge: %+v", k)
+	}
+
+	// Without a filter, it's plain dead reckoning
+	ad.Kinematics = nil
+	if pos,alt,ok := ad.PredictedPosition(truth.GeneratedTimestampUTC); !ok ||
+		pos.DistKM(truth.Position) > 0.01 || alt != truth.Altitude {
+		t.Errorf("dead reckoning: %s, %df (%v); wanted %s, %df", pos, alt, ok, truth.Position, truth.Altitude)
+	}
+	ad.Msg = &adsb.CompositeMsg{Msg:adsb.Msg{Icao24:"A81BD0", GeneratedTimestampUTC:tFusion}}
+	if _,_,ok := ad.PredictedPosition(tFusion); ok { t.Errorf("predicted a position from nothing") }
+}
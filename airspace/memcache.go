@@ -0,0 +1,57 @@
+package airspace
+
+import(
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DefaultCacheKey is where the consolidator leaves the airspace, in caches
+// that have keys (see package airspacesink).
+const DefaultCacheKey = "consolidated-airspace"
+
+var ErrCacheMiss = errors.New("airspace: not in the cache")
+
+// For clients, fetching the consolidator's latest snapshot from a memcached
+// (or anything else speaking its text protocol) at addr (HOST:PORT). If key
+// is empty, it's DefaultCacheKey. If the snapshot isn't there (or has
+// expired), the error is ErrCacheMiss.
+func FromMemcache(ctx context.Context, addr, key string) (*Airspace, error) {
+	if key == "" { key = DefaultCacheKey }
+
+	conn,err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil { return nil, err }
+	defer conn.Close()
+	if deadline,ok := ctx.Deadline(); ok { conn.SetDeadline(deadline) }
+
+	if _,err := fmt.Fprintf(conn, "get %s\r\n", key); err != nil { return nil, err }
+
+	// VALUE <key> <flags> <bytes>\r\n<data>\r\nEND\r\n, or just END\r\n
+	rd := bufio.NewReader(conn)
+	line,err := rd.ReadString('\n')
+	if err != nil { return nil, err }
+	line = strings.TrimRight(line, "\r\n")
+	if line == "END" { return nil, ErrCacheMiss }
+
+	f := strings.Fields(line)
+	if len(f) < 4 || f[0] != "VALUE" || f[1] != key {
+		return nil, fmt.Errorf("memcache get %s: unexpected reply %q", key, line)
+	}
+	size,err := strconv.Atoi(f[3])
+	if err != nil || size < 0 { return nil, fmt.Errorf("memcache get %s: bad reply %q", key, line) }
+
+	data := make([]byte, size+2)
+	if _,err := io.ReadFull(rd, data); err != nil { return nil, err }
+
+	as := Airspace{}
+	if err := json.Unmarshal(data[:size], &as); err != nil {
+		return nil, fmt.Errorf("memcache get %s: %v", key, err)
+	}
+	return &as, nil
+}
@@ -0,0 +1,55 @@
+package airspace
+
+import(
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replyWith serves one connection, checking the command, and sending back
+// a canned reply.
+func replyWith(t *testing.T, wantCmd, reply string) string {
+	ln,err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn,err := ln.Accept()
+		if err != nil { return }
+		defer conn.Close()
+		if line,_ := bufio.NewReader(conn).ReadString('\n'); line != wantCmd {
+			t.Errorf("got command %q, wanted %q", line, wantCmd)
+		}
+		conn.Write([]byte(reply))
+	}()
+	return ln.Addr().String()
+}
+
+func TestFromMemcache(t *testing.T) {
+	ctx,cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	val := `{"Aircraft":{"A81BD0":{"Msg":{"Icao24":"A81BD0","Callsign":"ABC1234"},"NumMessagesSeen":3}}}`
+	addr := replyWith(t, "get "+DefaultCacheKey+"\r\n", "VALUE "+DefaultCacheKey+" 0 "+
+		strconv.Itoa(len(val))+"\r\n"+val+"\r\nEND\r\n")
+	as,err := FromMemcache(ctx, addr, "")
+	if err != nil { t.Fatal(err) }
+	if ad,exists := as.Aircraft["A81BD0"]; !exists || ad.Msg.Callsign != "ABC1234" || ad.NumMessagesSeen != 3 {
+		t.Errorf("got %+v", as.Aircraft)
+	}
+
+	addr = replyWith(t, "get other\r\n", "END\r\n")
+	if _,err := FromMemcache(ctx, addr, "other"); err != ErrCacheMiss { t.Errorf("miss: got %v", err) }
+
+	addr = replyWith(t, "get other\r\n", "SERVER_ERROR out of memory\r\n")
+	if _,err := FromMemcache(ctx, addr, "other"); err == nil || !strings.Contains(err.Error(), "out of memory") {
+		t.Errorf("server error: got %v", err)
+	}
+
+	addr = replyWith(t, "get other\r\n", "VALUE other 0 5\r\nnope!\r\nEND\r\n")
+	if _,err := FromMemcache(ctx, addr, "other"); err == nil { t.Errorf("garbage value: no error") }
+}
@@ -0,0 +1,92 @@
+// Package airspacesink is where the consolidator publishes snapshots of
+// the live airspace, for other apps (the fdb frontend, maps, ...) to pick
+// up. In prod the snapshot goes into a Datastore singleton; it can also go
+// to a local file, a Redis-compatible cache, memcached, or be POSTed to
+// webhooks. A Publisher takes the snapshots off the consolidator's hot
+// path, and fans them out to each sink at its own pace.
+package airspacesink
+
+import(
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/skypies/pi/airspace"
+)
+
+// A Sink stores airspace snapshots somewhere. Publish is only ever called
+// by one goroutine at a time (per sink); the snapshot must not be
+// modified.
+type Sink interface {
+	Publish(ctx context.Context, as *airspace.Airspace) error
+	Close() error
+	String() string
+}
+
+// {{{ New
+
+// New builds a sink from a spec string. The Datastore sink needs more
+// setup than fits in a string, so use NewDatastoreSink for that.
+//   file:FILENAME                     - JSON, replaced atomically each time
+//   redis:[PASSWORD@]HOST:PORT[/KEY]  - SET KEY (default consolidated-airspace) to the JSON
+//   memcache:HOST:PORT[/KEY]          - set KEY (default consolidated-airspace) to the JSON
+//   webhook:URL                       - POST the JSON to the URL
+//   webhook+deltas:URL                - POST just what changed (see Delta)
+// Webhooks that need headers, or other options, need NewWebhookSink.
+func New(spec string) (Sink, error) {
+	kind,arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind,arg = spec[:i], spec[i+1:]
+	}
+
+	switch kind {
+	case "file":
+		if arg == "" { return nil, fmt.Errorf("airspacesink: file needs a filename") }
+		return NewFileSink(arg), nil
+	case "redis":
+		if arg == "" { return nil, fmt.Errorf("airspacesink: redis needs a host:port") }
+		return NewRedisSink(arg), nil
+	case "memcache":
+		if arg == "" { return nil, fmt.Errorf("airspacesink: memcache needs a host:port") }
+		s,err := NewMemcacheSink(arg)
+		if err != nil { return nil, err }
+		return s, nil
+	case "webhook", "webhook+deltas":
+		if !strings.HasPrefix(arg, "http://") && !strings.HasPrefix(arg, "https://") {
+			return nil, fmt.Errorf("airspacesink: %s needs an http(s) URL", kind)
+		}
+		return NewWebhookSink(arg, WebhookOptions{Deltas: kind == "webhook+deltas"}), nil
+	default:
+		return nil, fmt.Errorf("airspacesink: unknown sink spec %q", spec)
+	}
+}
+
+// }}}
+// {{{ SplitInterval
+
+// SplitInterval splits the optional publishing interval off the end of a
+// spec ("file:/tmp/airspace.json@5s"). If there isn't one, the interval is
+// zero.
+func SplitInterval(spec string) (string, time.Duration, error) {
+	i := strings.LastIndex(spec, "@")
+	if i < 0 { return spec, 0, nil }
+
+	d,err := time.ParseDuration(spec[i+1:])
+	if err != nil {
+		if strings.ContainsAny(spec[i+1:], ":/") { return spec, 0, nil } // An @ in a URL
+		return "", 0, fmt.Errorf("airspacesink: %q: bad interval: %v", spec, err)
+	}
+	if d <= 0 { return "", 0, fmt.Errorf("airspacesink: %q: interval must be positive", spec) }
+	return spec[:i], d, nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
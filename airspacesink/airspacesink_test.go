@@ -0,0 +1,409 @@
+package airspacesink
+
+import(
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skypies/adsb"
+	"github.com/skypies/pi/airspace"
+)
+
+func testAirspace(icaos ...string) *airspace.Airspace {
+	as := airspace.NewAirspace()
+	for _,icao := range icaos {
+		m := &adsb.CompositeMsg{Msg:adsb.Msg{Icao24:adsb.IcaoId(icao), Callsign:"UAL"+icao[:3],
+			GeneratedTimestampUTC:time.Now()}}
+		as.Aircraft[m.Icao24] = airspace.AircraftData{Msg:m, NumMessagesSeen:1}
+	}
+	return &as
+}
+
+// {{{ fakeSink
+
+type fakeSink struct {
+	name  string
+	delay time.Duration
+	fail  bool
+	block chan struct{} // If set, publishes wait for it to be closed
+
+	mu    sync.Mutex
+	snaps []*airspace.Airspace
+	inUse bool
+	races int
+}
+
+func (s *fakeSink)Publish(ctx context.Context, as *airspace.Airspace) error {
+	s.mu.Lock()
+	if s.inUse { s.races++ }
+	s.inUse = true
+	s.mu.Unlock()
+
+	time.Sleep(s.delay)
+	if s.block != nil { <-s.block }
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inUse = false
+	if s.fail { return fmt.Errorf("fake failure") }
+	s.snaps = append(s.snaps, as)
+	return nil
+}
+
+func (s *fakeSink)Close() error { return nil }
+func (s *fakeSink)String() string { return s.name }
+
+func (s *fakeSink)published() []*airspace.Airspace {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*airspace.Airspace{}, s.snaps...)
+}
+
+// }}}
+
+func TestPublisher(t *testing.T) {
+	fast := &fakeSink{name:"fast"}
+	slow := &fakeSink{name:"slow", delay:50*time.Millisecond}
+	broken := &fakeSink{name:"broken", fail:true}
+
+	calls := map[string]int{}
+	var mu sync.Mutex
+	p := NewPublisher(time.Second,
+		Target{Sink:fast, Interval:time.Millisecond},
+		Target{Sink:slow, Interval:time.Millisecond},
+		Target{Sink:broken, Interval:time.Hour})
+	p.OnPublish = func(sink string, took time.Duration, err error) {
+		mu.Lock()
+		calls[sink]++
+		mu.Unlock()
+	}
+
+	as := testAirspace("A00001")
+	for i:=0; i<20; i++ {
+		p.Offer(as)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The snapshots must be copies; the airspace carries on changing
+	as.Aircraft["A00002"] = as.Aircraft["A00001"]
+	if err := p.Flush(as); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("Flush: expected an error from the broken sink, got %v", err)
+	}
+	p.Close()
+
+	fs := fast.published()
+	if len(fs) < 10 { t.Errorf("fast sink only got %d snapshots", len(fs)) }
+	if len(fs[0].Aircraft) != 1 || len(fs[len(fs)-1].Aircraft) != 2 {
+		t.Errorf("snapshots weren't copies: first has %d aircraft, last has %d",
+			len(fs[0].Aircraft), len(fs[len(fs)-1].Aircraft))
+	}
+
+	stats := map[string]Stats{}
+	for _,st := range p.Stats() { stats[st.Sink] = st }
+	if st := stats["slow"]; st.Superseded == 0 || st.Published >= int64(len(fs)) {
+		t.Errorf("slow sink should have fallen behind: %+v", st)
+	}
+	if st := stats["broken"]; st.Failures != 2 || st.Published != 0 || st.LastError == "" {
+		t.Errorf("broken sink: %+v (one publish at the start, one at the flush)", st)
+	}
+	if slow.races > 0 || fast.races > 0 { t.Errorf("concurrent publishes to one sink") }
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["fast"] != len(fs) || calls["broken"] != 2 { t.Errorf("OnPublish calls: %v", calls) }
+
+	if err := p.Flush(as); err == nil { t.Errorf("Flush after Close should fail") }
+}
+
+// Flush must leave the sink holding the flushed snapshot, even if there's
+// an older one waiting to be published when it's called.
+func TestPublisherFlushIsLast(t *testing.T) {
+	sink := &fakeSink{name:"blocked", block:make(chan struct{})}
+	p := NewPublisher(time.Second, Target{Sink:sink, Interval:time.Nanosecond})
+
+	as := testAirspace("A00001")
+	p.Offer(as) // The goroutine takes this one, and blocks publishing it
+	time.Sleep(10 * time.Millisecond)
+	as.Aircraft["A00002"] = as.Aircraft["A00001"]
+	p.Offer(as) // This one waits
+	time.Sleep(10 * time.Millisecond)
+
+	as.Aircraft["A00003"] = as.Aircraft["A00001"]
+	flushed := make(chan error)
+	go func() { flushed <- p.Flush(as) }()
+	time.Sleep(10 * time.Millisecond)
+	close(sink.block)
+	if err := <-flushed; err != nil { t.Fatalf("Flush: %v", err) }
+	time.Sleep(10 * time.Millisecond) // Give the goroutine a chance to do the wrong thing
+	p.Close()
+
+	snaps := sink.published()
+	if n := len(snaps); n == 0 || len(snaps[n-1].Aircraft) != 3 {
+		t.Fatalf("the flushed snapshot wasn't the last one published (%d published)", n)
+	}
+	for i,snap := range snaps[1:] {
+		if len(snap.Aircraft) <= len(snaps[i].Aircraft) {
+			t.Errorf("published out of order: %d aircraft, then %d", len(snaps[i].Aircraft), len(snap.Aircraft))
+		}
+	}
+	if st := p.Stats()[0]; st.Superseded != 1 {
+		t.Errorf("expected the waiting snapshot to be superseded: %+v", st)
+	}
+}
+
+func TestSplitInterval(t *testing.T) {
+	tests := []struct{
+		in, spec string
+		d        time.Duration
+		err      bool
+	}{
+		{"datastore", "datastore", 0, false},
+		{"file:/tmp/as.json@5s", "file:/tmp/as.json", 5*time.Second, false},
+		{"redis:secret@localhost:6379/as@250ms", "redis:secret@localhost:6379/as", 250*time.Millisecond, false},
+		{"redis:secret@localhost:6379", "redis:secret@localhost:6379", 0, false},
+		{"file:/tmp/as.json@soon", "", 0, true},
+		{"file:/tmp/as.json@-1s", "", 0, true},
+	}
+	for _,test := range tests {
+		spec,d,err := SplitInterval(test.in)
+		if (err != nil) != test.err || spec != test.spec || d != test.d {
+			t.Errorf("%q: got %q, %s, %v", test.in, spec, d, err)
+		}
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "airspace.json")
+	s,err := New("file:" + file)
+	if err != nil { t.Fatal(err) }
+	if err := s.Publish(context.Background(), testAirspace("A00001", "A00002")); err != nil { t.Fatal(err) }
+
+	data,err := os.ReadFile(file)
+	if err != nil { t.Fatal(err) }
+	as := airspace.Airspace{}
+	if err := json.Unmarshal(data, &as); err != nil { t.Fatal(err) }
+	if len(as.Aircraft) != 2 || as.Aircraft["A00002"].Msg.Callsign != "UALA00" {
+		t.Errorf("read back %+v", as.Aircraft)
+	}
+
+	if ents,_ := os.ReadDir(filepath.Dir(file)); len(ents) != 1 { t.Errorf("left temp files behind: %v", ents) }
+}
+
+// {{{ fakeRedis
+
+// fakeRedis understands just AUTH and SET.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	vals     map[string]string
+	ttls     map[string]string
+	conns    int
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln,err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	r := &fakeRedis{ln:ln, password:password, vals:map[string]string{}, ttls:map[string]string{}}
+	go r.serve()
+	t.Cleanup(func() { ln.Close() })
+	return r
+}
+
+func (r *fakeRedis)serve() {
+	for {
+		conn,err := r.ln.Accept()
+		if err != nil { return }
+		r.mu.Lock()
+		r.conns++
+		r.mu.Unlock()
+		go r.handle(conn)
+	}
+}
+
+func (r *fakeRedis)handle(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authed := r.password == ""
+	for {
+		args,err := readCommand(rd)
+		if err != nil { return }
+		switch {
+		case args[0] == "AUTH":
+			authed = len(args) == 2 && args[1] == r.password
+			if !authed { fmt.Fprintf(conn, "-WRONGPASS invalid password\r\n"); continue }
+		case !authed:
+			fmt.Fprintf(conn, "-NOAUTH Authentication required.\r\n"); continue
+		case args[0] == "SET" && len(args) >= 3:
+			r.mu.Lock()
+			r.vals[args[1]] = args[2]
+			if len(args) == 5 { r.ttls[args[1]] = args[3] + " " + args[4] }
+			r.mu.Unlock()
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command\r\n"); continue
+		}
+		fmt.Fprintf(conn, "+OK\r\n")
+	}
+}
+
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line,err := rd.ReadString('\n')
+	if err != nil { return nil, err }
+	n,err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || line[0] != '*' { return nil, fmt.Errorf("bad command %q", line) }
+	args := []string{}
+	for i:=0; i<n; i++ {
+		line,err := rd.ReadString('\n')
+		if err != nil { return nil, err }
+		size,_ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _,err := io.ReadFull(rd, buf); err != nil { return nil, err }
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// }}}
+
+func TestRedisSink(t *testing.T) {
+	r := newFakeRedis(t, "sekrit")
+	ctx := context.Background()
+
+	s,err := New("redis:sekrit@" + r.ln.Addr().String() + "/as")
+	if err != nil { t.Fatal(err) }
+	defer s.Close()
+	for i:=0; i<3; i++ {
+		if err := s.Publish(ctx, testAirspace("A00001")); err != nil { t.Fatal(err) }
+	}
+
+	r.mu.Lock()
+	as := airspace.Airspace{}
+	if err := json.Unmarshal([]byte(r.vals["as"]), &as); err != nil || len(as.Aircraft) != 1 {
+		t.Errorf("stored value: %v, %v", as, err)
+	}
+	if r.ttls["as"] != "PX 60000" { t.Errorf("expiry: %q", r.ttls["as"]) }
+	if r.conns != 1 { t.Errorf("%d connections; should have reused the first", r.conns) }
+	r.mu.Unlock()
+
+	bad := NewRedisSink("wrong@" + r.ln.Addr().String())
+	defer bad.Close()
+	if err := bad.Publish(ctx, testAirspace("A00001")); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("bad password: got %v", err)
+	}
+}
+
+// {{{ fakeMemcache
+
+// fakeMemcache understands just set and get, and has a tiny item size limit.
+type fakeMemcache struct {
+	ln       net.Listener
+	maxItem  int
+
+	mu       sync.Mutex
+	vals     map[string][]byte
+	exptimes map[string]string
+	conns    int
+}
+
+func newFakeMemcache(t *testing.T) *fakeMemcache {
+	ln,err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	m := &fakeMemcache{ln:ln, maxItem:64*1024, vals:map[string][]byte{}, exptimes:map[string]string{}}
+	go m.serve()
+	t.Cleanup(func() { ln.Close() })
+	return m
+}
+
+func (m *fakeMemcache)serve() {
+	for {
+		conn,err := m.ln.Accept()
+		if err != nil { return }
+		m.mu.Lock()
+		m.conns++
+		m.mu.Unlock()
+		go m.handle(conn)
+	}
+}
+
+func (m *fakeMemcache)handle(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for {
+		line,err := rd.ReadString('\n')
+		if err != nil { return }
+		f := strings.Fields(line)
+		switch {
+		case len(f) == 5 && f[0] == "set":
+			size,_ := strconv.Atoi(f[4])
+			data := make([]byte, size+2)
+			if _,err := io.ReadFull(rd, data); err != nil { return }
+			if size > m.maxItem { fmt.Fprintf(conn, "SERVER_ERROR object too large for cache\r\n"); continue }
+			m.mu.Lock()
+			m.vals[f[1]] = data[:size]
+			m.exptimes[f[1]] = f[3]
+			m.mu.Unlock()
+			fmt.Fprintf(conn, "STORED\r\n")
+		case len(f) == 2 && f[0] == "get":
+			m.mu.Lock()
+			if data,exists := m.vals[f[1]]; exists {
+				fmt.Fprintf(conn, "VALUE %s 0 %d\r\n%s\r\n", f[1], len(data), data)
+			}
+			m.mu.Unlock()
+			fmt.Fprintf(conn, "END\r\n")
+		default:
+			fmt.Fprintf(conn, "ERROR\r\n")
+		}
+	}
+}
+
+// }}}
+
+func TestMemcacheSink(t *testing.T) {
+	m := newFakeMemcache(t)
+	ctx := context.Background()
+
+	s,err := New("memcache:" + m.ln.Addr().String())
+	if err != nil { t.Fatal(err) }
+	defer s.Close()
+	for i:=0; i<3; i++ {
+		if err := s.Publish(ctx, testAirspace("A00001", "A00002")); err != nil { t.Fatal(err) }
+	}
+
+	as,err := airspace.FromMemcache(ctx, m.ln.Addr().String(), "")
+	if err != nil { t.Fatal(err) }
+	if len(as.Aircraft) != 2 || as.Aircraft["A00002"].Msg.Callsign != "UALA00" {
+		t.Errorf("read back %+v", as.Aircraft)
+	}
+	m.mu.Lock()
+	if m.exptimes[DefaultKey] != "60" { t.Errorf("exptime: %q", m.exptimes[DefaultKey]) }
+	if m.conns != 2 { t.Errorf("%d connections; the sink should have reused its first", m.conns) }
+	m.mu.Unlock()
+
+	if _,err := airspace.FromMemcache(ctx, m.ln.Addr().String(), "elsewhere"); err != airspace.ErrCacheMiss {
+		t.Errorf("missing key: got %v", err)
+	}
+
+	// Too big for the server; and the sink should recover afterwards
+	big := testAirspace()
+	for i:=0; i<1000; i++ {
+		icao := adsb.IcaoId(fmt.Sprintf("B%05d", i))
+		big.Aircraft[icao] = airspace.AircraftData{Msg:&adsb.CompositeMsg{Msg:adsb.Msg{Icao24:icao}}}
+	}
+	if err := s.Publish(ctx, big); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("oversized airspace: got %v", err)
+	}
+	if err := s.Publish(ctx, testAirspace("A00003")); err != nil { t.Errorf("after failure: %v", err) }
+
+	if _,err := New("memcache:localhost:11211/has spaces"); err == nil { t.Errorf("bad key was accepted") }
+}
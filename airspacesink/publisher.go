@@ -0,0 +1,267 @@
+package airspacesink
+
+import(
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/skypies/pi/airspace"
+)
+
+// Publisher fans airspace snapshots out to sinks. Offer is cheap, and is
+// meant to be called from the goroutine that owns the airspace, as often
+// as it likes; a snapshot is only taken when some sink is due one. Each
+// sink publishes from its own goroutine, so a slow one doesn't hold up the
+// others (or the caller). If a sink is still busy when its next snapshot
+// is due, the one it hasn't got round to yet is replaced by the newer one;
+// and a sink is never sent a snapshot older than one it already has.
+type Publisher struct {
+	// If set, called after each publish attempt (e.g. for metrics).
+	OnPublish func(sink string, took time.Duration, err error)
+
+	timeout time.Duration
+	seq     int64 // Of the latest snapshot; only touched by Offer & Flush
+	targets []*target
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	mu      sync.Mutex
+	closed  bool
+}
+
+// Target is a sink, and how often to publish to it.
+type Target struct {
+	Sink     Sink
+	Interval time.Duration
+}
+
+// Stats are per sink.
+type Stats struct {
+	Sink          string
+	Interval      time.Duration
+	Published     int64
+	Failures      int64
+	Superseded    int64 // Snapshots dropped, as a newer one came along before they were published
+	LastLatency   time.Duration
+	LastPublished time.Time
+	LastError     string
+}
+
+type snapshot struct {
+	as      *airspace.Airspace
+	seq     int64
+}
+
+type target struct {
+	Target
+	next    time.Time     // Only touched by Offer
+	pending chan snapshot // Holds at most the latest snapshot
+
+	busy    sync.Mutex // Held while publishing, so Flush doesn't race the goroutine
+	latest  int64      // seq of the newest snapshot published (or tried); needs busy
+	mu      sync.Mutex
+	stats   Stats
+}
+
+// {{{ NewPublisher
+
+// NewPublisher starts a goroutine for each target. Each publish gets
+// timeout to finish (it defaults to 10s).
+func NewPublisher(timeout time.Duration, targets ...Target) *Publisher {
+	if timeout <= 0 { timeout = 10 * time.Second }
+	p := &Publisher{timeout:timeout, done:make(chan struct{})}
+
+	for _,t := range targets {
+		tgt := &target{Target:t, pending:make(chan snapshot, 1)}
+		tgt.stats.Sink,tgt.stats.Interval = t.Sink.String(), t.Interval
+		p.targets = append(p.targets, tgt)
+		p.wg.Add(1)
+		go p.run(tgt)
+	}
+	return p
+}
+
+// Len is the number of sinks; a nil Publisher has none.
+func (p *Publisher)Len() int {
+	if p == nil { return 0 }
+	return len(p.targets)
+}
+
+// }}}
+// {{{ p.Offer
+
+// Offer hands over the airspace, for any sinks that are due a snapshot.
+// It must be called from the goroutine that owns the airspace.
+func (p *Publisher)Offer(as *airspace.Airspace) {
+	if p.Len() == 0 { return }
+
+	now := time.Now()
+	var snap snapshot
+	for _,t := range p.targets {
+		if now.Before(t.next) { continue }
+		if snap.as == nil { snap = p.snapshot(as) }
+		t.next = now.Add(t.Interval)
+
+		t.discardPending()
+		t.pending <- snap // Can't block; we're the only sender, and just emptied it
+	}
+}
+
+func (p *Publisher)snapshot(as *airspace.Airspace) snapshot {
+	p.seq++
+	return snapshot{as:as.Snapshot(), seq:p.seq}
+}
+
+func (t *target)discardPending() {
+	select {
+	case <-t.pending:
+		t.count(func(st *Stats) { st.Superseded++ })
+	default:
+	}
+}
+
+// }}}
+// {{{ p.run, p.publish
+
+func (p *Publisher)run(t *target) {
+	defer p.wg.Done()
+	for {
+		select {
+		case snap := <-t.pending:
+			p.publish(t, snap)
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *Publisher)publish(t *target, snap snapshot) error {
+	t.busy.Lock()
+	defer t.busy.Unlock()
+
+	// The goroutine may have picked this up just before Flush published a
+	// newer one
+	if snap.seq < t.latest {
+		t.count(func(st *Stats) { st.Superseded++ })
+		return nil
+	}
+	t.latest = snap.seq
+
+	ctx,cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	tStart := time.Now()
+	err := t.Sink.Publish(ctx, snap.as)
+	took := time.Since(tStart)
+
+	t.count(func(st *Stats) {
+		st.LastLatency = took
+		if err != nil {
+			st.Failures++
+			st.LastError = err.Error()
+		} else {
+			st.Published++
+			st.LastPublished = time.Now()
+			st.LastError = ""
+		}
+	})
+	if p.OnPublish != nil { p.OnPublish(t.Sink.String(), took, err) }
+	return err
+}
+
+// }}}
+// {{{ p.Flush
+
+// Flush publishes the airspace to every sink right now, regardless of
+// their intervals, and waits for them; it's for shutdown. It must be called
+// from the goroutine that owns the airspace. It returns the first error.
+func (p *Publisher)Flush(as *airspace.Airspace) error {
+	if p.Len() == 0 { return nil }
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed { return fmt.Errorf("airspacesink: publisher is closed") }
+	snap := p.snapshot(as)
+
+	errs := make(chan error, len(p.targets))
+	for _,t := range p.targets {
+		t.discardPending() // Older than snap, so no point
+		go func(t *target) {
+			if err := p.publish(t, snap); err != nil {
+				errs <- fmt.Errorf("%s: %v", t.Sink, err)
+				return
+			}
+			errs <- nil
+		}(t)
+	}
+
+	var first error
+	for range p.targets {
+		if err := <-errs; err != nil && first == nil { first = err }
+	}
+	return first
+}
+
+// }}}
+// {{{ p.Stats, p.String
+
+func (t *target)count(f func(st *Stats)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f(&t.stats)
+}
+
+func (p *Publisher)Stats() []Stats {
+	ret := []Stats{}
+	if p == nil { return ret }
+	for _,t := range p.targets {
+		t.count(func(st *Stats) { ret = append(ret, *st) })
+	}
+	sort.Slice(ret, func(i,j int) bool { return ret[i].Sink < ret[j].Sink })
+	return ret
+}
+
+func (p *Publisher)String() string {
+	str := fmt.Sprintf("* Airspace sinks: %d\n", p.Len())
+	for _,st := range p.Stats() {
+		str += fmt.Sprintf("    %-40.40s every %-5s %6d published, %4d failed, %4d superseded, last took %s",
+			st.Sink, st.Interval, st.Published, st.Failures, st.Superseded, st.LastLatency.Round(time.Millisecond))
+		if st.LastError != "" { str += " (err: " + st.LastError + ")" }
+		str += "\n"
+	}
+	return str
+}
+
+// }}}
+// {{{ p.Close
+
+// Close stops the goroutines (waiting for any publishes in flight), and
+// closes the sinks. Snapshots not yet published are dropped; call Flush
+// first, to publish the final state.
+func (p *Publisher)Close() error {
+	if p == nil { return nil }
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed { return nil }
+	p.closed = true
+
+	close(p.done)
+	p.wg.Wait()
+
+	var first error
+	for _,t := range p.targets {
+		if err := t.Sink.Close(); err != nil && first == nil { first = err }
+	}
+	return first
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,267 @@
+package airspacesink
+
+import(
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skypies/pi/airspace"
+	dsprovider "github.com/skypies/util/gcp/ds"
+	"github.com/skypies/util/gcp/singleton"
+)
+
+// DefaultKey is the name the airspace is published under, where there's a
+// name to pick.
+const DefaultKey = airspace.DefaultCacheKey
+
+// {{{ DatastoreSink
+
+// DatastoreSink writes the airspace into a Datastore singleton, which is
+// how the fdb frontend has always picked it up.
+type DatastoreSink struct {
+	Provider dsprovider.DatastoreProvider
+	Name     string
+}
+
+func NewDatastoreSink(p dsprovider.DatastoreProvider) *DatastoreSink {
+	return &DatastoreSink{Provider:p, Name:DefaultKey}
+}
+
+func (s *DatastoreSink)Publish(ctx context.Context, as *airspace.Airspace) error {
+	return singleton.NewProvider(s.Provider).WriteSingleton(ctx, s.Name, nil, as)
+}
+
+func (s *DatastoreSink)Close() error { return nil }
+func (s *DatastoreSink)String() string { return "datastore:" + s.Name }
+
+// }}}
+// {{{ FileSink
+
+// FileSink writes the airspace as JSON to a file; a new file is renamed
+// over the old one, so readers never see half a snapshot.
+type FileSink struct {
+	Filename string
+}
+
+func NewFileSink(filename string) *FileSink { return &FileSink{Filename:filename} }
+
+func (s *FileSink)Publish(ctx context.Context, as *airspace.Airspace) error {
+	data,err := json.Marshal(as)
+	if err != nil { return err }
+
+	f,err := os.CreateTemp(filepath.Dir(s.Filename), "."+filepath.Base(s.Filename)+".*")
+	if err != nil { return err }
+	defer os.Remove(f.Name()) // Once renamed, this is a no-op
+
+	if _,err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil { return err }
+	if err := os.Chmod(f.Name(), 0644); err != nil { return err }
+	return os.Rename(f.Name(), s.Filename)
+}
+
+func (s *FileSink)Close() error { return nil }
+func (s *FileSink)String() string { return "file:" + s.Filename }
+
+// }}}
+// {{{ RedisSink
+
+// RedisSink SETs a key on a Redis-compatible server (Redis, Valkey,
+// KeyDB, ...) to the airspace, as JSON. The key expires after TTL, so a
+// dead consolidator doesn't leave a frozen airspace behind. It speaks just
+// enough RESP to do that, over a connection it keeps open.
+type RedisSink struct {
+	Addr     string
+	Password string
+	Key      string
+	TTL      time.Duration // Zero for no expiry
+
+	mu       sync.Mutex
+	conn     net.Conn
+	rd       *bufio.Reader
+}
+
+// NewRedisSink takes [PASSWORD@]HOST:PORT[/KEY].
+func NewRedisSink(spec string) *RedisSink {
+	s := &RedisSink{Key:DefaultKey, TTL:time.Minute}
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		s.Password,spec = spec[:i], spec[i+1:]
+	}
+	if i := strings.Index(spec, "/"); i >= 0 {
+		if spec[i+1:] != "" { s.Key = spec[i+1:] }
+		spec = spec[:i]
+	}
+	s.Addr = spec
+	return s
+}
+
+func (s *RedisSink)Publish(ctx context.Context, as *airspace.Airspace) error {
+	data,err := json.Marshal(as)
+	if err != nil { return err }
+
+	args := []string{"SET", s.Key, string(data)}
+	if s.TTL > 0 { args = append(args, "PX", fmt.Sprintf("%d", s.TTL.Milliseconds())) }
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_,err = s.do(ctx, args...)
+	if err != nil { s.hangup() } // Start afresh next time
+	return err
+}
+
+// do sends a command, and reads a simple reply (which is all SET and AUTH
+// send back).
+func (s *RedisSink)do(ctx context.Context, args ...string) (string, error) {
+	if s.conn == nil {
+		if err := s.dial(ctx); err != nil { return "", err }
+	}
+	if deadline,ok := ctx.Deadline(); ok { s.conn.SetDeadline(deadline) }
+
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _,arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _,err := s.conn.Write([]byte(cmd)); err != nil { return "", err }
+
+	line,err := s.rd.ReadString('\n')
+	if err != nil { return "", err }
+	line = strings.TrimRight(line, "\r\n")
+	switch {
+	case strings.HasPrefix(line, "+"):
+		return line[1:], nil
+	case strings.HasPrefix(line, "-"):
+		return "", fmt.Errorf("redis %s: %s", args[0], line[1:])
+	default:
+		return "", fmt.Errorf("redis %s: unexpected reply %q", args[0], line)
+	}
+}
+
+func (s *RedisSink)dial(ctx context.Context) error {
+	conn,err := (&net.Dialer{}).DialContext(ctx, "tcp", s.Addr)
+	if err != nil { return err }
+	s.conn,s.rd = conn, bufio.NewReader(conn)
+	if s.Password != "" {
+		if _,err := s.do(ctx, "AUTH", s.Password); err != nil {
+			s.hangup()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *RedisSink)hangup() {
+	if s.conn != nil { s.conn.Close() }
+	s.conn,s.rd = nil, nil
+}
+
+func (s *RedisSink)Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hangup()
+	return nil
+}
+
+func (s *RedisSink)String() string { return "redis:" + s.Addr + "/" + s.Key }
+
+// }}}
+
+// {{{ MemcacheSink
+
+// MemcacheSink sets a key on a memcached (or anything else that speaks its
+// text protocol) to the airspace, as JSON; airspace.FromMemcache reads it
+// back. Like RedisSink, the key expires after TTL, and the connection is
+// kept open. Memcached won't store items bigger than its -I setting (1MB,
+// by default), which is a few thousand aircraft.
+type MemcacheSink struct {
+	Addr     string
+	Key      string
+	TTL      time.Duration // Whole seconds; zero for no expiry
+
+	mu       sync.Mutex
+	conn     net.Conn
+	rd       *bufio.Reader
+}
+
+// NewMemcacheSink takes HOST:PORT[/KEY].
+func NewMemcacheSink(spec string) (*MemcacheSink, error) {
+	s := &MemcacheSink{Key:DefaultKey, TTL:time.Minute}
+	if i := strings.Index(spec, "/"); i >= 0 {
+		if spec[i+1:] != "" { s.Key = spec[i+1:] }
+		spec = spec[:i]
+	}
+	s.Addr = spec
+
+	// Memcached keys are short, and can't have spaces or control chars
+	if len(s.Key) > 250 || strings.IndexFunc(s.Key, func(r rune) bool { return r <= ' ' || r == 0x7f }) >= 0 {
+		return nil, fmt.Errorf("airspacesink: %q isn't a valid memcache key", s.Key)
+	}
+	return s, nil
+}
+
+func (s *MemcacheSink)Publish(ctx context.Context, as *airspace.Airspace) error {
+	data,err := json.Marshal(as)
+	if err != nil { return err }
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.set(ctx, data); err != nil {
+		s.hangup() // Start afresh next time
+		return err
+	}
+	return nil
+}
+
+func (s *MemcacheSink)set(ctx context.Context, data []byte) error {
+	if s.conn == nil {
+		conn,err := (&net.Dialer{}).DialContext(ctx, "tcp", s.Addr)
+		if err != nil { return err }
+		s.conn,s.rd = conn, bufio.NewReader(conn)
+	}
+	if deadline,ok := ctx.Deadline(); ok { s.conn.SetDeadline(deadline) }
+
+	// set <key> <flags> <exptime> <bytes>\r\n<data>\r\n
+	cmd := "set " + s.Key + " 0 " + strconv.Itoa(int(s.TTL.Seconds())) + " " + strconv.Itoa(len(data)) + "\r\n"
+	buf := append(append([]byte(cmd), data...), '\r', '\n')
+	if _,err := s.conn.Write(buf); err != nil { return err }
+
+	line,err := s.rd.ReadString('\n')
+	if err != nil { return err }
+	if line = strings.TrimRight(line, "\r\n"); line != "STORED" {
+		return fmt.Errorf("memcache set %s: %s", s.Key, line) // e.g. SERVER_ERROR object too large for cache
+	}
+	return nil
+}
+
+func (s *MemcacheSink)hangup() {
+	if s.conn != nil { s.conn.Close() }
+	s.conn,s.rd = nil, nil
+}
+
+func (s *MemcacheSink)Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hangup()
+	return nil
+}
+
+func (s *MemcacheSink)String() string { return "memcache:" + s.Addr + "/" + s.Key }
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,180 @@
+package airspacesink
+
+import(
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/skypies/adsb"
+	"github.com/skypies/pi/airspace"
+)
+
+// WebhookSink POSTs the airspace, as JSON, to a URL. It can send the
+// whole snapshot each time, or just what changed since the last one it
+// sent (see Delta). Failed POSTs are retried, with jittered backoff, unless
+// the server said the request itself was bad (a 4xx).
+type WebhookSink struct {
+	URL  string
+	opts WebhookOptions
+
+	client *http.Client
+	seq    int64
+	sent   map[adsb.IcaoId]*adsb.CompositeMsg // What the far end has, if sending deltas
+}
+
+// WebhookOptions configure a WebhookSink; zero values get the defaults.
+type WebhookOptions struct {
+	Header  http.Header   // Added to each request (e.g. Authorization)
+	Deltas  bool          // Send Deltas, rather than whole snapshots
+	Timeout time.Duration // For each attempt (default 5s)
+	Retries int           // After the first attempt (default 2; negative for none)
+	Backoff time.Duration // Before the first retry; doubles each time (default 250ms)
+}
+
+// Delta is what a WebhookSink sends when it's sending deltas. The first
+// one (and the first after any failure, as the far end may have missed
+// some) is Full, and has every aircraft; after that, Aircraft has just the
+// ones that are new or have changed. Seq goes up by one each time.
+type Delta struct {
+	Seq      int64
+	Full     bool
+	Aircraft map[adsb.IcaoId]airspace.AircraftData
+	Removed  []adsb.IcaoId `json:",omitempty"`
+}
+
+// Apply brings an airspace up to date with the delta.
+func (d Delta)Apply(as *airspace.Airspace) {
+	if d.Full || as.Aircraft == nil { as.Aircraft = map[adsb.IcaoId]airspace.AircraftData{} }
+	for k,v := range d.Aircraft { as.Aircraft[k] = v }
+	for _,k := range d.Removed { delete(as.Aircraft, k) }
+}
+
+// {{{ NewWebhookSink
+
+func NewWebhookSink(url string, opts WebhookOptions) *WebhookSink {
+	if opts.Timeout <= 0 { opts.Timeout = 5 * time.Second }
+	if opts.Retries < 0 { opts.Retries = 0 } else if opts.Retries == 0 { opts.Retries = 2 }
+	if opts.Backoff <= 0 { opts.Backoff = 250 * time.Millisecond }
+
+	return &WebhookSink{
+		URL:    url,
+		opts:   opts,
+		client: &http.Client{},
+	}
+}
+
+func (s *WebhookSink)Close() error { return nil }
+
+func (s *WebhookSink)String() string {
+	if s.opts.Deltas { return "webhook+deltas:" + s.URL }
+	return "webhook:" + s.URL
+}
+
+// }}}
+// {{{ s.Publish
+
+func (s *WebhookSink)Publish(ctx context.Context, as *airspace.Airspace) error {
+	var body interface{} = as
+	if s.opts.Deltas { body = s.delta(as) }
+
+	data,err := json.Marshal(body)
+	if err != nil { return err }
+
+	if err := s.post(ctx, data); err != nil {
+		s.sent = nil // Start afresh with a Full delta
+		return err
+	}
+	return nil
+}
+
+// delta works out what changed since the last delta we sent; it assumes
+// this one will get there, and Publish forgets it all if it doesn't.
+func (s *WebhookSink)delta(as *airspace.Airspace) Delta {
+	s.seq++
+	d := Delta{Seq:s.seq, Full:s.sent == nil, Aircraft:map[adsb.IcaoId]airspace.AircraftData{}}
+
+	sent := make(map[adsb.IcaoId]*adsb.CompositeMsg, len(as.Aircraft))
+	for k,ad := range as.Aircraft {
+		// The airspace replaces the msg whenever anything changes
+		if prev,exists := s.sent[k]; d.Full || !exists || prev != ad.Msg {
+			d.Aircraft[k] = ad
+		}
+		sent[k] = ad.Msg
+	}
+	for k := range s.sent {
+		if _,exists := as.Aircraft[k]; !exists { d.Removed = append(d.Removed, k) }
+	}
+	sort.Slice(d.Removed, func(i,j int) bool { return d.Removed[i] < d.Removed[j] })
+
+	s.sent = sent
+	return d
+}
+
+// }}}
+// {{{ s.post
+
+type permanentError struct{ error }
+
+func (s *WebhookSink)post(ctx context.Context, data []byte) error {
+	var err error
+	for attempt := 0; attempt <= s.opts.Retries; attempt++ {
+		if attempt > 0 {
+			// Full jitter, as for tracksink.ReliableSink
+			d := s.opts.Backoff << uint(attempt-1)
+			select {
+			case <-time.After(time.Duration(rand.Int63n(int64(d)) + 1)):
+			case <-ctx.Done():
+				return fmt.Errorf("%v (gave up: %v)", err, ctx.Err())
+			}
+		}
+
+		if err = s.postOnce(ctx, data); err == nil {
+			return nil
+		} else if p,ok := err.(permanentError); ok {
+			return p.error
+		}
+	}
+	return err
+}
+
+func (s *WebhookSink)postOnce(ctx context.Context, data []byte) error {
+	ctx,cancel := context.WithTimeout(ctx, s.opts.Timeout)
+	defer cancel()
+
+	req,err := http.NewRequestWithContext(ctx, "POST", s.URL, bytes.NewReader(data))
+	if err != nil { return permanentError{err} }
+	for k,vals := range s.opts.Header {
+		for _,v := range vals { req.Header.Add(k, v) }
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp,err := s.client.Do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024)) // So the connection can be reused
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("POST %s: %s", s.URL, resp.Status)
+	default:
+		return permanentError{fmt.Errorf("POST %s: %s", s.URL, resp.Status)}
+	}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
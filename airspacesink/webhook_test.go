@@ -0,0 +1,183 @@
+package airspacesink
+
+import(
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skypies/adsb"
+	"github.com/skypies/pi/airspace"
+)
+
+// {{{ hookServer
+
+// hookServer is a webhook endpoint that records what it's sent, and fails
+// when it's told to.
+type hookServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	bodies   [][]byte
+	headers  []http.Header
+	attempts int
+	failWith []int         // Status codes for the next requests, before succeeding
+	delay    time.Duration // Before replying
+}
+
+func newHookServer(t *testing.T) *hookServer {
+	h := &hookServer{}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		h.attempts++
+		delay := h.delay
+		status := http.StatusOK
+		if len(h.failWith) > 0 {
+			status,h.failWith = h.failWith[0], h.failWith[1:]
+		}
+		h.mu.Unlock()
+
+		time.Sleep(delay)
+		if status != http.StatusOK {
+			http.Error(w, "nope", status)
+			return
+		}
+
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "want a JSON POST", http.StatusBadRequest)
+			return
+		}
+		body,err := io.ReadAll(r.Body)
+		if err != nil { return }
+
+		h.mu.Lock()
+		h.bodies = append(h.bodies, body)
+		h.headers = append(h.headers, r.Header.Clone())
+		h.mu.Unlock()
+	}))
+	t.Cleanup(h.Close)
+	return h
+}
+
+func (h *hookServer)set(f func(h *hookServer)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f(h)
+}
+
+// }}}
+
+func TestWebhookSnapshots(t *testing.T) {
+	h := newHookServer(t)
+	s := NewWebhookSink(h.URL, WebhookOptions{
+		Header:  http.Header{"Authorization": []string{"Bearer sekrit"}},
+		Backoff: time.Millisecond,
+	})
+	ctx := context.Background()
+
+	if err := s.Publish(ctx, testAirspace("A00001", "A00002")); err != nil { t.Fatal(err) }
+
+	// Two failures, then success: the retries should cover it
+	h.set(func(h *hookServer) { h.failWith = []int{503, 429} })
+	if err := s.Publish(ctx, testAirspace("A00003")); err != nil { t.Errorf("with retries: %v", err) }
+
+	// Bad requests aren't worth retrying
+	h.set(func(h *hookServer) { h.failWith = []int{400, 503} })
+	if err := s.Publish(ctx, testAirspace("A00004")); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("400: got %v", err)
+	}
+
+	// Out of retries
+	h.set(func(h *hookServer) { h.failWith = []int{500, 500, 500} })
+	if err := s.Publish(ctx, testAirspace("A00005")); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("500s: got %v", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.attempts != 1+3+1+3 { t.Errorf("%d attempts, wanted 8", h.attempts) }
+	if len(h.bodies) != 2 { t.Fatalf("%d bodies, wanted 2", len(h.bodies)) }
+	as := airspace.Airspace{}
+	if err := json.Unmarshal(h.bodies[0], &as); err != nil || len(as.Aircraft) != 2 {
+		t.Errorf("first body: %v, %v", as, err)
+	}
+	if got := h.headers[0].Get("Authorization"); got != "Bearer sekrit" { t.Errorf("auth header %q", got) }
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	h := newHookServer(t)
+	h.set(func(h *hookServer) { h.delay = 200 * time.Millisecond })
+	s := NewWebhookSink(h.URL, WebhookOptions{Timeout:20*time.Millisecond, Retries:-1})
+
+	tStart := time.Now()
+	if err := s.Publish(context.Background(), testAirspace("A00001")); err == nil {
+		t.Errorf("expected a timeout")
+	}
+	if took := time.Since(tStart); took > 150*time.Millisecond { t.Errorf("took %s; timeout is 20ms", took) }
+
+	// The publisher's deadline cuts retries short, too
+	s = NewWebhookSink(h.URL, WebhookOptions{Timeout:time.Second, Backoff:time.Second})
+	ctx,cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	tStart = time.Now()
+	if err := s.Publish(ctx, testAirspace("A00001")); err == nil { t.Errorf("expected an error") }
+	if took := time.Since(tStart); took > 150*time.Millisecond { t.Errorf("took %s; deadline is 50ms", took) }
+}
+
+func TestWebhookDeltas(t *testing.T) {
+	h := newHookServer(t)
+	s,err := New("webhook+deltas:" + h.URL)
+	if err != nil { t.Fatal(err) }
+	ctx := context.Background()
+
+	as := testAirspace("A00001", "A00002", "A00003")
+	mirror := airspace.Airspace{}
+	lastDelta := func() Delta {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		d := Delta{}
+		if err := json.Unmarshal(h.bodies[len(h.bodies)-1], &d); err != nil { t.Fatal(err) }
+		d.Apply(&mirror)
+		return d
+	}
+	check := func(d Delta, seq int64, full bool, nAircraft int, removed ...adsb.IcaoId) {
+		t.Helper()
+		if d.Seq != seq || d.Full != full || len(d.Aircraft) != nAircraft || len(d.Removed) != len(removed) {
+			t.Errorf("delta %d: got seq %d, full %v, %d aircraft, removed %v",
+				seq, d.Seq, d.Full, len(d.Aircraft), d.Removed)
+		}
+		if len(mirror.Aircraft) != len(as.Aircraft) {
+			t.Errorf("delta %d: mirror has %d aircraft, wanted %d", seq, len(mirror.Aircraft), len(as.Aircraft))
+		}
+		for k := range as.Aircraft {
+			if _,exists := mirror.Aircraft[k]; !exists { t.Errorf("delta %d: mirror is missing %s", seq, k) }
+		}
+	}
+
+	if err := s.Publish(ctx, as); err != nil { t.Fatal(err) }
+	check(lastDelta(), 1, true, 3)
+
+	if err := s.Publish(ctx, as.Snapshot()); err != nil { t.Fatal(err) }
+	check(lastDelta(), 2, false, 0)
+
+	// One new msg, one new aircraft, one gone
+	ad := as.Aircraft["A00001"]
+	ad.Msg = &adsb.CompositeMsg{Msg:adsb.Msg{Icao24:"A00001", Callsign:"UALA01", GeneratedTimestampUTC:time.Now()}}
+	as.Aircraft["A00001"] = ad
+	as.Aircraft["A00004"] = testAirspace("A00004").Aircraft["A00004"]
+	delete(as.Aircraft, "A00002")
+	if err := s.Publish(ctx, as); err != nil { t.Fatal(err) }
+	check(lastDelta(), 3, false, 2, "A00002")
+	if mirror.Aircraft["A00001"].Msg.Callsign != "UALA01" { t.Errorf("mirror didn't get the update") }
+
+	// After a failure, the far end might be out of date; so start again
+	h.set(func(h *hookServer) { h.failWith = []int{400} })
+	if err := s.Publish(ctx, as); err == nil { t.Errorf("expected an error") }
+	if err := s.Publish(ctx, as); err != nil { t.Fatal(err) }
+	check(lastDelta(), 5, true, 3)
+}
@@ -0,0 +1,301 @@
+package bundlesource
+
+// Bundles can be signed by the receiver that sent them, so that a
+// consolidator can check they really came from who they claim. A signed
+// bundle is wrapped in an envelope:
+//   "SKYSIG1\n" + gob(envelope{Receiver, Alg, Payload, Sig})
+// where Payload is the Encode()d bundle, and Sig covers the receiver name
+// and the payload. Every message in the payload must carry the same
+// ReceiverName as the envelope.
+//
+// Keys live in a text file, one per line:
+//   # receiver     alg          base64 key
+//   ScottsValley   hmac-sha256  c2VjcmV0IHNxdWlycmVs
+//   CulverCity     ed25519      <32 byte public key, or 64 byte private key>
+// The sender needs the HMAC secret or ed25519 private key; the consolidator
+// needs the HMAC secret or the ed25519 public key. A receiver of "*"
+// signs for any receiver without a key of its own. Whoever holds a "*" key
+// can sign as any of those receivers, so verifiers ignore it unless
+// VerifyWildcard is set.
+
+import(
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/skypies/adsb"
+)
+
+const sigMagic = "SKYSIG1\n"
+
+const(
+	AlgHMAC    = "hmac-sha256"
+	AlgEd25519 = "ed25519"
+)
+
+var(
+	ErrUnsigned = errors.New("bundle is not signed")
+	ErrForged   = errors.New("bundle signature is not valid")
+)
+
+// If Keys is set, every bundle must be signed by a key in it; bundles that
+// aren't are rejected, and counted.
+var Keys *KeyRegistry
+
+// {{{ Key{}, KeyRegistry{}
+
+type Key struct {
+	Receiver string
+	Alg      string
+	Secret   []byte              // hmac-sha256
+	Public   ed25519.PublicKey   // ed25519
+	Private  ed25519.PrivateKey  // ed25519, only needed for signing
+}
+
+type KeyRegistry struct {
+	keys map[string]*Key
+
+	// If set, the "*" key verifies bundles from receivers without a key of
+	// their own; otherwise, their bundles are rejected as forged.
+	VerifyWildcard bool
+}
+
+// Lookup returns the key to sign for the receiver with; its own, or the
+// "*" key.
+func (r *KeyRegistry)Lookup(receiver string) *Key {
+	if k,exists := r.keys[receiver]; exists { return k }
+	return r.keys["*"]
+}
+
+func (r *KeyRegistry)Len() int { return len(r.keys) }
+
+func (r *KeyRegistry)HasWildcard() bool { return r.keys["*"] != nil }
+
+// }}}
+// {{{ LoadKeyRegistry, ParseKeyRegistry
+
+func LoadKeyRegistry(filename string) (*KeyRegistry, error) {
+	f,err := os.Open(filename)
+	if err != nil { return nil, err }
+	defer f.Close()
+	r,err := ParseKeyRegistry(f)
+	if err != nil { return nil, fmt.Errorf("%s: %v", filename, err) }
+	return r, nil
+}
+
+func ParseKeyRegistry(in io.Reader) (*KeyRegistry, error) {
+	r := &KeyRegistry{keys: map[string]*Key{}}
+	scanner := bufio.NewScanner(in)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") { continue }
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: want 'receiver alg key'", lineNum)
+		}
+		raw,err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+
+		k := &Key{Receiver: fields[0], Alg: fields[1]}
+		switch k.Alg {
+		case AlgHMAC:
+			if len(raw) < 16 { return nil, fmt.Errorf("line %d: hmac secret too short", lineNum) }
+			k.Secret = raw
+		case AlgEd25519:
+			switch len(raw) {
+			case ed25519.PublicKeySize:
+				k.Public = ed25519.PublicKey(raw)
+			case ed25519.PrivateKeySize:
+				k.Private = ed25519.PrivateKey(raw)
+				k.Public = k.Private.Public().(ed25519.PublicKey)
+			default:
+				return nil, fmt.Errorf("line %d: ed25519 key has bad length %d", lineNum, len(raw))
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unknown alg %q", lineNum, k.Alg)
+		}
+
+		if _,exists := r.keys[k.Receiver]; exists {
+			return nil, fmt.Errorf("line %d: duplicate key for %q", lineNum, k.Receiver)
+		}
+		r.keys[k.Receiver] = k
+	}
+	return r, scanner.Err()
+}
+
+// }}}
+// {{{ GenerateKey
+
+// GenerateKey returns a new key, as the lines for the sender's and the
+// consolidator's key files.
+func GenerateKey(receiver, alg string) (senderLine, verifierLine string, err error) {
+	line := func(key []byte) string {
+		return fmt.Sprintf("%s %s %s", receiver, alg, base64.StdEncoding.EncodeToString(key))
+	}
+	switch alg {
+	case AlgHMAC:
+		secret := make([]byte, 32)
+		if _,err := rand.Read(secret); err != nil { return "", "", err }
+		return line(secret), line(secret), nil
+	case AlgEd25519:
+		pub,priv,err := ed25519.GenerateKey(rand.Reader)
+		if err != nil { return "", "", err }
+		return line(priv), line(pub), nil
+	}
+	return "", "", fmt.Errorf("unknown alg %q", alg)
+}
+
+// }}}
+
+// {{{ envelope{}, Sign
+
+type envelope struct {
+	Receiver string
+	Alg      string
+	Payload  []byte
+	Sig      []byte
+}
+
+func (e *envelope)signedBytes() []byte {
+	return append([]byte(e.Receiver + "\x00"), e.Payload...)
+}
+
+func hmacSum(secret, data []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Sign claims the messages for the receiver, and returns the bundle in a
+// signed envelope. It can be sent anywhere an Encode()d bundle can.
+func Sign(msgs []*adsb.CompositeMsg, receiver string, k *Key) ([]byte, error) {
+	for i,_ := range msgs {
+		msgs[i].ReceiverName = receiver
+	}
+	payload,err := Encode(msgs)
+	if err != nil { return nil, err }
+
+	e := envelope{Receiver: receiver, Alg: k.Alg, Payload: payload}
+	switch k.Alg {
+	case AlgHMAC:
+		e.Sig = hmacSum(k.Secret, e.signedBytes())
+	case AlgEd25519:
+		if k.Private == nil { return nil, fmt.Errorf("Sign: no ed25519 private key for %q", receiver) }
+		e.Sig = ed25519.Sign(k.Private, e.signedBytes())
+	default:
+		return nil, fmt.Errorf("Sign: unknown alg %q", k.Alg)
+	}
+
+	buf := bytes.NewBufferString(sigMagic)
+	if err := gob.NewEncoder(buf).Encode(e); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// }}}
+// {{{ r.verify
+
+func (r *KeyRegistry)verify(e *envelope) error {
+	k := r.keys[e.Receiver]
+	if k == nil && r.VerifyWildcard {
+		k = r.keys["*"]
+	}
+	if k == nil || k.Alg != e.Alg {
+		return fmt.Errorf("%w: no %s key for %q", ErrForged, e.Alg, e.Receiver)
+	}
+	ok := false
+	switch k.Alg {
+	case AlgHMAC:
+		ok = hmac.Equal(e.Sig, hmacSum(k.Secret, e.signedBytes()))
+	case AlgEd25519:
+		ok = ed25519.Verify(k.Public, e.signedBytes(), e.Sig)
+	}
+	if !ok {
+		return fmt.Errorf("%w: bad signature for %q", ErrForged, e.Receiver)
+	}
+	return nil
+}
+
+// }}}
+
+// {{{ decodeBundle
+
+var authMutex = sync.Mutex{}
+var numUnsigned, numForged int64
+
+// NumRejected returns how many bundles were rejected for being unsigned,
+// and for failing verification.
+func NumRejected() (unsigned, forged int64) {
+	authMutex.Lock()
+	defer authMutex.Unlock()
+	return numUnsigned, numForged
+}
+
+// IsAuthError says if a bundle was rejected by Keys, rather than being
+// undecodable. Either way, redelivering it won't help.
+func IsAuthError(err error) bool {
+	return errors.Is(err, ErrUnsigned) || errors.Is(err, ErrForged)
+}
+
+// decodeBundle is what sources use to turn bytes into a bundle; it unwraps
+// signed envelopes, and enforces Keys.
+func decodeBundle(src BundleSource, data []byte) ([]*adsb.CompositeMsg, error) {
+	msgs,err := decodeAndVerify(data)
+	if IsAuthError(err) {
+		authMutex.Lock()
+		if errors.Is(err, ErrUnsigned) { numUnsigned++ } else { numForged++ }
+		authMutex.Unlock()
+		Log.Printf("%s: rejecting bundle: %v", src, err)
+	}
+	return msgs, err
+}
+
+func decodeAndVerify(data []byte) ([]*adsb.CompositeMsg, error) {
+	if !bytes.HasPrefix(data, []byte(sigMagic)) {
+		if Keys != nil { return nil, ErrUnsigned }
+		return Decode(data)
+	}
+
+	e := envelope{}
+	if err := gob.NewDecoder(bytes.NewReader(data[len(sigMagic):])).Decode(&e); err != nil {
+		return nil, fmt.Errorf("bundlesource: envelope: %v", err)
+	}
+	if Keys != nil {
+		if err := Keys.verify(&e); err != nil { return nil, err }
+	}
+
+	msgs,err := Decode(e.Payload)
+	if err != nil { return nil, err }
+	for _,m := range msgs {
+		if m.ReceiverName != e.Receiver {
+			return nil, fmt.Errorf("%w: %q signed a message from %q", ErrForged, e.Receiver,
+				m.ReceiverName)
+		}
+	}
+	return msgs, nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,162 @@
+// Package bundlesource abstracts away where the consolidator gets its
+// bundles of messages from. In prod they arrive via Google Cloud Pubsub;
+// but skypi can also send them directly over TCP or HTTP, they can come
+// via an MQTT or NATS broker, or be replayed from an SBS file. This lets
+// the whole pipeline run offline.
+package bundlesource
+
+import(
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/skypies/adsb"
+)
+
+var Log = log.New(os.Stdout,"", log.Ldate|log.Ltime)
+
+// A Handler is called for each bundle that arrives. Sources may call it
+// from many goroutines at once; it should block if the pipeline is
+// backed up, and the source will stop pulling new data. It should not
+// return until the bundle is safe; a nil error means the source can
+// forget about it (e.g. ack it), and an error means the source should
+// arrange for it to be redelivered, if it can.
+type Handler func(msgs []*adsb.CompositeMsg) error
+
+// A BundleSource delivers bundles of messages to a handler.
+type BundleSource interface {
+	// Run delivers bundles until the context is cancelled, or the source
+	// runs out of data (in which case it returns io.EOF).
+	Run(ctx context.Context, h Handler) error
+	String() string
+}
+
+// {{{ Encode, Decode
+
+// Encode serializes a bundle, in the same format used for pubsub messages.
+func Encode(msgs []*adsb.CompositeMsg) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(msgs); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func Decode(data []byte) ([]*adsb.CompositeMsg, error) {
+	msgs := []*adsb.CompositeMsg{}
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&msgs); err != nil {
+		return nil, fmt.Errorf("bundlesource.Decode: %v", err)
+	}
+	if len(msgs) == 0 {
+		return nil, fmt.Errorf("bundlesource.Decode: empty bundle")
+	}
+	return msgs, nil
+}
+
+// }}}
+// {{{ WriteFrame, ReadFrame
+
+// Bundles sent over a stream are framed with a four byte, big-endian length.
+const maxFrameSize = 16 * 1024 * 1024
+
+func WriteFrame(w io.Writer, msgs []*adsb.CompositeMsg) error {
+	data,err := Encode(msgs)
+	if err != nil { return err }
+	return WriteRawFrame(w, data)
+}
+
+// WriteRawFrame writes an already encoded (e.g. signed) bundle.
+func WriteRawFrame(w io.Writer, data []byte) error {
+	hdr := make([]byte, 4)
+	binary.BigEndian.PutUint32(hdr, uint32(len(data)))
+	if _,err := w.Write(append(hdr, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReadFrame reads a bundle, without checking any signature.
+func ReadFrame(r io.Reader) ([]*adsb.CompositeMsg, error) {
+	data,err := ReadRawFrame(r)
+	if err != nil { return nil, err }
+	return Decode(data)
+}
+
+func ReadRawFrame(r io.Reader) ([]byte, error) {
+	hdr := make([]byte, 4)
+	if _,err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr)
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("bundlesource.ReadFrame: frame too big (%d bytes)", n)
+	}
+
+	data := make([]byte, n)
+	if _,err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// }}}
+// {{{ New
+
+// New builds a source from a spec string. Pubsub needs more setup than
+// fits in a string, so use NewPubsubSource for that.
+//   http:HOST:PORT                   - accept POSTed bundles
+//   tcp:HOST:PORT                    - accept framed bundles over TCP
+//   mqtt:tcp://BROKER:PORT/TOPIC     - subscribe to an MQTT topic
+//   nats:nats://SERVER:PORT/SUBJECT  - subscribe to a NATS subject
+//   file:FILENAME[,RECEIVERNAME]     - replay an SBS file, in real time
+func New(spec string) (BundleSource, error) {
+	kind,arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind,arg = spec[:i], spec[i+1:]
+	}
+	if arg == "" {
+		return nil, fmt.Errorf("bundlesource: spec %q has no address", spec)
+	}
+
+	switch kind {
+	case "http":
+		return &HTTPSource{Addr: arg}, nil
+	case "tcp":
+		return &TCPSource{Addr: arg}, nil
+	case "mqtt", "nats":
+		u,err := url.Parse(arg)
+		if err != nil { return nil, fmt.Errorf("bundlesource: %q: %v", spec, err) }
+		topic := strings.TrimPrefix(u.Path, "/")
+		if topic == "" { return nil, fmt.Errorf("bundlesource: %q has no topic", spec) }
+		u.Path = ""
+		if kind == "mqtt" {
+			return &MQTTSource{Broker: u.String(), Topic: topic}, nil
+		}
+		return &NATSSource{URL: u.String(), Subject: topic}, nil
+	case "file":
+		filename,receiver := arg, "Replay"
+		if i := strings.Index(arg, ","); i >= 0 {
+			filename,receiver = arg[:i], arg[i+1:]
+		}
+		return &FileSource{Filename: filename, ReceiverName: receiver, Speed: 1.0}, nil
+	default:
+		return nil, fmt.Errorf("bundlesource: unknown source spec %q", spec)
+	}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,259 @@
+// go test -v github.com/skypies/pi/bundlesource
+package bundlesource
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skypies/adsb"
+)
+
+var sbsText = `MSG,3,1,1,A81BD0,1,2015/12/25,08:00:00.111111,2015/12/25,08:00:00.111999,ABC1234,36000,300,10,36.69804,-121.86007,+64,,,,,0
+MSG,3,1,1,A81BD1,1,2015/12/25,08:00:00.222222,2015/12/25,08:00:00.222999,DEF1234,36000,300,10,36.69804,-121.86007,+64,,,,,0
+MSG,3,1,1,A81BD0,1,2015/12/25,08:00:01.111111,2015/12/25,08:00:01.111999,ABC1234,36000,300,10,36.69904,-121.86007,+64,,,,,0
+MSG,3,1,1,A81BD1,1,2015/12/25,08:00:01.222222,2015/12/25,08:00:01.222999,DEF1234,36000,300,10,36.69904,-121.86007,+64,,,,,0
+MSG,3,1,1,A81BD0,1,2015/12/25,08:00:02.111111,2015/12/25,08:00:02.111999,ABC1234,36000,300,10,36.70004,-121.86007,+64,,,,,0
+`
+
+func bundle(n int) []*adsb.CompositeMsg {
+	msgs := []*adsb.CompositeMsg{}
+	for i:=0; i<n; i++ {
+		msgs = append(msgs, &adsb.CompositeMsg{
+			Msg: adsb.Msg{Type:"MSG", Icao24:"A81BD0", Altitude:int64(1000*i)},
+			ReceiverName: "Test",
+		})
+	}
+	return msgs
+}
+
+// collector is a Handler that remembers what it was given
+type collector struct {
+	sync.Mutex
+	bundles [][]*adsb.CompositeMsg
+	fail    bool
+}
+func (c *collector)handle(msgs []*adsb.CompositeMsg) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.fail { return fmt.Errorf("collector is failing") }
+	c.bundles = append(c.bundles, msgs)
+	return nil
+}
+func (c *collector)numMsgs() int {
+	c.Lock()
+	defer c.Unlock()
+	n := 0
+	for _,b := range c.bundles { n += len(b) }
+	return n
+}
+
+func TestFraming(t *testing.T) {
+	var buf bytes.Buffer
+	for i:=1; i<=3; i++ {
+		if err := WriteFrame(&buf, bundle(i)); err != nil { t.Fatal(err) }
+	}
+	for i:=1; i<=3; i++ {
+		msgs,err := ReadFrame(&buf)
+		if err != nil { t.Fatal(err) }
+		if len(msgs) != i || msgs[i-1].Altitude != int64(1000*(i-1)) || msgs[0].ReceiverName != "Test" {
+			t.Errorf("frame %d: bad round trip: %v", i, msgs)
+		}
+	}
+	if _,err := ReadFrame(&buf); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestTCPSource(t *testing.T) {
+	ln,err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+
+	ctx,cancel := context.WithCancel(context.Background())
+	c := collector{}
+	src := TCPSource{Listener: ln}
+	finished := make(chan error)
+	go func() { finished <- src.Run(ctx, c.handle) }()
+
+	conn,err := net.Dial("tcp", ln.Addr().String())
+	if err != nil { t.Fatal(err) }
+	WriteFrame(conn, bundle(2))
+	WriteFrame(conn, bundle(3))
+
+	for i:=0; i<50 && c.numMsgs() < 5; i++ { time.Sleep(10 * time.Millisecond) }
+	cancel()
+	if err := <-finished; err != nil { t.Errorf("Run: %v", err) }
+	if n := c.numMsgs(); n != 5 { t.Errorf("expected 5 msgs, got %d", n) }
+}
+
+func TestHTTPSource(t *testing.T) {
+	c := collector{}
+	src := &HTTPSource{h: c.handle}
+	srv := httptest.NewServer(src)
+	defer srv.Close()
+
+	data,_ := Encode(bundle(4))
+	resp,err := http.Post(srv.URL, "application/octet-stream", bytes.NewReader(data))
+	if err != nil { t.Fatal(err) }
+	if resp.StatusCode != http.StatusOK { t.Errorf("good bundle: status %s", resp.Status) }
+
+	DeadLetterDir = t.TempDir()
+	defer func() { DeadLetterDir = "" }()
+	resp,err = http.Post(srv.URL, "application/octet-stream", bytes.NewReader([]byte("junk")))
+	if err != nil { t.Fatal(err) }
+	if resp.StatusCode != http.StatusBadRequest { t.Errorf("bad bundle: status %s", resp.Status) }
+	if files,_ := filepath.Glob(filepath.Join(DeadLetterDir, "*.bin")); len(files) != 1 {
+		t.Errorf("expected 1 dead letter, found %v", files)
+	}
+
+	c.fail = true
+	resp,err = http.Post(srv.URL, "application/octet-stream", bytes.NewReader(data))
+	if err != nil { t.Fatal(err) }
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("failing handler: status %s", resp.Status)
+	}
+
+	if n := c.numMsgs(); n != 4 { t.Errorf("expected 4 msgs, got %d", n) }
+}
+
+func TestFileSource(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "replay.sbs")
+	if err := os.WriteFile(filename, []byte(sbsText), 0644); err != nil { t.Fatal(err) }
+
+	src,err := New("file:" + filename + ",Bob")
+	if err != nil { t.Fatal(err) }
+	src.(*FileSource).Speed = 0
+
+	c := collector{}
+	if err := src.Run(context.Background(), c.handle); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	// The first message from each aircraft just primes the message buffer
+	if n := c.numMsgs(); n != 3 { t.Errorf("expected 3 msgs, got %d", n) }
+	for _,b := range c.bundles {
+		for _,m := range b {
+			if m.ReceiverName != "Bob" { t.Errorf("bad receiver name %q", m.ReceiverName) }
+		}
+	}
+}
+
+func TestSpecs(t *testing.T) {
+	good := map[string]string{
+		"http::8081": "http::8081",
+		"tcp:localhost:30200": "tcp:localhost:30200",
+		"mqtt:tcp://broker:1883/adsb/bundles": "mqtt:tcp://broker:1883/adsb/bundles",
+		"nats:nats://localhost:4222/adsb.bundles": "nats:nats://localhost:4222/adsb.bundles",
+		"file:/tmp/foo.sbs": "file:/tmp/foo.sbs",
+	}
+	for spec,expected := range good {
+		if src,err := New(spec); err != nil {
+			t.Errorf("spec %q: %v", spec, err)
+		} else if src.String() != expected {
+			t.Errorf("spec %q: got %q, expected %q", spec, src.String(), expected)
+		}
+	}
+
+	for _,spec := range []string{"", "http", "pubsub:foo", "mqtt:tcp://broker:1883"} {
+		if _,err := New(spec); err == nil {
+			t.Errorf("spec %q: expected an error", spec)
+		}
+	}
+}
+
+func TestSigning(t *testing.T) {
+	hmacSender,hmacVerifier,_ := GenerateKey("Alpha", AlgHMAC)
+	edSender,edVerifier,_ := GenerateKey("Bravo", AlgEd25519)
+	_,otherVerifier,_ := GenerateKey("Bravo", AlgEd25519)
+
+	senders,err := ParseKeyRegistry(strings.NewReader(hmacSender + "\n" + edSender + "\n"))
+	if err != nil { t.Fatal(err) }
+	verifiers,err := ParseKeyRegistry(strings.NewReader("# comment\n" + hmacVerifier + "\n" +
+		edVerifier + "\n"))
+	if err != nil { t.Fatal(err) }
+	wrongKeys,_ := ParseKeyRegistry(strings.NewReader(hmacVerifier + "\n" + otherVerifier + "\n"))
+
+	defer func() { Keys = nil }()
+
+	for _,receiver := range []string{"Alpha", "Bravo"} {
+		data,err := Sign(bundle(3), receiver, senders.Lookup(receiver))
+		if err != nil { t.Fatal(err) }
+
+		Keys = nil // Signed bundles are fine even if we're not checking
+		if msgs,err := decodeAndVerify(data); err != nil || len(msgs) != 3 {
+			t.Errorf("%s, no keys: %v", receiver, err)
+		}
+
+		Keys = verifiers
+		msgs,err := decodeAndVerify(data)
+		if err != nil {
+			t.Errorf("%s: %v", receiver, err)
+		} else if msgs[0].ReceiverName != receiver {
+			t.Errorf("%s: msgs claimed by %q", receiver, msgs[0].ReceiverName)
+		}
+
+		// Flip a bit in the payload
+		data[len(data)-10] ^= 0x01
+		if _,err := decodeAndVerify(data); err == nil {
+			t.Errorf("%s: tampered bundle accepted", receiver)
+		}
+	}
+
+	// Signed with a key the consolidator doesn't recognize
+	Keys = wrongKeys
+	data,_ := Sign(bundle(3), "Bravo", senders.Lookup("Bravo"))
+	if _,err := decodeAndVerify(data); !errors.Is(err, ErrForged) {
+		t.Errorf("wrong key: expected ErrForged, got %v", err)
+	}
+
+	// Alpha signing for someone else
+	Keys = verifiers
+	data,_ = Sign(bundle(3), "Charlie", senders.Lookup("Alpha"))
+	if _,err := decodeAndVerify(data); !errors.Is(err, ErrForged) {
+		t.Errorf("impersonation: expected ErrForged, got %v", err)
+	}
+
+	unsigned,_ := Encode(bundle(3))
+	if _,err := decodeAndVerify(unsigned); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("expected ErrUnsigned, got %v", err)
+	}
+
+	for _,bad := range []string{"Alpha hmac-sha256", "Alpha rot13 c2VjcmV0", "Alpha ed25519 c2VjcmV0"} {
+		if _,err := ParseKeyRegistry(strings.NewReader(bad)); err == nil {
+			t.Errorf("key line %q accepted", bad)
+		}
+	}
+}
+
+// A "*" key signs for anyone, but only verifies if the consolidator has
+// asked for it; otherwise its holder could pass as any keyless receiver.
+func TestSigningWildcard(t *testing.T) {
+	sender,verifier,_ := GenerateKey("*", AlgHMAC)
+	senders,_ := ParseKeyRegistry(strings.NewReader(sender))
+	verifiers,_ := ParseKeyRegistry(strings.NewReader(verifier))
+	if !verifiers.HasWildcard() { t.Fatalf("wildcard key not found") }
+	defer func() { Keys = nil }()
+
+	data,err := Sign(bundle(3), "Charlie", senders.Lookup("Charlie"))
+	if err != nil { t.Fatal(err) }
+
+	Keys = verifiers
+	if _,err := decodeAndVerify(data); !errors.Is(err, ErrForged) {
+		t.Errorf("wildcard, not asked for: expected ErrForged, got %v", err)
+	}
+	verifiers.VerifyWildcard = true
+	if _,err := decodeAndVerify(data); err != nil {
+		t.Errorf("wildcard, asked for: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package bundlesource
+
+import(
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Bundles that can never be processed (e.g. they won't decode) are
+// "poison"; retrying them forever would clog up the source. Instead they
+// are written to the dead letter directory (if set), for later autopsy.
+var DeadLetterDir = ""
+
+var deadLetterMutex = sync.Mutex{}
+var numDeadLetters int64
+
+func NumDeadLetters() int64 {
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+	return numDeadLetters
+}
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// deadLetter records a poison bundle, as raw bytes plus a note on what
+// was wrong with it.
+func deadLetter(src BundleSource, data []byte, reason error) {
+	deadLetterMutex.Lock()
+	numDeadLetters++
+	deadLetterMutex.Unlock()
+
+	Log.Printf("%s: dead-lettering %d bytes: %v", src, len(data), reason)
+	if DeadLetterDir == "" { return }
+
+	base := filepath.Join(DeadLetterDir, fmt.Sprintf("%d-%s", time.Now().UnixNano(),
+		unsafeChars.ReplaceAllString(src.String(), "_")))
+	note := fmt.Sprintf("source: %s\ntime: %s\nreason: %v\n", src, time.Now(), reason)
+
+	if err := os.WriteFile(base+".bin", data, 0644); err != nil {
+		Log.Printf("deadLetter: %v", err)
+	} else if err := os.WriteFile(base+".txt", []byte(note), 0644); err != nil {
+		Log.Printf("deadLetter: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package bundlesource
+
+import(
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/skypies/adsb"
+	"github.com/skypies/adsb/msgbuffer"
+)
+
+const fastReplayBundleSize = 20
+
+// FileSource replays an SBS file (e.g. as captured from port 30003),
+// running it through a message buffer just as skypi would, to generate
+// bundles. Timestamps are rewritten to the time of replay.
+type FileSource struct {
+	Filename     string
+	ReceiverName string
+	Speed        float64 // 1.0 is real time, 2.0 twice as fast; 0 is as fast as possible
+}
+
+func (s *FileSource)String() string { return "file:" + s.Filename }
+
+func (s *FileSource)load() ([]adsb.Msg, error) {
+	f,err := os.Open(s.Filename)
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	msgs := []adsb.Msg{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if scanner.Text() == "" { continue }
+		m := adsb.Msg{}
+		if err := m.FromSBS1(scanner.Text()); err != nil {
+			return nil, fmt.Errorf("%s: bad line %q: %v", s, scanner.Text(), err)
+		}
+		msgs = append(msgs, m)
+	}
+	if err := scanner.Err(); err != nil { return nil, err }
+
+	sort.SliceStable(msgs, func(i,j int) bool {
+		return msgs[i].GeneratedTimestampUTC.Before(msgs[j].GeneratedTimestampUTC)
+	})
+	return msgs, nil
+}
+
+// Run returns io.EOF once the whole file has been replayed.
+func (s *FileSource)Run(ctx context.Context, h Handler) error {
+	msgs,err := s.load()
+	if err != nil { return err }
+	Log.Printf("(%s: replaying %d msgs, speed %.1f)\n", s, len(msgs), s.Speed)
+
+	flushChan := make(chan []*adsb.CompositeMsg, 3)
+	mb := msgbuffer.NewMsgBuffer()
+	mb.FlushChannel = flushChan
+	mb.MaxMessageAge = 2 * time.Second
+	mb.MinPublishInterval = 1500 * time.Millisecond
+	if s.Speed <= 0 {
+		// Time stands still, so flush by hand every so often
+		mb.MaxMessageAge = 24 * time.Hour
+	}
+
+	delivered := make(chan struct{})
+	go func() {
+		for bundle := range flushChan {
+			if len(bundle) == 0 { continue }
+			for _,m := range bundle { m.ReceiverName = s.ReceiverName }
+			if err := h(bundle); err != nil {
+				Log.Printf("%s: bundle lost, handler: %v", s, err)
+			}
+		}
+		close(delivered)
+	}()
+
+	for i,_ := range msgs {
+		if ctx.Err() != nil { break }
+
+		if i > 0 && s.Speed > 0 {
+			gap := msgs[i].GeneratedTimestampUTC.Sub(msgs[i-1].GeneratedTimestampUTC)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Duration(float64(gap) / s.Speed)):
+			}
+		}
+
+		m := msgs[i]
+		m.GeneratedTimestampUTC = time.Now().UTC()
+		m.LoggedTimestampUTC = m.GeneratedTimestampUTC
+		mb.Add(&m)
+
+		if s.Speed <= 0 && len(mb.Messages) >= fastReplayBundleSize {
+			mb.FinalFlush()
+		}
+	}
+
+	mb.FinalFlush()
+	close(flushChan)
+	<-delivered
+
+	if ctx.Err() != nil { return nil }
+	return io.EOF
+}
@@ -0,0 +1,68 @@
+package bundlesource
+
+import(
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// HTTPSource accepts bundles POSTed to it (from any path), with the body
+// in the same format as Encode. The response isn't sent until the handler
+// has accepted the bundle, so a backed up pipeline slows down the senders.
+// Bundles that won't decode get a 400 (and are dead-lettered); if the
+// handler fails, we send a 503, and the sender should retry. Bundles that
+// fail authentication get a 403.
+type HTTPSource struct {
+	Addr string
+	h    Handler
+}
+
+func (s *HTTPSource)String() string { return "http:" + s.Addr }
+
+func (s *HTTPSource)ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data,err := io.ReadAll(io.LimitReader(r.Body, maxFrameSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msgs,err := decodeBundle(s, data)
+	if IsAuthError(err) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		deadLetter(s, data, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.h(msgs); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "OK\n")
+}
+
+func (s *HTTPSource)Run(ctx context.Context, h Handler) error {
+	s.h = h
+	srv := &http.Server{Addr: s.Addr, Handler: s}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx,cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	Log.Printf("(%s listening)\n", s)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package bundlesource
+
+import(
+	"context"
+	"fmt"
+	"os"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTTSource subscribes to a topic on an MQTT broker; each message on the
+// topic is a single bundle, in the format produced by Encode.
+type MQTTSource struct {
+	Broker   string // e.g. tcp://localhost:1883
+	Topic    string
+	ClientID string // Defaults to something unique-ish
+}
+
+func (s *MQTTSource)String() string { return fmt.Sprintf("mqtt:%s/%s", s.Broker, s.Topic) }
+
+func (s *MQTTSource)Run(ctx context.Context, h Handler) error {
+	if s.ClientID == "" {
+		host,_ := os.Hostname()
+		s.ClientID = fmt.Sprintf("consolidator-%s-%d", host, os.Getpid())
+	}
+
+	onMessage := func(c mqtt.Client, m mqtt.Message) {
+		msgs,err := decodeBundle(s, m.Payload())
+		if IsAuthError(err) {
+			return
+		} else if err != nil {
+			deadLetter(s, m.Payload(), err)
+			return
+		}
+		if err := h(msgs); err != nil {
+			Log.Printf("%s: bundle lost, handler: %v", s, err) // paho has no nack
+		}
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(s.Broker).
+		SetClientID(s.ClientID).
+		SetAutoReconnect(true).
+		SetOrderMatters(false)
+
+	// Subscribe in the OnConnect handler, so we resubscribe after reconnects
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		if t := c.Subscribe(s.Topic, 1, onMessage); t.Wait() && t.Error() != nil {
+			Log.Printf("%s: subscribe: %v", s, t.Error())
+		}
+	})
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		Log.Printf("%s: connection lost: %v", s, err)
+	})
+
+	client := mqtt.NewClient(opts)
+	if t := client.Connect(); t.Wait() && t.Error() != nil {
+		return t.Error()
+	}
+
+	<-ctx.Done()
+	client.Disconnect(250)
+	return nil
+}
@@ -0,0 +1,42 @@
+package bundlesource
+
+import(
+	"context"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATSSource subscribes to a subject on a NATS server; each message on
+// the subject is a single bundle, in the format produced by Encode.
+type NATSSource struct {
+	URL     string // e.g. nats://localhost:4222
+	Subject string
+}
+
+func (s *NATSSource)String() string { return fmt.Sprintf("nats:%s/%s", s.URL, s.Subject) }
+
+func (s *NATSSource)Run(ctx context.Context, h Handler) error {
+	nc,err := nats.Connect(s.URL, nats.MaxReconnects(-1))
+	if err != nil { return err }
+
+	_,err = nc.Subscribe(s.Subject, func(m *nats.Msg) {
+		msgs,err := decodeBundle(s, m.Data)
+		if IsAuthError(err) {
+			return
+		} else if err != nil {
+			deadLetter(s, m.Data, err)
+			return
+		}
+		if err := h(msgs); err != nil {
+			Log.Printf("%s: bundle lost, handler: %v", s, err) // core NATS has no redelivery
+		}
+	})
+	if err != nil {
+		nc.Close()
+		return err
+	}
+
+	<-ctx.Done()
+	return nc.Drain() // Let in-flight messages finish
+}
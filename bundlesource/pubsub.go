@@ -0,0 +1,116 @@
+package bundlesource
+
+import(
+	"context"
+	"fmt"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+
+	mypubsub "github.com/skypies/util/gcp/pubsub"
+)
+
+// PubsubSource pulls bundles from a Google Cloud Pubsub subscription.
+type PubsubSource struct {
+	Project        string
+	Topic          string
+	Subscription   string
+	MaxOutstanding int  // How many bundles to juggle at once
+	MaxDeliveryAttempts int // Undecodable bundles are dead-lettered after this many tries
+
+	// If set, the subscription is recreated at startup, and deleted on
+	// exit; this is for dev instances, which shouldn't steal from prod.
+	Ephemeral      bool
+
+	mu             sync.Mutex
+	failures       map[string]int // Message ID -> failed deliveries
+}
+
+func NewPubsubSource(project, topic, sub string, ephemeral bool) *PubsubSource {
+	return &PubsubSource{
+		Project: project,
+		Topic: topic,
+		Subscription: sub,
+		MaxOutstanding: 10,
+		MaxDeliveryAttempts: 5,
+		Ephemeral: ephemeral,
+	}
+}
+
+func (s *PubsubSource)String() string {
+	return fmt.Sprintf("pubsub:%s/%s/%s", s.Project, s.Topic, s.Subscription)
+}
+
+func (s *PubsubSource)noteFailedDelivery(id string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures == nil { s.failures = map[string]int{} }
+	s.failures[id]++
+	return s.failures[id]
+}
+
+func (s *PubsubSource)forgetDelivery(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.failures, id)
+}
+
+func (s *PubsubSource)setup(ctx context.Context, pc *pubsub.Client) {
+	mypubsub.Setup(ctx, pc, s.Topic, s.Subscription)
+	if s.Ephemeral {
+		mypubsub.DeleteSub(ctx, pc, s.Subscription)
+		mypubsub.CreateSub(ctx, pc, s.Subscription, s.Topic)
+	}
+}
+
+func (s *PubsubSource)Run(ctx context.Context, h Handler) error {
+	pc := mypubsub.NewClient(ctx, s.Project)
+	s.setup(ctx, pc)
+
+	sub := pc.Subscription(s.Subscription)
+	sub.ReceiveSettings.MaxOutstandingMessages = s.MaxOutstanding
+
+	// sub.Receive invokes concurrent instances of this callback. We only
+	// ack once the handler says the bundle is safe; if it fails, we nack,
+	// and pubsub will redeliver.
+	callback := func(ctx context.Context, m *pubsub.Message) {
+		msgs,err := decodeBundle(s, m.Data)
+		if IsAuthError(err) {
+			m.Ack() // Redelivery won't make it any more trustworthy
+			return
+		} else if err != nil {
+			// Retrying won't fix a bad bundle, but it might be a one-off
+			// corruption; give it a few goes before giving up on it.
+			if s.noteFailedDelivery(m.ID) < s.MaxDeliveryAttempts {
+				m.Nack()
+			} else {
+				deadLetter(s, m.Data, err)
+				s.forgetDelivery(m.ID)
+				m.Ack()
+			}
+			return
+		}
+
+		if err := h(msgs); err != nil {
+			m.Nack()
+			return
+		}
+		m.Ack()
+	}
+
+	// Blocks until ctx is cancelled
+	err := sub.Receive(ctx, callback)
+
+	if s.Ephemeral {
+		// Clean up our wasteful subscription, using a fresh context
+		ctx2 := context.Background()
+		pc2 := mypubsub.NewClient(ctx2, s.Project)
+		if err := mypubsub.DeleteSub(ctx2, pc2, s.Subscription); err != nil {
+			Log.Printf("%s: del: %v", s, err)
+		} else {
+			Log.Printf("%s: deleted subscription", s)
+		}
+	}
+
+	return err
+}
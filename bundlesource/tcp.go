@@ -0,0 +1,84 @@
+package bundlesource
+
+import(
+	"context"
+	"io"
+	"net"
+	"sync"
+)
+
+// TCPSource accepts connections, each of which sends a stream of bundles
+// framed by WriteFrame. There is no way to nack a bundle, so if the
+// handler fails we drop the connection; the sender will notice, at least.
+type TCPSource struct {
+	Addr     string
+	Listener net.Listener // If nil, Run will listen on Addr
+}
+
+func (s *TCPSource)String() string { return "tcp:" + s.Addr }
+
+func (s *TCPSource)Run(ctx context.Context, h Handler) error {
+	if s.Listener == nil {
+		ln,err := net.Listen("tcp", s.Addr)
+		if err != nil { return err }
+		s.Listener = ln
+	}
+	Log.Printf("(%s listening on %s)\n", s, s.Listener.Addr())
+
+	wg := &sync.WaitGroup{}
+	conns := map[net.Conn]bool{}
+	mu := sync.Mutex{}
+
+	// Accept and Read block, so unblock them by closing everything
+	go func() {
+		<-ctx.Done()
+		s.Listener.Close()
+		mu.Lock()
+		for conn,_ := range conns { conn.Close() }
+		mu.Unlock()
+	}()
+
+	for {
+		conn,err := s.Listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil { break }
+			return err
+		}
+
+		mu.Lock()
+		conns[conn] = true
+		mu.Unlock()
+
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			for {
+				data,err := ReadRawFrame(conn)
+				if err != nil {
+					if err != io.EOF && ctx.Err() == nil {
+						Log.Printf("%s: conn from %s: %v", s, conn.RemoteAddr(), err)
+					}
+					break
+				}
+				msgs,err := decodeBundle(s, data)
+				if IsAuthError(err) {
+					break // Already logged
+				} else if err != nil {
+					deadLetter(s, data, err)
+					continue
+				}
+				if err := h(msgs); err != nil {
+					Log.Printf("%s: conn from %s: dropping, handler: %v", s, conn.RemoteAddr(), err)
+					break
+				}
+			}
+			conn.Close()
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+		}(conn)
+	}
+
+	wg.Wait()
+	return nil
+}
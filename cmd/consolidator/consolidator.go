@@ -1,19 +1,64 @@
 // The consolidator program subscribes to a topic on Google Cloud
 // Pubsub, and reads bundles of composite ADSB messages from it. These
 // are deduped, and unique ones are published to a different topic.
-// Updates are written to a flight database. A snapshot is written to
-// memcache twice a second, for other apps to access.
+// Updates are written to a flight database. Snapshots of the airspace are
+// published (see package airspacesink) for other apps to access.
 
 // Handy oneliners:
 //   $ curl -s fdb.serfr1.org/con/stack | pp -force-color -parse=false -aggressive
 
 // To test, using a clone of the prod pubsub inputs and not touching datastore:
 //   $ export GOOGLE_APPLICATION_CREDENTIALS=~/something.json
-//   $ go run consolidator.go                [prod topic, but with now subscription]
-//   $ go run consolidator.go -input=testing [attaches to a testing topic]
+//   $ go run .                [prod topic, but with now subscription]
+//   $ go run . -input=testing [attaches to a testing topic]
+
+// To run entirely offline, replaying a capture (or having skypi -direct send to us):
+//   $ go run . -source=file:../mockdump1090/31009.out -sink=ndjson:/tmp/frags.ndjson
+//   $ go run . -source=http::8081 -sink=bolt:/tmp/frags.db
+
+// Bundles are only acked once they're safely on local disk, in the journal
+// (see journal.go); by default it lives in ~/.local/state/consolidator/journal.
+// To put it somewhere else, and to keep bundles that won't decode:
+//   $ go run . -dryrun=false -journal=/var/consolidator/journal -deadletter=/var/consolidator/dead
+
+// To choose which receivers to listen to (see policy.go), and pick up edits:
+//   $ go run . -policy=policy.json
+//   $ curl -X POST localhost:8080/con/policy/reload
+
+// To only accept bundles signed by known receivers (keys made with skypi -genkey):
+//   $ go run . -keys=receivers.keys
+
+// To keep implausible positions & altitudes out of the DB (see plausibility.go), and keep what was rejected:
+//   $ go run . -plausibility=plausibility.json -quarantine=/var/consolidator/quarantine.ndjson
+//   $ open http://localhost:8080/con/plausibility
+
+// To get alerts when receivers go quiet or weird (see health.go), and see them all:
+//   $ go run . -alerts=alerts.json
+//   $ open http://localhost:8080/con/receivers
+
+// To fill in registrations & routes from local files, rather than (or as
+// well as) the datastore refdata (see package enrich):
+//   $ go run . -enrich=airframes:/tmp/airframes.csv,routes:/tmp/routes.csv,datastore
+// or from a local copy of the FAA registry (see cmd/regimport):
+//   $ go run . -enrich=registry:/tmp/registry.db,routes:/tmp/routes.csv
+
+// To keep the track fragments, but somewhere other than datastore:
+//   $ go run . -sink=bolt:/tmp/frags.db
+//   $ go run . -sink=ndjson:/tmp/frags.ndjson
+
+// To publish the airspace to more places than the datastore singleton, at their own pace:
+//   $ go run . -airspace=datastore,file:/var/www/airspace.json@5s,redis:localhost:6379/airspace@250ms
+//   $ go run . -airspace=memcache:localhost:11211   [read it back with airspace.FromMemcache]
+// or to POST it to webhooks (with auth headers, if listed in -config as airspace_webhooks):
+//   $ go run . -airspace=webhook+deltas:http://localhost:8000/airspace@2s
+
+// To resize the pipeline, or change how often things happen (see package config):
+//   $ go run . -config=consolidator.yaml -print-config
+// (e.g. fusion_window: 2s, to fuse near-simultaneous reports from different
+// receivers into one best estimate per aircraft; see airspace.Fusion)
 
 // To run in full prod mode, upload to a micro VM (that has full cloud API access), and then:
-//   $ go run consolidator.go -dryrun=false
+//   $ go run . -dryrun=false
 
 // If there is a backlog to clear, consider a 4x vCPU machine size. This should clear
 //  at the rate of ~10K bundles/minute. The micro size will thrash if it tries this;
@@ -27,29 +72,30 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"hash/fnv"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
-	"cloud.google.com/go/pubsub"
-
 	"github.com/skypies/adsb"
 	"github.com/skypies/adsb/trackbuffer"
 	fdb "github.com/skypies/flightdb"
 	"github.com/skypies/flightdb/fgae"
 	"github.com/skypies/flightdb/ref"
 	"github.com/skypies/pi/airspace"
+	"github.com/skypies/pi/airspacesink"
+	"github.com/skypies/pi/bundlesource"
+	"github.com/skypies/pi/config"
+	"github.com/skypies/pi/enrich"
+	"github.com/skypies/pi/tracksink"
+	"github.com/skypies/pi/vitals"
 	dsprovider "github.com/skypies/util/gcp/ds"
-	"github.com/skypies/util/histogram"
-	"github.com/skypies/util/metrics"
-	"github.com/skypies/util/gcp/singleton"
-	mypubsub "github.com/skypies/util/gcp/pubsub" // This is adding less value over time; kill ?
 )
 
 // }}}
@@ -60,21 +106,38 @@ var (
 	fProjectName           string
 	fPubsubInputTopic      string
 	fPubsubSubscription    string
-	// fAirspaceWebhook       string
-	// fMemcacheServer        string
 	fVerbosity             int
 	fDatabaseWorkers       int
 
 	fDryrunMode            bool
+	fTrackSink             string
+	fBundleSource          string
+	fJournalDir            string
+	fDeadLetterDir         string
+	fSpillDir              string
+	fPolicyFile            string
+	fKeysFile              string
+	fKeysWildcard          bool
+	fDrainTimeout          time.Duration
+	fAlertsFile            string
+	fPlausibilityFile      string
+	fQuarantineFile        string
+	fEnrichSpecs           string
+	fAirspaceSinks         string
+	fConfigFile            string
+	fPrintConfig           bool
 
 	tGlobalStart           time.Time
 	stackTraceBytes      []byte
 
 	Log                   *log.Logger
+	conf                  config.Config
 
-	// These globals are updated from time to time
-	airframeRefdata       *ref.AirframeCache
-	scheduleRefdata       *ref.ScheduleCache
+	jrnl                  *journal // nil if -journal=none
+	policy                *receiverPolicy
+	disp                  *dispatcher
+	enricher              *enrich.Enricher // nil, if there's nothing to enrich with
+	airspacePub           *airspacesink.Publisher // nil, if there's nowhere to publish
 )
 
 // }}}
@@ -90,55 +153,123 @@ func init() {
 		"Name of the pubsub topic we read from (i.e. add our subscription to)")
 	flag.StringVar(&fPubsubSubscription, "sub", "consolidator",
 		"Name of the pubsub subscription on the adsb-inbound topic")
-	//flag.StringVar(&fAirspaceWebhook, "hook-airspace", "fdb.serfr1.org/fdb/memcachesingleton",
-	//	"URL to publish airspace updates to")
-	//flag.StringVar(&fMemcacheServer, "memcache-server", "", // "localhost:11211",
-	//	"memcache server to post airspace to *DISABLED JUNK FOR NOW*")
 
 	flag.BoolVar(&fDryrunMode, "dryrun", true, "else uses prod pubsub & datastore")
+	flag.StringVar(&fBundleSource, "source", "pubsub",
+		"where to read bundles from: pubsub, http:HOST:PORT, tcp:HOST:PORT,"+
+		" mqtt:tcp://BROKER:PORT/TOPIC, nats:nats://SERVER:PORT/SUBJECT, file:SBSFILE[,RECEIVER]")
+	flag.StringVar(&fTrackSink, "sink", "",
+		"where to write track fragments: datastore, discard, memory, bolt:FILE, ndjson:FILE"+
+		" (default: datastore, or discard if -dryrun)")
+
+	flag.StringVar(&fJournalDir, "journal", defaultJournalDir(),
+		"directory for the write-ahead journal; 'none' acks bundles before they're on disk,"+
+		" so a crash loses whatever was still in memory (tests only)")
+	flag.StringVar(&fDeadLetterDir, "deadletter", "",
+		"directory to keep bundles that can't be decoded (default: just log them)")
+	flag.StringVar(&fSpillDir, "spill", "",
+		"directory to keep track fragments while the sink is failing, until it recovers"+
+		" (default: their msgs stay in the journal, and are replayed on restart)")
+
+	flag.StringVar(&fPolicyFile, "policy", "",
+		"JSON file of receiver allow/deny/quarantine/ratelimit rules (see policy.go)")
+
+	flag.StringVar(&fKeysFile, "keys", "",
+		"file of receiver keys; if set, unsigned or forged bundles are rejected")
+	flag.BoolVar(&fKeysWildcard, "keys-wildcard", false,
+		"accept a \"*\" key in -keys for receivers without their own; its holder can sign as any of them")
+
+	flag.StringVar(&fEnrichSpecs, "enrich", "",
+		"comma-separated providers of airframe & schedule data, first match wins:"+
+		" datastore, airframes:FILE.{csv,json}, routes:FILE.csv, registry:FILE.db (default: datastore, unless offline)")
+
+	flag.StringVar(&fAirspaceSinks, "airspace", "",
+		"comma-separated sinks for airspace snapshots, each with an optional @INTERVAL:"+
+		" datastore, file:FILE, redis:[PASSWORD@]HOST:PORT[/KEY], memcache:HOST:PORT[/KEY],"+
+		" webhook:URL, webhook+deltas:URL"+
+		" (default: datastore, unless offline; webhooks that need headers go in -config)")
+
+	flag.StringVar(&fPlausibilityFile, "plausibility", "",
+		"JSON file of limits on altitude, speed & range from receivers (see plausibility.go; default: built in)")
+	flag.StringVar(&fQuarantineFile, "quarantine", "",
+		"file to append implausible msgs to, as JSON lines (default: just count them)")
+
+	flag.StringVar(&fAlertsFile, "alerts", "",
+		"JSON file of receiver alert rules and webhooks (see health.go; default: log only)")
+	flag.DurationVar(&fDrainTimeout, "drain", 30*time.Second,
+		"on shutdown, how long to keep writing buffered fragments before giving up on them")
 
 	flag.IntVar(&fVerbosity, "v", 0, "verbosity level")
-	flag.IntVar(&fDatabaseWorkers, "n", 64, "number of database workers")
+	flag.IntVar(&fDatabaseWorkers, "n", 64, "number of database workers (default 16, if -dryrun)")
+	flag.StringVar(&fConfigFile, "config", "",
+		"YAML file of pipeline sizes & intervals; flags given on the command line override it")
+	flag.BoolVar(&fPrintConfig, "print-config", false, "print the config we would run with, and exit")
+}
+
+// }}}
+// {{{ setup
 
+// setup is the rest of the initialization; it's not in init, so that tests
+// can run without it.
+func setup() {
 	flag.Parse()
 
-	if fDryrunMode { fDatabaseWorkers = 16 } // Do we need this ?
+	loadConfig()
 
 	http.HandleFunc("/", statusHandler)
 	http.HandleFunc("/con/status", statusHandler)
+	http.HandleFunc("/metrics", metricsHandler)
 	http.HandleFunc("/con/stack", stackTraceHandler)
 	http.HandleFunc("/con/reset", resetHandler)
+	http.HandleFunc("/con/status.json", statusJSONHandler)
+	http.HandleFunc("/con/receivers", receiversHandler)
+	http.HandleFunc("/con/policy", policyHandler)
+	http.HandleFunc("/con/policy/reload", policyReloadHandler)
+	http.HandleFunc("/con/plausibility", plausibilityHandler)
 
 	// https://github.com/GoogleCloudPlatform/golang-samples
 	http.HandleFunc("/_ah/start", startHandler)
-	http.HandleFunc("/_ah/stop", stopHandler)
 	http.HandleFunc("/_ah/health", healthCheckHandler)
 
 	tGlobalStart = time.Now()
-
-	addSIGINTHandler()
 }
 
 // }}}
-// {{{ setupPubsub
+// {{{ loadConfig
+
+// loadConfig reads -config, and reconciles it with the flags that overlap
+// with it.
+func loadConfig() {
+	c,err := config.Load(fConfigFile)
+	if err != nil { Log.Fatal(err) }
+
+	flag.Visit(func(f *flag.Flag) { // Only the flags that were set
+		switch f.Name {
+		case "n":
+			if fDryrunMode {
+				c.Consolidator.DryrunWorkers = fDatabaseWorkers
+			} else {
+				c.Consolidator.Workers = fDatabaseWorkers
+			}
+		case "drain":
+			c.Consolidator.DrainTimeout.Duration = fDrainTimeout
+		}
+	})
+	if err := c.Validate(); err != nil { Log.Fatal(err) }
+	conf = c
 
-func setupPubsub() {		
-	ctx := getContext()
-	pc := mypubsub.NewClient(ctx, fProjectName)
+	fDatabaseWorkers = conf.Consolidator.Workers
+	if fDryrunMode { fDatabaseWorkers = conf.Consolidator.DryrunWorkers } // Do we need this ?
+	fDrainTimeout = conf.Consolidator.DrainTimeout.Duration
 
-	if !fDryrunMode {
-		mypubsub.Setup(ctx, pc, fPubsubInputTopic, fPubsubSubscription)
-	} else {
-		fPubsubSubscription += "-DEV"
-		mypubsub.Setup(ctx, pc, fPubsubInputTopic, fPubsubSubscription)
-		mypubsub.DeleteSub(ctx, pc, fPubsubSubscription)
-		mypubsub.CreateSub(ctx, pc, fPubsubSubscription, fPubsubInputTopic)
+	if fPrintConfig {
+		os.Stdout.Write(conf.YAML())
+		os.Exit(0)
 	}
 }
 
 // }}}
-
-// {{{ {start,stop,healthCheck,status,reset,stackTrace}Handler
+// {{{ {start,stop,healthCheck,status,metrics,reset,stackTrace}Handler
 
 func startHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("(startHandler)\n")
@@ -151,16 +282,20 @@ func getStackTraceBytes() []byte {
 	return bytes[:n]
 }
 
-func stopHandler(w http.ResponseWriter, r *http.Request) {
-	if weAreDone() {
-		fmt.Printf("(stopHandler, already stopping)\n")
-	} else {
-		fmt.Printf("(stopHandler, after %s)\n", time.Since(tGlobalStart))
-		close(done) // Shut down the pubsub goroutine (which should save airspace into datastore.)
-		fmt.Printf("\nFinal post-close stack trace:-\n\n%s\n", getStackTraceBytes())
+// stopHandler cancels the root context (via beginShutdown), if it isn't
+// already cancelled.
+func stopHandler(ctx context.Context, cancel context.CancelFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ctx.Err() != nil {
+			fmt.Printf("(stopHandler, already stopping)\n")
+		} else {
+			fmt.Printf("(stopHandler, after %s)\n", time.Since(tGlobalStart))
+			beginShutdown(cancel) // Drain the pipeline (which should save airspace into datastore.)
+			fmt.Printf("\nFinal post-close stack trace:-\n\n%s\n", getStackTraceBytes())
+		}
+
+		w.Write([]byte("OK"))	
 	}
-	
-	w.Write([]byte("OK"))	
 }
 
 func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
@@ -168,9 +303,13 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func statusHandler(w http.ResponseWriter, r *http.Request) {
-	vitalsRequestChan<- VitalsRequest{Name:"_output"}
-	vr := <-vitalsResponseChan
-	w.Write([]byte(fmt.Sprintf("OK\n%s", vr.Str)))
+	w.Write([]byte(fmt.Sprintf("OK\n%s\n%s\n%s\n%s\n%s", vitalsString(), health, policy, plausibility,
+		airspacePub)))
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	vitals.Default.WritePrometheus(w)
 }
 
 func stackTraceHandler(w http.ResponseWriter, r *http.Request) {
@@ -179,26 +318,16 @@ func stackTraceHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func resetHandler(w http.ResponseWriter, r *http.Request) {
-	vitalsRequestChan<- VitalsRequest{Name:"_reset"}
+	vitals.Default.Reset()
 	w.Write([]byte(fmt.Sprintf("OK\n")))
 }
 
 // }}}
 
-// {{{ weAreDone
-
-var done = make(chan struct{}) // Gets closed when everything is done
-func weAreDone() bool {
-	select{
-	case <-done:
-		return true
-	default:
-		return false
-	}
-}
+// {{{ addSIGINTHandler
 
 // When running a local instance ...
-func addSIGINTHandler() {
+func addSIGINTHandler(cancel context.CancelFunc) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 
@@ -206,7 +335,7 @@ func addSIGINTHandler() {
 		<-sig
 		Log.Printf("(SIGINT received)\n")
 		//Log.Printf("Final stack trace:-\n\n%s\n", getStackTraceBytes())
-		close(done)
+		beginShutdown(cancel)
 	}(c)
 }
 
@@ -221,356 +350,292 @@ func getContext() context.Context {
 }
 
 // }}}
-// {{{ flushTrackToDatastore
-
-func flushTrackToDatastore(myId int, p dsprovider.DatastoreProvider, msgs []*adsb.CompositeMsg) {
-	if fDryrunMode {
-		//Log.Printf(" -- (%d pushed for %s)\n", len(msgs), string(msgs[0].Icao24))
-		vitalsRequestChan<- VitalsRequest{Name: "_dbwrite", J:int64(myId)}
-		return
-	}
+// {{{ flushTrackToSink
 
+func flushTrackToSink(myId int, sink tracksink.TrackSink, msgs []*adsb.CompositeMsg) error {
 	tStart := time.Now()
 	perf := map[string]time.Time{}
 
-	db := fgae.New(getContext(), p)
-
 	frag := fdb.MessagesToTrackFragment(msgs)
-	if err := db.AddTrackFragment(frag, airframeRefdata, scheduleRefdata, perf); err != nil {
-		Log.Printf("flushPost/ToDatastore: err: %v\n--\n", err)
+	err := sink.AddTrackFragment(frag, perf)
+	if err != nil {
+		Log.Printf("flushTrackToSink: err: %v\n--\n", err)
 	}
 
-	durMillis := func(s,e string) int64 {
-		return int64(perf[e].Sub(perf[s]).Nanoseconds() / 1000000)
+	// These msgs no longer need replaying after a crash; nor do ones that
+	// the sink will never take, however often we replay them.
+	if jrnl != nil && (err == nil || tracksink.IsPermanent(err)) {
+		jrnl.Done(msgs)
 	}
 
-	wasNewEntity := 0
-	if _,exists := perf["03_notplausible"]; exists {
-		wasNewEntity = 1
-	}
+	noteDBWrite(myId, time.Since(tStart), perf)
 
-	vitalsRequestChan<- VitalsRequest{
-		Name: "_dbwrite",
-		I:(time.Since(tStart).Nanoseconds() / 1000000),
-		J:int64(myId),
-		// perf timings, in millis. Stages are: 01_start, 02_mostrecent,
-		// 03_plausible, 03_notplausible, 04_trackbuild, 05_waypoints, 06_persist
-		L:durMillis("01_start", "02_mostrecent"),
-		M:durMillis("02_mostrecent", "04_trackbuild"),
-		N:durMillis("04_trackbuild", "05_waypoints"),
-		O:durMillis("05_waypoints", "06_persist"),
-		// whether we created a new DS entity
-		P:int64(wasNewEntity),
-	}
+	return err
 }
 
 // }}}
-// {{{ maybePostAirspace
-
-var tLastMemcache = time.Now()
-var memcacheMutex = sync.Mutex{}
-
-var junkMutex = sync.Mutex{}
+// {{{ newTrackSink
+
+// trackSinkSpec returns the sink named by -sink. By default, that's
+// datastore in prod, and nowhere at all in dry-run mode.
+func trackSinkSpec() string {
+	if fTrackSink != "" { return fTrackSink }
+	if fDryrunMode { return "discard" }
+	return "datastore"
+}
 
-func maybePostAirspace(ctx context.Context, p dsprovider.DatastoreProvider, as *airspace.Airspace) {
-	memcacheMutex.Lock()
-	defer memcacheMutex.Unlock()
+// If we're neither reading from pubsub, nor writing to datastore, then
+// we're running offline and shouldn't touch any cloud services at all.
+func weAreOffline() bool {
+	return fBundleSource != "pubsub" && trackSinkSpec() != "datastore"
+}
 
-	if time.Since(tLastMemcache) < 1000 * time.Millisecond { return }
+// newTrackSink wraps the sink in a ReliableSink, which batches, retries,
+// and (with -spill) spills to disk when the sink is down. For sinks that
+// batch, each DB worker has at most one write in flight, so batches are
+// sized to fill up from half of them; if they were any bigger, every batch
+// would sit out the whole batch delay.
+func newTrackSink(p dsprovider.DatastoreProvider) (*tracksink.ReliableSink, error) {
+	spec := trackSinkSpec()
+	Log.Printf("(writing track fragments to %q)\n", spec)
+
+	var inner tracksink.TrackSink
+	if spec == "datastore" {
+		inner = tracksink.NewDatastoreSink(p)
+	} else if s,err := tracksink.New(spec); err != nil {
+		return nil, err
+	} else {
+		inner = s
+	}
+	if enricher != nil {
+		tracksink.SetLookup(inner, enricher)
+	}
 
-	justAircraft := airspace.Airspace{Aircraft: as.Aircraft}
+	opts := tracksink.ReliableOptions{SpillDir:fSpillDir, BatchSize:fDatabaseWorkers/2}
+	if opts.BatchSize < 1 { opts.BatchSize = 1 }
+	sink,err := tracksink.NewReliableSink(inner, opts)
+	if err != nil { return nil, err }
+	if fSpillDir != "" {
+		Log.Printf("(spilling to %s; %d fragments still to write)\n", fSpillDir, sink.Stats().SpillPending)
+	}
+	registerSinkVitals(sink)
+	return sink, nil
+}
 
-	// This stuff is broadly dead, until we figure out the networking to let Appengine apps
-	// access VMs.
-/*
-	if fMemcacheServer != "" {
-		sp := mcsingleton.NewProvider(fMemcacheServer)
-		if err := sp.WriteSingleton(ctx, "consolidated-airspace", nil, &justAircraft); err != nil {
-			Log.Printf("mc.WriteSingleton(airspace) err: %v\n", err)
+// }}}
+// {{{ newAirspacePublisher
+
+// newAirspacePublisher builds the sinks named by -airspace, each with its
+// own interval (or the config's airspace_interval), plus the config's
+// airspace_webhooks.
+func newAirspacePublisher(p dsprovider.DatastoreProvider) (*airspacesink.Publisher, error) {
+	specs := fAirspaceSinks
+	if specs == "" && p != nil { specs = "datastore" }
+	hooks := conf.Consolidator.AirspaceWebhooks
+	if specs == "" && len(hooks) == 0 { return nil, nil }
+
+	targets := []airspacesink.Target{}
+	for _,spec := range strings.Split(specs, ",") {
+		if spec == "" { continue }
+		spec,interval,err := airspacesink.SplitInterval(spec)
+		if err != nil { return nil, err }
+		if interval == 0 { interval = conf.Consolidator.AirspaceInterval.Duration }
+
+		var sink airspacesink.Sink
+		if spec == "datastore" {
+			if p == nil { return nil, fmt.Errorf("-airspace=datastore, but we're running offline") }
+			sink = airspacesink.NewDatastoreSink(p)
+		} else if sink,err = airspacesink.New(spec); err != nil {
+			return nil, err
 		}
+		Log.Printf("(publishing airspace to %s, every %s)\n", sink, interval)
+		targets = append(targets, airspacesink.Target{Sink:sink, Interval:interval})
 	}
-*/
-	// if fAirspaceWebhook == "" { return }
 
-	// Memcache is dead. Instead, publish to datastore.
-	// FIXME: should this spin off a goroutine ?
-	tStart := time.Now()
-	sp := singleton.NewProvider(p)
-	if err := sp.WriteSingleton(ctx, "consolidated-airspace", nil, &justAircraft); err != nil {
-		Log.Printf("mc.WriteSingleton(airspace) err: %v\n", err)
-	} else {
-		vitalsRequestChan<- VitalsRequest{
-			Name: "_memcache",
-			I:(time.Since(tStart).Nanoseconds() / 1000000),
+	for _,h := range hooks {
+		opts := airspacesink.WebhookOptions{
+			Header:  http.Header{},
+			Deltas:  h.Deltas,
+			Timeout: h.Timeout.Duration,
+			Retries: h.Retries,
 		}
+		for k,v := range h.Headers { opts.Header.Set(k, os.ExpandEnv(v)) }
+		interval := h.Interval.Duration
+		if interval == 0 { interval = conf.Consolidator.AirspaceInterval.Duration }
+
+		sink := airspacesink.NewWebhookSink(h.URL, opts)
+		Log.Printf("(publishing airspace to %s, every %s)\n", sink, interval)
+		targets = append(targets, airspacesink.Target{Sink:sink, Interval:interval})
 	}
 
-/*
-	if b,err := justAircraft.ToBytes(); err == nil {
-		go func(){
-			tStart := time.Now()
-			junkMutex.Lock()
-			nMemcacheStarts++
-			junkMutex.Unlock()
-			
-			if err := ae.SaveSingletonToMemcacheURL("airspace", b, fAirspaceWebhook); err != nil {
-				Log.Printf("main/maybePostAirspace(%s): err: %v", fAirspaceWebhook, err)
-			} else {
-				vitalsRequestChan<- VitalsRequest{
-					Name: "_memcache",
-					I:(time.Since(tStart).Nanoseconds() / 1000000),
-				}
-			}
-			junkMutex.Lock()
-			nMemcacheEnds++
-			junkMutex.Unlock()
-		}()
+	pub := airspacesink.NewPublisher(0, targets...)
+	registerAirspaceVitals(pub)
+	return pub, nil
+}
 
+// }}}
+
+// {{{ newEnricher
+
+// newEnricher builds the providers named by -enrich. The datastore one
+// needs cacheRefdata running, to keep it fresh; if it's in use, it's
+// returned too.
+func newEnricher(p dsprovider.DatastoreProvider) (*enrich.Enricher, *enrich.RefCaches, error) {
+	specs := fEnrichSpecs
+	if specs == "" && p != nil { specs = "datastore" }
+	if specs == "" { return nil, nil, nil }
+
+	providers := []enrich.Provider{}
+	var refs *enrich.RefCaches
+	for _,spec := range strings.Split(specs, ",") {
+		if spec == "datastore" {
+			if p == nil { return nil, nil, fmt.Errorf("-enrich=datastore, but we're running offline") }
+			refs = enrich.NewRefCaches()
+			providers = append(providers, refs)
+			continue
+		}
+		provider,err := enrich.NewProvider(spec)
+		if err != nil { return nil, nil, err }
+		if l,ok := provider.(interface{ Len() int }); ok {
+			Log.Printf("(enriching from %s, %d entries)\n", spec, l.Len())
+		}
+		providers = append(providers, provider)
 	}
-*/
-	
-	tLastMemcache = time.Now()
+
+	e := enrich.New(providers...)
+	registerEnrichVitals(e)
+	return e, refs, nil
 }
 
 // }}}
-
 // {{{ cacheRefdata
 
-func cacheRefdata(p dsprovider.DatastoreProvider) {
-	ctx := getContext()
+func cacheRefdata(ctx context.Context, p dsprovider.DatastoreProvider, refs *enrich.RefCaches) {
 	db := fgae.New(ctx, p)
 	sp := db.SingletonProvider
 
-	pollInterval := time.Second * 30
+	pollInterval := conf.Consolidator.RefdataPoll.Duration
 	lastPoll := time.Now().Add(-10 * pollInterval)
 	
-	for {
-		if weAreDone() { break }
-
+	for ctx.Err() == nil {
 		if time.Since(lastPoll) > pollInterval {
-			if newAirframes,err := ref.LoadAirframeCache(ctx,sp); err != nil {
+			newAirframes,err := ref.LoadAirframeCache(ctx,sp)
+			if err != nil {
 				Log.Printf("LoadAirframeCache err: %v\n", err)
-			} else {
-				airframeRefdata = newAirframes
 			}
-			if newSchedules,err := ref.LoadScheduleCache(ctx,sp); err != nil {
+			newSchedules,err := ref.LoadScheduleCache(ctx,sp)
+			if err != nil {
 				Log.Printf("LoadScheduleCache err: %v\n", err)
-			} else {
-				scheduleRefdata = newSchedules
 			}
+			refs.Set(newAirframes, newSchedules) // nils leave the old ones in place
 
+			nAirframes,nSchedules := refs.Sizes()
 			Log.Printf("-- cacheRefdata polling (every %s), loaded %d airframes, %d schedules",
-				pollInterval, len(airframeRefdata.Map), len(scheduleRefdata.Map))
+				pollInterval, nAirframes, nSchedules)
 
 			lastPoll = time.Now()
 		}
 
-		time.Sleep(time.Second)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
 	}
 
 	Log.Printf(" -- cacheRefdata clean exit\n")
 }
 
 // }}}
-// {{{ trackVitals
-
-// These two channels are accessible from all goroutines
-var vitalsRequestChan = make(chan VitalsRequest, 40)
-var vitalsResponseChan = make(chan VitalsResponse, 5)  // Only used for stats output
+// {{{ newBundleSource
 
-var nMemcacheStarts int
-var nMemcacheEnds int
-
-type VitalsRequest struct {
-	Name             string  // _blah
-	Str,Str2         string
-	I,J,K,L,M,N,O,P  int64
-	T                time.Time
-}
+// newBundleSource builds the source named by -source. Pubsub is the
+// default; in dry-run mode, it uses a throwaway -DEV subscription.
+func newBundleSource() (bundlesource.BundleSource, error) {
+	if fBundleSource != "" && fBundleSource != "pubsub" {
+		return bundlesource.New(fBundleSource)
+	}
 
-type VitalsResponse struct {
-	Str string
-	I int64
-	T time.Time
+	sub := fPubsubSubscription
+	if fDryrunMode { sub += "-DEV" }
+	src := bundlesource.NewPubsubSource(fProjectName, fPubsubInputTopic, sub, fDryrunMode)
+	src.MaxOutstanding = conf.Consolidator.MaxOutstandingMessages
+	return src, nil
 }
 
-type ReceiverSummary struct {
-	NumMessagesSent int64
-	NumBundlesSent  int64
-	LastBundleTime  time.Time
-}
+// }}}
+// {{{ inboundBundle{}
 
-func memStats() string {
-	ms := runtime.MemStats{}
+var errShuttingDown = fmt.Errorf("consolidator is shutting down")
 
-	runtime.ReadMemStats(&ms)
-	return fmt.Sprintf("go:% 5d(% 4d cb; %d/%d mc); heap:% 13d, % 13d; stack:% 13d",
-		runtime.NumGoroutine(), nReceiveCallbacks, nMemcacheStarts, nMemcacheEnds,
-		ms.HeapObjects, ms.HeapAlloc, ms.StackInuse)
+// An inboundBundle is a bundle on its way into the pipeline. Once it is
+// safe - journaled and deduped - filterNewMessages sends
+// the outcome on Result, so the source can ack (or nack) it.
+type inboundBundle struct {
+	Msgs   []*adsb.CompositeMsg
+	Result chan error
 }
 
-func trackVitals() {
-	startupTime := time.Now().Round(time.Second)
-	lastBundleTime := time.Now()
-	strings := map[string]string{}
-	workers := map[string]int64{}
-	counters := map[string]int64{}
-	receivers := map[string]ReceiverSummary{}
-	m := metrics.NewMetrics()
-
-	// {{{ vitals2str()
-
-	vitals2str := func() string {
-		rcvrs := ""
-		keys := []string{}
-		for k,_ := range receivers { keys = append(keys,k) }
-		sort.Strings(keys)
-		for _,k := range keys {
-			v := receivers[k]
-			rcvrs += fmt.Sprintf(
-				"    %-15.15s: %9d msgs, %8d bundles, last %.1f s\n",
-				k, v.NumMessagesSent, v.NumBundlesSent, time.Since(v.LastBundleTime).Seconds())
-		}
-
-		workerHist := histogram.Histogram{NumBuckets:40, ValMin:0, ValMax:400}
-		// Measure if each worker did more (or less) of its fair share (where fair is 100)
-		expectedFraction := 1 / float64(len(workers))
-		tot := 0
-		for _,count := range workers {
-			tot += int(count)
-		}
-		for _,count := range workers {
-			actualFraction := float64(count) / float64(tot)
-			shareOfLoad := actualFraction / expectedFraction
-			workerHist.Add(histogram.ScalarVal(shareOfLoad * 100))
-		}
-
-		str := fmt.Sprintf(
-			"* %d messages (%d dupes; %d total; %d bundles; %d writes)\n"+
-				"* Uptime: %s (started %s; last bundle:%5.3fs)\n"+
-				"* Trackbuffer: %d elems, Airspace: (%d,%d) elems\n"+
-				"\n"+
-				"* Receivers:-\n%s\n"+
-				"* Workers: %s\n\n"+
-				"* Metrics:-\n%s\n",
-			(counters["nAll"] - counters["nDupes"]), counters["nDupes"], counters["nAll"],
-			counters["nBundles"], counters["nFrags"],
-			time.Second * time.Duration(int(time.Since(startupTime).Seconds())), startupTime,
-			time.Since(lastBundleTime).Seconds(),
-			counters["TrackbufferSize"], counters["AirspaceSigCount"], counters["AirspaceAircraftCount"],
-			rcvrs,
-			workerHist,
-			m.String())
+func newInboundBundle(msgs []*adsb.CompositeMsg) inboundBundle {
+	return inboundBundle{Msgs:msgs, Result:make(chan error, 1)}
+}
 
-		return str
+// send pushes the bundle into the pipeline, and waits to hear if it was
+// made safe. Once we're shutting down, new bundles are turned away; but
+// one that's already in the pipeline will be seen through, as the
+// pipeline drains.
+func (b inboundBundle)send(ctx context.Context, msgsOut chan<- inboundBundle) error {
+	select {
+	case msgsOut <- b:
+	case <-ctx.Done():
+		drain.update(func(d *drainReport) { d.BundlesNacked++ })
+		return errShuttingDown
 	}
+	return <-b.Result
+}
 
-	// }}}
-
-	tLastDump := time.Now()
-	tLastCounts := time.Now()
-
-	for {
-		if weAreDone() { break }
-
-		if time.Since(tLastDump) > time.Minute * 5 {
-			Log.Printf("vital dump:-\n%s", vitals2str())
-			tLastDump = time.Now()
-		}
-
-		if time.Since(tLastCounts) > 5 * time.Second {
-			Log.Printf("* memstats  %s\n", memStats())
-			Log.Printf("* Trackbuffer: %d msgs, Airspace: %d sigs, %d aircraft\n",
-				counters["TrackbufferSize"], counters["AirspaceSigCount"],
-				counters["AirspaceAircraftCount"])
-			tLastCounts = time.Now()
+// }}}
+// {{{ replayJournal
+
+// replayJournal feeds bundles from a previous run's journal segments back
+// into the pipeline. They get rejournaled on the way in, so each old
+// segment can be removed once all its bundles have been accepted.
+func replayJournal(ctx context.Context, segments []string, msgsOut chan<- inboundBundle) {
+	for _,seg := range segments {
+		bundles,err := readJournalSegment(seg)
+		if err != nil {
+			Log.Printf("replayJournal: %s: %v (replaying the %d readable bundles)", seg, err,
+				len(bundles))
 		}
+		Log.Printf("(replaying %d bundles from %s)\n", len(bundles), seg)
 
-		select {
-		case <-time.After(time.Second):
-			// break
-
-		case req := <-vitalsRequestChan:
-			if req.Name == "_reset" {
-				counters = map[string]int64{}
-				receivers = map[string]ReceiverSummary{}
-				workers = map[string]int64{}
-				m = metrics.NewMetrics()
-
-			} else if req.Name == "_bundle" {
-				lastBundleTime = time.Now()
-				s := receivers[req.Str]
-				s.NumBundlesSent += 1
-				s.NumMessagesSent += req.I
-				s.LastBundleTime = req.T
-				receivers[req.Str] = s
-				counters["nBundles"] += 1
-				counters["nAll"] += req.I
-				//counters["nNew"] += req.J
-				m.RecordValue("BundleSize", req.I)
-
-			} else if req.Name == "_dbwrite" {
-				m.RecordValue("DBWriteMillis", req.I)
-				workers[fmt.Sprintf("%03d",req.J)]++
-				counters["nFrags"]++
-
-				m.RecordValue("Z02_MostRecentMillis", req.L)
-				m.RecordValue("Z05_WaypointsMillis", req.N)
-				if req.P > 0 {
-					m.RecordValue("Z04_New_TrackbuildMillis", req.M)
-					m.RecordValue("Z06_New_PersistMillis", req.O)
-				} else {
-					m.RecordValue("Z04_Extend_TrackbuildMillis", req.M)
-					m.RecordValue("Z06_Extend_PersistMillis", req.O)
-				}
-
-			} else if req.Name == "_memcache" {
-				m.RecordValue("MemcacheMillis", req.I)
-
-			} else if req.Name == "_filterMessages" {
-				counters["nDupes"] += req.I
-				counters["AirspaceSigCount"] = req.J
-				counters["AirspaceAircraftCount"] = req.K
-				
-			} else if req.Name == "_bufferTracks" {
-				counters["TrackbufferSize"] = req.I
-
-			} else if req.Name == "_lastBundleTime" {
-				vitalsResponseChan<- VitalsResponse{T: lastBundleTime}
-
-			} else if req.Name == "_output" {
-				vitalsResponseChan<- VitalsResponse{Str: vitals2str()}
-
-			} else if req.Name != "" {
-				if req.Str != "" { strings[req.Name] = req.Str }
+		for _,msgs := range bundles {
+			if err := newInboundBundle(msgs).send(ctx, msgsOut); err != nil {
+				Log.Printf("replayJournal: %s: giving up: %v", seg, err) // Try again next time
+				return
 			}
 		}
+		if err := os.Remove(seg); err != nil {
+			Log.Printf("replayJournal: %v", err)
+		}
 	}
-
-	Log.Printf(" -- trackVitals clean exit\n")
 }
 
 // }}}
-// {{{ pullNewFromPubsub
+// {{{ pullNewFromSource
 
 var nReceiveCallbacks = 0
 
-func pullNewFromPubsub(msgsOut chan<- []*adsb.CompositeMsg) {
-	ctx, ctxCancelFunc := context.WithCancel(getContext())
-
-	setupPubsub()
-	Log.Printf("(pullNewFromPubsub starting)\n")	
-
-	pc := mypubsub.NewClient(ctx, fProjectName)
-	sub := pc.Subscription(fPubsubSubscription)
-
-	sub.ReceiveSettings.MaxOutstandingMessages = 10 // put a limit on how many we juggle
+// pullNewFromSource runs the source until ctx is cancelled.
+func pullNewFromSource(ctx context.Context, src bundlesource.BundleSource, msgsOut chan<- inboundBundle) {
+	Log.Printf("(pullNewFromSource starting, %s)\n", src)
 
 	var mu = &sync.Mutex{}
 	
-	// sub.Receive invokes concurrent instances of this callback; we funnel their
-	// (unpacked) responses back into the msgsOut channel, for the processing pipeline to eat
-	callback := func(ctx context.Context, m *pubsub.Message) {
+	// Sources may invoke concurrent instances of this callback; we funnel the
+	// bundles into the msgsOut channel, for the processing pipeline to eat. We
+	// don't return until the pipeline says the bundle is safe, so the source
+	// won't ack it too early.
+	callback := func(msgs []*adsb.CompositeMsg) error {
 
 		// I'm not entirely sure we need to count how many callbacks are running ...
 		mu.Lock()
@@ -582,131 +647,179 @@ func pullNewFromPubsub(msgsOut chan<- []*adsb.CompositeMsg) {
 			nReceiveCallbacks--
 			mu.Unlock()
 		}()
-		
-		m.Ack()
-		msgs,err := mypubsub.UnpackPubsubMessage(m)
-		if err != nil {
-			Log.Printf("[%d] Unpack: err: %v", err)
-			return
-		}
 
-		// We're blacklisting CulverCity, to see if that's the problem
-		if msgs[0].ReceiverName == "CulverCity" {
-			return
+		// Denied & ratelimited bundles are acked and dropped; redelivery
+		// wouldn't change the outcome. (Ratelimited msgs are counted as lost,
+		// on /con/status.) Quarantined bundles show up in the receiver stats,
+		// but go no further.
+		switch policy.Check(msgs[0].ReceiverName, len(msgs)) {
+		case verdictDeny, verdictRateLimit:
+			return nil
+		case verdictQuarantine:
+			noteBundle(msgs)
+			return nil
 		}
 		
-		msgsOut <- msgs
-
-		// Update our vital stats, with info about this bundle
-		vitalsRequestChan<- VitalsRequest{
-			Name: "_bundle",
-			Str: msgs[0].ReceiverName,
-			I: int64(len(msgs)),
-			T: msgs[len(msgs)-1].GeneratedTimestampUTC,
+		err := newInboundBundle(msgs).send(ctx, msgsOut)
+		if err != nil {
+			vNacks.Inc()
+			return err
 		}
+
+		noteBundle(msgs)
+		return nil
 	}
 	
-	// sub.Receive doesn't terminate, so spin off into a goroutine
+	// src.Run doesn't terminate until ctx is cancelled (once in-flight
+	// callbacks return), so spin off into a goroutine
+	finished := make(chan struct{})
 	go func() {
-		Log.Printf("(sub.Receive starting)\n")
-		if err := sub.Receive(ctx, callback); err != nil {
-			Log.Printf("sub.Receive() err:%v", err)
-			return
+		if err := src.Run(ctx, callback); err == io.EOF {
+			Log.Printf("(%s ran out of data)\n", src)
+		} else if err != nil {
+			Log.Printf("%s: Run() err:%v", src, err)
 		}
+		close(finished)
 	}()
 
-	// Block until done channel lights up
-	<-done
-
-	ctxCancelFunc() // terminates call to sub.Receive()
-
-	if fDryrunMode {
-		// We're not on AppEngine; clean up our wasteful subscription
-		ctx = getContext() // use a new context, the one above has been canceled
-		pc := mypubsub.NewClient(ctx, fProjectName)
-		if err := mypubsub.DeleteSub(ctx, pc, fPubsubSubscription); err != nil {
-			Log.Printf(" -- pullNewFromPubsub clean exit; del '%s': %v", fPubsubSubscription, err)
-		}
-		Log.Printf("  - pullNewFromPubsub, deleted %q\n", fPubsubSubscription)
-	}
+	// Block until we're shutting down
+	<-ctx.Done()
+	<-finished
+	drain.update(func(d *drainReport) { d.InputStopped = time.Since(d.Started) })
 	
-	Log.Printf(" -- pullNewFromPubsub clean exit\n")
+	Log.Printf(" -- pullNewFromSource clean exit\n")
 }
 
 // }}}
 // {{{ filterNewMessages
 
-// pubsub.Receiver's goroutines will send to the msgIns channel; we dedupe and send on
+// pubsub.Receiver's goroutines will send to the msgIns channel; we journal, dedupe and send on
 // This goroutine owns the airspace object (which is not concurrent safe)
-func filterNewMessages(p dsprovider.DatastoreProvider, msgsIn <-chan []*adsb.CompositeMsg, msgsOut chan<- []*adsb.CompositeMsg) {
+func filterNewMessages(msgsIn <-chan inboundBundle, msgsOut chan<- []*adsb.CompositeMsg) {
 	as := airspace.NewAirspace()
 	//as.Signatures.RollAfter = 10 * time.Second // very aggressive, while we have probs
-	as.RollWhenThisMany = 10000                // Dedupe set consists of 1-2x this number
-	
-	ctx := getContext()
-
-	// TODO - make `as.EverythingFromMemcache(ctx)` work using webhook thing
-
-	for {
-		if weAreDone() { break } // Clean exit
+	as.RollWhenThisMany = conf.Consolidator.RollWhenThisMany // Dedupe set consists of 1-2x this number
+	if enricher != nil {
+		as.Decorate = enricher.Decorate            // Fill in airframe & schedule, from refdata
+	}
+	if w := conf.Consolidator.FusionWindow.Duration; w > 0 {
+		as.Fusion = &airspace.Fusion{Window:w}     // Combine receivers' reports of each aircraft
+	}
 
-		select {
-		case <-time.After(time.Second):
-			// break, in case weAreDone
+	for b := range msgsIn { // Runs until the input stage closes the channel
+		msgs := b.Msgs
+
+		// Journal the whole bundle before deduping; if the write fails, the
+		// source will redeliver it, and it mustn't look like a dupe then.
+		seg := ""
+		if jrnl != nil {
+			var err error
+			if seg,err = jrnl.Append(msgs); err != nil {
+				Log.Printf("filterNewMessages: journal: %v", err)
+				b.Result <- err
+				continue
+			}
+		}
 
-		case msgs := <-msgsIn:
-			newMsgs := as.MaybeUpdate(msgs)
-			if len(newMsgs) > 0 {
-				// Pass them to the other goroutine for dissemination, and get back to business.
-				msgsOut <- newMsgs
+		newMsgs := as.MaybeUpdate(msgs)
+		if jrnl != nil {
+			jrnl.Track(seg, newMsgs)
+			nSegs,nPending := jrnl.Sizes()
+			vJournalSegments.Set(float64(nSegs))
+			vJournalPending.Set(float64(nPending))
+		}
+		b.Result <- nil // Safe to ack
 
-				maybePostAirspace(ctx, p, &as)
+		if len(newMsgs) > 0 {
+			// Pass them to the other goroutine for dissemination, and get back to business.
+			msgsOut <- newMsgs
 
-				if fVerbosity > 0 {
-					Log.Printf("- %2d were new (%2d already seen) - %s",
-						len(newMsgs), len(msgs)-len(newMsgs), msgs[0].ReceiverName)
-				}
-			}
+			airspacePub.Offer(&as) // Publishers take a snapshot if they're due one
 
-			// Update our vital stats, with info about the airspace & deduping
-			nSigs,nAircraft := as.Sizes()
-			vitalsRequestChan<- VitalsRequest{
-				Name: "_filterMessages",
-				I:int64(len(msgs) - len(newMsgs)),
-				J:nSigs,
-				K:nAircraft,
+			if fVerbosity > 0 {
+				Log.Printf("- %2d were new (%2d already seen) - %s",
+					len(newMsgs), len(msgs)-len(newMsgs), msgs[0].ReceiverName)
 			}
 		}
+
+		// Update our vital stats, with info about the airspace & deduping
+		nSigs,nAircraft := as.Sizes()
+		vDupes.Add(int64(len(msgs) - len(newMsgs)))
+		vAirspaceSigs.Set(float64(nSigs))
+		vAirspaceAircraft.Set(float64(nAircraft))
 	}
 
-	// TODO - make `as.EverythingToMemcache(ctx)` work
+	if airspacePub.Len() > 0 {
+		if err := airspacePub.Flush(&as); err != nil {
+			Log.Printf("filterNewMessages: final airspace: %v\n", err)
+		} else {
+			drain.update(func(d *drainReport) { d.AirspacePosted = true })
+		}
+	}
+	close(msgsOut)
 	
 	Log.Printf(" -- filterNewMessages clean exit\n")
 }
 
+// }}}
+// {{{ checkPlausibility
+
+// checkPlausibility keeps implausible msgs (see plausibility.go) away from
+// the trackbuffer, and so out of the DB.
+func checkPlausibility(msgsIn <-chan []*adsb.CompositeMsg, msgsOut chan<- []*adsb.CompositeMsg) {
+	for msgs := range msgsIn {
+		ok,rejected := plausibility.check(msgs)
+		if jrnl != nil && len(rejected) > 0 {
+			jrnl.Done(rejected) // They're in the quarantine log, if anywhere; no need to replay them
+		}
+		if fVerbosity > 0 && len(rejected) > 0 {
+			Log.Printf("- %2d were implausible - %s", len(rejected), rejected[0].ReceiverName)
+		}
+		if len(ok) > 0 {
+			msgsOut <- ok
+		}
+	}
+
+	close(msgsOut)
+	Log.Printf(" -- checkPlausibility clean exit\n")
+}
+
 // }}}
 // {{{ bufferTracks
 
+// How long the trackbuffer holds on to a track's msgs; a gap longer than
+// this splits a track into separate fragments (which the dispatcher then
+// won't coalesce back together).
+const trackMaxAge = 30 * time.Second
+
 func bufferTracks(msgsIn <-chan []*adsb.CompositeMsg, msgsOut chan<- []*adsb.CompositeMsg) {	
 	// Our primary piece of state ! It groups msgs into tracks for distinct aircraft, and
 	// then flushes out individual tracks as/when they have data older than MaxAge
 	tb := trackbuffer.NewTrackBuffer()
+	tb.MaxAge = trackMaxAge
 
-	for {
-		if weAreDone() { break }
+	for msgs := range msgsIn {
+		for _,m := range msgs {
+			tb.AddMessage(m)
+		}
+		tb.Flush(msgsOut)
 
-		select {
-		case <-time.After(time.Second):
-			// break
-		case msgs := <-msgsIn:
-			for _,m := range msgs {
-				tb.AddMessage(m)
-			}
-			tb.Flush(msgsOut)
+		vTrackbufferSize.Set(float64(tb.Size()))
+	}
 
-			vitalsRequestChan<- VitalsRequest{Name: "_bufferTracks", I:tb.Size()}
-		}
+	// Final flush; everything goes, however recent.
+	ids := []adsb.IcaoId{}
+	for id,_ := range tb.Tracks { ids = append(ids, id) }
+	nFrags,nMsgs := int64(0), int64(0)
+	for _,t := range tb.RemoveTracks(ids) {
+		if len(t.Messages) == 0 { continue }
+		sort.Sort(adsb.CompositeMsgPtrByTimeAsc(t.Messages))
+		msgsOut <- t.Messages
+		nFrags++
+		nMsgs += int64(len(t.Messages))
 	}
+	drain.update(func(d *drainReport) { d.FinalFrags, d.FinalMsgs = nFrags, nMsgs })
+	close(msgsOut)
 
 	Log.Printf(" -- bufferTracks clean exit\n")
 }
@@ -714,46 +827,44 @@ func bufferTracks(msgsIn <-chan []*adsb.CompositeMsg, msgsOut chan<- []*adsb.Com
 // }}}
 // {{{ workerDispatch
 
-func workerDispatch(msgsIn <-chan []*adsb.CompositeMsg, workersOut []chan []*adsb.CompositeMsg) {
-	for {
-		if weAreDone() { break }
-
-		select {
-		case <-time.After(time.Second):
-			// break
-		case msgs := <-msgsIn:
-			// pick a worker, based on the icao24; it's important that we
-			// don't process frags for the same icaoid in parallel, or we'll
-			// suffer a write-write conflict and overwrite some data.
-			h := fnv.New32a()
-			h.Write([]byte(msgs[0].Icao24))
-			i := h.Sum32()
-			workerId := i % uint32(len(workersOut))
-			workersOut[workerId] <- msgs // Send the message frag to the worker.
-		}
+// workerDispatch feeds the frags to the dispatcher (see dispatch.go), which
+// hands them out to the workers.
+func workerDispatch(msgsIn <-chan []*adsb.CompositeMsg, d *dispatcher) {
+	for msgs := range msgsIn {
+		d.Add(msgs) // Blocks if the workers are backed up
 	}
+
+	d.Close()
 	Log.Printf(" -- workerDispatch clean exit\n")
 }
 
 // }}}
 // {{{ flushTracks
 
-// The worker bee function
-func flushTracks(myId int, p dsprovider.DatastoreProvider, msgsIn <-chan []*adsb.CompositeMsg) {
-	//Log.Printf("(flushTracks/%03d starting)\n", myId)
+// The worker bee function. Once ctx is cancelled, what it writes counts
+// towards the drain; once workCtx is cancelled too (the drain deadline has
+// passed), it stops writing, and just counts what it's dropping.
+func flushTracks(ctx, workCtx context.Context, myId int, sink tracksink.TrackSink, disp *dispatcher, wg *sync.WaitGroup) {
+	defer wg.Done()
 
 	for {
-		if weAreDone() { break }
+		msgs,ok := disp.Next(myId)
+		if !ok { break }
 
-		select {
-		case <-time.After(time.Second):
-			// break
-		case msgs := <-msgsIn:
-			flushTrackToDatastore(myId, p, msgs)
-		}			
-	}
+		if workCtx.Err() != nil {
+			drain.update(func(d *drainReport) { d.FragsLost++; d.MsgsLost += int64(len(msgs)) })
+			disp.Done(msgs)
+			continue
+		}
 
-	//Log.Printf(" ---- flushTracks/%03d clean exit\n", myId)
+		err := flushTrackToSink(myId, sink, msgs)
+		disp.Done(msgs)
+		if ctx.Err() != nil {
+			drain.update(func(d *drainReport) {
+				if err != nil { d.FragsFailed++ } else { d.FragsWritten++ }
+			})
+		}
+	}
 }
 
 // }}}
@@ -761,38 +872,166 @@ func flushTracks(myId int, p dsprovider.DatastoreProvider, msgsIn <-chan []*adsb
 // {{{ main
 
 func main() {
+	setup()
 	Log.Printf("(main starting)\n")
 
+	// Cancelling the root context (SIGINT, or /_ah/stop) drains the pipeline
+	ctx,cancel := context.WithCancel(context.Background())
+	defer cancel()
+	http.HandleFunc("/_ah/stop", stopHandler(ctx, cancel))
+	addSIGINTHandler(cancel)
+
 	// The cloud provider's client leaks goroutines, so just use one client forever
-	db,err := dsprovider.NewCloudDSProvider(getContext(), fProjectName)
+	var db dsprovider.DatastoreProvider
+	if weAreOffline() {
+		Log.Printf("(running offline; no datastore, no refdata, no airspace singleton)\n")
+	} else if p,err := dsprovider.NewCloudDSProvider(getContext(), fProjectName); err != nil {
+		Log.Fatal(err)
+	} else {
+		db = p
+	}
+
+	if p,err := newReceiverPolicy(fPolicyFile); err != nil {
+		Log.Fatal(err)
+	} else {
+		policy = p
+	}
+
+	refs := (*enrich.RefCaches)(nil)
+	if e,r,err := newEnricher(db); err != nil {
+		Log.Fatal(err)
+	} else {
+		enricher,refs = e,r
+	}
+
+	if pub,err := newAirspacePublisher(db); err != nil {
+		Log.Fatal(err)
+	} else {
+		airspacePub = pub
+	}
+
+	if cfg,err := loadAlertConfig(fAlertsFile); err != nil {
+		Log.Fatal(err)
+	} else {
+		health = newHealthMonitor(cfg, time.Now())
+	}
+
+	if cfg,err := loadPlausibilityConfig(fPlausibilityFile); err != nil {
+		Log.Fatal(err)
+	} else if plausibility,err = newPlausibilityChecker(cfg, fQuarantineFile); err != nil {
+		Log.Fatal(err)
+	}
+
+	sink,err := newTrackSink(db)
+	if err != nil { Log.Fatal(err) }
+	src,err := newBundleSource()
 	if err != nil { Log.Fatal(err) }
 
-	msgChan1 := make(chan []*adsb.CompositeMsg, 3)
-	msgChan2 := make(chan []*adsb.CompositeMsg, 3)
-	msgChan3 := make(chan []*adsb.CompositeMsg, 3)
-	workerChans := []chan []*adsb.CompositeMsg{}
+	bundlesource.DeadLetterDir = fDeadLetterDir
+	if fKeysFile != "" {
+		keys,err := bundlesource.LoadKeyRegistry(fKeysFile)
+		if err != nil { Log.Fatal(err) }
+		if keys.HasWildcard() {
+			if !fKeysWildcard {
+				Log.Fatalf("%s has a \"*\" key, which can sign as any receiver without a key;"+
+					" give every receiver its own key, or use -keys-wildcard", fKeysFile)
+			}
+			Log.Printf("(-keys-wildcard: the \"*\" key can sign as any receiver without a key)\n")
+			keys.VerifyWildcard = true
+		}
+		bundlesource.Keys = keys
+		Log.Printf("(verifying bundle signatures, %d keys loaded from %s)\n", keys.Len(), fKeysFile)
+	}
+	replaySegments := []string{}
+	switch fJournalDir {
+	case "none":
+		Log.Printf("(NOT journaling; bundles are acked once deduped, and lost if we crash)\n")
+	case "":
+		Log.Fatal("nowhere to put the journal (no home directory?); use -journal=DIR")
+	default:
+		j,old,err := openJournal(fJournalDir)
+		if err != nil { Log.Fatal(err) }
+		jrnl = j
+		replaySegments = old
+		Log.Printf("(journaling to %s; %d segments to replay)\n", fJournalDir, len(old))
+	}
+
+	chanSize := conf.Consolidator.ChanSize
+	msgChan1 := make(chan inboundBundle, chanSize)
+	msgChan2 := make(chan []*adsb.CompositeMsg, chanSize)
+	msgChan3 := make(chan []*adsb.CompositeMsg, chanSize)
+	msgChan4 := make(chan []*adsb.CompositeMsg, chanSize)
+	workersWG := &sync.WaitGroup{}
+
+	// The workers carry on through the drain; workCtx is cancelled once the
+	// -drain deadline passes.
+	workCtx,abandon := context.WithCancel(context.WithoutCancel(ctx))
+	defer abandon()
 
 	nWorkers := fDatabaseWorkers // avoid getting backed up on DB writes
 	Log.Printf("(spawning %d DB workers)\n", nWorkers)
+	disp = newDispatcher(nWorkers, conf.Consolidator.DispatchQueuePerWorker,
+		conf.Consolidator.DispatchMaxCoalesce, trackMaxAge)
 	for i:=0; i<nWorkers; i++ {
-		workerChan := make(chan []*adsb.CompositeMsg, 3)
-		workerChans = append(workerChans, workerChan)
-		go flushTracks(i, db, workerChan)      // worker bee, write per-flight fragments to disc
+		workersWG.Add(1)
+		go flushTracks(ctx, workCtx, i, sink, disp, workersWG) // worker bee, write per-flight fragments to disc
 	}
 
-	go pullNewFromPubsub(msgChan1)           // sends mixed bundles down chan1
-	go filterNewMessages(db, msgChan1, msgChan2) // ... dedupes them, into chan2 ...
-	go bufferTracks(msgChan2, msgChan3)      // ... sorts msgs into per-flight frags, into chan3 ...
-	go workerDispatch(msgChan3, workerChans) // ... takes a per-flight frag, shards over workerChans
-
-	go trackVitals()    // Manage vital statistics via global channels
-	go cacheRefdata(db) // Cache some refdata
+	// The input stage is the replayer and the source; chan1 closes once both are finished.
+	inputWG := &sync.WaitGroup{}
+	inputWG.Add(2)
+	go func() { replayJournal(ctx, replaySegments, msgChan1); inputWG.Done() }() // anything left over from last time, plus ...
+	go func() { pullNewFromSource(ctx, src, msgChan1); inputWG.Done() }()           // sends mixed bundles down chan1
+	go func() { inputWG.Wait(); close(msgChan1) }()
+	go filterNewMessages(msgChan1, msgChan2) // ... dedupes them, into chan2 ...
+	go checkPlausibility(msgChan2, msgChan3) // ... drops the implausible ones, into chan3 ...
+	go bufferTracks(msgChan3, msgChan4)      // ... sorts msgs into per-flight frags, into chan4 ...
+	go workerDispatch(msgChan4, disp)        // ... and queues per-flight frags up for the workers
+
+	go logVitals(ctx)      // Periodically log our vital statistics
+	go health.monitor(ctx) // ... and keep an eye on the receivers
+	if refs != nil {
+		go cacheRefdata(ctx, db, refs) // Cache some refdata
+	}
 
 	go func(){ Log.Fatal(http.ListenAndServe(":8080", nil)) }()
 
-	// Block until done channel lights up
-	<-done
-	time.Sleep(time.Second * 4)  // Give the pubsub loop a chance to unblock and exit
+	// Block until we're shutting down, then drain the pipeline (see drain.go)
+	<-ctx.Done()
+	workersFinished := make(chan struct{})
+	go func() { workersWG.Wait(); close(workersFinished) }()
+
+	deadline,cancelDeadline := context.WithDeadline(context.Background(), time.Now().Add(fDrainTimeout))
+	defer cancelDeadline()
+
+	select {
+	case <-workersFinished:
+	case <-deadline.Done():
+		Log.Printf("(drain deadline of %s passed, abandoning unwritten fragments)\n", fDrainTimeout)
+		abandon()
+		select {
+		case <-workersFinished:
+		case <-time.After(5 * time.Second): // Whatever they're stuck on, we can't wait
+			drain.update(func(d *drainReport) { d.TimedOut = true })
+		}
+	}
+
+	if err := sink.Close(); err != nil {
+		Log.Printf("sink.Close: err: %v\n", err)
+	}
+	drain.update(func(d *drainReport) { d.FragsSpilled = sink.Stats().SpillPending })
+	if err := plausibility.Close(); err != nil {
+		Log.Printf("quarantine.Close: err: %v\n", err)
+	}
+	if err := airspacePub.Close(); err != nil {
+		Log.Printf("airspace.Close: err: %v\n", err)
+	}
+	if jrnl != nil {
+		if err := jrnl.Close(); err != nil {
+			Log.Printf("journal.Close: err: %v\n", err)
+		}
+	}
+	Log.Printf("%s", drain.String())
 	Log.Printf("(-- main clean exit)\n")
 }
 
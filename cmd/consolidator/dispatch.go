@@ -0,0 +1,233 @@
+package main
+
+// The dispatcher hands track fragments out to the DB workers. Each
+// aircraft has a home worker (picked by hashing its icao24, as before),
+// but an idle worker may steal from a busy worker's queue, so one slow
+// write on a hot worker doesn't stall everything behind it. Two rules
+// keep us safe from write-write conflicts in the DB:
+//  - an aircraft is only ever being written by one worker at a time
+//  - an aircraft has at most one fragment queued; if more arrive while it
+//    waits, they're coalesced onto the end of it.
+// The queue is bounded; when it's full, Add blocks, and the pipeline backs
+// up behind it. Add also blocks if a fragment can't be coalesced onto the
+// queued one (it would get too big, or there's a gap between them that the
+// trackbuffer split on), until that one has been taken; so a slow aircraft
+// backs up the pipeline too, rather than its fragment growing without end.
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/skypies/adsb"
+	"github.com/skypies/pi/vitals"
+)
+
+var (
+	vWorkerQueueDepth   = vitals.NewGaugeVec("consolidator_worker_queue_depth", "Fragments queued for each DB worker.", "worker")
+	vDispatchSteals     = vitals.NewCounter("consolidator_dispatch_steals_total", "Fragments written by a worker other than their home worker.")
+	vDispatchCoalesced  = vitals.NewCounter("consolidator_dispatch_coalesced_total", "Fragments merged into one already queued for the same aircraft.")
+	vDispatchWaitMillis = vitals.NewHistogram("consolidator_dispatch_wait_milliseconds", "Time spent waiting for room in the worker queues.", vitals.MillisBuckets)
+)
+
+// {{{ dispatcher{}
+
+type dispatchEntry struct {
+	icao adsb.IcaoId
+	msgs []*adsb.CompositeMsg
+}
+
+type dispatcher struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+
+	queues   [][]*dispatchEntry            // Per worker, oldest first
+	queued   map[adsb.IcaoId]*dispatchEntry
+	busy     map[adsb.IcaoId]bool          // Being written right now
+	working  []bool                        // Which workers are writing
+	capacity int                           // Max entries, over all the queues
+	maxMsgs  int                           // Max msgs in a coalesced entry
+	maxGap   time.Duration                 // Don't coalesce across a gap longer than this
+	closed   bool
+}
+
+func newDispatcher(nWorkers, queuePerWorker, maxMsgs int, maxGap time.Duration) *dispatcher {
+	d := &dispatcher{
+		queues:   make([][]*dispatchEntry, nWorkers),
+		queued:   map[adsb.IcaoId]*dispatchEntry{},
+		busy:     map[adsb.IcaoId]bool{},
+		working:  make([]bool, nWorkers),
+		capacity: nWorkers * queuePerWorker,
+		maxMsgs:  maxMsgs,
+		maxGap:   maxGap,
+	}
+	d.cond = sync.NewCond(&d.mu)
+
+	for i:=0; i<nWorkers; i++ {
+		i := i
+		vWorkerQueueDepth.With(fmt.Sprintf("%03d", i)).SetFunc(func() float64 {
+			return float64(d.Depths()[i])
+		})
+	}
+	return d
+}
+
+// It's important that we don't process frags for the same icaoid in
+// parallel, or we'll suffer a write-write conflict and overwrite some data.
+func (d *dispatcher)home(icao adsb.IcaoId) int {
+	h := fnv.New32a()
+	h.Write([]byte(icao))
+	return int(h.Sum32() % uint32(len(d.queues)))
+}
+
+// }}}
+// {{{ d.Add
+
+// Add queues up a fragment (or coalesces it onto the aircraft's queued
+// one), blocking while there's no room for it.
+func (d *dispatcher)Add(msgs []*adsb.CompositeMsg) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	icao := msgs[0].Icao24
+	tStart := time.Time{}
+	for {
+		e,exists := d.queued[icao]
+		if exists && d.coalescable(e, msgs) {
+			e.msgs = append(e.msgs, msgs...)
+			vDispatchCoalesced.Inc()
+			break
+		}
+		if !exists && d.size() < d.capacity {
+			e := &dispatchEntry{icao:icao, msgs:msgs}
+			w := d.home(icao)
+			d.queues[w] = append(d.queues[w], e)
+			d.queued[icao] = e
+			d.cond.Broadcast()
+			break
+		}
+
+		if tStart.IsZero() { tStart = time.Now() }
+		d.cond.Wait()
+	}
+
+	if !tStart.IsZero() {
+		vDispatchWaitMillis.Observe(float64(time.Since(tStart).Milliseconds()))
+	}
+}
+
+// coalescable says whether the msgs can go onto the end of the entry.
+func (d *dispatcher)coalescable(e *dispatchEntry, msgs []*adsb.CompositeMsg) bool {
+	if len(e.msgs) + len(msgs) > d.maxMsgs { return false }
+	gap := msgs[0].GeneratedTimestampUTC.Sub(e.msgs[len(e.msgs)-1].GeneratedTimestampUTC)
+	return gap <= d.maxGap
+}
+
+// }}}
+// {{{ d.Next
+
+// Next blocks until there's a fragment for worker myId to write, and
+// returns it. Once the dispatcher is closed and empty, it returns false.
+// The worker must call Done when it's finished with the fragment.
+func (d *dispatcher)Next(myId int) ([]*adsb.CompositeMsg, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.working[myId] = false // If it's asking, it's finished with the last one
+	for {
+		if e := d.take(myId); e != nil {
+			d.working[myId] = true
+			d.busy[e.icao] = true
+			delete(d.queued, e.icao)
+			d.cond.Broadcast() // There's room in the queues now
+			return e.msgs, true
+		}
+		if d.closed && d.size() == 0 {
+			return nil, false
+		}
+		d.cond.Wait()
+	}
+}
+
+// take removes the first writable entry from the worker's own queue; if
+// there isn't one, it steals one from the longest queue that has one and
+// whose worker is busy. Caller must hold the lock.
+func (d *dispatcher)take(myId int) *dispatchEntry {
+	if e := d.takeFrom(myId); e != nil {
+		return e
+	}
+
+	victim := -1
+	for i,q := range d.queues {
+		if i == myId || len(q) == 0 || !d.working[i] { continue }
+		if victim < 0 || len(q) > len(d.queues[victim]) {
+			if d.writable(i) { victim = i }
+		}
+	}
+	if victim < 0 { return nil }
+	vDispatchSteals.Inc()
+	return d.takeFrom(victim)
+}
+
+func (d *dispatcher)writable(w int) bool {
+	for _,e := range d.queues[w] {
+		if !d.busy[e.icao] { return true }
+	}
+	return false
+}
+
+func (d *dispatcher)takeFrom(w int) *dispatchEntry {
+	for i,e := range d.queues[w] {
+		if d.busy[e.icao] { continue }
+		d.queues[w] = append(d.queues[w][:i], d.queues[w][i+1:]...)
+		return e
+	}
+	return nil
+}
+
+// Caller must hold the lock.
+func (d *dispatcher)size() int { return len(d.queued) }
+
+// }}}
+// {{{ d.Done, d.Close
+
+// Done says that a fragment from Next has been written (or given up on),
+// so that aircraft's next fragment can go.
+func (d *dispatcher)Done(msgs []*adsb.CompositeMsg) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.busy, msgs[0].Icao24)
+	d.cond.Broadcast()
+}
+
+// Close says no more fragments are coming; Next returns false to every
+// worker once the queues are empty.
+func (d *dispatcher)Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	d.cond.Broadcast()
+}
+
+// }}}
+// {{{ d.Depths
+
+// Depths returns how many fragments are queued for each worker.
+func (d *dispatcher)Depths() []int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ret := make([]int, len(d.queues))
+	for i,q := range d.queues { ret[i] = len(q) }
+	return ret
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
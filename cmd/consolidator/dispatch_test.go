@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skypies/adsb"
+)
+
+// fragOf makes a fragment for the aircraft; the msgs' altitudes are their
+// sequence numbers.
+func fragOf(icao adsb.IcaoId, seqs ...int) []*adsb.CompositeMsg {
+	msgs := []*adsb.CompositeMsg{}
+	for _,seq := range seqs {
+		msgs = append(msgs, &adsb.CompositeMsg{Msg:adsb.Msg{Icao24:icao, Altitude:int64(seq)}})
+	}
+	return msgs
+}
+
+func seqsOf(msgs []*adsb.CompositeMsg) []int {
+	ret := []int{}
+	for _,m := range msgs { ret = append(ret, int(m.Altitude)) }
+	return ret
+}
+
+// returnsWithin says whether f returns within d.
+func returnsWithin(d time.Duration, f func()) bool {
+	finished := make(chan struct{})
+	go func() { f(); close(finished) }()
+	select {
+	case <-finished:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// All the aircraft share a home worker, so the others have to steal; but
+// each aircraft's msgs must still be written in order, by one worker at a
+// time.
+func TestDispatchOrderingUnderStealing(t *testing.T) {
+	const nWorkers, nIcaos, nFrags = 4, 6, 50
+	d := newDispatcher(nWorkers, 4, 100, trackMaxAge)
+
+	icaos := []adsb.IcaoId{}
+	for i:=0; len(icaos) < nIcaos; i++ {
+		if icao := adsb.IcaoId(fmt.Sprintf("A%05X", i)); d.home(icao) == 0 { icaos = append(icaos, icao) }
+	}
+
+	var mu sync.Mutex
+	writing := map[adsb.IcaoId]bool{}
+	written := map[adsb.IcaoId][]int{}
+	writers := map[int]bool{}
+	steals := vDispatchSteals.Value()
+
+	wg := sync.WaitGroup{}
+	for w:=0; w<nWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for {
+				msgs,ok := d.Next(w)
+				if !ok { return }
+				icao := msgs[0].Icao24
+
+				mu.Lock()
+				if writing[icao] { t.Errorf("%s: concurrent writes", icao) }
+				writing[icao] = true
+				writers[w] = true
+				mu.Unlock()
+
+				time.Sleep(time.Duration(rand.Intn(2000)) * time.Microsecond)
+
+				mu.Lock()
+				writing[icao] = false
+				written[icao] = append(written[icao], seqsOf(msgs)...)
+				mu.Unlock()
+				d.Done(msgs)
+			}
+		}(w)
+	}
+
+	for seq:=0; seq<nFrags; seq++ {
+		for _,icao := range icaos { d.Add(fragOf(icao, seq)) }
+	}
+	d.Close()
+	wg.Wait()
+
+	for _,icao := range icaos {
+		seqs := written[icao]
+		if len(seqs) != nFrags { t.Errorf("%s: %d of %d msgs written", icao, len(seqs), nFrags) }
+		for i := range seqs {
+			if seqs[i] != i { t.Errorf("%s: written out of order: %v", icao, seqs); break }
+		}
+	}
+	if vDispatchSteals.Value() == steals || len(writers) < 2 {
+		t.Errorf("no stealing happened (%d workers wrote)", len(writers))
+	}
+}
+
+// While an aircraft's fragment is being written, the ones after it pile up
+// into a single queued fragment.
+func TestDispatchCoalescing(t *testing.T) {
+	d := newDispatcher(2, 4, 100, trackMaxAge)
+	coalesced := vDispatchCoalesced.Value()
+
+	home := d.home("A00001")
+	thief := 1 - home
+
+	d.Add(fragOf("A00001", 1))
+	first,_ := d.Next(home)
+	d.Add(fragOf("A00001", 2))
+	d.Add(fragOf("A00001", 3, 4))
+	if n := vDispatchCoalesced.Value() - coalesced; n != 1 { t.Errorf("expected 1 coalesce, got %d", n) }
+
+	// The home worker is busy, but the other can't steal the aircraft's
+	// next fragment until the first one is done
+	stolen := make(chan []*adsb.CompositeMsg, 1)
+	go func() { msgs,_ := d.Next(thief); stolen <- msgs }()
+	select {
+	case msgs := <-stolen:
+		t.Fatalf("got %v while the aircraft was busy", seqsOf(msgs))
+	case <-time.After(20 * time.Millisecond):
+	}
+	d.Done(first)
+
+	select {
+	case msgs := <-stolen:
+		if s := seqsOf(msgs); len(s) != 3 || s[0] != 2 || s[2] != 4 {
+			t.Errorf("coalesced fragment: %v", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the next fragment wasn't handed out")
+	}
+	d.Close()
+	if _,ok := d.Next(home); ok { t.Errorf("expected nothing left") }
+}
+
+// A fragment that would make the queued one too big, or that comes after
+// a gap the trackbuffer split on, isn't coalesced; Add waits for the queued
+// one to be taken, and then queues it separately.
+func TestDispatchCoalesceLimits(t *testing.T) {
+	t0 := time.Now()
+	at := func(msgs []*adsb.CompositeMsg, d time.Duration) []*adsb.CompositeMsg {
+		for _,m := range msgs { m.GeneratedTimestampUTC = t0.Add(d) }
+		return msgs
+	}
+
+	for _,tc := range []struct{
+		name string
+		next []*adsb.CompositeMsg
+	}{
+		{"too big", at(fragOf("A00001", 4), time.Second)},
+		{"gap", at(fragOf("A00001", 4), 2*trackMaxAge)},
+	} {
+		d := newDispatcher(1, 4, 3, trackMaxAge)
+		d.Add(at(fragOf("A00001", 1, 2), 0))
+		d.Add(at(fragOf("A00001", 3), time.Second))
+
+		added := make(chan struct{})
+		go func() { d.Add(tc.next); close(added) }()
+		select {
+		case <-added:
+			t.Fatalf("%s: Add didn't wait for the queued fragment to be taken", tc.name)
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		msgs,_ := d.Next(0)
+		if s := seqsOf(msgs); len(s) != 3 { t.Errorf("%s: first fragment: %v", tc.name, s) }
+		select {
+		case <-added:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: Add didn't unblock when the fragment was taken", tc.name)
+		}
+		d.Done(msgs)
+
+		if msgs,_ = d.Next(0); len(msgs) != 1 || msgs[0].Altitude != 4 {
+			t.Errorf("%s: second fragment: %v", tc.name, seqsOf(msgs))
+		}
+	}
+}
+
+func TestDispatchBlocksAtCapacity(t *testing.T) {
+	d := newDispatcher(1, 2, 100, trackMaxAge)
+	d.Add(fragOf("A00001", 1))
+	d.Add(fragOf("A00002", 1))
+	if !returnsWithin(20*time.Millisecond, func() { d.Add(fragOf("A00001", 2)) }) {
+		t.Errorf("coalescing onto a queued fragment shouldn't need room")
+	}
+
+	added := make(chan struct{})
+	go func() { d.Add(fragOf("A00003", 1)); close(added) }()
+	select {
+	case <-added:
+		t.Fatalf("Add didn't block when the queues were full")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	msgs,_ := d.Next(0)
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatalf("Add didn't unblock when a fragment was taken")
+	}
+	if d.Done(msgs); d.Depths()[0] != 2 { t.Errorf("depths: %v", d.Depths()) }
+}
+
+// Close lets the workers finish what's queued, and then sends them home.
+func TestDispatchClose(t *testing.T) {
+	d := newDispatcher(3, 4, 100, trackMaxAge)
+	results := make(chan int, 3)
+	for w:=0; w<3; w++ {
+		go func(w int) {
+			n := 0
+			for {
+				msgs,ok := d.Next(w)
+				if !ok { break }
+				n++
+				d.Done(msgs)
+			}
+			results <- n
+		}(w)
+	}
+	time.Sleep(10 * time.Millisecond) // They're all waiting now
+	d.Add(fragOf("A00001", 1))
+	d.Add(fragOf("A00002", 1))
+	d.Close()
+
+	total := 0
+	for w:=0; w<3; w++ {
+		select {
+		case n := <-results:
+			total += n
+		case <-time.After(time.Second):
+			t.Fatalf("a worker is still waiting after Close")
+		}
+	}
+	if total != 2 { t.Errorf("expected 2 fragments written, got %d", total) }
+}
@@ -0,0 +1,99 @@
+package main
+
+// Shutting down in order. Once the root context is cancelled (SIGINT, or /_ah/stop):
+//   1. the input stage stops taking bundles (anything in flight is nacked)
+//      and closes its output channel
+//   2. filterNewMessages drains, posts a final airspace snapshot, and closes its output
+//   3. checkPlausibility drains, and closes its output
+//   4. bufferTracks drains, then flushes every track it holds, however young
+//   5. workerDispatch drains, and closes the dispatcher
+//   6. the workers write out what they have, until the -drain deadline passes;
+//      after that, fragments are counted as lost rather than written
+// and then we report what was flushed, and what was lost. (Lost messages
+// are still in the journal, and get replayed next time, unless
+// -journal=none; with -spill, fragments the sink couldn't take are on disk,
+// and get written next time.)
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// {{{ drainReport{}
+
+type drainReport struct {
+	sync.Mutex
+
+	Started        time.Time
+	InputStopped   time.Duration // How long the input stage took to stop
+	BundlesNacked  int64         // In flight when we stopped taking input
+	AirspacePosted bool
+	FinalFrags     int64         // From the trackbuffer's final flush
+	FinalMsgs      int64
+	FragsWritten   int64         // Written by workers during the drain
+	FragsFailed    int64
+	FragsLost      int64         // Abandoned after the deadline
+	MsgsLost       int64
+	TimedOut       bool          // Gave up waiting for workers altogether
+	FragsSpilled   int           // Left on disk in the -spill dir
+}
+
+var drain = drainReport{}
+
+func (d *drainReport)update(f func(d *drainReport)) {
+	d.Lock()
+	defer d.Unlock()
+	f(d)
+}
+
+// }}}
+// {{{ beginShutdown
+
+var shutdownOnce = sync.Once{}
+
+// beginShutdown starts the drain, by cancelling the root context; it's
+// safe to call more than once.
+func beginShutdown(cancel context.CancelFunc) {
+	shutdownOnce.Do(func() {
+		drain.update(func(d *drainReport) { d.Started = time.Now() })
+		cancel()
+	})
+}
+
+// }}}
+// {{{ d.String
+
+func (d *drainReport)String() string {
+	d.Lock()
+	defer d.Unlock()
+
+	str := fmt.Sprintf("drain report, after %s:-\n"+
+		"  input: stopped in %s, %d in-flight bundles nacked\n"+
+		"  airspace: final snapshot posted: %v\n"+
+		"  trackbuffer: final flush of %d fragments (%d msgs)\n"+
+		"  workers: %d fragments written, %d failed, %d lost at deadline (%d msgs)\n",
+		time.Since(d.Started).Round(time.Millisecond),
+		d.InputStopped.Round(time.Millisecond), d.BundlesNacked,
+		d.AirspacePosted,
+		d.FinalFrags, d.FinalMsgs,
+		d.FragsWritten, d.FragsFailed, d.FragsLost, d.MsgsLost)
+	if d.FragsSpilled > 0 {
+		str += fmt.Sprintf("  sink: %d fragments left in the spill dir, for next time\n", d.FragsSpilled)
+	}
+	if d.TimedOut {
+		str += "  !! gave up waiting for workers; anything they held is lost too\n"
+	}
+	return str
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,376 @@
+package main
+
+// Per-receiver health. Every bundle updates its receiver's lag (how far
+// behind our wall clock its newest message was) and message rate; every
+// so often we check each receiver against the alert rules, and rate it
+// green, amber or red. When a receiver's rating changes, an alert goes
+// to the log and/or to webhooks. The rules come from a JSON file (-alerts),
+// with anything left out taking the default:
+//
+//   {
+//     "Expected":      ["ScottsValley"], // flagged even if we've not heard from them yet
+//     "SilentAmber":   "2m",    "SilentRed":   "10m",  // time since last bundle
+//     "SkewAmber":     "30s",   "SkewRed":     "5m",   // lag of the newest msg in a bundle
+//     "CollapseAmber": 0.5,     "CollapseRed": 0.1,    // recent rate, as a fraction of baseline
+//     "MinBaseline":   10,      // msgs/min; quieter receivers aren't judged on rate
+//     "CheckEvery":    "30s",
+//     "Log":           true,
+//     "Webhooks":      ["https://example.com/hooks/skypies"]
+//   }
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/skypies/adsb"
+	"github.com/skypies/pi/vitals"
+)
+
+const rateShortWindow = 5 * time.Minute  // Time constant of the recent rate
+const rateBaselineWindow = time.Hour     // ... and of the baseline
+const rateWarmup = 15 * time.Minute      // Don't judge rates until we've watched this long
+
+// {{{ healthLevel
+
+type healthLevel int
+
+const(
+	healthGreen healthLevel = iota
+	healthAmber
+	healthRed
+)
+
+func (l healthLevel)String() string { return []string{"green", "amber", "red"}[l] }
+func (l healthLevel)MarshalText() ([]byte, error) { return []byte(l.String()), nil }
+
+// }}}
+// {{{ alertConfig{}
+
+// duration lets the config file say "2m" rather than 120000000000.
+type duration struct{ time.Duration }
+
+func (d *duration)UnmarshalJSON(b []byte) error {
+	s := ""
+	if err := json.Unmarshal(b, &s); err != nil { return err }
+	dur,err := time.ParseDuration(s)
+	d.Duration = dur
+	return err
+}
+
+func (d duration)MarshalJSON() ([]byte, error) { return json.Marshal(d.String()) }
+
+type alertConfig struct {
+	Expected      []string
+	SilentAmber   duration
+	SilentRed     duration
+	SkewAmber     duration
+	SkewRed       duration
+	CollapseAmber float64
+	CollapseRed   float64
+	MinBaseline   float64
+	CheckEvery    duration
+	Log           bool
+	Webhooks      []string
+}
+
+var defaultAlertConfig = alertConfig{
+	SilentAmber:   duration{2 * time.Minute},
+	SilentRed:     duration{10 * time.Minute},
+	SkewAmber:     duration{30 * time.Second},
+	SkewRed:       duration{5 * time.Minute},
+	CollapseAmber: 0.5,
+	CollapseRed:   0.1,
+	MinBaseline:   10,
+	CheckEvery:    duration{30 * time.Second},
+	Log:           true,
+}
+
+func loadAlertConfig(filename string) (alertConfig, error) {
+	cfg := defaultAlertConfig
+	if filename == "" { return cfg, nil }
+
+	data,err := os.ReadFile(filename)
+	if err != nil { return cfg, err }
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("alerts: %s: %v", filename, err)
+	}
+	if cfg.CheckEvery.Duration <= 0 {
+		return cfg, fmt.Errorf("alerts: %s: CheckEvery must be positive", filename)
+	}
+	return cfg, nil
+}
+
+// }}}
+// {{{ receiverHealth{}
+
+type receiverHealth struct {
+	Name          string
+	FirstSeen     time.Time
+	LastBundle    time.Time     // Wall clock
+	LastMsg       time.Time     // Newest GeneratedTimestampUTC we've seen
+	Lag           time.Duration // Wall clock minus newest msg, when the last bundle arrived
+	RateRecent    float64       // msgs/min
+	RateBaseline  float64       // msgs/min
+
+	Level         healthLevel
+	Reasons       []string
+	LevelSince    time.Time
+
+	msgsSinceCheck int64
+}
+
+// }}}
+// {{{ healthMonitor{}
+
+type healthMonitor struct {
+	sync.Mutex
+
+	cfg        alertConfig
+	receivers  map[string]*receiverHealth
+	lastCheck  time.Time
+	client     *http.Client
+}
+
+var vReceiverHealth = vitals.NewGaugeVec("consolidator_receiver_health",
+	"Receiver health; 0 is green, 1 amber, 2 red.", "receiver")
+var vAlerts = vitals.NewCounterVec("consolidator_alerts_total",
+	"Alerts fired, by the level the receiver moved to.", "level")
+
+var health *healthMonitor
+
+func newHealthMonitor(cfg alertConfig, now time.Time) *healthMonitor {
+	h := &healthMonitor{
+		cfg: cfg,
+		receivers: map[string]*receiverHealth{},
+		lastCheck: now,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	for _,name := range cfg.Expected {
+		h.get(name, now)
+	}
+	return h
+}
+
+// Caller must hold the lock.
+func (h *healthMonitor)get(name string, now time.Time) *receiverHealth {
+	if _,exists := h.receivers[name]; !exists {
+		h.receivers[name] = &receiverHealth{Name:name, FirstSeen:now, LevelSince:now,
+			Reasons:[]string{}}
+	}
+	return h.receivers[name]
+}
+
+// }}}
+// {{{ h.observe
+
+// observe notes a bundle arriving from a receiver at time now.
+func (h *healthMonitor)observe(msgs []*adsb.CompositeMsg, now time.Time) {
+	h.Lock()
+	defer h.Unlock()
+
+	r := h.get(msgs[0].ReceiverName, now)
+	r.LastBundle = now
+	r.msgsSinceCheck += int64(len(msgs))
+	for _,m := range msgs {
+		if m.GeneratedTimestampUTC.After(r.LastMsg) { r.LastMsg = m.GeneratedTimestampUTC }
+	}
+	r.Lag = now.Sub(r.LastMsg)
+}
+
+// }}}
+// {{{ h.check
+
+type alert struct {
+	Receiver string
+	From     string
+	To       string
+	Reasons  []string
+	Time     time.Time
+}
+
+// check updates the rates as of time now, rates every receiver, and
+// returns alerts for those whose level changed.
+func (h *healthMonitor)check(now time.Time) []alert {
+	h.Lock()
+	defer h.Unlock()
+
+	dt := now.Sub(h.lastCheck)
+	h.lastCheck = now
+	if dt <= 0 { return nil }
+
+	ewma := func(prev, val float64, window time.Duration) float64 {
+		alpha := 1 - math.Exp(-dt.Seconds() / window.Seconds())
+		return prev + alpha * (val - prev)
+	}
+
+	alerts := []alert{}
+	for _,r := range h.receivers {
+		rate := float64(r.msgsSinceCheck) / dt.Minutes()
+		r.msgsSinceCheck = 0
+		r.RateRecent = ewma(r.RateRecent, rate, rateShortWindow)
+		r.RateBaseline = ewma(r.RateBaseline, rate, rateBaselineWindow)
+
+		level,reasons := h.rate(r, now)
+		vReceiverHealth.With(r.Name).Set(float64(level))
+		if level != r.Level {
+			alerts = append(alerts, alert{Receiver:r.Name, From:r.Level.String(), To:level.String(),
+				Reasons:reasons, Time:now})
+			r.LevelSince = now
+		}
+		r.Level,r.Reasons = level,reasons
+	}
+	return alerts
+}
+
+// rate applies the alert rules. Caller must hold the lock.
+func (h *healthMonitor)rate(r *receiverHealth, now time.Time) (healthLevel, []string) {
+	level := healthGreen
+	reasons := []string{}
+	flag := func(l healthLevel, reason string, args ...interface{}) {
+		if l > level { level = l }
+		reasons = append(reasons, fmt.Sprintf(reason, args...))
+	}
+	c := &h.cfg
+
+	silence := now.Sub(r.FirstSeen)
+	if !r.LastBundle.IsZero() { silence = now.Sub(r.LastBundle) }
+	if silence > c.SilentRed.Duration {
+		flag(healthRed, "silent for %s", silence.Round(time.Second))
+	} else if silence > c.SilentAmber.Duration {
+		flag(healthAmber, "silent for %s", silence.Round(time.Second))
+	}
+
+	if skew := r.Lag; !r.LastBundle.IsZero() {
+		if skew < 0 { skew = -skew }
+		if skew > c.SkewRed.Duration {
+			flag(healthRed, "clock skew %s", r.Lag.Round(time.Second))
+		} else if skew > c.SkewAmber.Duration {
+			flag(healthAmber, "clock skew %s", r.Lag.Round(time.Second))
+		}
+	}
+
+	if now.Sub(r.FirstSeen) > rateWarmup && r.RateBaseline >= c.MinBaseline {
+		frac := r.RateRecent / r.RateBaseline
+		if frac < c.CollapseRed {
+			flag(healthRed, "rate %.0f/min, vs. baseline %.0f/min", r.RateRecent, r.RateBaseline)
+		} else if frac < c.CollapseAmber {
+			flag(healthAmber, "rate %.0f/min, vs. baseline %.0f/min", r.RateRecent, r.RateBaseline)
+		}
+	}
+
+	return level, reasons
+}
+
+// }}}
+// {{{ h.fire
+
+func (h *healthMonitor)fire(a alert) {
+	vAlerts.With(a.To).Inc()
+
+	if h.cfg.Log {
+		Log.Printf("ALERT: receiver %s is %s (was %s): %v\n", a.Receiver, a.To, a.From, a.Reasons)
+	}
+
+	body,_ := json.Marshal(a)
+	for _,url := range h.cfg.Webhooks {
+		resp,err := h.client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			Log.Printf("alert webhook %s: %v", url, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode / 100 != 2 {
+			Log.Printf("alert webhook %s: %s", url, resp.Status)
+		}
+	}
+}
+
+// }}}
+// {{{ h.monitor
+
+// monitor runs the checks, until ctx is cancelled.
+func (h *healthMonitor)monitor(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			Log.Printf(" -- healthMonitor clean exit\n")
+			return
+		case <-time.After(h.cfg.CheckEvery.Duration):
+		}
+
+		for _,a := range h.check(time.Now()) {
+			h.fire(a)
+		}
+	}
+}
+
+// }}}
+// {{{ h.snapshot, h.String
+
+// snapshot returns copies of all the receivers, worst first.
+func (h *healthMonitor)snapshot() []receiverHealth {
+	h.Lock()
+	defer h.Unlock()
+	ret := []receiverHealth{}
+	for _,r := range h.receivers { ret = append(ret, *r) }
+	sort.Slice(ret, func(i,j int) bool {
+		if ret[i].Level != ret[j].Level { return ret[i].Level > ret[j].Level }
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+func (h *healthMonitor)String() string {
+	str := "* Receiver health:-\n"
+	for _,r := range h.snapshot() {
+		str += fmt.Sprintf("    %-15.15s: %-5s lag %6.1fs, %6.0f/min (baseline %6.0f/min) %v\n",
+			r.Name, r.Level, r.Lag.Seconds(), r.RateRecent, r.RateBaseline, r.Reasons)
+	}
+	return str
+}
+
+// }}}
+
+// {{{ receiversHandler
+
+var receiversTmpl = template.Must(template.New("receivers").Parse(`<html>
+<head><title>Receivers</title><meta http-equiv="refresh" content="30">
+<style>
+ td,th { padding: 2px 8px; font-family: monospace; text-align: left }
+ .green { background: #9e9 } .amber { background: #fc6 } .red { background: #f88 }
+</style></head>
+<body><table>
+<tr><th>Receiver</th><th>Health</th><th>Since</th><th>Last bundle</th><th>Lag</th>
+ <th>Rate (msgs/min)</th><th>Baseline</th><th>Why</th></tr>
+{{range .}}<tr class="{{.Level}}"><td>{{.Name}}</td><td>{{.Level}}</td>
+ <td>{{.LevelSince.Format "15:04:05"}}</td><td>{{if .LastBundle.IsZero}}never{{else}}{{.LastBundle.Format "15:04:05"}}{{end}}</td>
+ <td>{{printf "%.1fs" .Lag.Seconds}}</td><td>{{printf "%.0f" .RateRecent}}</td>
+ <td>{{printf "%.0f" .RateBaseline}}</td><td>{{range .Reasons}}{{.}}; {{end}}</td></tr>
+{{end}}</table></body></html>
+`))
+
+// receiversHandler lists the receivers, worst first, in red/amber/green.
+func receiversHandler(w http.ResponseWriter, r *http.Request) {
+	if err := receiversTmpl.Execute(w, health.snapshot()); err != nil {
+		Log.Printf("receiversHandler: %v", err)
+	}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
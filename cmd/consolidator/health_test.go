@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skypies/adsb"
+)
+
+var tHealth0 = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+// bundleFrom makes a bundle from the receiver, with msgs generated at the
+// given times.
+func bundleFrom(receiver string, times ...time.Time) []*adsb.CompositeMsg {
+	msgs := []*adsb.CompositeMsg{}
+	for _,t := range times {
+		msgs = append(msgs, &adsb.CompositeMsg{Msg:adsb.Msg{Icao24:"A00001", GeneratedTimestampUTC:t},
+			ReceiverName:receiver})
+	}
+	return msgs
+}
+
+func TestHealthRules(t *testing.T) {
+	for _,tc := range []struct{
+		name     string
+		age      time.Duration // Since we first heard from the receiver
+		silence  time.Duration // Since its last bundle
+		skew     time.Duration // Of the newest msg, when the last bundle arrived
+		recent   float64       // msgs/min
+		baseline float64
+		want     healthLevel
+		reason   string        // Expected in the reasons, if not empty
+	}{
+		{"healthy", time.Hour, 30*time.Second, 2*time.Second, 100, 100, healthGreen, ""},
+		{"silent amber", time.Hour, 3*time.Minute, 0, 100, 100, healthAmber, "silent for 3m0s"},
+		{"silent red", time.Hour, 11*time.Minute, 0, 100, 100, healthRed, "silent for 11m0s"},
+		{"skew amber", time.Hour, 0, time.Minute, 100, 100, healthAmber, "clock skew 1m0s"},
+		{"skew red", time.Hour, 0, 6*time.Minute, 100, 100, healthRed, "clock skew 6m0s"},
+		{"skew ahead", time.Hour, 0, -time.Minute, 100, 100, healthAmber, "clock skew -1m0s"},
+		{"collapse amber", time.Hour, 0, 0, 40, 100, healthAmber, "rate 40/min, vs. baseline 100/min"},
+		{"collapse red", time.Hour, 0, 0, 5, 100, healthRed, "rate 5/min, vs. baseline 100/min"},
+		{"warming up", 10*time.Minute, 0, 0, 5, 100, healthGreen, ""},
+		{"too quiet to judge", time.Hour, 0, 0, 0, 5, healthGreen, ""},
+		{"worst wins", time.Hour, 3*time.Minute, 6*time.Minute, 100, 100, healthRed, "silent for 3m0s"},
+	} {
+		h := newHealthMonitor(defaultAlertConfig, tHealth0)
+		now := tHealth0.Add(tc.age)
+		last := now.Add(-tc.silence)
+		h.observe(bundleFrom("Rx", tHealth0), tHealth0)
+		h.observe(bundleFrom("Rx", last.Add(-tc.skew)), last)
+
+		// Pin the rates; with no msgs, and next to no time since the last
+		// check, check barely moves them.
+		r := h.receivers["Rx"]
+		r.RateRecent,r.RateBaseline,r.msgsSinceCheck = tc.recent, tc.baseline, 0
+		h.lastCheck = now.Add(-time.Millisecond)
+		h.check(now)
+
+		if r.Level != tc.want {
+			t.Errorf("%s: got %s %v, wanted %s", tc.name, r.Level, r.Reasons, tc.want)
+		}
+		if tc.reason == "" && len(r.Reasons) > 0 {
+			t.Errorf("%s: unexpected reasons %v", tc.name, r.Reasons)
+		} else if tc.reason != "" && !strings.Contains(strings.Join(r.Reasons, "; "), tc.reason) {
+			t.Errorf("%s: reasons %v don't include %q", tc.name, r.Reasons, tc.reason)
+		}
+	}
+}
+
+// The lag is from the newest msg, wherever it is in the bundle.
+func TestHealthLagIsFromNewestMsg(t *testing.T) {
+	h := newHealthMonitor(defaultAlertConfig, tHealth0)
+	now := tHealth0.Add(time.Minute)
+	h.observe(bundleFrom("Rx", now.Add(-time.Second), now.Add(-10*time.Minute)), now)
+	if lag := h.receivers["Rx"].Lag; lag != time.Second {
+		t.Errorf("lag %s, wanted 1s", lag)
+	}
+}
+
+// Alerts fire when (and only when) a receiver's level changes; expected
+// receivers are judged even if we've never heard from them.
+func TestHealthAlerts(t *testing.T) {
+	cfg := defaultAlertConfig
+	cfg.Expected = []string{"Quiet"}
+	h := newHealthMonitor(cfg, tHealth0)
+
+	for _,step := range []struct{
+		at       time.Duration
+		from     []string // Receivers we hear from, just before the check
+		from2,to string   // Quiet's alert, if any
+	}{
+		{1*time.Minute, []string{"Rx"}, "", ""},
+		{3*time.Minute, []string{"Rx"}, "green", "amber"},
+		{4*time.Minute, []string{"Rx"}, "", ""},
+		{11*time.Minute, []string{"Rx"}, "amber", "red"},
+		{12*time.Minute, []string{"Rx", "Quiet"}, "red", "green"},
+		{13*time.Minute, []string{"Rx", "Quiet"}, "", ""},
+	} {
+		now := tHealth0.Add(step.at)
+		for _,rx := range step.from { h.observe(bundleFrom(rx, now), now) }
+
+		alerts := h.check(now)
+		if step.to == "" {
+			if len(alerts) != 0 { t.Errorf("%s: unexpected alerts %v", step.at, alerts) }
+			continue
+		}
+		if len(alerts) != 1 {
+			t.Errorf("%s: got %d alerts, wanted 1: %v", step.at, len(alerts), alerts)
+			continue
+		}
+		if a := alerts[0]; a.Receiver != "Quiet" || a.From != step.from2 || a.To != step.to || !a.Time.Equal(now) {
+			t.Errorf("%s: got alert %+v, wanted Quiet %s->%s", step.at, a, step.from2, step.to)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+// The journal is a write-ahead log of inbound bundles. Once a bundle is
+// in the journal (and synced to disk), it can be acked back to its source;
+// if we then crash with its messages still sitting in the trackbuffer,
+// they are replayed from the journal when we restart.
+//
+// The journal is split into segments, one per journalSegmentLife. A
+// segment is deleted once it has been rotated out, and all the new (i.e.
+// non-dupe) messages in it have been written to the track sink.
+//
+// The journal is on by default, so that bundles are delivered at least
+// once; -journal=none turns it off, for tests.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/skypies/adsb"
+	"github.com/skypies/pi/bundlesource"
+)
+
+const journalSegmentLife = time.Minute
+
+// {{{ journal{}
+
+type journal struct {
+	sync.Mutex
+
+	Dir          string
+	f            *os.File
+	seg          string                         // filename of the active segment
+	segStart     time.Time
+	outstanding  map[string]int                 // segment -> msgs not yet in the sink
+	msgSeg       map[*adsb.CompositeMsg]string  // msg -> segment it is waiting on
+}
+
+// }}}
+// {{{ defaultJournalDir
+
+// defaultJournalDir is under $XDG_STATE_HOME (or ~/.local/state), which
+// survives reboots; or empty, if we have no home directory.
+func defaultJournalDir() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home,err := os.UserHomeDir()
+		if err != nil || home == "" { return "" }
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "consolidator", "journal")
+}
+
+// }}}
+// {{{ openJournal
+
+// openJournal opens the journal in dir, and returns the names of any
+// segments left over from a previous run. Their contents should be
+// replayed, and then they can be removed.
+func openJournal(dir string) (*journal, []string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	old,err := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(old)
+
+	j := &journal{
+		Dir: dir,
+		outstanding: map[string]int{},
+		msgSeg: map[*adsb.CompositeMsg]string{},
+	}
+	if err := j.rotate(); err != nil {
+		return nil, nil, err
+	}
+	return j, old, nil
+}
+
+// }}}
+// {{{ j.rotate
+
+// rotate starts a new segment. Caller must hold the lock (or be the constructor).
+func (j *journal)rotate() error {
+	prev := j.seg
+	if j.f != nil {
+		if err := j.f.Close(); err != nil { return err }
+	}
+
+	j.segStart = time.Now()
+	j.seg = filepath.Join(j.Dir, fmt.Sprintf("segment-%020d.log", j.segStart.UnixNano()))
+	f,err := os.OpenFile(j.seg, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil { return err }
+	j.f = f
+
+	if prev != "" { j.maybeRemove(prev) }
+	return nil
+}
+
+// }}}
+// {{{ j.maybeRemove
+
+// Caller must hold the lock.
+func (j *journal)maybeRemove(seg string) {
+	if seg == j.seg || j.outstanding[seg] > 0 { return }
+	delete(j.outstanding, seg)
+	if err := os.Remove(seg); err != nil && !os.IsNotExist(err) {
+		Log.Printf("journal: %v", err)
+	}
+}
+
+// }}}
+
+// {{{ j.Append
+
+// Append durably writes the bundle to the active segment, and returns the
+// segment's name, for use with Track.
+func (j *journal)Append(msgs []*adsb.CompositeMsg) (string, error) {
+	j.Lock()
+	defer j.Unlock()
+
+	if time.Since(j.segStart) > journalSegmentLife {
+		if err := j.rotate(); err != nil { return "", err }
+	}
+
+	if err := bundlesource.WriteFrame(j.f, msgs); err != nil { return "", err }
+	if err := j.f.Sync(); err != nil { return "", err }
+
+	return j.seg, nil
+}
+
+// }}}
+// {{{ j.Track
+
+// Track notes that the segment can't be removed until these messages have
+// been written to the sink.
+func (j *journal)Track(seg string, msgs []*adsb.CompositeMsg) {
+	j.Lock()
+	defer j.Unlock()
+	for _,m := range msgs {
+		j.msgSeg[m] = seg
+		j.outstanding[seg]++
+	}
+}
+
+// }}}
+// {{{ j.Done
+
+// Done notes that these messages are now safely in the sink.
+func (j *journal)Done(msgs []*adsb.CompositeMsg) {
+	j.Lock()
+	defer j.Unlock()
+
+	segs := map[string]bool{}
+	for _,m := range msgs {
+		seg,exists := j.msgSeg[m]
+		if !exists { continue }
+		delete(j.msgSeg, m)
+		j.outstanding[seg]--
+		segs[seg] = true
+	}
+	for seg,_ := range segs {
+		j.maybeRemove(seg)
+	}
+}
+
+// }}}
+// {{{ j.Sizes
+
+// Sizes returns the number of segments on disk, and the number of
+// messages still waiting to reach the sink.
+func (j *journal)Sizes() (int64, int64) {
+	j.Lock()
+	defer j.Unlock()
+	n := 1 // the active segment
+	for seg,_ := range j.outstanding {
+		if seg != j.seg { n++ }
+	}
+	return int64(n), int64(len(j.msgSeg))
+}
+
+// }}}
+// {{{ j.Close
+
+// Close closes the active segment, and removes it if everything in it has
+// reached the sink (else a clean restart would replay it).
+func (j *journal)Close() error {
+	j.Lock()
+	defer j.Unlock()
+	err := j.f.Close()
+	seg := j.seg
+	j.seg = ""
+	j.maybeRemove(seg)
+	return err
+}
+
+// }}}
+
+// {{{ readJournalSegment
+
+// readJournalSegment returns all the bundles in a segment. A segment that
+// ends in a partial frame (we crashed mid-write) is fine; that bundle was
+// never acked, so it will be redelivered.
+func readJournalSegment(filename string) ([][]*adsb.CompositeMsg, error) {
+	f,err := os.Open(filename)
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	bundles := [][]*adsb.CompositeMsg{}
+	for {
+		msgs,err := bundlesource.ReadFrame(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return bundles, err
+		}
+		bundles = append(bundles, msgs)
+	}
+	return bundles, nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
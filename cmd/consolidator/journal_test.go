@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/skypies/adsb"
+	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/pi/tracksink"
+)
+
+func testBundle(icaos ...string) []*adsb.CompositeMsg {
+	msgs := []*adsb.CompositeMsg{}
+	for i,icao := range icaos {
+		m := &adsb.CompositeMsg{Msg:adsb.Msg{Icao24:adsb.IcaoId(icao), Altitude:int64(1000*(i+1)),
+			GeneratedTimestampUTC:time.Now()}, ReceiverName:"TestRx"}
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+func segments(t *testing.T, dir string) []string {
+	t.Helper()
+	segs,err := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	if err != nil { t.Fatal(err) }
+	return segs
+}
+
+// What's not yet in the sink when we crash gets replayed; a crash mid-write
+// loses only the partial bundle, which was never acked.
+func TestJournalReplay(t *testing.T) {
+	dir := t.TempDir()
+	j,old,err := openJournal(dir)
+	if err != nil { t.Fatal(err) }
+	if len(old) != 0 { t.Errorf("fresh journal has %d segments to replay", len(old)) }
+
+	for _,b := range [][]*adsb.CompositeMsg{testBundle("A00001", "A00002"), testBundle("A00003")} {
+		seg,err := j.Append(b)
+		if err != nil { t.Fatal(err) }
+		j.Track(seg, b)
+	}
+	j.f.Write([]byte{0, 0, 1}) // Half a frame
+	j.f.Close()                // Crash, rather than Close
+
+	j,old,err = openJournal(dir)
+	if err != nil { t.Fatal(err) }
+	defer j.Close()
+	if len(old) != 1 { t.Fatalf("expected 1 segment to replay, got %v", old) }
+
+	bundles,err := readJournalSegment(old[0])
+	if err != nil { t.Fatal(err) }
+	if len(bundles) != 2 || len(bundles[0]) != 2 || bundles[1][0].Icao24 != "A00003" {
+		t.Errorf("replayed the wrong bundles: %v", bundles)
+	}
+}
+
+func TestJournalCleansUp(t *testing.T) {
+	dir := t.TempDir()
+	j,_,err := openJournal(dir)
+	if err != nil { t.Fatal(err) }
+
+	written,pending := testBundle("A00001", "A00002"), testBundle("A00003")
+	seg,_ := j.Append(written)
+	j.Track(seg, written)
+	j.Track(seg, pending)
+
+	j.Done(written)
+	if nSegs,nPending := j.Sizes(); nSegs != 1 || nPending != 1 {
+		t.Errorf("sizes: %d segments, %d pending", nSegs, nPending)
+	}
+
+	// The rotated segment has to stay until its last msg reaches the sink
+	j.Lock()
+	j.rotate()
+	j.Unlock()
+	if n := len(segments(t, dir)); n != 2 { t.Fatalf("expected 2 segments, found %d", n) }
+	j.Done(pending)
+	if segs := segments(t, dir); len(segs) != 1 || segs[0] == seg {
+		t.Errorf("finished segment wasn't removed: %v", segs)
+	}
+
+	// A clean shutdown leaves nothing to replay
+	if err := j.Close(); err != nil { t.Fatal(err) }
+	if segs := segments(t, dir); len(segs) != 0 { t.Errorf("segments left after Close: %v", segs) }
+}
+
+// errSink fails every write with err.
+type errSink struct{ err error }
+
+func (s errSink)AddTrackFragment(frag *fdb.TrackFragment, perf map[string]time.Time) error { return s.err }
+func (s errSink)Close() error { return nil }
+
+// A bundle the sink will never take is done with, just like one it took;
+// otherwise it pins its segment, and gets replayed (and fails) every restart.
+func TestJournalDoneOnPermanentError(t *testing.T) {
+	j,_,err := openJournal(t.TempDir())
+	if err != nil { t.Fatal(err) }
+	defer j.Close()
+	defer func(old *journal) { jrnl = old }(jrnl)
+	jrnl = j
+
+	for _,tc := range []struct{
+		err      error
+		nPending int64
+	}{
+		{nil, 0},
+		{tracksink.Permanent(fmt.Errorf("blob too big")), 0},
+		{fmt.Errorf("datastore is down"), 1}, // Worth another go
+	} {
+		b := testBundle("A00001")
+		seg,_ := j.Append(b)
+		j.Track(seg, b)
+
+		flushTrackToSink(0, errSink{tc.err}, b)
+		if _,nPending := j.Sizes(); nPending != tc.nPending {
+			t.Errorf("%v: %d msgs pending, wanted %d", tc.err, nPending, tc.nPending)
+		}
+	}
+}
+
+func TestJournalKeepsUnfinishedOnClose(t *testing.T) {
+	dir := t.TempDir()
+	j,_,err := openJournal(dir)
+	if err != nil { t.Fatal(err) }
+	b := testBundle("A00001")
+	seg,_ := j.Append(b)
+	j.Track(seg, b)
+	j.Close()
+
+	if _,old,_ := openJournal(dir); len(old) != 1 { t.Errorf("expected 1 segment to replay, got %v", old) }
+}
+
+func TestDefaultJournalDir(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", "/var/state")
+	if d := defaultJournalDir(); d != "/var/state/consolidator/journal" { t.Errorf("got %q", d) }
+
+	t.Setenv("XDG_STATE_HOME", "")
+	home,_ := os.UserHomeDir()
+	if d := defaultJournalDir(); d != filepath.Join(home, ".local/state/consolidator/journal") {
+		t.Errorf("got %q", d)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+// The plausibility check sits between filterNewMessages and bufferTracks,
+// and keeps messages that can't be right out of the track fragments (the
+// live airspace is built before this stage, so they still show up there).
+// The rules come from a JSON file (-plausibility), with anything left out
+// taking the default:
+//
+//   {
+//     "MinAltitude": -2000, "MaxAltitude": 60000,  // feet
+//     "MaxSpeed":    1000,   // knots, as implied by an aircraft's consecutive positions
+//     "MaxRange":    600,    // km from the receiver; only for receivers listed here
+//     "Receivers":   {"ScottsValley": {"Lat":37.05, "Long":-122.01}},
+//     "Disable":     ["range"]  // any of: icao, altitude, position, speed, range
+//   }
+//
+// Rejected messages are counted, per reason, and go into the quarantine
+// log: the most recent are listed at /con/plausibility, and with
+// -quarantine=FILE they're all appended to it, one JSON object per line.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/skypies/adsb"
+	"github.com/skypies/geo"
+	"github.com/skypies/pi/vitals"
+)
+
+const plausibilityStrikes = 3               // Speed rejections in a row before we believe the new position
+const plausibilityForget = 10 * time.Minute // Aircraft we've not heard from in this long start afresh
+const quarantineRecent = 50                 // How many rejects /con/plausibility lists
+
+var plausibilityReasons = []string{"icao", "altitude", "position", "speed", "range"}
+
+// {{{ plausibilityConfig{}
+
+type plausibilityConfig struct {
+	MinAltitude  int64
+	MaxAltitude  int64
+	MaxSpeed     float64
+	MaxRange     float64
+	Receivers    map[string]geo.Latlong
+	Disable      []string
+}
+
+var defaultPlausibilityConfig = plausibilityConfig{
+	MinAltitude: -2000,
+	MaxAltitude: 60000,
+	MaxSpeed:    1000,
+	MaxRange:    600,
+}
+
+func loadPlausibilityConfig(filename string) (plausibilityConfig, error) {
+	cfg := defaultPlausibilityConfig
+	if filename == "" { return cfg, nil }
+
+	data,err := os.ReadFile(filename)
+	if err != nil { return cfg, err }
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("plausibility: %s: %v", filename, err)
+	}
+	if cfg.MinAltitude >= cfg.MaxAltitude {
+		return cfg, fmt.Errorf("plausibility: %s: MinAltitude must be below MaxAltitude", filename)
+	}
+	if cfg.MaxSpeed <= 0 || cfg.MaxRange <= 0 {
+		return cfg, fmt.Errorf("plausibility: %s: MaxSpeed and MaxRange must be positive", filename)
+	}
+	for _,d := range cfg.Disable {
+		if !contains(plausibilityReasons, d) {
+			return cfg, fmt.Errorf("plausibility: %s: can't disable %q; not one of %v", filename, d,
+				plausibilityReasons)
+		}
+	}
+	return cfg, nil
+}
+
+// }}}
+// {{{ plausibilityChecker{}
+
+// lastFix is the most recent plausible position for an aircraft.
+type lastFix struct {
+	Pos      geo.Latlong
+	Time     time.Time // GeneratedTimestampUTC
+	Seen     time.Time // Wall clock
+	Strikes  int       // Speed rejections since Pos
+}
+
+type quarantined struct {
+	Time     time.Time
+	Reason   string
+	Detail   string
+	Msg      *adsb.CompositeMsg
+}
+
+// Only checkPlausibility calls check, so the fixes need no lock; the lock
+// is for the quarantine log, which the status pages read.
+type plausibilityChecker struct {
+	cfg        plausibilityConfig
+	fixes      map[adsb.IcaoId]*lastFix
+	lastPrune  time.Time
+
+	sync.Mutex
+	recent     []quarantined // Ring buffer, of quarantineRecent
+	nRecent    int64         // Total ever added to recent
+	file       *os.File      // nil, unless -quarantine
+}
+
+var vImplausible = vitals.NewCounterVec("consolidator_implausible_messages_total",
+	"Messages kept out of the track fragments as implausible, per reason.", "reason")
+
+var plausibility *plausibilityChecker
+
+func newPlausibilityChecker(cfg plausibilityConfig, quarantineFile string) (*plausibilityChecker, error) {
+	p := &plausibilityChecker{
+		cfg: cfg,
+		fixes: map[adsb.IcaoId]*lastFix{},
+		lastPrune: time.Now(),
+		recent: make([]quarantined, quarantineRecent),
+	}
+	if quarantineFile != "" {
+		f,err := os.OpenFile(quarantineFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil { return nil, err }
+		p.file = f
+	}
+	for _,r := range plausibilityReasons {
+		vImplausible.With(r) // So they all show up, even at zero
+	}
+	return p, nil
+}
+
+func (p *plausibilityChecker)enabled(reason string) bool { return !contains(p.cfg.Disable, reason) }
+
+// }}}
+// {{{ p.check
+
+// check returns the msgs that look plausible, and quarantines the rest.
+func (p *plausibilityChecker)check(msgs []*adsb.CompositeMsg) (ok, rejected []*adsb.CompositeMsg) {
+	ok = make([]*adsb.CompositeMsg, 0, len(msgs))
+	for _,m := range msgs {
+		if reason,detail := p.verdict(m); reason != "" {
+			p.quarantine(m, reason, detail)
+			rejected = append(rejected, m)
+		} else {
+			ok = append(ok, m)
+		}
+	}
+
+	if time.Since(p.lastPrune) > time.Minute {
+		for k,f := range p.fixes {
+			if time.Since(f.Seen) > plausibilityForget { delete(p.fixes, k) }
+		}
+		p.lastPrune = time.Now()
+	}
+	return ok, rejected
+}
+
+// verdict returns why the msg is implausible, or an empty reason if it's
+// fine.
+func (p *plausibilityChecker)verdict(m *adsb.CompositeMsg) (string, string) {
+	c := &p.cfg
+
+	if p.enabled("icao") && !plausibleIcao(m.Icao24) {
+		return "icao", fmt.Sprintf("bogus address %q", m.Icao24)
+	}
+
+	if p.enabled("altitude") && (m.Altitude < c.MinAltitude || m.Altitude > c.MaxAltitude) {
+		return "altitude", fmt.Sprintf("%df, outside [%d,%d]", m.Altitude, c.MinAltitude, c.MaxAltitude)
+	}
+
+	// The has* flags don't survive the trip through pubsub; an unset position is (0,0)
+	pos := m.Position
+	if pos.IsNil() { return "", "" }
+
+	if p.enabled("position") && (pos.Lat < -90 || pos.Lat > 90 || pos.Long < -180 || pos.Long > 180) {
+		return "position", fmt.Sprintf("%s is off the map", pos)
+	}
+
+	if rx,exists := c.Receivers[m.ReceiverName]; exists && p.enabled("range") {
+		if km := pos.DistKM(rx); km > c.MaxRange {
+			return "range", fmt.Sprintf("%.0fkm from %s", km, m.ReceiverName)
+		}
+	}
+
+	if p.enabled("speed") {
+		if reason,detail := p.checkSpeed(m); reason != "" { return reason, detail }
+	}
+	return "", ""
+}
+
+// checkSpeed compares the msg's position against the aircraft's previous
+// one. If the first position we saw was the bad one, every good one after
+// it would look like a jump; so after a few rejections in a row, we give up
+// on the old position, and start again from the new one.
+func (p *plausibilityChecker)checkSpeed(m *adsb.CompositeMsg) (string, string) {
+	f,exists := p.fixes[m.Icao24]
+	if !exists {
+		p.fixes[m.Icao24] = &lastFix{Pos:m.Position, Time:m.GeneratedTimestampUTC, Seen:time.Now()}
+		return "", ""
+	}
+
+	// Receivers' clocks disagree a little, and msgs from several receivers
+	// arrive interleaved; so don't read much into very short intervals.
+	dt := m.GeneratedTimestampUTC.Sub(f.Time)
+	if dt < 0 { dt = -dt }
+	if dt < time.Second { dt = time.Second }
+	knots := m.Position.DistNM(f.Pos) / dt.Hours()
+
+	if knots > p.cfg.MaxSpeed && f.Strikes+1 < plausibilityStrikes {
+		f.Strikes++
+		return "speed", fmt.Sprintf("%.0fkts from %s, %s earlier", knots, f.Pos, dt)
+	}
+
+	f.Pos,f.Time,f.Seen,f.Strikes = m.Position, m.GeneratedTimestampUTC, time.Now(), 0
+	return "", ""
+}
+
+// Real addresses are 24 bits, in hex; all-zeroes and all-ones are what
+// garbled decodes tend to produce. Non-ICAO addresses (TIS-B, etc.) start
+// with a '~'.
+func plausibleIcao(id adsb.IcaoId) bool {
+	s := string(id)
+	if len(s) == 7 && s[0] == '~' { s = s[1:] }
+	if len(s) != 6 || s == "000000" || s == "FFFFFF" || s == "ffffff" { return false }
+	for _,c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'A' && c <= 'F') && !(c >= 'a' && c <= 'f') { return false }
+	}
+	return true
+}
+
+// }}}
+// {{{ p.quarantine
+
+func (p *plausibilityChecker)quarantine(m *adsb.CompositeMsg, reason, detail string) {
+	vImplausible.With(reason).Inc()
+	q := quarantined{Time:time.Now(), Reason:reason, Detail:detail, Msg:m}
+
+	p.Lock()
+	defer p.Unlock()
+	p.recent[p.nRecent % quarantineRecent] = q
+	p.nRecent++
+
+	if p.file != nil {
+		data,_ := json.Marshal(q)
+		if _,err := p.file.Write(append(data, '\n')); err != nil {
+			Log.Printf("quarantine: %v; no longer writing to %s\n", err, p.file.Name())
+			p.file.Close()
+			p.file = nil
+		}
+	}
+}
+
+func (p *plausibilityChecker)Close() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.file == nil { return nil }
+	err := p.file.Close()
+	p.file = nil
+	return err
+}
+
+// }}}
+// {{{ p.String
+
+func (p *plausibilityChecker)String() string {
+	str := "* Plausibility:"
+	vImplausible.Each(func(l []string, c *vitals.Counter) {
+		str += fmt.Sprintf(" %d %s,", c.Value(), l[0])
+	})
+	str = str[:len(str)-1] + " rejected\n"
+
+	p.Lock()
+	defer p.Unlock()
+	if len(p.cfg.Disable) > 0 { str += fmt.Sprintf("    disabled: %v\n", p.cfg.Disable) }
+	if p.file != nil { str += fmt.Sprintf("    quarantine log: %s\n", p.file.Name()) }
+	return str
+}
+
+// recentRejects returns the latest quarantined msgs, newest first.
+func (p *plausibilityChecker)recentRejects() []quarantined {
+	p.Lock()
+	defer p.Unlock()
+	ret := []quarantined{}
+	for i := p.nRecent-1; i >= 0 && i >= p.nRecent-quarantineRecent; i-- {
+		ret = append(ret, p.recent[i % quarantineRecent])
+	}
+	return ret
+}
+
+// }}}
+
+// {{{ plausibilityHandler
+
+func plausibilityHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	str := plausibility.String() + "\n"
+	for _,q := range plausibility.recentRejects() {
+		str += fmt.Sprintf("%s %-8s %-40s %s\n", q.Time.Format("15:04:05"), q.Reason, q.Detail, q.Msg)
+	}
+	w.Write([]byte(str))
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
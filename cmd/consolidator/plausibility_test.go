@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/skypies/adsb"
+	"github.com/skypies/geo"
+)
+
+var tPlausible = time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func plausibleMsg(icao string, secs int, lat, long float64, alt int64) *adsb.CompositeMsg {
+	return &adsb.CompositeMsg{Msg:adsb.Msg{Icao24:adsb.IcaoId(icao), Altitude:alt,
+		Position:geo.Latlong{Lat:lat, Long:long},
+		GeneratedTimestampUTC:tPlausible.Add(time.Duration(secs) * time.Second)}, ReceiverName:"TestRx"}
+}
+
+func newTestChecker(t *testing.T, cfg plausibilityConfig, quarantineFile string) *plausibilityChecker {
+	t.Helper()
+	p,err := newPlausibilityChecker(cfg, quarantineFile)
+	if err != nil { t.Fatal(err) }
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestPlausibilityConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(json string) string {
+		filename := filepath.Join(dir, "plausibility.json")
+		os.WriteFile(filename, []byte(json), 0644)
+		return filename
+	}
+
+	cfg,err := loadPlausibilityConfig(write(`{"MaxAltitude": 45000, "Disable": ["range"]}`))
+	if err != nil { t.Fatal(err) }
+	if cfg.MaxAltitude != 45000 || cfg.MinAltitude != -2000 || cfg.MaxSpeed != 1000 {
+		t.Errorf("unset fields should keep their defaults: %+v", cfg)
+	}
+
+	for _,bad := range []string{`{"MinAltitude": 70000}`, `{"MaxSpeed": -1}`, `{"Disable": ["gravity"]}`, `{`} {
+		if _,err := loadPlausibilityConfig(write(bad)); err == nil { t.Errorf("%s: expected an error", bad) }
+	}
+}
+
+func TestPlausibilityVerdicts(t *testing.T) {
+	cfg := defaultPlausibilityConfig
+	cfg.Receivers = map[string]geo.Latlong{"TestRx": {Lat:37.0, Long:-122.0}}
+	p := newTestChecker(t, cfg, "")
+
+	for _,tc := range []struct{
+		msg    *adsb.CompositeMsg
+		reason string
+	}{
+		{plausibleMsg("A81BD0", 0, 37.1, -122.1, 10000), ""},
+		{plausibleMsg("~A81BD1", 0, 37.1, -122.1, 10000), ""}, // Non-ICAO addresses are fine
+		{plausibleMsg("A81BD2", 0, 0, 0, 10000), ""},          // No position
+		{plausibleMsg("000000", 0, 37.1, -122.1, 10000), "icao"},
+		{plausibleMsg("A81BZ0", 0, 37.1, -122.1, 10000), "icao"},
+		{plausibleMsg("A81BD3", 0, 37.1, -122.1, 90000), "altitude"},
+		{plausibleMsg("A81BD4", 0, 97.1, -122.1, 10000), "position"},
+		{plausibleMsg("A81BD5", 0, 47.1, -122.1, 10000), "range"}, // ~1100km away
+	} {
+		if reason,_ := p.verdict(tc.msg); reason != tc.reason {
+			t.Errorf("%s: expected %q, got %q", tc.msg.Icao24, tc.reason, reason)
+		}
+	}
+
+	cfg.Disable = []string{"range", "altitude"}
+	p = newTestChecker(t, cfg, "")
+	if reason,_ := p.verdict(plausibleMsg("A81BD5", 0, 47.1, -122.1, 90000)); reason != "" {
+		t.Errorf("disabled checks still ran: %q", reason)
+	}
+}
+
+// A jump is rejected; but if the aircraft stays where it jumped to, we
+// come round to believing it.
+func TestPlausibilitySpeed(t *testing.T) {
+	p := newTestChecker(t, defaultPlausibilityConfig, "")
+	reasons := []string{}
+	for _,m := range []*adsb.CompositeMsg{
+		plausibleMsg("A81BD0", 0, 37.00, -122.0, 10000),
+		plausibleMsg("A81BD0", 10, 37.01, -122.0, 10000), // ~200 kts
+		plausibleMsg("A81BD0", 20, 39.00, -122.0, 10000), // ~43,000 kts
+		plausibleMsg("A81BD0", 30, 37.03, -122.0, 10000), // Back on track
+		plausibleMsg("A81BD0", 40, 40.00, -122.0, 10000), // Jumps, and stays there ...
+		plausibleMsg("A81BD0", 50, 40.01, -122.0, 10000),
+		plausibleMsg("A81BD0", 60, 40.02, -122.0, 10000), // ... so we believe it
+		plausibleMsg("A81BD0", 70, 40.03, -122.0, 10000),
+	} {
+		reason,_ := p.verdict(m)
+		reasons = append(reasons, reason)
+	}
+	expected := []string{"", "", "speed", "", "speed", "speed", "", ""}
+	for i := range expected {
+		if reasons[i] != expected[i] { t.Errorf("msg %d: expected %q, got %q", i, expected[i], reasons[i]) }
+	}
+}
+
+func TestPlausibilityQuarantine(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "quarantine.ndjson")
+	p := newTestChecker(t, defaultPlausibilityConfig, filename)
+	before := vImplausible.With("altitude").Value()
+
+	msgs := []*adsb.CompositeMsg{}
+	for i:=0; i<quarantineRecent+5; i++ {
+		msgs = append(msgs, plausibleMsg("A81BD0", i, 0, 0, 99000+int64(i)))
+	}
+	msgs = append(msgs, plausibleMsg("A81BD1", 0, 37.0, -122.0, 10000))
+	ok,rejected := p.check(msgs)
+	if len(ok) != 1 || len(rejected) != quarantineRecent+5 {
+		t.Fatalf("%d ok, %d rejected", len(ok), len(rejected))
+	}
+	if n := vImplausible.With("altitude").Value() - before; n != int64(len(rejected)) {
+		t.Errorf("counted %d rejections", n)
+	}
+
+	recent := p.recentRejects()
+	if len(recent) != quarantineRecent || recent[0].Msg.Altitude != 99000+quarantineRecent+4 {
+		t.Errorf("recent rejects should be the latest %d, newest first; got %d", quarantineRecent, len(recent))
+	}
+
+	p.Close()
+	f,err := os.Open(filename)
+	if err != nil { t.Fatal(err) }
+	defer f.Close()
+	n := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); n++ {
+		q := quarantined{}
+		if err := json.Unmarshal(scanner.Bytes(), &q); err != nil || q.Reason != "altitude" || q.Msg == nil {
+			t.Errorf("line %d: %v, %+v", n, err, q)
+		}
+	}
+	if n != len(rejected) { t.Errorf("quarantine file has %d lines, expected %d", n, len(rejected)) }
+}
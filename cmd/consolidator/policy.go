@@ -0,0 +1,250 @@
+package main
+
+// The receiver policy decides what happens to each inbound bundle, based
+// on which receiver sent it. It is loaded from a JSON file (-policy), and
+// can be reloaded without a restart by POSTing to /con/policy/reload.
+//
+//   {
+//     "Default":    "allow",            // or "deny"; applies to receivers in neither list
+//     "Allow":      ["ScottsValley"],
+//     "Deny":       ["CulverCity"],     // Deny wins over Allow
+//     "Quarantine": ["NewBox"],         // counted, but never written to the DB
+//     "RateLimit":  0,                  // max msgs/sec per receiver; 0 means no limit
+//     "RateLimits": {"NewBox": 50},     // per-receiver overrides of RateLimit
+//     "BurstSecs":  10                  // how many seconds of rate a receiver may save up
+//   }
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/skypies/pi/vitals"
+)
+
+// {{{ policyConfig{}
+
+type policyConfig struct {
+	Default     string
+	Allow       []string
+	Deny        []string
+	Quarantine  []string
+	RateLimit   float64
+	RateLimits  map[string]float64
+	BurstSecs   float64
+}
+
+// Without a -policy file, we keep on blacklisting CulverCity, to see if
+// that's the problem.
+var defaultPolicyConfig = policyConfig{Default:"allow", Deny:[]string{"CulverCity"}}
+
+func (c *policyConfig)validate() error {
+	if c.Default == "" { c.Default = "allow" }
+	if c.Default != "allow" && c.Default != "deny" {
+		return fmt.Errorf("policy: Default must be allow or deny, not %q", c.Default)
+	}
+	if c.BurstSecs <= 0 { c.BurstSecs = 10 }
+	if c.RateLimit < 0 { return fmt.Errorf("policy: RateLimit %f < 0", c.RateLimit) }
+	for r,l := range c.RateLimits {
+		if l < 0 { return fmt.Errorf("policy: RateLimits[%s] %f < 0", r, l) }
+	}
+	return nil
+}
+
+func (c *policyConfig)rateFor(receiver string) float64 {
+	if l,exists := c.RateLimits[receiver]; exists { return l }
+	return c.RateLimit
+}
+
+func contains(l []string, s string) bool {
+	for _,v := range l {
+		if v == s { return true }
+	}
+	return false
+}
+
+// }}}
+// {{{ policyVerdict
+
+type policyVerdict int
+
+const(
+	verdictAccept policyVerdict = iota
+	verdictDeny
+	verdictRateLimit
+	verdictQuarantine
+)
+
+func (v policyVerdict)String() string {
+	return []string{"accept", "deny", "ratelimit", "quarantine"}[v]
+}
+
+// }}}
+// {{{ receiverPolicy{}
+
+type receiverPolicy struct {
+	sync.Mutex
+
+	Filename    string // if empty, we use defaultPolicyConfig
+	Loaded      time.Time
+	cfg         policyConfig
+	tokens      map[string]float64   // receiver -> msgs it may send right now
+	lastRefill  map[string]time.Time
+}
+
+var vPolicyMsgs = vitals.NewCounterVec("consolidator_policy_messages_total",
+	"Messages seen, per receiver and policy verdict.", "receiver", "verdict")
+var vRateLimitLost = vitals.NewCounter("consolidator_ratelimit_lost_messages_total",
+	"Messages dropped by receiver rate limits; they're acked, so they're gone for good.")
+
+func newReceiverPolicy(filename string) (*receiverPolicy, error) {
+	p := &receiverPolicy{
+		Filename: filename,
+		tokens: map[string]float64{},
+		lastRefill: map[string]time.Time{},
+	}
+	return p, p.Reload()
+}
+
+// }}}
+// {{{ p.Reload
+
+// Reload rereads the policy file. If it can't be read, or is invalid, the
+// current policy stays in force. Rate limit state carries over.
+func (p *receiverPolicy)Reload() error {
+	cfg := defaultPolicyConfig
+	if p.Filename != "" {
+		data,err := os.ReadFile(p.Filename)
+		if err != nil { return err }
+		cfg = policyConfig{}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return fmt.Errorf("policy: %s: %v", p.Filename, err)
+		}
+	}
+	if err := cfg.validate(); err != nil { return err }
+
+	p.Lock()
+	defer p.Unlock()
+	p.cfg = cfg
+	p.Loaded = time.Now()
+	return nil
+}
+
+// }}}
+// {{{ p.Check
+
+// Check decides what to do with a bundle of nMsgs from the receiver, and
+// counts it against that verdict.
+func (p *receiverPolicy)Check(receiver string, nMsgs int) policyVerdict {
+	p.Lock()
+	defer p.Unlock()
+
+	v := p.verdict(receiver, nMsgs)
+	vPolicyMsgs.With(receiver, v.String()).Add(int64(nMsgs))
+	if v == verdictRateLimit { vRateLimitLost.Add(int64(nMsgs)) }
+	return v
+}
+
+// Caller must hold the lock.
+func (p *receiverPolicy)verdict(receiver string, nMsgs int) policyVerdict {
+	c := &p.cfg
+	if contains(c.Deny, receiver) {
+		return verdictDeny
+	} else if c.Default == "deny" && !contains(c.Allow, receiver) {
+		return verdictDeny
+	}
+
+	if rate := c.rateFor(receiver); rate > 0 {
+		// Token bucket; refill at the rate, up to BurstSecs worth. A bundle
+		// bigger than the whole bucket still gets in once the bucket is full
+		// (leaving it in debt), else it would never get in at all.
+		max := rate * c.BurstSecs
+		if last,exists := p.lastRefill[receiver]; !exists {
+			p.tokens[receiver] = max
+		} else {
+			p.tokens[receiver] += time.Since(last).Seconds() * rate
+			if p.tokens[receiver] > max { p.tokens[receiver] = max }
+		}
+		p.lastRefill[receiver] = time.Now()
+
+		if p.tokens[receiver] < float64(nMsgs) && p.tokens[receiver] < max {
+			return verdictRateLimit
+		}
+		p.tokens[receiver] -= float64(nMsgs)
+	}
+
+	if contains(c.Quarantine, receiver) {
+		return verdictQuarantine
+	}
+	return verdictAccept
+}
+
+// }}}
+// {{{ p.String
+
+func (p *receiverPolicy)String() string {
+	p.Lock()
+	defer p.Unlock()
+
+	src := p.Filename
+	if src == "" { src = "(built in)" }
+	cfg,_ := json.Marshal(p.cfg)
+	str := fmt.Sprintf("* Policy: %s, loaded %s\n    %s\n", src, p.Loaded.Round(time.Second), cfg)
+	if n := vRateLimitLost.Value(); n > 0 {
+		str += fmt.Sprintf("    LOST to rate limits: %d msgs\n", n)
+	}
+
+	counts := map[string]*[4]int64{} // receiver -> msgs, indexed by verdict
+	keys := []string{}
+	vPolicyMsgs.Each(func(l []string, c *vitals.Counter) {
+		if _,exists := counts[l[0]]; !exists {
+			counts[l[0]] = &[4]int64{}
+			keys = append(keys, l[0])
+		}
+		for v := verdictAccept; v <= verdictQuarantine; v++ {
+			if v.String() == l[1] { counts[l[0]][v] = c.Value() }
+		}
+	})
+	for _,k := range keys {
+		c := counts[k]
+		str += fmt.Sprintf("    %-15.15s: %9d accepted, %9d denied, %9d ratelimited, %9d quarantined\n",
+			k, c[verdictAccept], c[verdictDeny], c[verdictRateLimit], c[verdictQuarantine])
+	}
+	return str
+}
+
+// }}}
+
+// {{{ policy{,Reload}Handler
+
+func policyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(policy.String()))
+}
+
+func policyReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := policy.Reload(); err != nil {
+		Log.Printf("policy reload: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	Log.Printf("(policy reloaded from %s)\n", policy.Filename)
+	w.Write([]byte("OK\n" + policy.String()))
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
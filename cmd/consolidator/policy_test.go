@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testPolicy(t *testing.T, json string) *receiverPolicy {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(filename, []byte(json), 0644); err != nil { t.Fatal(err) }
+	p,err := newReceiverPolicy(filename)
+	if err != nil { t.Fatal(err) }
+	return p
+}
+
+func TestPolicyVerdicts(t *testing.T) {
+	p := testPolicy(t, `{"Default":"deny", "Allow":["A", "B", "Q"], "Deny":["B"], "Quarantine":["Q"]}`)
+	for rx,expected := range map[string]policyVerdict{
+		"A": verdictAccept,
+		"B": verdictDeny,       // Deny wins over Allow
+		"C": verdictDeny,       // Not allowed
+		"Q": verdictQuarantine,
+	} {
+		if v := p.Check(rx, 10); v != expected { t.Errorf("%s: expected %s, got %s", rx, expected, v) }
+	}
+
+	if p := testPolicy(t, `{}`); p.Check("C", 10) != verdictAccept {
+		t.Errorf("Default should default to allow")
+	}
+}
+
+func TestPolicyRateLimit(t *testing.T) {
+	p := testPolicy(t, `{"RateLimit":10, "RateLimits":{"Big":1}, "BurstSecs":1}`)
+
+	// Ten msgs/sec, with a second's burst
+	if v := p.Check("A", 10); v != verdictAccept { t.Errorf("first bundle: %s", v) }
+	if v := p.Check("A", 5); v != verdictRateLimit { t.Errorf("over the limit: %s", v) }
+
+	// A bundle that's bigger than the whole bucket gets in once it's full,
+	// and then the receiver has to wait to pay it off
+	lost := vRateLimitLost.Value()
+	if v := p.Check("Big", 50); v != verdictAccept { t.Errorf("oversized bundle, full bucket: %s", v) }
+	if v := p.Check("Big", 1); v != verdictRateLimit { t.Errorf("in debt: %s", v) }
+	if n := vRateLimitLost.Value() - lost; n != 1 { t.Errorf("expected 1 msg counted as lost, got %d", n) }
+
+	p.Lock()
+	p.lastRefill["Big"] = p.lastRefill["Big"].Add(-49 * time.Second)
+	p.Unlock()
+	if v := p.Check("Big", 50); v != verdictRateLimit { t.Errorf("still in debt: %s", v) }
+	p.Lock()
+	p.lastRefill["Big"] = p.lastRefill["Big"].Add(-2 * time.Second)
+	p.Unlock()
+	if v := p.Check("Big", 50); v != verdictAccept { t.Errorf("paid off: %s", v) }
+}
+
+func TestPolicyReload(t *testing.T) {
+	p := testPolicy(t, `{"Deny":["A"]}`)
+	if p.Check("A", 1) != verdictDeny { t.Fatalf("A should be denied") }
+
+	os.WriteFile(p.Filename, []byte(`{"Default":"maybe"}`), 0644)
+	if err := p.Reload(); err == nil { t.Errorf("bad policy should fail to load") }
+	if p.Check("A", 1) != verdictDeny { t.Errorf("bad reload replaced the policy") }
+
+	os.WriteFile(p.Filename, []byte(`{"Deny":["B"]}`), 0644)
+	if err := p.Reload(); err != nil { t.Fatal(err) }
+	if p.Check("A", 1) != verdictAccept || p.Check("B", 1) != verdictDeny { t.Errorf("reload didn't take") }
+}
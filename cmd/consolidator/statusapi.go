@@ -0,0 +1,184 @@
+package main
+
+// /con/status.json is /con/status for programs: the same vitals, as JSON.
+// With ?receiver=NAME, the receivers and metrics are scoped to just that
+// receiver (and it's a 404 if we've never heard of it).
+//
+//   $ curl -s localhost:8080/con/status.json?receiver=ScottsValley | jq .receivers
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/skypies/pi/bundlesource"
+	"github.com/skypies/pi/vitals"
+	"github.com/skypies/util/histogram"
+)
+
+// {{{ statusJSON{}
+
+type statusJSON struct {
+	Started        time.Time            `json:"started"`
+	UptimeSecs     float64              `json:"uptime_secs"`
+	LastBundleSecs float64              `json:"last_bundle_secs"`
+	Counters       map[string]int64     `json:"counters"`
+	Pipeline       map[string]float64   `json:"pipeline"`
+	Receivers      []receiverStatusJSON `json:"receivers"`
+	Workers        *workersJSON         `json:"workers,omitempty"`
+	Metrics        []vitals.Sample      `json:"metrics"`
+	Mem            *memJSON             `json:"mem,omitempty"`
+}
+
+type receiverStatusJSON struct {
+	Name         string      `json:"name"`
+	Messages     int64       `json:"messages"`
+	Bundles      int64       `json:"bundles"`
+	LastBundle   *time.Time  `json:"last_bundle,omitempty"`
+	LagSecs      float64     `json:"lag_secs"`
+	RateRecent   float64     `json:"rate_per_min"`
+	RateBaseline float64     `json:"baseline_per_min"`
+	Health       healthLevel `json:"health"`
+	HealthSince  time.Time   `json:"health_since"`
+	Reasons      []string    `json:"reasons"`
+}
+
+type workersJSON struct {
+	Writes    map[string]int64   `json:"writes"`
+	Shares    map[string]float64 `json:"fair_share_pct"` // 100 is a fair share
+	Queues    []int              `json:"queue_depths"`
+	Steals    int64              `json:"steals"`
+	Coalesced int64              `json:"coalesced"`
+	Fairness  *histogram.Stats   `json:"fairness,omitempty"`
+}
+
+type memJSON struct {
+	Goroutines       int    `json:"goroutines"`
+	ReceiveCallbacks int    `json:"receive_callbacks"`
+	HeapObjects      uint64 `json:"heap_objects"`
+	HeapAlloc        uint64 `json:"heap_alloc"`
+	StackInuse       uint64 `json:"stack_inuse"`
+}
+
+// }}}
+// {{{ receiverStatuses
+
+// receiverStatuses merges the receiver counters with their health; if
+// receiver isn't empty, it's the only one returned.
+func receiverStatuses(receiver string) []receiverStatusJSON {
+	ret := []receiverStatusJSON{}
+	for _,h := range health.snapshot() {
+		if receiver != "" && h.Name != receiver { continue }
+		r := receiverStatusJSON{
+			Name:         h.Name,
+			LagSecs:      h.Lag.Seconds(),
+			RateRecent:   h.RateRecent,
+			RateBaseline: h.RateBaseline,
+			Health:       h.Level,
+			HealthSince:  h.LevelSince,
+			Reasons:      h.Reasons,
+		}
+		if !h.LastBundle.IsZero() { // Don't conjure up series for receivers we've not heard from
+			r.LastBundle = &h.LastBundle
+			r.Messages = vReceiverMsgs.With(h.Name).Value()
+			r.Bundles = vReceiverBundles.With(h.Name).Value()
+			r.LagSecs = vReceiverLag.With(h.Name).Value()
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+// }}}
+// {{{ vitalsJSON
+
+func vitalsJSON(receiver string) statusJSON {
+	nUnsigned,nForged := bundlesource.NumRejected()
+	s := statusJSON{
+		Started:        startupTime,
+		UptimeSecs:     vUptime.Value(),
+		LastBundleSecs: vLastBundleAge.Value(),
+		Counters: map[string]int64{
+			"messages":          vMessages.Value(),
+			"dupes":             vDupes.Value(),
+			"bundles":           vBundles.Value(),
+			"writes":            vFrags.Value(),
+			"nacks":             vNacks.Value(),
+			"dead_letters":      bundlesource.NumDeadLetters(),
+			"rejected_unsigned": nUnsigned,
+			"rejected_forged":   nForged,
+			"ratelimit_lost":    vRateLimitLost.Value(),
+			"sink_retries":      vSinkRetries.Value(),
+			"sink_failures":     vSinkFailures.Value(),
+			"sink_spilled":      vSinkSpilled.Value(),
+			"sink_unspilled":    vSinkUnspilled.Value(),
+		},
+		Pipeline: map[string]float64{
+			"trackbuffer_msgs":     vTrackbufferSize.Value(),
+			"airspace_sigs":        vAirspaceSigs.Value(),
+			"airspace_aircraft":    vAirspaceAircraft.Value(),
+			"journal_segments":     vJournalSegments.Value(),
+			"journal_pending_msgs": vJournalPending.Value(),
+		},
+		Receivers: receiverStatuses(receiver),
+	}
+
+	if receiver != "" {
+		s.Metrics = vitals.Default.Snapshot(func(name string, labels map[string]string) bool {
+			return labels["receiver"] == receiver
+		})
+		return s
+	}
+
+	s.Metrics = vitals.Default.Snapshot(nil)
+
+	shares,hist := workerFairness()
+	s.Workers = &workersJSON{Writes:map[string]int64{}, Shares:shares, Queues:disp.Depths(),
+		Steals:vDispatchSteals.Value(), Coalesced:vDispatchCoalesced.Value()}
+	vWorkerWrites.Each(func(l []string, c *vitals.Counter) { s.Workers.Writes[l[0]] = c.Value() })
+	if stats,ok := hist.Stats(); ok {
+		s.Workers.Fairness = stats
+	}
+
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+	s.Mem = &memJSON{
+		Goroutines:       runtime.NumGoroutine(),
+		ReceiveCallbacks: nReceiveCallbacks,
+		HeapObjects:      ms.HeapObjects,
+		HeapAlloc:        ms.HeapAlloc,
+		StackInuse:       ms.StackInuse,
+	}
+
+	return s
+}
+
+// }}}
+// {{{ statusJSONHandler
+
+func statusJSONHandler(w http.ResponseWriter, r *http.Request) {
+	receiver := r.FormValue("receiver")
+	s := vitalsJSON(receiver)
+	if receiver != "" && len(s.Receivers) == 0 {
+		http.Error(w, "no such receiver: "+receiver, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		Log.Printf("statusJSONHandler: %v", err)
+	}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
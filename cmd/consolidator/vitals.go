@@ -0,0 +1,320 @@
+package main
+
+// The consolidator's vital statistics. These live in the vitals registry,
+// so any goroutine can update them directly; /con/status renders them for
+// humans, and /metrics for Prometheus.
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skypies/adsb"
+	"github.com/skypies/pi/airspacesink"
+	"github.com/skypies/pi/bundlesource"
+	"github.com/skypies/pi/enrich"
+	"github.com/skypies/pi/tracksink"
+	"github.com/skypies/pi/vitals"
+	"github.com/skypies/util/histogram"
+)
+
+// {{{ var()
+
+var (
+	vUptime           = vitals.NewGauge("consolidator_uptime_seconds", "Seconds since the consolidator started.")
+	vBundles          = vitals.NewCounter("consolidator_bundles_total", "Bundles received.")
+	vMessages         = vitals.NewCounter("consolidator_messages_total", "Messages received, including dupes.")
+	vDupes            = vitals.NewCounter("consolidator_dupes_total", "Messages discarded as duplicates.")
+	vFrags            = vitals.NewCounter("consolidator_fragments_written_total", "Track fragments sent to the DB.")
+	vLastBundleAge    = vitals.NewGauge("consolidator_last_bundle_age_seconds", "Seconds since the last bundle arrived.")
+	vNacks            = vitals.NewCounter("consolidator_nacks_total", "Bundles handed back to the source for redelivery.")
+	vDeadLetters      = vitals.NewCounter("consolidator_dead_letters_total", "Bundles set aside as undecodable.")
+	vRejected         = vitals.NewCounterVec("consolidator_rejected_bundles_total", "Bundles that failed authentication.", "reason")
+
+	vTrackbufferSize  = vitals.NewGauge("consolidator_trackbuffer_messages", "Messages held in the track buffer.")
+	vAirspaceSigs     = vitals.NewGauge("consolidator_airspace_signatures", "Message signatures held for deduping.")
+	vAirspaceAircraft = vitals.NewGauge("consolidator_airspace_aircraft", "Aircraft in the live airspace.")
+	vJournalSegments  = vitals.NewGauge("consolidator_journal_segments", "Journal segments on disk.")
+	vJournalPending   = vitals.NewGauge("consolidator_journal_pending_messages", "Journaled messages not yet written to the sink.")
+
+	vReceiverMsgs     = vitals.NewCounterVec("consolidator_receiver_messages_total", "Messages received, per receiver.", "receiver")
+	vReceiverBundles  = vitals.NewCounterVec("consolidator_receiver_bundles_total", "Bundles received, per receiver.", "receiver")
+	vReceiverLag      = vitals.NewGaugeVec("consolidator_receiver_lag_seconds", "Age of the newest message in the receiver's last bundle.", "receiver")
+	vWorkerWrites     = vitals.NewCounterVec("consolidator_worker_writes_total", "Fragments written, per DB worker.", "worker")
+
+	vBundleSize       = vitals.NewHistogram("consolidator_bundle_size_messages", "Messages per bundle.", vitals.CountBuckets)
+	vDBWriteMillis    = vitals.NewHistogram("consolidator_db_write_milliseconds", "Time to write a track fragment.", vitals.MillisBuckets)
+	vDBStageMillis    = vitals.NewHistogramVec("consolidator_db_write_stage_milliseconds", "Time spent in each stage of a track fragment write.", vitals.MillisBuckets, "stage")
+	vAirspaceMillis   = vitals.NewHistogramVec("consolidator_airspace_publish_milliseconds", "Time to publish an airspace snapshot, per sink.", vitals.MillisBuckets, "sink")
+	vAirspacePubs     = vitals.NewCounterVec("consolidator_airspace_publishes_total", "Airspace snapshots published, per sink and result.", "sink", "result")
+	vAirspaceStale    = vitals.NewCounterVec("consolidator_airspace_superseded_total", "Airspace snapshots dropped for a newer one before the sink got to them.", "sink")
+
+	vSinkBatches      = vitals.NewCounter("consolidator_sink_batches_total", "Batches of fragments sent to the sink.")
+	vSinkRetries      = vitals.NewCounter("consolidator_sink_retries_total", "Sink writes that were retried.")
+	vSinkFailures     = vitals.NewCounter("consolidator_sink_failures_total", "Fragments the sink failed to write, and that weren't spilled.")
+	vSinkSpilled      = vitals.NewCounter("consolidator_sink_spilled_total", "Fragments spilled to disk while the sink was failing.")
+	vSinkUnspilled    = vitals.NewCounter("consolidator_sink_unspilled_total", "Spilled fragments later written to the sink.")
+	vSinkTrips        = vitals.NewCounter("consolidator_sink_breaker_trips_total", "Times the sink's circuit breaker opened.")
+	vSinkBreakerOpen  = vitals.NewGauge("consolidator_sink_breaker_open", "1 if the sink's circuit breaker is open.")
+	vSinkSpillPending = vitals.NewGauge("consolidator_sink_spill_pending", "Fragments waiting on disk for the sink.")
+
+	vEnrichLookups    = vitals.NewCounterVec("consolidator_enrich_lookups_total", "Airframe & schedule lookups, by the provider that answered (none, for misses).", "provider", "kind")
+
+	startupTime       = time.Now()
+	lastBundleNanos   int64 // UnixNano of the last bundle; atomic
+)
+
+func init() {
+	atomic.StoreInt64(&lastBundleNanos, startupTime.UnixNano())
+
+	vUptime.SetFunc(func() float64 { return time.Since(startupTime).Seconds() })
+	vLastBundleAge.SetFunc(func() float64 {
+		return time.Since(time.Unix(0, atomic.LoadInt64(&lastBundleNanos))).Seconds()
+	})
+	vDeadLetters.SetFunc(bundlesource.NumDeadLetters)
+	vRejected.With("unsigned").SetFunc(func() int64 { n,_ := bundlesource.NumRejected(); return n })
+	vRejected.With("forged").SetFunc(func() int64 { _,n := bundlesource.NumRejected(); return n })
+}
+
+// }}}
+
+// {{{ noteBundle
+
+// noteBundle records a bundle that was accepted from a receiver.
+func noteBundle(msgs []*adsb.CompositeMsg) {
+	receiver := msgs[0].ReceiverName
+	newest := msgs[len(msgs)-1].GeneratedTimestampUTC
+
+	atomic.StoreInt64(&lastBundleNanos, time.Now().UnixNano())
+	vBundles.Inc()
+	vMessages.Add(int64(len(msgs)))
+	vBundleSize.Observe(float64(len(msgs)))
+	vReceiverBundles.With(receiver).Inc()
+	vReceiverMsgs.With(receiver).Add(int64(len(msgs)))
+	vReceiverLag.With(receiver).SetFunc(func() float64 { return time.Since(newest).Seconds() })
+	health.observe(msgs, time.Now())
+}
+
+// }}}
+// {{{ registerSinkVitals
+
+func registerSinkVitals(sink *tracksink.ReliableSink) {
+	vSinkBatches.SetFunc(func() int64 { return sink.Stats().Batches })
+	vSinkRetries.SetFunc(func() int64 { return sink.Stats().Retries })
+	vSinkFailures.SetFunc(func() int64 { return sink.Stats().Failures })
+	vSinkSpilled.SetFunc(func() int64 { return sink.Stats().Spilled })
+	vSinkUnspilled.SetFunc(func() int64 { return sink.Stats().Unspilled })
+	vSinkTrips.SetFunc(func() int64 { return sink.Stats().BreakerTrips })
+	vSinkBreakerOpen.SetFunc(func() float64 {
+		if sink.Stats().BreakerOpen { return 1 }
+		return 0
+	})
+	vSinkSpillPending.SetFunc(func() float64 { return float64(sink.Stats().SpillPending) })
+}
+
+// }}}
+// {{{ registerAirspaceVitals
+
+// registerAirspaceVitals also logs when a sink starts (or stops) failing;
+// logging every failure of a sink that publishes each second is too much.
+func registerAirspaceVitals(pub *airspacesink.Publisher) {
+	mu := sync.Mutex{}
+	failing := map[string]bool{}
+	pub.OnPublish = func(sink string, took time.Duration, err error) {
+		vAirspaceMillis.With(sink).Observe(float64(took.Milliseconds()))
+		if err != nil {
+			vAirspacePubs.With(sink, "error").Inc()
+		} else {
+			vAirspacePubs.With(sink, "ok").Inc()
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil && !failing[sink] {
+			Log.Printf("airspace %s: failing, err: %v\n", sink, err)
+		} else if err == nil && failing[sink] {
+			Log.Printf("airspace %s: recovered\n", sink)
+		}
+		failing[sink] = err != nil
+	}
+	for _,st := range pub.Stats() {
+		name := st.Sink
+		vAirspaceStale.With(name).SetFunc(func() int64 {
+			for _,st := range pub.Stats() {
+				if st.Sink == name { return st.Superseded }
+			}
+			return 0
+		})
+	}
+}
+
+// }}}
+// {{{ registerEnrichVitals
+
+func registerEnrichVitals(e *enrich.Enricher) {
+	names := []string{"none"}
+	for _,p := range e.Providers { names = append(names, p.Name()) }
+	for _,name := range names {
+		for _,kind := range []string{"airframe", "schedule"} {
+			key := name + "/" + kind
+			vEnrichLookups.With(name, kind).SetFunc(func() int64 { return e.Lookups()[key] })
+		}
+	}
+}
+
+// }}}
+// {{{ noteDBWrite
+
+// noteDBWrite records a fragment write, and the per-stage timings the
+// sink leaves in perf. Stages are: 01_start, 02_mostrecent, 03_plausible,
+// 03_notplausible, 04_trackbuild, 05_waypoints, 06_persist; batched writes
+// only have the first and last (see tracksink.ReliableSink).
+func noteDBWrite(workerId int, elapsed time.Duration, perf map[string]time.Time) {
+	vFrags.Inc()
+	vWorkerWrites.With(fmt.Sprintf("%03d", workerId)).Inc()
+	vDBWriteMillis.Observe(float64(elapsed.Milliseconds()))
+
+	if _,exists := perf["06_persist"]; !exists { return }
+
+	stage := func(name, s, e string) {
+		vDBStageMillis.With(name).Observe(float64(perf[e].Sub(perf[s]).Milliseconds()))
+	}
+	if _,exists := perf["02_mostrecent"]; !exists {
+		stage("Z06_Batch_Persist", "01_start", "06_persist")
+		return
+	}
+	stage("Z02_MostRecent", "01_start", "02_mostrecent")
+	stage("Z05_Waypoints", "04_trackbuild", "05_waypoints")
+
+	// whether we created a new DS entity
+	if _,exists := perf["03_notplausible"]; exists {
+		stage("Z04_New_Trackbuild", "02_mostrecent", "04_trackbuild")
+		stage("Z06_New_Persist", "05_waypoints", "06_persist")
+	} else {
+		stage("Z04_Extend_Trackbuild", "02_mostrecent", "04_trackbuild")
+		stage("Z06_Extend_Persist", "05_waypoints", "06_persist")
+	}
+}
+
+// }}}
+
+// {{{ memStats
+
+func memStats() string {
+	ms := runtime.MemStats{}
+
+	runtime.ReadMemStats(&ms)
+	return fmt.Sprintf("go:% 5d(% 4d cb); heap:% 13d, % 13d; stack:% 13d",
+		runtime.NumGoroutine(), nReceiveCallbacks,
+		ms.HeapObjects, ms.HeapAlloc, ms.StackInuse)
+}
+
+// }}}
+// {{{ workerFairness
+
+// workerFairness measures whether each worker did more (or less) than its
+// fair share of the writes (where fair is 100).
+func workerFairness() (map[string]float64, histogram.Histogram) {
+	workerHist := histogram.Histogram{NumBuckets:40, ValMin:0, ValMax:400}
+	writes := map[string]int64{}
+	tot := int64(0)
+	vWorkerWrites.Each(func(l []string, c *vitals.Counter) {
+		writes[l[0]] = c.Value()
+		tot += c.Value()
+	})
+
+	shares := map[string]float64{}
+	expectedFraction := 1 / float64(len(writes))
+	for id,count := range writes {
+		actualFraction := float64(count) / float64(tot)
+		shares[id] = actualFraction / expectedFraction * 100
+		workerHist.Add(histogram.ScalarVal(shares[id]))
+	}
+	return shares, workerHist
+}
+
+// }}}
+// {{{ vitalsString
+
+func vitalsString() string {
+	rcvrs := ""
+	vReceiverBundles.Each(func(l []string, c *vitals.Counter) {
+		k := l[0]
+		rcvrs += fmt.Sprintf(
+			"    %-15.15s: %9d msgs, %8d bundles, last %.1f s\n",
+			k, vReceiverMsgs.With(k).Value(), c.Value(), vReceiverLag.With(k).Value())
+	})
+
+	_,workerHist := workerFairness()
+
+	nUnsigned,nForged := bundlesource.NumRejected()
+	str := fmt.Sprintf(
+		"* %d messages (%d dupes; %d total; %d bundles; %d writes)\n"+
+			"* Uptime: %s (started %s; last bundle:%5.3fs)\n"+
+			"* Trackbuffer: %.0f elems, Airspace: (%.0f,%.0f) elems\n"+
+			"* Journal: %.0f segments, %.0f msgs pending; %d nacks, %d dead letters\n"+
+			"* Rejected: %d unsigned, %d forged\n"+
+			"* Lost: %d msgs to receiver rate limits (acked, and dropped)\n"+
+			"* Sink: %d batches, %d retries, %d failures; breaker open:%v (%d trips); %d spilled, %.0f pending\n"+
+			"\n"+
+			"* Receivers:-\n%s\n"+
+			"* Workers: %s\n"+
+			"* Worker queues: %v (%d steals, %d coalesced)\n\n"+
+			"* Metrics:-\n%s\n",
+		vMessages.Value() - vDupes.Value(), vDupes.Value(), vMessages.Value(),
+		vBundles.Value(), vFrags.Value(),
+		time.Second * time.Duration(int(time.Since(startupTime).Seconds())),
+		startupTime.Round(time.Second), vLastBundleAge.Value(),
+		vTrackbufferSize.Value(), vAirspaceSigs.Value(), vAirspaceAircraft.Value(),
+		vJournalSegments.Value(), vJournalPending.Value(), vNacks.Value(),
+		bundlesource.NumDeadLetters(),
+		nUnsigned, nForged,
+		vRateLimitLost.Value(),
+		vSinkBatches.Value(), vSinkRetries.Value(), vSinkFailures.Value(), vSinkBreakerOpen.Value() > 0,
+		vSinkTrips.Value(), vSinkSpilled.Value(), vSinkSpillPending.Value(),
+		rcvrs,
+		workerHist,
+		disp.Depths(), vDispatchSteals.Value(), vDispatchCoalesced.Value(),
+		vitals.Default.String())
+
+	return str
+}
+
+// }}}
+// {{{ logVitals
+
+// logVitals periodically logs the vital stats, until ctx is cancelled.
+func logVitals(ctx context.Context) {
+	tLastDump := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			Log.Printf(" -- logVitals clean exit\n")
+			return
+		case <-time.After(5 * time.Second):
+		}
+
+		Log.Printf("* memstats  %s\n", memStats())
+		Log.Printf("* Trackbuffer: %.0f msgs, Airspace: %.0f sigs, %.0f aircraft\n",
+			vTrackbufferSize.Value(), vAirspaceSigs.Value(), vAirspaceAircraft.Value())
+
+		if time.Since(tLastDump) > time.Minute * 5 {
+			Log.Printf("vital dump:-\n%s", vitalsString())
+			tLastDump = time.Now()
+		}
+	}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
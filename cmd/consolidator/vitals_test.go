@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/pi/tracksink"
+)
+
+// stageSink reports the same perf stages as the datastore sink.
+type stageSink struct{}
+
+func (stageSink)AddTrackFragment(frag *fdb.TrackFragment, perf map[string]time.Time) error {
+	for _,stage := range []string{"01_start", "02_mostrecent", "03_plausible", "04_trackbuild",
+		"05_waypoints", "06_persist"} {
+		perf[stage] = time.Now()
+	}
+	return nil
+}
+func (stageSink)Close() error { return nil }
+
+func stageCount(name string) int64 {
+	n,_ := vDBStageMillis.With(name).Count()
+	return n
+}
+
+// Writes through a ReliableSink, batched or not, end up in the per-stage
+// histograms.
+func TestDBWriteStages(t *testing.T) {
+	for _,tc := range []struct{
+		name  string
+		inner tracksink.TrackSink
+		stage string
+	}{
+		{"batched", tracksink.NewMemorySink(), "Z06_Batch_Persist"},
+		{"unbatched", stageSink{}, "Z02_MostRecent"},
+	} {
+		sink,err := tracksink.NewReliableSink(tc.inner, tracksink.ReliableOptions{BatchDelay:time.Millisecond})
+		if err != nil { t.Fatal(err) }
+
+		before := stageCount(tc.stage)
+		if err := flushTrackToSink(0, sink, testBundle("A00001", "A00001")); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if after := stageCount(tc.stage); after != before+1 {
+			t.Errorf("%s: %s has %d observations, wanted %d", tc.name, tc.stage, after, before+1)
+		}
+		sink.Close()
+	}
+}
@@ -1,7 +1,7 @@
 // go run ./mockdump1090.go replay.go -p 30003 -delay=10s         (will listen on localhost:30003)
 // go run ./mockdump1090.go replay.go -p 39003 -delay=10s -mlat   (generate MLAT messages)
 
-// go run ./skypi.go -topic="" -v=1
+// go run github.com/skypies/pi/cmd/skypi -topic="" -v=1
 
 package main
 
@@ -68,7 +68,7 @@ outerLoop:
 			GroundSpeed: 300,
 			Track: 315,
 			VerticalRate: 64,
-			Position: geo.Latlong{36.0, -122.0},
+			Position: geo.Latlong{Lat:36.0, Long:-122.0},
 			GeneratedTimestampUTC: time.Now().UTC(),
 			LoggedTimestampUTC: time.Now().UTC(),
 		}
@@ -2,7 +2,7 @@ package main
 
 // go run ./mockdump1090.go replay.go -replay=30003.out,31009.out  (replay, rewriting timestamps)
 
-// go run ./skypi.go -topic="" -v=1 -hosts=localhost:30003,localhost:31009
+// go run github.com/skypies/pi/cmd/skypi -topic="" -v=1 -hosts=localhost:30003,localhost:31009
 
 import (
 	"bufio"
@@ -38,7 +38,7 @@ func file2msgs(filename string) []adsb.Msg {
 
 		msg := adsb.Msg{}
 		if err := msg.FromSBS1(scanner.Text()); err != nil {
-			log.Fatal("Bad parse '%s'\n%v\n", scanner.Text(), err)
+			log.Fatalf("Bad parse '%s'\n%v\n", scanner.Text(), err)
 		}
 
 		// We drop the useless "111" fields, so this doesn't work. Maybe add them in, for ToSBS1 ?
@@ -0,0 +1,124 @@
+package main
+
+// regimport builds a local index of aircraft registrations (see package
+// registry), for the consolidator to enrich from (-enrich=registry:FILE).
+
+// From the FAA releasable database (unzip it first; we want MASTER.txt and
+// ACFTREF.txt), and a generic CSV of icao24,registration[,type] - or the
+// OpenSky aircraft database, which has a header. Later sources win:
+//   $ go run . -faa=/tmp/ReleasableAircraft -csv=/tmp/aircraftDatabase.csv -out=/tmp/registry.db
+
+// To look something up:
+//   $ go run . -out=/tmp/registry.db -lookup=A835AF
+
+import(
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/skypies/pi/registry"
+)
+
+var Log *log.Logger
+
+var(
+	fFAADir   string
+	fCSVFiles string
+	fOutFile  string
+	fLookup   string
+)
+
+func init() {
+	flag.StringVar(&fFAADir, "faa", "", "directory holding the FAA's MASTER.txt and ACFTREF.txt")
+	flag.StringVar(&fCSVFiles, "csv", "", "comma-separated CSV files of icao24,registration[,type] (or with a header)")
+	flag.StringVar(&fOutFile, "out", "registry.db", "the index to build (or look things up in)")
+	flag.StringVar(&fLookup, "lookup", "", "comma-separated icao24s to look up, instead of building")
+	flag.Parse()
+
+	Log = log.New(os.Stdout,"", log.Ldate|log.Ltime)
+}
+
+// {{{ readFAA
+
+func readFAA(dir string, put func(registry.Record) error) error {
+	master,err := os.Open(filepath.Join(dir, "MASTER.txt"))
+	if err != nil { return err }
+	defer master.Close()
+
+	acftref,err := os.Open(filepath.Join(dir, "ACFTREF.txt"))
+	if err != nil {
+		Log.Printf("(no ACFTREF.txt, so no manufacturers or models: %v)\n", err)
+		n,skipped,err := registry.ReadFAA(master, nil, put)
+		Log.Printf("%s: %d records (%d skipped)\n", dir, n, skipped)
+		return err
+	}
+	defer acftref.Close()
+
+	n,skipped,err := registry.ReadFAA(master, acftref, put)
+	Log.Printf("%s: %d records (%d skipped)\n", dir, n, skipped)
+	return err
+}
+
+// }}}
+// {{{ readCSV
+
+func readCSV(filename string, put func(registry.Record) error) error {
+	f,err := os.Open(filename)
+	if err != nil { return err }
+	defer f.Close()
+
+	n,skipped,err := registry.ReadHexCSV(f, filepath.Base(filename), put)
+	Log.Printf("%s: %d records (%d skipped)\n", filename, n, skipped)
+	return err
+}
+
+// }}}
+// {{{ lookup
+
+func lookup(filename string, icaos []string) {
+	ix,err := registry.Open(filename)
+	if err != nil { Log.Fatal(err) }
+	defer ix.Close()
+
+	for _,s := range icaos {
+		icao,ok := registry.NormalizeHex(s)
+		if !ok { fmt.Printf("%s: not an icao24\n", s); continue }
+		rec,err := ix.Get(icao)
+		if err != nil { Log.Fatal(err) }
+		if rec == nil { fmt.Printf("%s: not found\n", icao); continue }
+		js,_ := json.MarshalIndent(rec, "", "  ")
+		fmt.Printf("%s\n", js)
+	}
+}
+
+// }}}
+
+func main() {
+	if fLookup != "" {
+		lookup(fOutFile, strings.Split(fLookup, ","))
+		return
+	}
+
+	sources := []string{}
+	if fFAADir != "" { sources = append(sources, fFAADir) }
+	if fCSVFiles != "" { sources = append(sources, strings.Split(fCSVFiles, ",")...) }
+	if len(sources) == 0 { Log.Fatal("nothing to import; use -faa and/or -csv") }
+
+	n,err := registry.Build(fOutFile, sources, func(put func(registry.Record) error) error {
+		if fFAADir != "" {
+			if err := readFAA(fFAADir, put); err != nil { return err }
+		}
+		for _,filename := range strings.Split(fCSVFiles, ",") {
+			if filename == "" { continue }
+			if err := readCSV(filename, put); err != nil { return err }
+		}
+		return nil
+	})
+	if err != nil { Log.Fatal(err) }
+
+	Log.Printf("%s: %d aircraft\n", fOutFile, n)
+}
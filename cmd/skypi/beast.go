@@ -0,0 +1,426 @@
+package main
+
+// Beast is dump1090's binary output format (port 30005, and what most
+// feeders push): raw Mode S frames, each wrapped as
+//
+//   0x1a TYPE TIMESTAMP[6] SIGNAL[1] MESSAGE[2|7|14]
+//
+// where TYPE is '1' (Mode A/C), '2' (Mode S short) or '3' (Mode S long),
+// and any 0x1a in the rest of the frame is doubled. mlat-client sends its
+// results in the same format, with a timestamp of "\xff\x00MLAT".
+//
+// We decode the ADS-B extended squitters (DF17, and DF18 from non-
+// transponders and mlat-client) into the SBS lines dump1090 would have
+// written for them, so they go through the same path as SBS input:
+// identification (MSG,1), airborne position (MSG,3) and ground velocity
+// (MSG,4). Everything else (Mode A/C, surveillance replies, surface
+// positions, airspeed) is skipped, as the SBS output carries little of
+// use from them.
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/skypies/adsb"
+)
+
+const beastEscape = 0x1a
+const cprMaxPairAge = 10 * time.Second // Even & odd positions further apart than this don't pair up
+const cprSweepInterval = time.Minute   // How often we forget about aircraft we've stopped hearing
+
+var beastMLATTimestamp = []byte{0xff, 0x00, 'M', 'L', 'A', 'T'}
+
+// errBadFrame wraps the errors for frames we couldn't make sense of; the
+// stream is still OK, and we carry on with the next frame.
+var errBadFrame = errors.New("bad Beast frame")
+
+// {{{ beastDecoder{}
+
+// beastDecoder reads Beast frames from a single connection. It remembers
+// each aircraft's most recent even & odd positions, as it takes one of
+// each to work out where the aircraft is.
+type beastDecoder struct {
+	r         *bufio.Reader
+	escaped   bool // The escape byte starting the next frame has already been read
+	cpr       map[adsb.IcaoId]*cprPair
+	lastSweep time.Time
+}
+
+func newBeastDecoder(r *bufio.Reader) *beastDecoder {
+	return &beastDecoder{r:r, cpr:map[adsb.IcaoId]*cprPair{}, lastSweep:time.Now()}
+}
+
+// }}}
+// {{{ d.readLine
+
+// readLine returns the next extended squitter, as an SBS line. If a
+// frame is garbled, it returns the frame (in hex) and an errBadFrame; any
+// other error means the stream has failed.
+func (d *beastDecoder)readLine() (string, error) {
+	for {
+		typ,frame,err := d.readFrame()
+		if err != nil {
+			if errors.Is(err, errBadFrame) { return hex.EncodeToString(frame), err }
+			return "", err
+		}
+		if typ != '3' { continue } // Extended squitters are all long frames
+
+		line,err := d.decode(frame)
+		if err != nil {
+			return hex.EncodeToString(frame), err
+		} else if line != "" {
+			return line, nil
+		}
+	}
+}
+
+// }}}
+// {{{ d.readFrame
+
+// readFrame returns the type byte, and the rest of the frame (timestamp,
+// signal & message), unescaped.
+func (d *beastDecoder)readFrame() (byte, []byte, error) {
+	if !d.escaped {
+		b,err := d.r.ReadByte()
+		if err != nil { return 0, nil, err }
+		if b != beastEscape {
+			d.resync()
+			return 0, []byte{b}, fmt.Errorf("%w: expected 0x1a, got 0x%02x", errBadFrame, b)
+		}
+	}
+	d.escaped = false
+
+	typ,err := d.r.ReadByte()
+	if err != nil { return 0, nil, err }
+
+	n := 7 // timestamp & signal
+	switch typ {
+	case '1': n += 2
+	case '2': n += 7
+	case '3': n += 14
+	default:
+		d.resync()
+		return 0, []byte{typ}, fmt.Errorf("%w: unknown frame type 0x%02x", errBadFrame, typ)
+	}
+
+	frame := make([]byte, 0, n)
+	for len(frame) < n {
+		b,err := d.r.ReadByte()
+		if err != nil { return 0, nil, err }
+		if b == beastEscape {
+			next,err := d.r.Peek(1)
+			if err != nil { return 0, nil, err }
+			if next[0] != beastEscape {
+				// A lone escape byte starts the next frame; this one was cut short
+				d.escaped = true
+				return 0, frame, fmt.Errorf("%w: truncated (%d of %d bytes)", errBadFrame, len(frame), n)
+			}
+			d.r.ReadByte()
+		}
+		frame = append(frame, b)
+	}
+
+	return typ, frame, nil
+}
+
+// resync skips ahead to the start of the next frame.
+func (d *beastDecoder)resync() {
+	if _,err := d.r.ReadBytes(beastEscape); err == nil {
+		d.escaped = true
+	}
+}
+
+// }}}
+// {{{ d.decode
+
+// decode turns a long frame into an SBS line. It returns an empty line
+// for frames that are fine, but that we don't have a use for.
+func (d *beastDecoder)decode(frame []byte) (string, error) {
+	ts,msg := frame[:6], frame[7:]
+	df := msg[0] >> 3
+	if df != 17 && df != 18 { return "", nil }
+
+	if crc,parity := modesChecksum(msg), uint32(msg[11])<<16|uint32(msg[12])<<8|uint32(msg[13]); crc != parity {
+		return "", fmt.Errorf("%w: DF%d checksum mismatch (%06x != %06x)", errBadFrame, df, crc, parity)
+	}
+
+	sbs := sbsLine{Type:"MSG", Icao24:adsb.IcaoId(fmt.Sprintf("%02X%02X%02X", msg[1], msg[2], msg[3]))}
+	if string(ts) == string(beastMLATTimestamp) {
+		sbs.Type = "MLAT"
+	}
+
+	me := msg[4:11]
+	tc := me[0] >> 3
+	if df == 18 {
+		// Only CF=0 (non-transponder ADS-B) and CF=2 (fine TIS-B, as sent by
+		// mlat-client) use this layout; for TIS-B, IMF means the address
+		// isn't an ICAO one, so mask it the way mlat-client's SBS output does.
+		switch cf := msg[0] & 0x07; {
+		case cf == 0:
+		case cf == 2:
+			if (tc >= 9 && tc <= 18 && me[0]&0x01 != 0) || (tc == 19 && me[1]&0x80 != 0) {
+				sbs.Icao24 = "~"+sbs.Icao24
+			}
+		default:
+			return "", nil
+		}
+	}
+
+	switch {
+	case tc >= 1 && tc <= 4:
+		callsign,err := decodeCallsign(me)
+		if err != nil { return "", fmt.Errorf("%w: %v", errBadFrame, err) }
+		sbs.SubType,sbs.Callsign = 1, callsign
+
+	case tc >= 9 && tc <= 18:
+		sbs.SubType = 3
+		if alt,ok := decodeAltitude(me); ok { sbs.Altitude = fmt.Sprintf("%d", alt) }
+		if lat,long,ok := d.position(sbs.Icao24, me); ok {
+			sbs.Lat,sbs.Long = fmt.Sprintf("%.5f", lat), fmt.Sprintf("%.5f", long)
+		}
+		if sbs.Altitude == "" && sbs.Lat == "" { return "", nil }
+
+	case tc == 19:
+		gs,track,vr,ok := decodeVelocity(me)
+		if !ok { return "", nil }
+		sbs.SubType = 4
+		sbs.GroundSpeed,sbs.Track = fmt.Sprintf("%d", gs), fmt.Sprintf("%d", track)
+		if vr != nil { sbs.VerticalRate = fmt.Sprintf("%d", *vr) }
+
+	default:
+		return "", nil
+	}
+
+	return sbs.String(time.Now()), nil
+}
+
+// }}}
+// {{{ d.position
+
+// A compact position report, as received.
+type cprFrame struct {
+	Lat,Long int
+	T        time.Time
+}
+
+type cprPair struct {
+	Even,Odd *cprFrame
+}
+
+// position remembers this compact position, and works out the aircraft's
+// actual position if we've recently had one of the other sort from it.
+func (d *beastDecoder)position(icao adsb.IcaoId, me []byte) (float64, float64, bool) {
+	now := time.Now()
+	if now.Sub(d.lastSweep) > cprSweepInterval {
+		for id,p := range d.cpr {
+			if (p.Even == nil || now.Sub(p.Even.T) > cprMaxPairAge) &&
+				(p.Odd == nil || now.Sub(p.Odd.T) > cprMaxPairAge) {
+				delete(d.cpr, id)
+			}
+		}
+		d.lastSweep = now
+	}
+
+	odd := me[2]&0x04 != 0
+	f := &cprFrame{
+		Lat:  int(me[2]&0x03)<<15 | int(me[3])<<7 | int(me[4])>>1,
+		Long: int(me[4]&0x01)<<16 | int(me[5])<<8 | int(me[6]),
+		T:    now,
+	}
+
+	p := d.cpr[icao]
+	if p == nil {
+		p = &cprPair{}
+		d.cpr[icao] = p
+	}
+	if odd { p.Odd = f } else { p.Even = f }
+
+	if p.Even == nil || p.Odd == nil { return 0, 0, false }
+	if gap := p.Even.T.Sub(p.Odd.T); gap > cprMaxPairAge || gap < -cprMaxPairAge { return 0, 0, false }
+
+	return decodeCPR(*p.Even, *p.Odd, odd)
+}
+
+// }}}
+// {{{ decodeCPR
+
+// decodeCPR is the global (unambiguous) decoding of an even/odd pair of
+// airborne positions; the position is as of the most recent one.
+func decodeCPR(even, odd cprFrame, oddIsLatest bool) (float64, float64, bool) {
+	const nb = 131072.0 // 2^17
+	latE,latO := float64(even.Lat)/nb, float64(odd.Lat)/nb
+	longE,longO := float64(even.Long)/nb, float64(odd.Long)/nb
+
+	j := math.Floor(59*latE - 60*latO + 0.5)
+	lat0 := 360.0/60 * (cprMod(j, 60) + latE)
+	lat1 := 360.0/59 * (cprMod(j, 59) + latO)
+	if lat0 >= 270 { lat0 -= 360 }
+	if lat1 >= 270 { lat1 -= 360 }
+	if lat0 < -90 || lat0 > 90 || lat1 < -90 || lat1 > 90 { return 0, 0, false }
+
+	// Both positions need to be in the same longitude zone
+	if cprNL(lat0) != cprNL(lat1) { return 0, 0, false }
+
+	lat,nl,long := lat0, cprNL(lat0), longE
+	ni := math.Max(float64(nl), 1)
+	if oddIsLatest {
+		lat,nl,long = lat1, cprNL(lat1), longO
+		ni = math.Max(float64(nl-1), 1)
+	}
+
+	m := math.Floor(longE*float64(nl-1) - longO*float64(nl) + 0.5)
+	lon := 360.0/ni * (cprMod(m, ni) + long)
+	if lon >= 180 { lon -= 360 }
+
+	return lat, lon, true
+}
+
+// cprNL is the number of longitude zones at this latitude.
+func cprNL(lat float64) int {
+	lat = math.Abs(lat)
+	switch {
+	case lat == 0:  return 59
+	case lat == 87: return 2
+	case lat > 87:  return 1
+	}
+
+	const nz = 15
+	a := 1 - math.Cos(math.Pi/(2*nz))
+	b := math.Pow(math.Cos(math.Pi/180*lat), 2)
+	return int(math.Floor(2*math.Pi / math.Acos(1 - a/b)))
+}
+
+// cprMod is a modulus that's always positive.
+func cprMod(x, n float64) float64 {
+	return x - n*math.Floor(x/n)
+}
+
+// }}}
+// {{{ decodeCallsign, decodeAltitude, decodeVelocity
+
+const callsignChars = "#ABCDEFGHIJKLMNOPQRSTUVWXYZ##### ###############0123456789######"
+
+func decodeCallsign(me []byte) (string, error) {
+	bits := uint64(0)
+	for _,b := range me[1:] { bits = bits<<8 | uint64(b) }
+
+	callsign := make([]byte, 8)
+	for i := range callsign {
+		callsign[i] = callsignChars[(bits >> uint(42-6*i)) & 0x3f]
+	}
+	if strings.Contains(string(callsign), "#") {
+		return "", fmt.Errorf("callsign %q has invalid characters", callsign)
+	}
+	return strings.TrimSpace(string(callsign)), nil
+}
+
+// decodeAltitude returns the barometric altitude from an airborne
+// position, if it's in 25ft increments (the Gillham coded 100ft ones are
+// rare these days, so we don't bother).
+func decodeAltitude(me []byte) (int64, bool) {
+	alt := int64(me[1])<<4 | int64(me[2])>>4
+	if alt == 0 || alt&0x010 == 0 { return 0, false }
+
+	n := (alt&0xfe0)>>1 | alt&0x00f
+	return n*25 - 1000, true
+}
+
+// decodeVelocity returns the ground speed (knots), track (degrees) and
+// vertical rate (ft/min, if known) from a velocity message. Airspeed &
+// heading (subtypes 3 & 4) aren't what the SBS output carries, so we skip
+// those.
+func decodeVelocity(me []byte) (int64, int64, *int64, bool) {
+	st := me[0] & 0x07
+	if st != 1 && st != 2 { return 0, 0, nil, false }
+
+	vew := int64(me[1]&0x03)<<8 | int64(me[2])
+	vns := int64(me[3]&0x7f)<<3 | int64(me[4])>>5
+	if vew == 0 || vns == 0 { return 0, 0, nil, false }
+
+	scale := int64(1)
+	if st == 2 { scale = 4 } // Supersonic
+	vx,vy := float64((vew-1)*scale), float64((vns-1)*scale)
+	if me[1]&0x04 != 0 { vx = -vx }
+	if me[3]&0x80 != 0 { vy = -vy }
+
+	gs := int64(math.Round(math.Hypot(vx, vy)))
+	track := int64(math.Round(cprMod(math.Atan2(vx, vy)*180/math.Pi, 360))) % 360
+
+	var vr *int64
+	if v := int64(me[4]&0x07)<<6 | int64(me[5])>>2; v != 0 {
+		rate := (v-1) * 64
+		if me[4]&0x08 != 0 { rate = -rate }
+		vr = &rate
+	}
+
+	return gs, track, vr, true
+}
+
+// }}}
+// {{{ modesChecksum
+
+// modesChecksum is the Mode S CRC over all but the last 3 bytes (the
+// parity field) of the message. For extended squitters, it should match
+// the parity field.
+func modesChecksum(msg []byte) uint32 {
+	const poly = 0x1fff409
+
+	crc := uint32(0)
+	for _,b := range msg[:len(msg)-3] {
+		crc ^= uint32(b) << 16
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if crc & 0x1000000 != 0 { crc ^= poly }
+		}
+	}
+	return crc & 0xffffff
+}
+
+// }}}
+// {{{ sbsLine{}
+
+// sbsLine is the subset of an SBS line that we can fill in from an
+// extended squitter; empty fields are left blank, as dump1090 does.
+type sbsLine struct {
+	Type         string
+	SubType      int
+	Icao24       adsb.IcaoId
+	Callsign     string
+	Altitude     string
+	GroundSpeed  string
+	Track        string
+	Lat,Long     string
+	VerticalRate string
+}
+
+// String renders the line, timestamped in dump1090's local time (see
+// adsb.TimeLocation), so it parses back to the right time.
+func (s sbsLine)String(t time.Time) string {
+	if loc,err := time.LoadLocation(adsb.TimeLocation); err == nil {
+		t = t.In(loc)
+	}
+	date,tod := t.Format("2006/01/02"), t.Format("15:04:05.000")
+
+	r := []string{
+		s.Type, fmt.Sprintf("%d", s.SubType), "1", "1", string(s.Icao24), "1",
+		date, tod, date, tod,
+		s.Callsign, s.Altitude, s.GroundSpeed, s.Track, s.Lat, s.Long, s.VerticalRate,
+		"", "", "", "", "",
+	}
+	return strings.Join(r, ",") + "\n"
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/skypies/adsb"
+)
+
+// Example messages from "The 1090MHz Riddle" (mode-s.org)
+const (
+	beastIdent    = "8D4840D6202CC371C32CE0576098" // KLM1023
+	beastPosEven  = "8D40621D58C382D690C8AC2863A7" // 38000ft; with the odd one, 52.2572,3.91937
+	beastPosOdd   = "8D40621D58C386435CC412692AD6"
+	beastVelocity = "8D485020994409940838175B284F" // 159kt, track 182.88, -832ft/min
+	beastShort    = "5D4840D6ABCDEF"               // DF11 all-call reply; skipped
+)
+
+// The timestamp & signal have escape bytes in them, so every frame
+// exercises the unescaping.
+var beastTestTimestamp = []byte{0x00, 0x1a, 0x02, 0x03, 0x04, 0x05}
+
+func beastFrame(t *testing.T, typ byte, ts []byte, msgHex string) []byte {
+	t.Helper()
+	msg,err := hex.DecodeString(msgHex)
+	if err != nil { t.Fatal(err) }
+
+	frame := []byte{beastEscape, typ}
+	for _,b := range append(append(append([]byte{}, ts...), 0x1a), msg...) {
+		frame = append(frame, b)
+		if b == beastEscape { frame = append(frame, b) }
+	}
+	return frame
+}
+
+// readAll decodes the stream, returning the messages, and the number of
+// bad frames.
+func readAll(t *testing.T, stream []byte) ([]adsb.Msg, int) {
+	t.Helper()
+	d := newBeastDecoder(bufio.NewReader(bytes.NewReader(stream)))
+	msgs,nBad := []adsb.Msg{}, 0
+	for {
+		line,err := d.readLine()
+		if errors.Is(err, errBadFrame) {
+			nBad++
+			continue
+		} else if err == io.EOF {
+			return msgs, nBad
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		msg := adsb.Msg{}
+		if err := msg.FromSBS1(line); err != nil { t.Fatalf("%q: %v", line, err) }
+		msgs = append(msgs, msg)
+	}
+}
+
+func TestBeastDecode(t *testing.T) {
+	stream := []byte{}
+	for _,f := range [][]byte{
+		beastFrame(t, '3', beastTestTimestamp, beastIdent),
+		beastFrame(t, '1', beastTestTimestamp, "1234"), // Mode A/C; skipped
+		beastFrame(t, '2', beastTestTimestamp, beastShort),
+		beastFrame(t, '3', beastTestTimestamp, beastPosOdd),
+		beastFrame(t, '3', beastTestTimestamp, beastPosEven),
+		beastFrame(t, '3', beastTestTimestamp, beastVelocity),
+	} {
+		stream = append(stream, f...)
+	}
+
+	msgs,nBad := readAll(t, stream)
+	if nBad != 0 { t.Errorf("%d bad frames, wanted none", nBad) }
+	if len(msgs) != 4 { t.Fatalf("got %d msgs, wanted 4: %v", len(msgs), msgs) }
+
+	if m := msgs[0]; m.Type != "MSG" || m.SubType != 1 || m.Icao24 != "4840D6" || m.Callsign != "KLM1023" {
+		t.Errorf("ident: got %s %q", m, m.Callsign)
+	}
+
+	// The first position can't be decoded on its own; the second can
+	if m := msgs[1]; m.SubType != 3 || m.Icao24 != "40621D" || m.Altitude != 38000 || m.HasPosition() {
+		t.Errorf("first position: got %s, alt %d", m, m.Altitude)
+	}
+	if m := msgs[2]; m.SubType != 3 || m.Altitude != 38000 || !m.HasPosition() ||
+		math.Abs(m.Position.Lat - 52.25720) > 1e-4 || math.Abs(m.Position.Long - 3.91937) > 1e-4 {
+		t.Errorf("second position: got %s, alt %d", m, m.Altitude)
+	}
+
+	if m := msgs[3]; m.SubType != 4 || m.Icao24 != "485020" || m.GroundSpeed != 159 || m.Track != 183 ||
+		m.VerticalRate != -832 {
+		t.Errorf("velocity: got %s, gs %d, track %d, vr %d", m, m.GroundSpeed, m.Track, m.VerticalRate)
+	}
+}
+
+// Garbled frames are reported, and the decoder picks up again at the next
+// frame.
+func TestBeastBadFrames(t *testing.T) {
+	good := beastFrame(t, '3', beastTestTimestamp, beastIdent)
+	badCRC := beastFrame(t, '3', beastTestTimestamp, "8D4840D6202CC371C32CE0576099")
+	truncated := beastFrame(t, '3', beastTestTimestamp, beastIdent)[:12]
+
+	stream := []byte{'x', 'y'}     // Not a frame at all
+	stream = append(stream, good...)
+	stream = append(stream, badCRC...)
+	stream = append(stream, truncated...)
+	stream = append(stream, good...)
+	stream = append(stream, beastEscape, '9') // Unknown frame type
+	stream = append(stream, good...)
+
+	msgs,nBad := readAll(t, stream)
+	if len(msgs) != 3 { t.Errorf("got %d msgs, wanted 3", len(msgs)) }
+	if nBad != 4 { t.Errorf("got %d bad frames, wanted 4", nBad) }
+}
+
+func TestBeastMLAT(t *testing.T) {
+	msgs,_ := readAll(t, beastFrame(t, '3', beastMLATTimestamp, beastVelocity))
+	if len(msgs) != 1 || !msgs[0].IsMLAT() {
+		t.Errorf("wanted one MLAT msg, got %v", msgs)
+	}
+}
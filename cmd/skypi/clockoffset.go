@@ -0,0 +1,122 @@
+package main
+
+// dump1090 writes out timestamps in local time, without a timezone. If
+// we parse them with the wrong timezone, every message looks hours old
+// (or from the future). Rather than make people set -timeloc by hand,
+// we watch how far the message timestamps are from our own wall clock,
+// and infer the offset.
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const clockSampleWindow = 50               // Estimate offsets from this many recent messages
+const clockMinSamples = 10                 // Don't guess until we have at least this many
+const clockTZGranularity = 15 * time.Minute // All timezones are a multiple of this from UTC
+const clockMaxSkew = 30 * time.Minute      // After correction, messages this far out are dropped
+
+// {{{ clockOffset{}
+
+// clockOffset estimates how far an input's timestamps are from our wall
+// clock. The offset is split into two parts: the timezone part (a whole
+// multiple of 15m, due to dump1090 running with a different TZ to the one
+// we parsed with), which we correct for; and the residual drift (due to
+// clocks being out of sync, and network latency), which we just report.
+type clockOffset struct {
+	sync.Mutex
+
+	TZOffset      time.Duration // Added to every message timestamp (zero, unless -autotz)
+	Drift         time.Duration // Median age of messages, after TZ correction
+	NumSkewed     int64         // Messages dropped, as they were too far out even after correction
+	LastChange    time.Time     // When TZOffset last changed
+
+	samples       []time.Duration
+	pos           int
+	sinceEstimate int
+}
+
+// }}}
+// {{{ c.observe
+
+// observe records the offset of a message's timestamp from our clock
+// (which reads now), and returns the amount the message should be shifted by. If the
+// message is still badly skewed after correcting for the timezone,
+// ok is false and the message should be dropped.
+func (c *clockOffset)observe(msgTime, now time.Time) (correction time.Duration, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	offset := now.Sub(msgTime)
+
+	if len(c.samples) < clockSampleWindow {
+		c.samples = append(c.samples, offset)
+	} else {
+		c.samples[c.pos] = offset
+		c.pos = (c.pos + 1) % clockSampleWindow
+	}
+
+	// Sorting on every message is wasteful; re-estimate every so often.
+	c.sinceEstimate++
+	if len(c.samples) >= clockMinSamples && c.sinceEstimate >= clockMinSamples {
+		c.estimate(now)
+		c.sinceEstimate = 0
+	}
+
+	corrected := offset - c.TZOffset
+	if corrected > clockMaxSkew || corrected < -1 * clockMaxSkew {
+		c.NumSkewed++
+		return c.TZOffset, false
+	}
+
+	return c.TZOffset, true
+}
+
+// }}}
+// {{{ c.estimate
+
+// estimate takes the median of the recent samples (which shrugs off
+// the occasional batch of stale data), and splits it into TZ and drift.
+// Caller must hold the lock.
+func (c *clockOffset)estimate(now time.Time) {
+	sorted := append([]time.Duration{}, c.samples...)
+	sort.Slice(sorted, func(i,j int) bool { return sorted[i] < sorted[j] })
+	median := sorted[len(sorted)/2]
+
+	tz := time.Duration(0)
+	if fAutoTimezone {
+		tz = median.Round(clockTZGranularity)
+	}
+	if tz != c.TZOffset {
+		Log.Printf("clock offset: timestamps are %s behind our clock; correcting", tz)
+		c.TZOffset = tz
+		c.LastChange = now
+	}
+	c.Drift = median - tz
+}
+
+// }}}
+// {{{ c.String
+
+func (c *clockOffset)String() string {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.samples) < clockMinSamples {
+		return "clock: (gathering)"
+	}
+	return fmt.Sprintf("clock: tz %s, drift %.3fs, %d skewed", c.TZOffset, c.Drift.Seconds(),
+		c.NumSkewed)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
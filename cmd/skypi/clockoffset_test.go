@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var tClock0 = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+// feedClock observes n msgs, one a second from tClock0, each lag(i) behind
+// our clock, and returns how many were kept.
+func feedClock(c *clockOffset, n int, lag func(i int) time.Duration) int {
+	nOK := 0
+	for i := 0; i < n; i++ {
+		now := tClock0.Add(time.Duration(i) * time.Second)
+		if _,ok := c.observe(now.Add(-lag(i)), now); ok { nOK++ }
+	}
+	return nOK
+}
+
+func withAutoTimezone(t *testing.T, on bool) {
+	old := fAutoTimezone
+	fAutoTimezone = on
+	t.Cleanup(func() { fAutoTimezone = old })
+}
+
+// A feed's timestamps are off by its timezone (which we correct), plus
+// some drift (which we just report). Late-arriving msgs don't fool the
+// median.
+func TestClockOffsetTimezones(t *testing.T) {
+	withAutoTimezone(t, true)
+
+	for _,tc := range []struct{
+		name      string
+		lag       time.Duration // How far behind our clock most msgs look
+		wantTZ    time.Duration
+		wantDrift time.Duration
+	}{
+		{"in sync", 2*time.Second, 0, 2*time.Second},
+		{"US/Pacific", 7*time.Hour + 2*time.Second, 7*time.Hour, 2*time.Second},
+		{"US/Pacific, clock ahead", 7*time.Hour - 40*time.Second, 7*time.Hour, -40*time.Second},
+		{"Asia/Kolkata", -5*time.Hour - 30*time.Minute + time.Second, -5*time.Hour - 30*time.Minute, time.Second},
+		{"Asia/Kathmandu", -5*time.Hour - 45*time.Minute, -5*time.Hour - 45*time.Minute, 0},
+		{"rounds down", 3*time.Hour + 7*time.Minute, 3*time.Hour, 7*time.Minute},
+		{"rounds up", 3*time.Hour + 8*time.Minute, 3*time.Hour + 15*time.Minute, -7*time.Minute},
+	} {
+		c := &clockOffset{}
+		nOK := feedClock(c, clockSampleWindow, func(i int) time.Duration {
+			if i % 5 == 4 { return tc.lag + time.Hour } // Stale data, replayed
+			return tc.lag
+		})
+
+		if c.TZOffset != tc.wantTZ || c.Drift != tc.wantDrift {
+			t.Errorf("%s: got tz %s, drift %s; wanted %s, %s", tc.name, c.TZOffset, c.Drift,
+				tc.wantTZ, tc.wantDrift)
+		}
+		if c.LastChange.IsZero() != (tc.wantTZ == 0) {
+			t.Errorf("%s: LastChange %s", tc.name, c.LastChange)
+		}
+
+		// Once the TZ is known, only the stale msgs get dropped
+		if c.NumSkewed != int64(clockSampleWindow - nOK) {
+			t.Errorf("%s: %d skewed, but %d of %d kept", tc.name, c.NumSkewed, nOK, clockSampleWindow)
+		}
+		if correction,ok := c.observe(tClock0.Add(-tc.lag), tClock0); !ok || correction != tc.wantTZ {
+			t.Errorf("%s: got correction %s (ok=%v), wanted %s", tc.name, correction, ok, tc.wantTZ)
+		}
+	}
+}
+
+// Without -autotz we don't correct anything, and a feed in the wrong
+// timezone is all dropped.
+func TestClockOffsetNoAutoTimezone(t *testing.T) {
+	withAutoTimezone(t, false)
+
+	c := &clockOffset{}
+	if nOK := feedClock(c, clockSampleWindow, func(int) time.Duration { return 7*time.Hour }); nOK != 0 {
+		t.Errorf("kept %d msgs, wanted none", nOK)
+	}
+	if c.TZOffset != 0 || c.Drift != 7*time.Hour || c.NumSkewed != clockSampleWindow {
+		t.Errorf("got tz %s, drift %s, %d skewed", c.TZOffset, c.Drift, c.NumSkewed)
+	}
+}
+
+// A clock that drifts away from ours shows up as drift; the TZ stays put,
+// and nothing more is dropped.
+func TestClockOffsetDrifting(t *testing.T) {
+	withAutoTimezone(t, true)
+
+	// 7h out, plus a clock that loses 100ms every second
+	c := &clockOffset{}
+	lag := func(i int) time.Duration { return 7*time.Hour + time.Duration(i) * 100*time.Millisecond }
+
+	// Until we have enough samples to guess, the msgs look too old to keep
+	if nOK := feedClock(c, clockMinSamples-1, lag); nOK != 0 {
+		t.Errorf("kept %d msgs before we'd estimated the TZ, wanted none", nOK)
+	}
+
+	lastDrift := time.Duration(0)
+	for i := clockMinSamples-1; i < 600; i++ {
+		now := tClock0.Add(time.Duration(i) * time.Second)
+		if _,ok := c.observe(now.Add(-lag(i)), now); !ok {
+			t.Fatalf("msg %d (lag %s) dropped; tz %s, drift %s", i, lag(i), c.TZOffset, c.Drift)
+		}
+		if c.TZOffset != 7*time.Hour {
+			t.Fatalf("msg %d: tz moved to %s", i, c.TZOffset)
+		}
+		if c.Drift < lastDrift {
+			t.Errorf("msg %d: drift went backwards, %s -> %s", i, lastDrift, c.Drift)
+		}
+		lastDrift = c.Drift
+	}
+
+	// The drift is the median of the recent window
+	if min,max := lag(599-clockSampleWindow)-7*time.Hour, lag(599)-7*time.Hour; c.Drift < min || c.Drift > max {
+		t.Errorf("final drift %s, wanted between %s and %s", c.Drift, min, max)
+	}
+}
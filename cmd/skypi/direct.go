@@ -0,0 +1,73 @@
+package main
+
+// Sending bundles straight to a consolidator (one started with
+// -source=http:... or -source=tcp:...), bypassing Google Cloud Pubsub.
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/skypies/adsb"
+	"github.com/skypies/pi/bundlesource"
+)
+
+// directSender posts bundles to an http:// URL, or streams them over a
+// persistent tcp:// connection.
+type directSender struct {
+	sync.Mutex
+	u      *url.URL
+	client *http.Client
+	conn   net.Conn
+}
+
+func newDirectSender(spec string) (*directSender, error) {
+	u,err := url.Parse(spec)
+	if err != nil { return nil, err }
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "tcp" {
+		return nil, fmt.Errorf("-direct: want http://, https:// or tcp://, got %q", spec)
+	}
+	return &directSender{u:u, client:&http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (d *directSender)Send(receiver string, msgs []*adsb.CompositeMsg) error {
+	data,err := encodeBundle(receiver, msgs)
+	if err != nil { return err }
+
+	if d.u.Scheme == "tcp" {
+		return d.sendTCP(data)
+	}
+
+	resp,err := d.client.Post(d.u.String(), "application/octet-stream", bytes.NewReader(data))
+	if err != nil { return err }
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("POST %s: %s", d.u, resp.Status)
+	}
+	return nil
+}
+
+// Bundles are published from many goroutines, so serialize them onto the
+// one connection. If it fails, we drop it and redial on the next bundle.
+func (d *directSender)sendTCP(data []byte) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.conn == nil {
+		conn,err := net.DialTimeout("tcp", d.u.Host, 10 * time.Second)
+		if err != nil { return err }
+		d.conn = conn
+	}
+
+	d.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := bundlesource.WriteRawFrame(d.conn, data); err != nil {
+		d.conn.Close()
+		d.conn = nil
+		return err
+	}
+	return nil
+}
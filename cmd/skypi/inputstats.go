@@ -0,0 +1,188 @@
+package main
+
+// Per-input bookkeeping, so that one flaky feeder sending the odd garbled
+// line doesn't cost us the whole connection, and so we can see which
+// inputs are misbehaving.
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const parseErrWindowSize = 100 // We compute error rates over this many recent lines
+const parseErrSamples = 5      // How many recent bad lines to hang on to
+
+// {{{ inputStats{}
+
+// inputStats tracks the health of a single input; either a dump1090 we
+// dialed out to, or a feeder that connected in to us.
+type inputStats struct {
+	sync.Mutex
+
+	Name          string
+	Receiver      string
+	Connected     bool
+	LastConnect   time.Time
+	NumConnects   int64
+	NumLines      int64
+	NumParseErrs  int64
+	NumReconnects int64 // How many times we gave up on the connection due to parse errors
+	BadSamples    []string
+	Clock         clockOffset
+
+	window        [parseErrWindowSize]bool // Ring buffer of recent lines; true if it was bad
+	windowPos     int
+	windowLen     int
+	windowBad     int
+}
+
+// }}}
+// {{{ getInputStats
+
+var inputsMutex = sync.Mutex{}
+var inputs = map[string]*inputStats{}
+
+// getInputStats returns the stats for the named input, creating them if
+// needed. Stats survive reconnects.
+func getInputStats(name, receiver string) *inputStats {
+	inputsMutex.Lock()
+	defer inputsMutex.Unlock()
+
+	if _,exists := inputs[name]; !exists {
+		inputs[name] = &inputStats{Name:name, Receiver:receiver}
+		registerInputVitals(inputs[name])
+	}
+	return inputs[name]
+}
+
+// allInputStats returns the names of all inputs, sorted, and the stats for each.
+func allInputStats() ([]string, map[string]*inputStats) {
+	inputsMutex.Lock()
+	defer inputsMutex.Unlock()
+
+	names := []string{}
+	ret := map[string]*inputStats{}
+	for k,v := range inputs {
+		names = append(names, k)
+		ret[k] = v
+	}
+	sort.Strings(names)
+	return names, ret
+}
+
+// }}}
+
+// {{{ s.connected, s.disconnected
+
+func (s *inputStats)connected() {
+	s.Lock()
+	defer s.Unlock()
+	s.Connected = true
+	s.LastConnect = time.Now()
+	s.NumConnects++
+	s.windowPos, s.windowLen, s.windowBad = 0, 0, 0 // Fresh connection, fresh error rate
+}
+
+func (s *inputStats)disconnected(dueToParseErrs bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.Connected = false
+	if dueToParseErrs { s.NumReconnects++ }
+}
+
+// }}}
+// {{{ s.recordLine
+
+// recordLine notes whether a line parsed OK. It returns true if the
+// recent error rate has exceeded maxRate, and the connection should be
+// dropped. A maxRate of zero means any bad line is too many.
+func (s *inputStats)recordLine(text string, parseErr error, maxRate float64) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	s.NumLines++
+	bad := parseErr != nil
+
+	if s.windowLen == parseErrWindowSize {
+		if s.window[s.windowPos] { s.windowBad-- }
+	} else {
+		s.windowLen++
+	}
+	s.window[s.windowPos] = bad
+	s.windowPos = (s.windowPos + 1) % parseErrWindowSize
+
+	if !bad { return false }
+
+	s.windowBad++
+	s.NumParseErrs++
+	sample := fmt.Sprintf("%s %q: %v", time.Now().Format("15:04:05"), text, parseErr)
+	s.BadSamples = append(s.BadSamples, sample)
+	if len(s.BadSamples) > parseErrSamples {
+		s.BadSamples = s.BadSamples[len(s.BadSamples)-parseErrSamples:]
+	}
+
+	if maxRate <= 0 { return true }
+
+	// Don't judge a connection on just a handful of lines
+	if s.windowLen < parseErrWindowSize/10 { return false }
+	return float64(s.windowBad) / float64(s.windowLen) > maxRate
+}
+
+// }}}
+// {{{ s.String
+
+func (s *inputStats)String() string {
+	s.Lock()
+	defer s.Unlock()
+
+	state := "down"
+	if s.Connected { state = "up" }
+
+	rate := 0.0
+	if s.windowLen > 0 { rate = float64(s.windowBad) / float64(s.windowLen) }
+
+	str := fmt.Sprintf("%-30.30s [%-12.12s] %-4s %9d lines, %6d parse errs (%4.1f%% recent),"+
+		" %3d connects, %3d reconnects; %s\n",
+		s.Name, s.Receiver, state, s.NumLines, s.NumParseErrs, rate*100, s.NumConnects,
+		s.NumReconnects, s.Clock.String())
+	for _,sample := range s.BadSamples {
+		str += fmt.Sprintf("    bad: %s\n", sample)
+	}
+	return str
+}
+
+// }}}
+
+// {{{ logInputStats
+
+// logInputStats periodically dumps out the state of all inputs.
+func logInputStats(interval time.Duration) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+
+		names,stats := allInputStats()
+		str := ""
+		for _,name := range names {
+			str += stats[name].String()
+		}
+		if str != "" {
+			Log.Printf("input stats:-\n%s", str)
+		}
+	}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var errTestParse = errors.New("garbled")
+
+// feedLines records n lines, every badEvery'th one bad (none, if zero),
+// and reports whether the last line asked for the connection to be dropped.
+func feedLines(s *inputStats, n, badEvery int, maxRate float64) bool {
+	drop := false
+	for i := 1; i <= n; i++ {
+		var err error
+		if badEvery > 0 && i % badEvery == 0 { err = errTestParse }
+		drop = s.recordLine(fmt.Sprintf("line %d", i), err, maxRate)
+	}
+	return drop
+}
+
+func TestInputStatsErrorRate(t *testing.T) {
+	for _,tc := range []struct{
+		name     string
+		n        int
+		badEvery int
+		maxRate  float64
+		want     bool
+	}{
+		{"all good", 50, 0, 0.1, false},
+		{"zero tolerance", 1, 1, 0, true},
+		{"zero tolerance, good line", 1, 0, 0, false},
+		{"too few lines to judge", 9, 3, 0.1, false},       // 3 in 9; but not 10 lines yet
+		{"over the rate", 10, 5, 0.1, true},                // 2 in 10
+		{"at the rate", 100, 10, 0.1, false},               // 10 in 100
+		{"over the rate, nearly full", 99, 9, 0.1, true},   // 11 in 99
+	} {
+		s := &inputStats{}
+		got := feedLines(s, tc.n, tc.badEvery, tc.maxRate)
+		if got != tc.want {
+			t.Errorf("%s: drop=%v, wanted %v (%d bad in %d)", tc.name, got, tc.want, s.windowBad, s.windowLen)
+		}
+	}
+}
+
+// Old lines fall out of the window; errors from a while back are
+// forgiven.
+func TestInputStatsWindowRollsOver(t *testing.T) {
+	s := &inputStats{}
+	feedLines(s, parseErrWindowSize, 5, 1.0) // 20% bad, but we're tolerant for now
+	if s.windowBad != 20 || s.windowLen != parseErrWindowSize {
+		t.Fatalf("got %d bad in %d, wanted 20 in %d", s.windowBad, s.windowLen, parseErrWindowSize)
+	}
+
+	feedLines(s, parseErrWindowSize/2, 0, 1.0)
+	if s.windowBad != 10 {
+		t.Errorf("half a window later, got %d bad, wanted 10", s.windowBad)
+	}
+	feedLines(s, parseErrWindowSize/2, 0, 1.0)
+	if s.windowBad != 0 || s.windowLen != parseErrWindowSize {
+		t.Errorf("a window later, got %d bad in %d, wanted 0 in %d", s.windowBad, s.windowLen,
+			parseErrWindowSize)
+	}
+
+	// One bad line in a window of good ones is fine; the totals remember everything
+	if s.recordLine("bad", errTestParse, 0.1) {
+		t.Errorf("dropped for one bad line in %d", parseErrWindowSize)
+	}
+	if s.NumLines != 2*parseErrWindowSize+1 || s.NumParseErrs != 21 {
+		t.Errorf("got %d lines, %d parse errs; wanted %d, 21", s.NumLines, s.NumParseErrs,
+			2*parseErrWindowSize+1)
+	}
+
+	// A fresh connection starts with a clean window
+	s.connected()
+	if s.windowBad != 0 || s.windowLen != 0 {
+		t.Errorf("after reconnect, got %d bad in %d", s.windowBad, s.windowLen)
+	}
+}
+
+// We only keep the most recent few bad lines.
+func TestInputStatsSampleCap(t *testing.T) {
+	s := &inputStats{}
+	for i := 1; i <= parseErrSamples+3; i++ {
+		s.recordLine(fmt.Sprintf("bad %d", i), errTestParse, 1.0)
+	}
+	if len(s.BadSamples) != parseErrSamples {
+		t.Fatalf("got %d samples, wanted %d", len(s.BadSamples), parseErrSamples)
+	}
+	for i,sample := range s.BadSamples {
+		want := fmt.Sprintf("%q", fmt.Sprintf("bad %d", i+4))
+		if !strings.Contains(sample, want) {
+			t.Errorf("sample %d: got %s, wanted it to include %s", i, sample, want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+// Signing bundles, so the consolidator knows they really came from us.
+// Make a key, then give one line to skypi (-keys) and the other to the
+// consolidator (its -keys file):
+//   $ skypi -genkey=ed25519:MyStationName
+// With -listen, each receiver is signed for with its own key (or the "*"
+// key, if there is one).
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	gpubsub "cloud.google.com/go/pubsub"
+
+	"github.com/skypies/adsb"
+	"github.com/skypies/pi/bundlesource"
+	"github.com/skypies/util/gcp/pubsub"
+)
+
+var signingKeys *bundlesource.KeyRegistry // nil, unless -keys
+
+// genKey prints out a fresh key, for -genkey=ALG:RECEIVER
+func genKey(spec string) error {
+	alg,receiver := bundlesource.AlgEd25519, spec
+	if i := strings.Index(spec, ":"); i >= 0 {
+		alg,receiver = spec[:i], spec[i+1:]
+	}
+	sender,verifier,err := bundlesource.GenerateKey(receiver, alg)
+	if err != nil { return err }
+	fmt.Printf("# For skypi's -keys file:\n%s\n\n# For the consolidator's -keys file:\n%s\n",
+		sender, verifier)
+	return nil
+}
+
+// encodeBundle claims the messages for the receiver, and encodes them;
+// signed, if we have keys.
+func encodeBundle(receiver string, msgs []*adsb.CompositeMsg) ([]byte, error) {
+	if signingKeys == nil {
+		for i,_ := range msgs {
+			msgs[i].ReceiverName = receiver // Claim this message, for upstream fame & glory
+		}
+		return bundlesource.Encode(msgs)
+	}
+
+	k := signingKeys.Lookup(receiver)
+	if k == nil {
+		return nil, fmt.Errorf("no signing key for receiver %q", receiver)
+	}
+	return bundlesource.Sign(msgs, receiver, k)
+}
+
+// publishBundle sends a bundle to the pubsub topic.
+func publishBundle(ctx context.Context, client *gpubsub.Client, receiver string, msgs []*adsb.CompositeMsg) error {
+	if signingKeys == nil {
+		return pubsub.PublishMsgs(ctx, client, fPubsubTopic, receiver, msgs)
+	}
+
+	data,err := encodeBundle(receiver, msgs)
+	if err != nil { return err }
+	_,err = client.Topic(fPubsubTopic).Publish(ctx, &gpubsub.Message{Data: data}).Get(ctx)
+	return err
+}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
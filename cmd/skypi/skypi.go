@@ -1,4 +1,4 @@
-// The skypi application attaches to sockets that write out SBS formatted ADS-B messages.
+// The skypi application attaches to sockets that write out SBS (or Beast) formatted ADS-B messages.
 // It filters out the interesting ones, and aggregates together fields from different messages, to
 // build useful packets. These are then published up to a topic in Google Cloud PubSub in bundles.
 package main
@@ -10,10 +10,22 @@ package main
 // $GOPATH/bin/skypi -receiver="MyStationName"
 // ... maybe also: -h=southpi:30003 -maxage=4s -timeloc="America/Los_angeles" -v=2 -topic=""
 
+// To aggregate nearby stations, have them push their SBS or Beast output to us:
+// $GOPATH/bin/skypi -receiver="MyStationName" -listen="Neighbour@:30105,NeighbourMLAT@:30106"
+
+// To resize the pipeline, or change its timings (see package config):
+// $GOPATH/bin/skypi -config=skypi.yaml -print-config
+
+// To sign bundles (see signing.go):
+// $GOPATH/bin/skypi -genkey=ed25519:MyStationName
+// $GOPATH/bin/skypi -receiver="MyStationName" -keys=skypi.keys
+
 import (
 	"bufio"
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"os"
@@ -23,47 +35,122 @@ import (
 	"syscall"
 	"time"
 
+	gpubsub "cloud.google.com/go/pubsub"
+
 	"github.com/skypies/adsb"
 	"github.com/skypies/adsb/msgbuffer"
+	"github.com/skypies/pi/bundlesource"
+	"github.com/skypies/pi/config"
 	"github.com/skypies/util/gcp/pubsub"
 )
 
 var Log *log.Logger
 
 var fHostPorts             string
+var fListenPorts           string
 var fProjectName           string
 var fPubsubTopic           string
+var fDirectURL             string
 var fReceiverName          string
 var fDump1090TimeLocation  string
+var fAutoTimezone          bool
 var fBufferMaxAge          time.Duration
 var fBufferMinPublish      time.Duration
+var fMaxParseErrRate       float64
 var fVerbose               int
+var fHTTPAddr              string
+var fKeysFile              string
+var fGenKey                string
+var fConfigFile            string
+var fPrintConfig           bool
+
+var conf config.Config
 
 func init() {
 	flag.StringVar(&fReceiverName, "receiver", "TestStation", "Name for this receiver gizmo")
-	flag.StringVar(&fHostPorts, "hosts", "localhost:30003", "host:port[,host2:port2]")	
+	flag.StringVar(&fHostPorts, "hosts", "localhost:30003",
+		"[receiver@]host:port[,...]; dump1090 SBS (or Beast) ports to connect to")
+	flag.StringVar(&fListenPorts, "listen", "",
+		"[receiver@]host:port[,...]; ports to accept inbound SBS or Beast feeds on (e.g. Bob@:30105)")
 	flag.StringVar(&fProjectName, "project", "serfr0-fdb",
 		"Name of the Google cloud project hosting the pubsub")
 	flag.StringVar(&fPubsubTopic, "topic", "adsb-inbound",
 		"Name of the pubsub topic to post to (set to empty for dry-run mode)")
+	flag.StringVar(&fDirectURL, "direct", "",
+		"send bundles straight to a consolidator, instead of pubsub (http://host:port/ or tcp://host:port)")
 	flag.StringVar(&fDump1090TimeLocation, "timeloc", "UTC",
 		"Which timezone dump1090 thinks it is in (e.g. America/Los_Angeles)")
+	flag.BoolVar(&fAutoTimezone, "autotz", true,
+		"infer dump1090's timezone from message timestamps, and correct for it")
 	flag.DurationVar(&fBufferMaxAge, "maxage", 2*time.Second,
 		"If we're holding a message this old, ship 'em all out to pubsub")
 	flag.DurationVar(&fBufferMinPublish, "minwait", 1500*time.Millisecond,
 		"maxage notwithstanding, *always* wait at least this long between shipping bundles to pubsub")
+	flag.Float64Var(&fMaxParseErrRate, "maxparseerrs", 0.2,
+		"drop & reconnect an input if more than this fraction of its recent lines fail to parse"+
+		" (0 == drop on first bad line)")
 	flag.IntVar(&fVerbose, "v", 0, "how verbose to get")	
-	flag.Parse()
-	
+	flag.StringVar(&fHTTPAddr, "http", "",
+		"host:port to serve /healthz, /status and /metrics on (empty to disable)")
+	flag.StringVar(&fKeysFile, "keys", "",
+		"file of keys to sign bundles with, one per receiver (see signing.go)")
+	flag.StringVar(&fGenKey, "genkey", "",
+		"print a new key for [hmac-sha256|ed25519:]RECEIVER, and exit")
+	flag.StringVar(&fConfigFile, "config", "",
+		"YAML file of pipeline sizes & intervals; flags given on the command line override it")
+	flag.BoolVar(&fPrintConfig, "print-config", false, "print the config we would run with, and exit")
+
 	Log = log.New(os.Stdout,"", log.Ldate|log.Ltime)//|log.Lshortfile)	
+}
+
+// setup is the rest of the initialization; it's not in init, so that tests
+// can run without it.
+func setup() {
+	flag.Parse()
+
+	loadConfig()
+	if fGenKey != "" {
+		if err := genKey(fGenKey); err != nil { Log.Fatal(err) }
+		os.Exit(0)
+	}
+	if fKeysFile != "" {
+		keys,err := bundlesource.LoadKeyRegistry(fKeysFile)
+		if err != nil { Log.Fatal(err) }
+		signingKeys = keys
+		Log.Printf("(signing bundles, %d keys loaded from %s)\n", keys.Len(), fKeysFile)
+	}
 	Log.Printf("(max message age is %s, min interval is %s)\n", fBufferMaxAge, fBufferMinPublish)
-	if fPubsubTopic == "" {
+	if fDirectURL != "" {
+		Log.Printf("(sending bundles direct to %s)\n", fDirectURL)
+	} else if fPubsubTopic == "" {
 		Log.Printf("(no topic defined, in dry-run mode)\n")
 	}
 
 	addSIGINTHandler()
 }
 
+// loadConfig reads -config, and reconciles it with the flags that
+// overlap with it.
+func loadConfig() {
+	c,err := config.Load(fConfigFile)
+	if err != nil { Log.Fatal(err) }
+
+	flag.Visit(func(f *flag.Flag) { // Only the flags that were set
+		switch f.Name {
+		case "maxage":  c.Skypi.MaxAge.Duration = fBufferMaxAge
+		case "minwait": c.Skypi.MinWait.Duration = fBufferMinPublish
+		}
+	})
+	if err := c.Validate(); err != nil { Log.Fatal(err) }
+	conf = c
+	fBufferMaxAge,fBufferMinPublish = conf.Skypi.MaxAge.Duration, conf.Skypi.MinWait.Duration
+
+	if fPrintConfig {
+		os.Stdout.Write(conf.YAML())
+		os.Exit(0)
+	}
+}
+
 var done = make(chan struct{}) // Gets closed when everything is done
 func weAreDone() bool {
 	select{
@@ -85,52 +172,127 @@ func addSIGINTHandler() {
 	}(c)
 }
 
-// acceptMsg is a goroutine which owns the message buffer data structure.
-// All input sources of messages submit to this routine, which adds the to the message buffer.
-func acceptMsg(msgChan <-chan *adsb.Msg, publishChan chan<- []*adsb.CompositeMsg) {
+// taggedMsg is a message read from one of our inputs, along with the
+// name of the receiver that generated it.
+type taggedMsg struct {
+	*adsb.Msg
+	Receiver string
+}
+
+// msgBundle is a batch of composite messages, all from the same receiver.
+type msgBundle struct {
+	Receiver string
+	Msgs     []*adsb.CompositeMsg
+}
+
+// parseEndpoint splits a "[receivername@]host:port" spec. If no name is
+// given, the name from the -receiver flag is used.
+func parseEndpoint(spec string) (receiver, hostport string) {
+	if i := strings.Index(spec, "@"); i >= 0 {
+		return spec[:i], spec[i+1:]
+	}
+	return fReceiverName, spec
+}
+
+// newMsgBuffer creates a buffer for a single receiver's messages. Its
+// flushed output is tagged with the receiver name, and forwarded on to
+// the publish channel; the forwarder exits when FlushChannel is closed.
+func newMsgBuffer(receiver string, publishChan chan<- msgBundle, wg *sync.WaitGroup) *msgbuffer.MsgBuffer {
+	flushChan := make(chan []*adsb.CompositeMsg, conf.Skypi.FlushChanSize)
+
 	mb := msgbuffer.NewMsgBuffer()
-	mb.FlushChannel = publishChan
+	mb.FlushChannel = flushChan
 	mb.MaxMessageAge = fBufferMaxAge
 	mb.MinPublishInterval = fBufferMinPublish
 
-	for msg := range msgChan {
-		mb.Add(msg)
+	wg.Add(1)
+	go func() {
+		for msgs := range flushChan {
+			publishChan <- msgBundle{Receiver: receiver, Msgs: msgs}
+		}
+		wg.Done()
+	}()
+
+	return mb
+}
+
+// acceptMsg is a goroutine which owns the message buffer data structures.
+// All input sources of messages submit to this routine, which adds them to
+// the message buffer for the receiver that generated them.
+func acceptMsg(msgChan <-chan taggedMsg, publishChan chan<- msgBundle) {
+	buffers := map[string]*msgbuffer.MsgBuffer{}
+	forwardersWG := &sync.WaitGroup{}
+
+	for tm := range msgChan {
+		mb,exists := buffers[tm.Receiver]
+		if !exists {
+			mb = newMsgBuffer(tm.Receiver, publishChan, forwardersWG)
+			buffers[tm.Receiver] = mb
+		}
+		mb.Add(tm.Msg)
+		vMessages.Inc()
+
+		nAircraft := 0
+		for _,b := range buffers { nAircraft += len(b.Senders) }
+		vAircraft.Set(float64(nAircraft))
+
 		if weAreDone() { break }
 	}
 
-	mb.FinalFlush()
+	for _,mb := range buffers {
+		mb.FinalFlush()
+		close(mb.FlushChannel)
+	}
+	forwardersWG.Wait()
 
 	close(publishChan)
 	
 	Log.Printf(" ---- acceptMsg, clean shutdown\n")
 }
 
-func publishMsgBundles(thisGoroutineWG *sync.WaitGroup, ch <-chan []*adsb.CompositeMsg) {
+func publishMsgBundles(thisGoroutineWG *sync.WaitGroup, ch <-chan msgBundle) {
 	thisGoroutineWG.Add(1)
 
 	ctx := context.TODO()
-	client := pubsub.NewClient(ctx,fProjectName)
+	var client *gpubsub.Client
+	var direct *directSender
+	if fDirectURL != "" {
+		d,err := newDirectSender(fDirectURL)
+		if err != nil { Log.Fatal(err) }
+		direct = d
+	} else if fPubsubTopic != "" {
+		client = pubsub.NewClient(ctx,fProjectName) // needs creds, so skip in dry-run mode
+	}
 	// c := pubsub.GetLocalContext(fProjectName)
 	wg := &sync.WaitGroup{}
 	
-	for msgs := range ch {
-		if len(msgs) == 0 { continue }
+	for b := range ch {
+		if len(b.Msgs) == 0 { continue }
 
 		wg.Add(1)
 
-		go func(msgs []*adsb.CompositeMsg) {
+		go func(b msgBundle) {
+			msgs := b.Msgs
 			if fVerbose > 0 {
 				age := time.Since(msgs[0].GeneratedTimestampUTC)
-				Log.Printf("-- flushing %d msgs, oldest %s\n", len(msgs), age)
+				Log.Printf("-- flushing %d msgs from %s, oldest %s\n", len(msgs), b.Receiver, age)
 				if fVerbose > 1 { for i,m := range msgs { Log.Printf(" [%2d] %s\n", i, m) } }
 			}
-			if fPubsubTopic != "" {
-				if err := pubsub.PublishMsgs(ctx, client, fPubsubTopic, fReceiverName, msgs); err != nil {
+			if direct != nil || client != nil {
+				tStart := time.Now()
+				var err error
+				if direct != nil {
+					err = direct.Send(b.Receiver, msgs)
+				} else {
+					err = publishBundle(ctx, client, b.Receiver, msgs)
+				}
+				if err != nil {
 					Log.Printf("-- err: %v\n", err)
 				}
+				notePublish(time.Since(tStart), err)
 			}
 			wg.Done()
-		}(msgs)
+		}(b)
 		
 		if weAreDone() { break }
 	}
@@ -140,18 +302,78 @@ func publishMsgBundles(thisGoroutineWG *sync.WaitGroup, ch <-chan []*adsb.Compos
 	Log.Printf(" ---- publishMsgBundles, clean shutdown\n")
 }
 
-// readMsgFromSocket will pull basestation (and extended basestation)
-// formatted messages from the socket, and send them down the channel.
-// It will retry the connection on failure.
-func readMsgFromSocket(wg *sync.WaitGroup, hostport string, msgChan chan<-*adsb.Msg) {
-	nTimeMismatches := 0
+// readMsgsFromConn pulls basestation (and extended basestation)
+// formatted messages from the connection, tags them with the receiver
+// name, and sends them down the channel. Beast binary streams are decoded
+// into basestation messages first (see beast.go). Lines (or frames) that
+// fail to parse are counted and skipped, unless they become too frequent.
+// It returns when the connection fails, or when we're done; it does not
+// close the connection.
+func readMsgsFromConn(conn net.Conn, stats *inputStats, msgChan chan<- taggedMsg) error {
+	reader := bufio.NewReader(conn)
+
+	stats.connected()
+	tooManyErrs := false
+	defer func() { stats.disconnected(tooManyErrs) }()
+
+	// Beast is a binary format, and every frame starts with an escape byte
+	readLine := func() (string, error) { return reader.ReadString('\n') }
+	if b,err := reader.Peek(1); err == nil && b[0] == beastEscape {
+		Log.Printf("%s: Beast binary stream, decoding it", stats.Name)
+		readLine = newBeastDecoder(reader).readLine
+	}
+
+	for {
+		if weAreDone() { return nil }
+		text,err := readLine()
+		if err != nil && !errors.Is(err, errBadFrame) {
+			return fmt.Errorf("reader err: %v", err)
+		}
+
+		if text == "\n" {
+			// dump1090 will print a newline every 30s, if it has nothing else to print.
+			continue
+		}
+
+		msg := adsb.Msg{}
+		parseErr := err
+		if parseErr == nil { parseErr = msg.FromSBS1(text) }
+		if tooManyErrs = stats.recordLine(text, parseErr, fMaxParseErrRate); tooManyErrs {
+			return fmt.Errorf("too many parse fails; last input:%q, err:%v", text, parseErr)
+		} else if parseErr != nil {
+			if fVerbose > 0 { Log.Printf("%s: skipping bad input:%q, err:%v", stats.Name, text, parseErr) }
+			continue
+		}
+
+		// Correct for dump1090 running in a different timezone. Messages
+		// that are still badly skewed are stale data; skip them.
+		if correction,ok := stats.Clock.observe(msg.GeneratedTimestampUTC, time.Now()); !ok {
+			continue
+		} else if correction != 0 {
+			msg.GeneratedTimestampUTC = msg.GeneratedTimestampUTC.Add(correction)
+			msg.LoggedTimestampUTC = msg.LoggedTimestampUTC.Add(correction)
+		}
+
+		// If the message is flagged as one we should mask, honor that
+		if msg.IsMasked() {
+			continue
+		}
+			
+		msgChan <- taggedMsg{Msg: &msg, Receiver: stats.Receiver}
+	}
+}
+
+// readMsgFromSocket dials out to a dump1090 style SBS (or Beast) port, and reads
+// messages from it. It will retry the connection on failure.
+func readMsgFromSocket(wg *sync.WaitGroup, spec string, msgChan chan<- taggedMsg) {
+	receiver,hostport := parseEndpoint(spec)
+	stats := getInputStats(hostport, receiver)
 	lastBackoff := time.Second
 
 	wg.Add(1)
 
-outerLoop:
 	for {
-		if weAreDone() { break } // outer
+		if weAreDone() { break }
 
 		conn,err := net.Dial("tcp", hostport)
 		if err != nil {
@@ -162,72 +384,107 @@ outerLoop:
 		}
 		
 		lastBackoff = time.Second
-		Log.Printf("connected to %q", hostport)
-
-		reader := bufio.NewReader(conn)
-		for {
-			if weAreDone() { break outerLoop }
-			text,err := reader.ReadString('\n')
-			if err != nil {
-				Log.Printf("killing connection, reader err: %v", err)
-				conn.Close()
-				break // inner
-			}
+		Log.Printf("connected to %q (as %s)", hostport, receiver)
 
-			if text == "\n" {
-				// dump1090 will print a newline every 30s, if it has nothing else to print.
-				continue
-			}
+		if err := readMsgsFromConn(conn, stats, msgChan); err != nil {
+			Log.Printf("killing connection to %q, %v", hostport, err)
+		}
+		conn.Close()
+	}
 
-			msg := adsb.Msg{}
-			if err := msg.FromSBS1(text); err != nil {
-				Log.Printf("killing connection, parse fail; input:%q, err:%v", text, err)
-				break // inner
-			}
+	wg.Done()
+	Log.Printf(" ---- readMsgFromSocket, clean shutdown\n")
+}
 
-			// If there is significant clock skew, we should bail. But, it seems
-			// that sometimes we pick up stale data from dump1090; so wait to see
-			// if it passes.
-			offset := time.Since(msg.GeneratedTimestampUTC)
-			if offset > time.Minute * 30 || offset < time.Minute * -30 {
-				nTimeMismatches++
-				if nTimeMismatches < 100 {
-					continue // do not process this message
-				} else {
-					Log.Fatalf("100 bad msgs; set -timeloc ?\nNow = %s\nmsg = %s\n", time.Now(),
-						msg.GeneratedTimestampUTC)
+// listenForFeeders accepts inbound connections from feeders that push
+// SBS or Beast streams to us (e.g. mlat-client, or a neighbouring
+// dump1090 via socat), and reads messages from each of them. Everything
+// arriving on this port is tagged with the receiver name from the spec.
+// If we can't listen on the port, we log it and carry on without it.
+func listenForFeeders(wg *sync.WaitGroup, spec string, msgChan chan<- taggedMsg) {
+	receiver,hostport := parseEndpoint(spec)
+
+	ln,err := net.Listen("tcp", hostport)
+	if err != nil {
+		Log.Printf("listen '%s': err %v; not accepting feeders there", hostport, err)
+		return
+	}
+	Log.Printf("listening for feeders on %q (as %s)", hostport, receiver)
+
+	wg.Add(1)
+
+	// Accept blocks, so unblock it by closing the listener when we're done
+	go func() {
+		<-done
+		ln.Close()
+	}()
+
+	connsWG := &sync.WaitGroup{}
+	for {
+		conn,err := ln.Accept()
+		if err != nil {
+			if !weAreDone() { Log.Printf("accept on %q: err %v", hostport, err) }
+			break
+		}
+
+		connsWG.Add(1)
+		go func(conn net.Conn) {
+			finished := make(chan struct{})
+			go func() {
+				select {
+				case <-done:     conn.Close() // unblock the reader
+				case <-finished:
 				}
-			}
+			}()
+
+			addr := conn.RemoteAddr().String()
+			Log.Printf("feeder %s connected to %q (as %s)", addr, hostport, receiver)
+
+			// Key the stats on the feeder's IP, so they survive reconnects
+			ip,_,_ := net.SplitHostPort(addr)
+			stats := getInputStats(fmt.Sprintf("%s<-%s", hostport, ip), receiver)
 
-			// If the message is flagged as one we should mask, honor that
-			if msg.IsMasked() {
-				continue
+			if err := readMsgsFromConn(conn, stats, msgChan); err != nil && !weAreDone() {
+				Log.Printf("dropping feeder %s, %v", addr, err)
 			}
-			
-			msgChan <- &msg
-		}
+			conn.Close()
+			close(finished)
+			connsWG.Done()
+		}(conn)
 	}
 
+	connsWG.Wait()
 	wg.Done()
-	Log.Printf(" ---- readMsgFromSocket, clean shutdown\n")
+	Log.Printf(" ---- listenForFeeders(%s), clean shutdown\n", hostport)
 }
 
 func main() {
-	adsb.TimeLocation = fDump1090TimeLocation  // We should really autodetect this, somehow
+	setup()
+	adsb.TimeLocation = fDump1090TimeLocation  // If this is wrong, -autotz will correct for it
 
 	// For clean shutdown, we need to know when various goroutines finish cleanly
 	readersWaitgroup := &sync.WaitGroup{}
 	publisherWG := &sync.WaitGroup{}
 
 	// Setup the channel for new messages, and launch goroutines to write to it
-	msgChan := make(chan *adsb.Msg, 20)
-	for _,hostport := range strings.Split(fHostPorts, ",") {
-		go readMsgFromSocket(readersWaitgroup, hostport, msgChan)
+	msgChan := make(chan taggedMsg, conf.Skypi.MsgChanSize)
+	for _,spec := range strings.Split(fHostPorts, ",") {
+		if spec == "" { continue }
+		go readMsgFromSocket(readersWaitgroup, spec, msgChan)
+	}
+	for _,spec := range strings.Split(fListenPorts, ",") {
+		if spec == "" { continue }
+		go listenForFeeders(readersWaitgroup, spec, msgChan)
 	}
 
 	// Setup the channel for publishing outbound bundles of messages, and launch its goroutines
-	publishChan := make(chan []*adsb.CompositeMsg, 3)
+	publishChan := make(chan msgBundle, conf.Skypi.PublishChanSize)
 	go acceptMsg(msgChan, publishChan)
+	go logInputStats(conf.Skypi.StatsInterval.Duration)
+	go trackRates(conf.Skypi.RateInterval.Duration)
+	if fHTTPAddr != "" {
+		go serveStatus(fHTTPAddr)
+	}
 	go publishMsgBundles(publisherWG, publishChan)
 
 	// Now wait until all the readers have closed down.
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A port we can't listen on is logged, and skipped; it doesn't take the
+// other inputs down with it.
+func TestListenForFeedersBadPort(t *testing.T) {
+	ln,err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { t.Fatal(err) }
+	defer ln.Close()
+
+	wg := &sync.WaitGroup{}
+	returned := make(chan struct{})
+	go func() {
+		listenForFeeders(wg, "Neighbour@"+ln.Addr().String(), make(chan taggedMsg))
+		close(returned)
+	}()
+
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("listenForFeeders didn't return")
+	}
+
+	waited := make(chan struct{})
+	go func() { wg.Wait(); close(waited) }()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("listenForFeeders left the waitgroup waiting")
+	}
+}
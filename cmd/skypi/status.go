@@ -0,0 +1,200 @@
+package main
+
+// An optional HTTP listener, so we can see how skypi is doing without
+// trawling through stdout. Enable with -http=:8081
+//   /healthz - "ok" if at least one input is connected, else a 503
+//   /status  - human readable summary
+//   /metrics - the same data, in Prometheus text exposition format
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/skypies/pi/vitals"
+)
+
+// {{{ var()
+
+// The process-wide stats. Per-input state lives in inputStats, and is
+// exported via SetFunc (see registerInputVitals).
+var (
+	vUptime         = vitals.NewGauge("skypi_uptime_seconds", "Seconds since skypi started.")
+	vMessages       = vitals.NewCounter("skypi_messages_total", "Messages accepted from all inputs.")
+	vMsgsPerSec     = vitals.NewGauge("skypi_messages_per_second", "Recent rate of messages accepted.")
+	vAircraft       = vitals.NewGauge("skypi_aircraft", "Aircraft currently being tracked.")
+	vBundles        = vitals.NewCounter("skypi_bundles_published_total", "Bundles successfully published.")
+	vPublishErrs    = vitals.NewCounter("skypi_publish_errors_total", "Bundles that failed to publish.")
+	vPublishMillis  = vitals.NewHistogram("skypi_publish_latency_milliseconds", "Time taken to publish a bundle.", vitals.MillisBuckets)
+	vPublishMax     = vitals.NewGauge("skypi_publish_latency_max_seconds", "Slowest bundle publish since startup.")
+
+	startTime       = time.Now()
+
+	lastPublishMutex = sync.Mutex{}
+	lastPublish      time.Time
+	lastPublishErr   string
+)
+
+func init() {
+	vUptime.SetFunc(func() float64 { return time.Since(startTime).Seconds() })
+}
+
+// notePublish records the outcome of publishing a bundle.
+func notePublish(latency time.Duration, err error) {
+	lastPublishMutex.Lock()
+	defer lastPublishMutex.Unlock()
+	if err != nil {
+		vPublishErrs.Inc()
+		lastPublishErr = err.Error()
+		return
+	}
+	vBundles.Inc()
+	vPublishMillis.Observe(float64(latency.Milliseconds()))
+	lastPublish = time.Now()
+	if latency.Seconds() > vPublishMax.Value() { vPublishMax.Set(latency.Seconds()) }
+}
+
+// }}}
+// {{{ registerInputVitals
+
+var (
+	vInputUp         = vitals.NewGaugeVec("skypi_input_up", "Whether the input is currently connected.", "input", "receiver")
+	vInputLines      = vitals.NewCounterVec("skypi_input_lines_total", "Lines read from the input.", "input", "receiver")
+	vInputParseErrs  = vitals.NewCounterVec("skypi_input_parse_errors_total", "Lines from the input that failed to parse.", "input", "receiver")
+	vInputConnects   = vitals.NewCounterVec("skypi_input_connects_total", "Connections made on the input.", "input", "receiver")
+	vInputReconnects = vitals.NewCounterVec("skypi_input_reconnects_total", "Connections dropped due to parse errors.", "input", "receiver")
+	vClockTZ         = vitals.NewGaugeVec("skypi_input_clock_tz_offset_seconds", "Timezone correction applied to the input.", "input", "receiver")
+	vClockDrift      = vitals.NewGaugeVec("skypi_input_clock_drift_seconds", "Median message age, after timezone correction.", "input", "receiver")
+	vClockSkewed     = vitals.NewCounterVec("skypi_input_clock_skewed_total", "Messages dropped for being badly skewed.", "input", "receiver")
+)
+
+// registerInputVitals exports an input's stats; they are read straight
+// out of the inputStats when needed.
+func registerInputVitals(s *inputStats) {
+	stat := func(f func() int64) func() int64 {
+		return func() int64 { s.Lock(); defer s.Unlock(); return f() }
+	}
+	clock := func(f func(c *clockOffset) float64) func() float64 {
+		return func() float64 { s.Clock.Lock(); defer s.Clock.Unlock(); return f(&s.Clock) }
+	}
+
+	l := []string{s.Name, s.Receiver}
+	vInputUp.With(l...).SetFunc(func() float64 {
+		s.Lock()
+		defer s.Unlock()
+		if s.Connected { return 1 }
+		return 0
+	})
+	vInputLines.With(l...).SetFunc(stat(func() int64 { return s.NumLines }))
+	vInputParseErrs.With(l...).SetFunc(stat(func() int64 { return s.NumParseErrs }))
+	vInputConnects.With(l...).SetFunc(stat(func() int64 { return s.NumConnects }))
+	vInputReconnects.With(l...).SetFunc(stat(func() int64 { return s.NumReconnects }))
+	vClockTZ.With(l...).SetFunc(clock(func(c *clockOffset) float64 { return c.TZOffset.Seconds() }))
+	vClockDrift.With(l...).SetFunc(clock(func(c *clockOffset) float64 { return c.Drift.Seconds() }))
+	vClockSkewed.With(l...).SetFunc(func() int64 {
+		s.Clock.Lock()
+		defer s.Clock.Unlock()
+		return s.Clock.NumSkewed
+	})
+}
+
+// }}}
+// {{{ trackRates
+
+// trackRates periodically turns the message counter into a rate.
+func trackRates(interval time.Duration) {
+	lastTime,lastMsgs := time.Now(), vMessages.Value()
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+
+		n := vMessages.Value()
+		vMsgsPerSec.Set(float64(n - lastMsgs) / time.Since(lastTime).Seconds())
+		lastTime,lastMsgs = time.Now(), n
+	}
+}
+
+// }}}
+
+// {{{ {healthz,status,metrics}Handler
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	names,stats := allInputStats()
+	for _,name := range names {
+		s := stats[name]
+		s.Lock()
+		up := s.Connected
+		s.Unlock()
+		if up {
+			w.Write([]byte("ok\n"))
+			return
+		}
+	}
+	http.Error(w, "no inputs connected", http.StatusServiceUnavailable)
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	lastPublishMutex.Lock()
+	lastStr := "never"
+	if !lastPublish.IsZero() {
+		lastStr = time.Since(lastPublish).Round(time.Millisecond).String() + " ago"
+	}
+	lastErr := lastPublishErr
+	lastPublishMutex.Unlock()
+
+	avgLatency := time.Duration(0)
+	if n,sum := vPublishMillis.Count(); n > 0 {
+		avgLatency = time.Duration(sum / float64(n) * float64(time.Millisecond))
+	}
+
+	str := fmt.Sprintf("* Uptime: %s (started %s)\n"+
+		"* Messages: %d (%.1f/sec), aircraft: %.0f\n"+
+		"* Bundles: %d published (last %s), %d errors (last: %q)\n"+
+		"* Publish latency: avg %s, max %s\n\n"+
+		"* Inputs:-\n",
+		time.Since(startTime).Round(time.Second), startTime.Round(time.Second),
+		vMessages.Value(), vMsgsPerSec.Value(), vAircraft.Value(),
+		vBundles.Value(), lastStr, vPublishErrs.Value(), lastErr,
+		avgLatency, time.Duration(vPublishMax.Value() * float64(time.Second)))
+
+	names,stats := allInputStats()
+	for _,name := range names {
+		str += "  " + stats[name].String()
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(str))
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	vitals.Default.WritePrometheus(w)
+}
+
+// }}}
+// {{{ serveStatus
+
+func serveStatus(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/", statusHandler)
+
+	Log.Printf("(serving status on %q)\n", addr)
+	Log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,235 @@
+// Package config reads the YAML config file shared by skypi and the
+// consolidator (-config). It holds the pipeline sizing and timing knobs
+// that used to be hardcoded. Every field is optional; anything left out
+// keeps its default, which is what the code used before there was a config
+// file. Where a setting also has a flag, a flag given on the command line
+// wins over the file.
+//
+//   skypi:
+//     msg_chan_size: 20
+//     max_age: 2s
+//   consolidator:
+//     workers: 128
+//     airspace_interval: 2s
+//     refdata_poll: 1m
+//     fusion_window: 2s
+//     airspace_webhooks:
+//       - url: https://example.com/hooks/airspace
+//         interval: 5s
+//         deltas: true
+//         headers:
+//           Authorization: Bearer ${AIRSPACE_HOOK_TOKEN}
+//
+// Run either binary with -print-config to see the full set, with the
+// values it would use.
+package config
+
+import(
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config has a section for each binary; each ignores the other's.
+type Config struct {
+	Skypi        Skypi        `yaml:"skypi"`
+	Consolidator Consolidator `yaml:"consolidator"`
+}
+
+type Skypi struct {
+	MsgChanSize     int      `yaml:"msg_chan_size"`     // Parsed msgs, from all the readers to the buffers
+	FlushChanSize   int      `yaml:"flush_chan_size"`   // Per receiver, bundles flushed from its buffer
+	PublishChanSize int      `yaml:"publish_chan_size"` // Bundles waiting to be published
+	MaxAge          Duration `yaml:"max_age"`           // -maxage
+	MinWait         Duration `yaml:"min_wait"`          // -minwait
+	StatsInterval   Duration `yaml:"stats_interval"`    // How often to log input stats
+	RateInterval    Duration `yaml:"rate_interval"`     // How often to update the rate gauges
+}
+
+type Consolidator struct {
+	Workers                int       `yaml:"workers"`                     // -n
+	DryrunWorkers          int       `yaml:"dryrun_workers"`              // -n, in dry-run mode
+	ChanSize               int       `yaml:"chan_size"`                   // Between the pipeline stages
+	DispatchQueuePerWorker int       `yaml:"dispatch_queue_per_worker"`   // Fragments queued up, per worker
+	DispatchMaxCoalesce    int       `yaml:"dispatch_max_coalesce"`       // Max msgs in a queued fragment
+	RollWhenThisMany       int       `yaml:"roll_when_this_many"`         // Dedupe set holds 1-2x this many
+	MaxOutstandingMessages int       `yaml:"max_outstanding_messages"`    // Pubsub bundles in flight at once
+	AirspaceInterval       Duration  `yaml:"airspace_interval"`           // For -airspace sinks without an @INTERVAL
+	RefdataPoll            Duration  `yaml:"refdata_poll"`                // How often to reload refdata
+	DrainTimeout           Duration  `yaml:"drain_timeout"`               // -drain
+	FusionWindow           Duration  `yaml:"fusion_window"`               // Zero for no fusion (see airspace.Fusion)
+	AirspaceWebhooks       []Webhook `yaml:"airspace_webhooks,omitempty"` // As well as the -airspace sinks
+}
+
+// Webhook is somewhere to POST airspace snapshots (see
+// airspacesink.WebhookSink). They live here rather than in -airspace, as
+// they need headers; header values have $VARS expanded from the
+// environment, so secrets needn't be in the file. Zero values get the
+// sink's defaults (and airspace_interval).
+type Webhook struct {
+	URL      string            `yaml:"url"`
+	Interval Duration          `yaml:"interval,omitempty"`
+	Deltas   bool              `yaml:"deltas,omitempty"`
+	Headers  map[string]string `yaml:"headers,omitempty"`
+	Timeout  Duration          `yaml:"timeout,omitempty"` // Per attempt
+	Retries  int               `yaml:"retries,omitempty"` // -1 for none
+}
+
+// Default returns the values we used before there was a config file.
+func Default() Config {
+	return Config{
+		Skypi: Skypi{
+			MsgChanSize:     20,
+			FlushChanSize:   3,
+			PublishChanSize: 3,
+			MaxAge:          Duration{2 * time.Second},
+			MinWait:         Duration{1500 * time.Millisecond},
+			StatsInterval:   Duration{5 * time.Minute},
+			RateInterval:    Duration{10 * time.Second},
+		},
+		Consolidator: Consolidator{
+			Workers:                64,
+			DryrunWorkers:          16,
+			ChanSize:               3,
+			DispatchQueuePerWorker: 3,
+			DispatchMaxCoalesce:    500,
+			RollWhenThisMany:       10000,
+			MaxOutstandingMessages: 10,
+			AirspaceInterval:       Duration{time.Second},
+			RefdataPoll:            Duration{30 * time.Second},
+			DrainTimeout:           Duration{30 * time.Second},
+			FusionWindow:           Duration{0},
+		},
+	}
+}
+
+// {{{ Duration
+
+// Duration is a time.Duration that reads and writes as "1m30s".
+type Duration struct{ time.Duration }
+
+func (d Duration)MarshalYAML() (interface{}, error) { return d.String(), nil }
+
+func (d *Duration)UnmarshalYAML(n *yaml.Node) error {
+	var s string
+	if err := n.Decode(&s); err != nil { return err }
+	v,err := time.ParseDuration(s)
+	if err != nil { return fmt.Errorf("line %d: %v", n.Line, err) }
+	d.Duration = v
+	return nil
+}
+
+// }}}
+// {{{ Load, Parse
+
+// Load reads the config file; if filename is empty, it returns the
+// defaults.
+func Load(filename string) (Config, error) {
+	if filename == "" { return Default(), nil }
+	f,err := os.Open(filename)
+	if err != nil { return Config{}, fmt.Errorf("config: %v", err) }
+	defer f.Close()
+
+	c,err := Parse(f)
+	if err != nil { return Config{}, fmt.Errorf("config: %s: %v", filename, err) }
+	return c, nil
+}
+
+// Parse reads a config, on top of the defaults, and validates it. Unknown
+// fields are errors; a misspelled knob shouldn't quietly do nothing.
+func Parse(r io.Reader) (Config, error) {
+	c := Default()
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil && err != io.EOF {
+		return Config{}, err
+	}
+	return c, c.Validate()
+}
+
+// }}}
+// {{{ c.Validate
+
+func (c Config)Validate() error {
+	sizes := []struct{
+		name string
+		val  int
+		min  int
+	}{
+		{"skypi.msg_chan_size", c.Skypi.MsgChanSize, 0},
+		{"skypi.flush_chan_size", c.Skypi.FlushChanSize, 0},
+		{"skypi.publish_chan_size", c.Skypi.PublishChanSize, 0},
+		{"consolidator.workers", c.Consolidator.Workers, 1},
+		{"consolidator.dryrun_workers", c.Consolidator.DryrunWorkers, 1},
+		{"consolidator.chan_size", c.Consolidator.ChanSize, 0},
+		{"consolidator.dispatch_queue_per_worker", c.Consolidator.DispatchQueuePerWorker, 1},
+		{"consolidator.dispatch_max_coalesce", c.Consolidator.DispatchMaxCoalesce, 1},
+		{"consolidator.roll_when_this_many", c.Consolidator.RollWhenThisMany, 1},
+		{"consolidator.max_outstanding_messages", c.Consolidator.MaxOutstandingMessages, 1},
+	}
+	for _,s := range sizes {
+		if s.val < s.min { return fmt.Errorf("%s is %d; must be at least %d", s.name, s.val, s.min) }
+	}
+
+	durations := []struct{
+		name string
+		val  Duration
+	}{
+		{"skypi.max_age", c.Skypi.MaxAge},
+		{"skypi.min_wait", c.Skypi.MinWait},
+		{"skypi.stats_interval", c.Skypi.StatsInterval},
+		{"skypi.rate_interval", c.Skypi.RateInterval},
+		{"consolidator.airspace_interval", c.Consolidator.AirspaceInterval},
+		{"consolidator.refdata_poll", c.Consolidator.RefdataPoll},
+		{"consolidator.drain_timeout", c.Consolidator.DrainTimeout},
+	}
+	for _,d := range durations {
+		if d.val.Duration <= 0 { return fmt.Errorf("%s is %s; must be positive", d.name, d.val) }
+	}
+
+	if c.Consolidator.FusionWindow.Duration < 0 {
+		return fmt.Errorf("consolidator.fusion_window is %s; must be positive, or zero for off",
+			c.Consolidator.FusionWindow)
+	}
+
+	for i,w := range c.Consolidator.AirspaceWebhooks {
+		name := fmt.Sprintf("consolidator.airspace_webhooks[%d]", i)
+		if !strings.HasPrefix(w.URL, "http://") && !strings.HasPrefix(w.URL, "https://") {
+			return fmt.Errorf("%s.url is %q; must be http(s)", name, w.URL)
+		}
+		if w.Interval.Duration < 0 || w.Timeout.Duration < 0 {
+			return fmt.Errorf("%s: durations can't be negative", name)
+		}
+		if w.Retries < -1 { return fmt.Errorf("%s.retries is %d; must be at least -1", name, w.Retries) }
+	}
+
+	return nil
+}
+
+// }}}
+// {{{ c.YAML
+
+// YAML returns the config as a file that Load would read back in.
+func (c Config)YAML() []byte {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	enc.Encode(c) // Can't fail; it's all ints and strings
+	enc.Close()
+	return buf.Bytes()
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
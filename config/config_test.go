@@ -0,0 +1,106 @@
+package config
+
+import(
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefault(t *testing.T) {
+	if err := Default().Validate(); err != nil { t.Errorf("defaults don't validate: %v", err) }
+
+	c,err := Load("")
+	if err != nil { t.Fatal(err) }
+	if !reflect.DeepEqual(c, Default()) { t.Errorf("Load(\"\") isn't the defaults: %+v", c) }
+}
+
+func TestParse(t *testing.T) {
+	in := `
+skypi:
+  msg_chan_size: 50
+consolidator:
+  workers: 128
+  airspace_interval: 2500ms
+`
+	c,err := Parse(strings.NewReader(in))
+	if err != nil { t.Fatal(err) }
+
+	want := Default()
+	want.Skypi.MsgChanSize = 50
+	want.Consolidator.Workers = 128
+	want.Consolidator.AirspaceInterval = Duration{2500 * time.Millisecond}
+	if !reflect.DeepEqual(c, want) { t.Errorf("got %+v\nwanted %+v", c, want) }
+
+	// An empty file is fine too
+	if c,err := Parse(strings.NewReader("")); err != nil || !reflect.DeepEqual(c, Default()) {
+		t.Errorf("empty file: %+v, %v", c, err)
+	}
+}
+
+func TestParseWebhooks(t *testing.T) {
+	in := `
+consolidator:
+  airspace_webhooks:
+    - url: https://example.com/hook
+      interval: 5s
+      deltas: true
+      headers:
+        Authorization: Bearer ${TOKEN}
+    - url: http://localhost:8000/
+`
+	c,err := Parse(strings.NewReader(in))
+	if err != nil { t.Fatal(err) }
+
+	want := []Webhook{
+		{URL:"https://example.com/hook", Interval:Duration{5 * time.Second}, Deltas:true,
+			Headers:map[string]string{"Authorization":"Bearer ${TOKEN}"}},
+		{URL:"http://localhost:8000/"},
+	}
+	if !reflect.DeepEqual(c.Consolidator.AirspaceWebhooks, want) {
+		t.Errorf("got %+v\nwanted %+v", c.Consolidator.AirspaceWebhooks, want)
+	}
+
+	// The unset fields should stay out of the way
+	back,err := Parse(bytes.NewReader(c.YAML()))
+	if err != nil { t.Fatal(err) }
+	if !reflect.DeepEqual(back, c) { t.Errorf("round trip: got %+v\nwanted %+v", back, c) }
+	if bytes.Contains(c.YAML(), []byte("retries")) { t.Errorf("zero values were written out:\n%s", c.YAML()) }
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct{
+		in   string
+		want string // A substring of the error
+	}{
+		{"consolidator:\n  wrokers: 10\n", "wrokers"},
+		{"consolidator:\n  workers: 0\n", "consolidator.workers"},
+		{"skypi:\n  msg_chan_size: -1\n", "skypi.msg_chan_size"},
+		{"consolidator:\n  refdata_poll: soon\n", "soon"},
+		{"consolidator:\n  refdata_poll: -5s\n", "consolidator.refdata_poll"},
+		{"consolidator:\n  fusion_window: -1s\n", "consolidator.fusion_window"},
+		{"skypi: [1, 2]\n", "cannot unmarshal"},
+		{"consolidator:\n  airspace_webhooks:\n    - url: example.com\n", "airspace_webhooks[0].url"},
+		{"consolidator:\n  airspace_webhooks:\n    - url: http://a\n      retries: -2\n", "retries"},
+	}
+	for _,test := range tests {
+		_,err := Parse(strings.NewReader(test.in))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got err %v, wanted one about %q", test.in, err, test.want)
+		}
+	}
+}
+
+func TestYAMLRoundTrip(t *testing.T) {
+	c := Default()
+	c.Consolidator.RefdataPoll = Duration{time.Minute}
+	c.Skypi.PublishChanSize = 0
+
+	out := c.YAML()
+	if !bytes.Contains(out, []byte("refdata_poll: 1m0s")) { t.Errorf("durations should be strings:\n%s", out) }
+
+	back,err := Parse(bytes.NewReader(out))
+	if err != nil { t.Fatal(err) }
+	if !reflect.DeepEqual(back, c) { t.Errorf("round trip: got %+v\nwanted %+v", back, c) }
+}
@@ -0,0 +1,146 @@
+// Package enrich decorates aircraft with reference data: the airframe
+// (registration, equipment type) and the schedule (flight number, origin,
+// destination). The data comes from a chain of providers - the Datastore
+// refdata caches, local registration databases, callsign-to-route tables -
+// and the first provider to know the answer wins.
+package enrich
+
+import(
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/skypies/adsb"
+	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/pi/airspace"
+	"github.com/skypies/pi/registry"
+)
+
+// A Provider looks up reference data. Both lookups return nil if the
+// provider doesn't know; implementations must be safe for concurrent use.
+type Provider interface {
+	Name() string
+	Airframe(icao adsb.IcaoId) *fdb.Airframe
+	Schedule(icao adsb.IcaoId, callsign string) *fdb.Schedule
+}
+
+// {{{ NewProvider
+
+// NewProvider builds a provider from a spec string. The Datastore caches
+// need more setup than fits in a string, so use NewRefCaches for those.
+//   airframes:FILENAME  - airframes, from CSV (or JSON, if FILENAME ends in .json)
+//   routes:FILENAME     - schedules, from a CSV of callsign,origin,destination
+//   registry:FILENAME   - airframes, from an index built by cmd/regimport
+func NewProvider(spec string) (Provider, error) {
+	kind,arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind,arg = spec[:i], spec[i+1:]
+	}
+	if arg == "" { return nil, fmt.Errorf("enrich: %q needs a filename", spec) }
+
+	switch kind {
+	case "airframes":
+		return LoadAirframes(arg)
+	case "routes":
+		return LoadRoutes(arg)
+	case "registry":
+		return registry.Open(arg)
+	default:
+		return nil, fmt.Errorf("enrich: unknown provider spec %q", spec)
+	}
+}
+
+// }}}
+// {{{ Enricher{}
+
+// Enricher runs through its providers in order. A nil *Enricher is fine
+// to use, and knows nothing.
+type Enricher struct {
+	Providers []Provider
+
+	mu      sync.Mutex
+	lookups map[string]int64 // "provider/kind"; misses are under "none/kind"
+}
+
+func New(providers ...Provider) *Enricher {
+	return &Enricher{Providers:providers, lookups:map[string]int64{}}
+}
+
+func (e *Enricher)count(provider, kind string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lookups[provider+"/"+kind]++
+}
+
+// Lookups returns how many lookups each provider answered, keyed by
+// "provider/kind" (kind is airframe or schedule); misses are "none/kind".
+func (e *Enricher)Lookups() map[string]int64 {
+	ret := map[string]int64{}
+	if e == nil { return ret }
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for k,v := range e.lookups { ret[k] = v }
+	return ret
+}
+
+// }}}
+// {{{ e.Airframe, e.Schedule
+
+func (e *Enricher)Airframe(icao adsb.IcaoId) *fdb.Airframe {
+	if e == nil { return nil }
+	for _,p := range e.Providers {
+		if af := p.Airframe(icao); af != nil {
+			e.count(p.Name(), "airframe")
+			return af
+		}
+	}
+	e.count("none", "airframe")
+	return nil
+}
+
+func (e *Enricher)Schedule(icao adsb.IcaoId, callsign string) *fdb.Schedule {
+	if e == nil { return nil }
+	for _,p := range e.Providers {
+		if s := p.Schedule(icao, callsign); s != nil {
+			e.count(p.Name(), "schedule")
+			return s
+		}
+	}
+	e.count("none", "schedule")
+	return nil
+}
+
+// }}}
+// {{{ e.Decorate
+
+// Decorate fills in whatever the aircraft is missing; it's meant for
+// airspace.Airspace.Decorate.
+func (e *Enricher)Decorate(ad *airspace.AircraftData) {
+	if e == nil || ad.Msg == nil { return }
+
+	if ad.Registration == "" {
+		if af := e.Airframe(ad.Msg.Icao24); af != nil {
+			ad.Airframe = *af
+		}
+	}
+
+	if ad.Schedule.ICAO == "" && ad.Msg.Callsign != "" {
+		// Some airlines broadcast a bare flight number; the airframe might
+		// know whose it is.
+		cs := fdb.NewCallsign(ad.Msg.Callsign)
+		cs.MaybeAddPrefix(ad.CallsignPrefix)
+		if s := e.Schedule(ad.Msg.Icao24, cs.String()); s != nil {
+			ad.Schedule = *s
+		}
+	}
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
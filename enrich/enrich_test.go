@@ -0,0 +1,112 @@
+// go test -v github.com/skypies/pi/enrich
+package enrich
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/skypies/adsb"
+	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/flightdb/ref"
+	"github.com/skypies/pi/airspace"
+)
+
+func writeFile(t *testing.T, name, contents string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(contents), 0644); err != nil { t.Fatal(err) }
+	return filename
+}
+
+func TestLoadAirframes(t *testing.T) {
+	files := map[string]string{
+		"plain.csv":  "# A comment\na81bd0,N12345,B738,SWA\nA81BD1,N54321,C172\n",
+		"header.csv": "Registration,Hex,Owner,TypeCode\nN12345,a81bd0,Bob,B738\nN54321,A81BD1,Alice,C172\n",
+		"json.json":  `[{"Icao24":"a81bd0","Registration":"N12345","EquipmentType":"B738"},` +
+			`{"Icao24":"A81BD1","Registration":"N54321","EquipmentType":"C172"}]`,
+	}
+	for name,contents := range files {
+		p,err := NewProvider("airframes:" + writeFile(t, name, contents))
+		if err != nil { t.Errorf("%s: %v", name, err); continue }
+		if af := p.Airframe("A81BD0"); af == nil || af.Registration != "N12345" || af.EquipmentType != "B738" {
+			t.Errorf("%s: A81BD0: %v", name, af)
+		}
+		if af := p.Airframe("A81BD1"); af == nil || af.Registration != "N54321" {
+			t.Errorf("%s: A81BD1: %v", name, af)
+		}
+		if af := p.Airframe("FFFFFF"); af != nil { t.Errorf("%s: unknown aircraft: %v", name, af) }
+	}
+
+	if _,err := LoadAirframes(writeFile(t, "bad.csv", "registration,owner\nN12345,Bob\n")); err == nil {
+		t.Errorf("expected an error for a header without icao24")
+	}
+}
+
+func TestLoadRoutes(t *testing.T) {
+	p,err := NewProvider("routes:" + writeFile(t, "routes.csv", "callsign,from,to\nUAL0123,SFO,ORD\nN839AL,PAO,SQL\n"))
+	if err != nil { t.Fatal(err) }
+
+	if s := p.Schedule("A81BD0", "UAL123"); s == nil || s.ICAO != "UAL" || s.Number != 123 || s.Destination != "ORD" {
+		t.Errorf("UAL123: %+v", s)
+	}
+	if s := p.Schedule("A81BD0", "N839AL"); s == nil || s.Origin != "PAO" || s.Number != 0 {
+		t.Errorf("N839AL: %+v", s)
+	}
+	if s := p.Schedule("A81BD0", "UAL124"); s != nil { t.Errorf("UAL124: %+v", s) }
+}
+
+func TestEnricher(t *testing.T) {
+	first,second := NewTable("first"), NewTable("second")
+	first.AddAirframe(fdb.Airframe{Icao24:"A81BD0", Registration:"N1"})
+	second.AddAirframe(fdb.Airframe{Icao24:"A81BD0", Registration:"N2"})
+	second.AddAirframe(fdb.Airframe{Icao24:"A81BD1", Registration:"N3", CallsignPrefix:"SWA"})
+	second.AddRoute("SWA948", "SJC", "LAS")
+
+	e := New(first, second)
+	if af := e.Airframe("A81BD0"); af.Registration != "N1" { t.Errorf("first provider should win: %v", af) }
+
+	// A bare flight number gets the airframe's prefix
+	ad := airspace.AircraftData{Msg:&adsb.CompositeMsg{Msg:adsb.Msg{Icao24:"A81BD1", Callsign:"948"}}}
+	e.Decorate(&ad)
+	if ad.Registration != "N3" || ad.Schedule.ICAO != "SWA" || ad.Destination != "LAS" {
+		t.Errorf("decorated: %+v", ad)
+	}
+
+	e.Airframe("FFFFFF")
+	lookups := e.Lookups()
+	if lookups["first/airframe"] != 1 || lookups["second/airframe"] != 1 ||
+		lookups["second/schedule"] != 1 || lookups["none/airframe"] != 1 {
+		t.Errorf("lookups: %v", lookups)
+	}
+
+	var nilEnricher *Enricher
+	if nilEnricher.Airframe("A81BD0") != nil { t.Errorf("nil enricher knew something") }
+	nilEnricher.Decorate(&ad)
+}
+
+func TestRefCaches(t *testing.T) {
+	c := NewRefCaches()
+	if c.Airframe("A81BD0") != nil { t.Errorf("empty caches knew something") }
+
+	afs := ref.BlankAirframeCache()
+	afs.Set(&fdb.Airframe{Icao24:"A81BD0", Registration:"N1"})
+	scheds := ref.BlankScheduleCache()
+	snap := &fdb.FlightSnapshot{}
+	snap.Flight.Identity.Callsign = "UAL123"
+	snap.Flight.Identity.Schedule = fdb.Schedule{ICAO:"UAL", Number:123, Destination:"ORD"}
+	scheds.Map["A81BD0"] = snap
+	c.Set(&afs, &scheds)
+
+	if af := c.Airframe("A81BD0"); af == nil || af.Registration != "N1" { t.Errorf("airframe: %v", af) }
+	if s := c.Schedule("A81BD0", "UAL0123"); s == nil || s.Destination != "ORD" { t.Errorf("schedule: %v", s) }
+	if s := c.Schedule("A81BD0", "SWA1"); s != nil { t.Errorf("stale schedule: %v", s) }
+}
+
+func TestBadSpecs(t *testing.T) {
+	for _,spec := range []string{"", "airframes", "routes:", "datastore", "sqlite:foo.db",
+		"airframes:/no/such/file.csv"} {
+		if _,err := NewProvider(spec); err == nil {
+			t.Errorf("spec %q: expected an error", spec)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package enrich
+
+import(
+	"sync"
+
+	"github.com/skypies/adsb"
+	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/flightdb/ref"
+)
+
+// RefCaches is a provider backed by the Datastore refdata singletons
+// (ref.AirframeCache and ref.ScheduleCache). It doesn't load them itself;
+// whoever polls Datastore should call Set with each new pair.
+type RefCaches struct {
+	sync.RWMutex
+	airframes *ref.AirframeCache
+	schedules *ref.ScheduleCache
+}
+
+func NewRefCaches() *RefCaches { return &RefCaches{} }
+
+func (c *RefCaches)Name() string { return "datastore" }
+
+// Set replaces the caches; a nil leaves that cache as it was.
+func (c *RefCaches)Set(airframes *ref.AirframeCache, schedules *ref.ScheduleCache) {
+	c.Lock()
+	defer c.Unlock()
+	if airframes != nil { c.airframes = airframes }
+	if schedules != nil { c.schedules = schedules }
+}
+
+// Sizes returns the number of airframes and schedules held.
+func (c *RefCaches)Sizes() (int, int) {
+	c.RLock()
+	defer c.RUnlock()
+	nAirframes,nSchedules := 0, 0
+	if c.airframes != nil { nAirframes = len(c.airframes.Map) }
+	if c.schedules != nil { nSchedules = len(c.schedules.Map) }
+	return nAirframes, nSchedules
+}
+
+func (c *RefCaches)Airframe(icao adsb.IcaoId) *fdb.Airframe {
+	c.RLock()
+	defer c.RUnlock()
+	if c.airframes == nil { return nil }
+	if af := c.airframes.Get(string(icao)); af != nil {
+		ret := *af
+		return &ret
+	}
+	return nil
+}
+
+// Schedule is keyed on the aircraft; if the cached schedule is for a
+// different callsign, it's stale, and we ignore it.
+func (c *RefCaches)Schedule(icao adsb.IcaoId, callsign string) *fdb.Schedule {
+	c.RLock()
+	defer c.RUnlock()
+	if c.schedules == nil { return nil }
+	snap := c.schedules.Get(string(icao))
+	if snap == nil { return nil }
+	if callsign != "" && snap.Flight.Identity.Callsign != "" &&
+		!fdb.CallsignStringsEqual(callsign, snap.Flight.Identity.Callsign) {
+		return nil
+	}
+	ret := snap.Flight.Identity.Schedule
+	return &ret
+}
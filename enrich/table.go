@@ -0,0 +1,184 @@
+package enrich
+
+import(
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/skypies/adsb"
+	fdb "github.com/skypies/flightdb"
+)
+
+// Table is a provider that holds everything in memory; it's what the
+// file-based providers load into.
+type Table struct {
+	name      string
+	airframes map[adsb.IcaoId]*fdb.Airframe
+	routes    map[string]*fdb.Schedule // Keyed by normalized callsign
+}
+
+func NewTable(name string) *Table {
+	return &Table{
+		name:      name,
+		airframes: map[adsb.IcaoId]*fdb.Airframe{},
+		routes:    map[string]*fdb.Schedule{},
+	}
+}
+
+func (t *Table)Name() string { return t.name }
+func (t *Table)Len() int { return len(t.airframes) + len(t.routes) }
+
+func (t *Table)AddAirframe(af fdb.Airframe) {
+	af.Icao24 = strings.ToUpper(af.Icao24)
+	t.airframes[adsb.IcaoId(af.Icao24)] = &af
+}
+
+// AddRoute adds a route for a callsign; the airline & flight number come
+// from the callsign, if it's of the form UAL123.
+func (t *Table)AddRoute(callsign, origin, destination string) {
+	cs := fdb.NewCallsign(strings.ToUpper(callsign))
+	s := fdb.Schedule{Origin:origin, Destination:destination}
+	if cs.CallsignType == fdb.IcaoFlightNumber {
+		s.ICAO,s.Number = cs.IcaoPrefix, cs.Number
+	}
+	t.routes[cs.String()] = &s
+}
+
+func (t *Table)Airframe(icao adsb.IcaoId) *fdb.Airframe {
+	if af,exists := t.airframes[icao]; exists {
+		ret := *af
+		return &ret
+	}
+	return nil
+}
+
+func (t *Table)Schedule(icao adsb.IcaoId, callsign string) *fdb.Schedule {
+	if callsign == "" { return nil }
+	if s,exists := t.routes[fdb.NewCallsign(callsign).String()]; exists {
+		ret := *s
+		return &ret
+	}
+	return nil
+}
+
+// {{{ LoadAirframes
+
+// Column names we understand in an airframe CSV header, and what they mean.
+var airframeColumns = map[string]string{
+	"icao24": "icao24", "icao": "icao24", "hex": "icao24",
+	"registration": "registration", "reg": "registration",
+	"equipment_type": "type", "type": "type", "typecode": "type",
+	"callsign_prefix": "prefix", "operator": "prefix",
+}
+
+// LoadAirframes reads airframes from a file. JSON files hold an array of
+// fdb.Airframe. CSV files have the columns icao24,registration,type and
+// (optionally) callsign_prefix; if the first line is a header, columns are
+// found by name instead, and any others ignored. Lines starting with # are
+// comments.
+func LoadAirframes(filename string) (*Table, error) {
+	f,err := os.Open(filename)
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	t := NewTable("airframes:" + filepath.Base(filename))
+	if strings.HasSuffix(filename, ".json") {
+		afs := []fdb.Airframe{}
+		if err := json.NewDecoder(f).Decode(&afs); err != nil {
+			return nil, fmt.Errorf("enrich: %s: %v", filename, err)
+		}
+		for _,af := range afs { t.AddAirframe(af) }
+		return t, nil
+	}
+
+	cols := map[string]int{"icao24":0, "registration":1, "type":2, "prefix":3}
+	err = readCSV(f, func(i int, rec []string) error {
+		if i == 0 {
+			if header := csvHeader(rec, airframeColumns); header != nil {
+				if _,exists := header["icao24"]; !exists {
+					return fmt.Errorf("no icao24 column in header")
+				}
+				cols = header
+				return nil
+			}
+		}
+		get := func(col string) string {
+			if j,exists := cols[col]; exists && j < len(rec) { return strings.TrimSpace(rec[j]) }
+			return ""
+		}
+		if get("icao24") == "" { return fmt.Errorf("line %d: no icao24", i+1) }
+		t.AddAirframe(fdb.Airframe{
+			Icao24:         get("icao24"),
+			Registration:   get("registration"),
+			EquipmentType:  get("type"),
+			CallsignPrefix: get("prefix"),
+		})
+		return nil
+	})
+	if err != nil { return nil, fmt.Errorf("enrich: %s: %v", filename, err) }
+	return t, nil
+}
+
+// }}}
+// {{{ LoadRoutes
+
+// LoadRoutes reads a CSV of callsign,origin,destination (with an optional
+// header line).
+func LoadRoutes(filename string) (*Table, error) {
+	f,err := os.Open(filename)
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	t := NewTable("routes:" + filepath.Base(filename))
+	err = readCSV(f, func(i int, rec []string) error {
+		if len(rec) < 3 { return fmt.Errorf("line %d: want callsign,origin,destination", i+1) }
+		if i == 0 && strings.EqualFold(rec[0], "callsign") { return nil }
+		t.AddRoute(strings.TrimSpace(rec[0]), strings.TrimSpace(rec[1]), strings.TrimSpace(rec[2]))
+		return nil
+	})
+	if err != nil { return nil, fmt.Errorf("enrich: %s: %v", filename, err) }
+	return t, nil
+}
+
+// }}}
+// {{{ readCSV, csvHeader
+
+func readCSV(r io.Reader, f func(i int, rec []string) error) error {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	for i:=0; ; i++ {
+		rec,err := cr.Read()
+		if err == io.EOF { return nil }
+		if err != nil { return err }
+		if err := f(i, rec); err != nil { return err }
+	}
+}
+
+// csvHeader returns the column index of each field it recognizes, or nil
+// if the record doesn't look like a header.
+func csvHeader(rec []string, names map[string]string) map[string]int {
+	cols := map[string]int{}
+	for i,name := range rec {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if field,exists := names[name]; exists {
+			if _,seen := cols[field]; !seen { cols[field] = i }
+		}
+	}
+	if len(cols) == 0 { return nil }
+	return cols
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,189 @@
+package registry
+
+import(
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// {{{ csvRecords
+
+// csvRecords calls f with each record, with fields trimmed; the first
+// record (the header, if there is one) has its names lower-cased too.
+// Registry dumps are messy: byte order marks, trailing commas, stray
+// quotes, space padding.
+func csvRecords(r io.Reader, f func(i int, rec []string) error) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	cr.ReuseRecord = true
+	for i:=0; ; i++ {
+		rec,err := cr.Read()
+		if err == io.EOF { return nil }
+		if err != nil { return err }
+		for j := range rec {
+			rec[j] = strings.TrimSpace(strings.TrimPrefix(rec[j], "\uFEFF"))
+			if i == 0 { rec[j] = strings.ToLower(rec[j]) }
+		}
+		if err := f(i, rec); err != nil { return err }
+	}
+}
+
+type columns map[string]int
+
+// index finds the columns we want (each has a list of names it might go
+// by), in a header.
+func index(header []string, want map[string][]string) columns {
+	cols := columns{}
+	for field,names := range want {
+		for _,name := range names {
+			for i,h := range header {
+				if h == name {
+					if _,seen := cols[field]; !seen { cols[field] = i }
+				}
+			}
+		}
+	}
+	return cols
+}
+
+func (c columns)get(rec []string, field string) string {
+	if i,exists := c[field]; exists && i < len(rec) { return rec[i] }
+	return ""
+}
+
+// }}}
+// {{{ ReadFAA
+
+// ReadFAA reads the FAA's releasable aircraft database: master is
+// MASTER.txt, and acftref (which may be nil) is ACFTREF.txt, which has the
+// manufacturer & model for each MFR MDL CODE. Both have header lines.
+// https://www.faa.gov/licenses_certificates/aircraft_certification/aircraft_registry/releasable_aircraft_download
+// It returns the number of records passed to f, and the number skipped
+// (mostly, those with no Mode S address).
+func ReadFAA(master, acftref io.Reader, f func(Record) error) (int, int, error) {
+	type model struct{ mfr, model string }
+	models := map[string]model{}
+	if acftref != nil {
+		var cols columns
+		err := csvRecords(acftref, func(i int, rec []string) error {
+			if i == 0 {
+				cols = index(rec, map[string][]string{"code":{"code"}, "mfr":{"mfr"}, "model":{"model"}})
+				if len(cols) < 3 { return fmt.Errorf("ACFTREF: want CODE, MFR & MODEL columns, got %v", rec) }
+				return nil
+			}
+			models[cols.get(rec, "code")] = model{cols.get(rec, "mfr"), cols.get(rec, "model")}
+			return nil
+		})
+		if err != nil { return 0, 0, fmt.Errorf("registry: %v", err) }
+	}
+
+	var cols columns
+	n,skipped := 0, 0
+	err := csvRecords(master, func(i int, rec []string) error {
+		if i == 0 {
+			cols = index(rec, map[string][]string{
+				"n":     {"n-number"},
+				"hex":   {"mode s code hex"},
+				"octal": {"mode s code"},
+				"mdl":   {"mfr mdl code"},
+				"year":  {"year mfr"},
+				"name":  {"name"},
+			})
+			if _,exists := cols["n"]; !exists { return fmt.Errorf("MASTER: no N-NUMBER column") }
+			return nil
+		}
+
+		icao,ok := NormalizeHex(cols.get(rec, "hex"))
+		if !ok {
+			// Older dumps only have the octal form
+			if v,err := strconv.ParseUint(cols.get(rec, "octal"), 8, 32); err == nil {
+				icao,ok = NormalizeHex(fmt.Sprintf("%06X", v))
+			}
+		}
+		if !ok || cols.get(rec, "n") == "" { skipped++; return nil }
+
+		m := models[cols.get(rec, "mdl")]
+		year,_ := strconv.Atoi(cols.get(rec, "year"))
+		n++
+		return f(Record{
+			Icao24:       icao,
+			Registration: "N" + cols.get(rec, "n"),
+			Manufacturer: m.mfr,
+			Model:        m.model,
+			Owner:        cols.get(rec, "name"),
+			Year:         year,
+			Source:       "faa",
+		})
+	})
+	if err != nil { return n, skipped, fmt.Errorf("registry: %v", err) }
+	return n, skipped, nil
+}
+
+// }}}
+// {{{ ReadHexCSV
+
+// The columns ReadHexCSV understands; the names cover our own format, and
+// the OpenSky aircraft database.
+var hexCSVColumns = map[string][]string{
+	"hex":    {"icao24", "hex", "icao", "mode s code hex", "modes"},
+	"reg":    {"registration", "reg", "n-number", "tail"},
+	"type":   {"typecode", "type", "icaotype", "equipment_type"},
+	"mfr":    {"manufacturername", "manufacturer", "mfr"},
+	"model":  {"model"},
+	"prefix": {"operatoricao", "callsign_prefix", "operator_icao"},
+	"owner":  {"owner", "operator"},
+	"year":   {"built", "year"},
+}
+
+// ReadHexCSV reads a generic CSV that maps ICAO addresses to registrations
+// (and perhaps more). If the first line is a header, columns are found by
+// name (see hexCSVColumns); if not, the columns are icao24,registration,
+// and optionally type. It returns the number of records passed to f, and
+// the number skipped.
+func ReadHexCSV(r io.Reader, source string, f func(Record) error) (int, int, error) {
+	cols := columns{"hex":0, "reg":1, "type":2}
+	n,skipped := 0, 0
+	err := csvRecords(r, func(i int, rec []string) error {
+		if i == 0 {
+			if _,ok := NormalizeHex(rec[0]); !ok {
+				cols = index(rec, hexCSVColumns)
+				if _,exists := cols["hex"]; !exists { return fmt.Errorf("%s: no icao24 column in header", source) }
+				return nil
+			}
+		}
+
+		icao,ok := NormalizeHex(cols.get(rec, "hex"))
+		if !ok || cols.get(rec, "reg") == "" { skipped++; return nil }
+		year,_ := strconv.Atoi(cols.get(rec, "year"))
+		if len(cols.get(rec, "year")) > 4 { // OpenSky has dates
+			year,_ = strconv.Atoi(cols.get(rec, "year")[:4])
+		}
+		n++
+		return f(Record{
+			Icao24:         icao,
+			Registration:   strings.ToUpper(cols.get(rec, "reg")),
+			Manufacturer:   cols.get(rec, "mfr"),
+			Model:          cols.get(rec, "model"),
+			EquipmentType:  strings.ToUpper(cols.get(rec, "type")),
+			CallsignPrefix: strings.ToUpper(cols.get(rec, "prefix")),
+			Owner:          cols.get(rec, "owner"),
+			Year:           year,
+			Source:         source,
+		})
+	})
+	if err != nil { return n, skipped, fmt.Errorf("registry: %v", err) }
+	return n, skipped, nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
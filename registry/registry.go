@@ -0,0 +1,205 @@
+// Package registry keeps a local index of aircraft registrations, keyed by
+// ICAO 24-bit address, built from public registry dumps (see cmd/regimport).
+// An Index can be used as an enrichment provider (see package enrich), so
+// we can fill in airframes without any cloud dependency.
+package registry
+
+import(
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/skypies/adsb"
+	fdb "github.com/skypies/flightdb"
+)
+
+var(
+	bucketRecords = []byte("records")
+	bucketMeta    = []byte("meta")
+
+	hexRegexp = regexp.MustCompile("^[0-9A-F]{6}$")
+)
+
+// Record is what we know about an airframe.
+type Record struct {
+	Icao24         adsb.IcaoId
+	Registration   string
+	Manufacturer   string
+	Model          string
+	EquipmentType  string // ICAO type designator (e.g. B738), if the source has it
+	CallsignPrefix string // ICAO code of the operator, if the source has it
+	Owner          string
+	Year           int
+	Source         string // Where the record came from
+}
+
+// Airframe turns the record into what flightdb wants. If we have no ICAO
+// type designator, the model will have to do.
+func (r Record)Airframe() fdb.Airframe {
+	af := fdb.Airframe{
+		Icao24:         string(r.Icao24),
+		Registration:   r.Registration,
+		EquipmentType:  r.EquipmentType,
+		CallsignPrefix: r.CallsignPrefix,
+	}
+	if af.EquipmentType == "" { af.EquipmentType = r.Model }
+	return af
+}
+
+// NormalizeHex returns the address as six upper-case hex digits, or false
+// if it isn't one.
+func NormalizeHex(s string) (adsb.IcaoId, bool) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if len(s) > 0 && len(s) < 6 { s = strings.Repeat("0", 6-len(s)) + s }
+	if !hexRegexp.MatchString(s) || s == "000000" { return "", false }
+	return adsb.IcaoId(s), true
+}
+
+// {{{ Index{}
+
+// Index is the on-disk index, a BoltDB file with a bucket of JSON records.
+type Index struct {
+	db   *bolt.DB
+	name string
+}
+
+// Open opens an index read-only; any number of processes can do that at
+// once.
+func Open(filename string) (*Index, error) {
+	db,err := bolt.Open(filename, 0644, &bolt.Options{ReadOnly:true, Timeout:5*time.Second})
+	if err != nil { return nil, fmt.Errorf("registry: open %q: %v", filename, err) }
+	return &Index{db:db, name:"registry:" + filepath.Base(filename)}, nil
+}
+
+func (ix *Index)Close() error { return ix.db.Close() }
+
+// Get returns the record for the aircraft, or nil if there isn't one.
+func (ix *Index)Get(icao adsb.IcaoId) (*Record, error) {
+	var rec *Record
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketRecords)
+		if b == nil { return nil }
+		if data := b.Get([]byte(icao)); data != nil {
+			rec = &Record{}
+			return json.Unmarshal(data, rec)
+		}
+		return nil
+	})
+	return rec, err
+}
+
+// Len returns the number of records.
+func (ix *Index)Len() int {
+	n := 0
+	ix.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucketRecords); b != nil { n = b.Stats().KeyN }
+		return nil
+	})
+	return n
+}
+
+// Meta returns when the index was built, and from what.
+func (ix *Index)Meta() (time.Time, []string) {
+	built,sources := time.Time{}, []string{}
+	ix.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMeta)
+		if b == nil { return nil }
+		built,_ = time.Parse(time.RFC3339, string(b.Get([]byte("built"))))
+		json.Unmarshal(b.Get([]byte("sources")), &sources)
+		return nil
+	})
+	return built, sources
+}
+
+// }}}
+// {{{ ix.Name, ix.Airframe, ix.Schedule
+
+// These make an Index an enrich.Provider.
+
+func (ix *Index)Name() string { return ix.name }
+
+func (ix *Index)Airframe(icao adsb.IcaoId) *fdb.Airframe {
+	rec,err := ix.Get(icao)
+	if err != nil || rec == nil { return nil }
+	af := rec.Airframe()
+	return &af
+}
+
+// Registries don't know about schedules.
+func (ix *Index)Schedule(icao adsb.IcaoId, callsign string) *fdb.Schedule { return nil }
+
+// }}}
+// {{{ Build
+
+const buildBatchSize = 10000
+
+// Build creates a fresh index in filename, from whatever records fill
+// calls put with; later records for an address replace earlier ones. The
+// index is built alongside, and renamed into place at the end, so readers
+// never see a half-built one (but hang on to the old one until they
+// reopen it). It returns the number of records in the new index.
+func Build(filename string, sources []string, fill func(put func(Record) error) error) (int, error) {
+	tmp := filename + ".tmp"
+	os.Remove(tmp)
+	db,err := bolt.Open(tmp, 0644, &bolt.Options{Timeout:5*time.Second})
+	if err != nil { return 0, fmt.Errorf("registry: %v", err) }
+	defer os.Remove(tmp) // Once renamed, this is a no-op
+
+	batch := []Record{}
+	flush := func() error {
+		err := db.Update(func(tx *bolt.Tx) error {
+			b,err := tx.CreateBucketIfNotExists(bucketRecords)
+			if err != nil { return err }
+			for _,rec := range batch {
+				data,err := json.Marshal(rec)
+				if err != nil { return err }
+				if err := b.Put([]byte(rec.Icao24), data); err != nil { return err }
+			}
+			return nil
+		})
+		batch = batch[:0]
+		return err
+	}
+
+	err = fill(func(rec Record) error {
+		batch = append(batch, rec)
+		if len(batch) >= buildBatchSize { return flush() }
+		return nil
+	})
+	if err == nil { err = flush() }
+	if err == nil {
+		err = db.Update(func(tx *bolt.Tx) error {
+			b,err := tx.CreateBucketIfNotExists(bucketMeta)
+			if err != nil { return err }
+			srcs,_ := json.Marshal(sources)
+			if err := b.Put([]byte("sources"), srcs); err != nil { return err }
+			return b.Put([]byte("built"), []byte(time.Now().UTC().Format(time.RFC3339)))
+		})
+	}
+
+	n := 0
+	db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucketRecords); b != nil { n = b.Stats().KeyN }
+		return nil
+	})
+	if closeErr := db.Close(); err == nil { err = closeErr }
+	if err != nil { return 0, fmt.Errorf("registry: %v", err) }
+
+	return n, os.Rename(tmp, filename)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
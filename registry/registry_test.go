@@ -0,0 +1,117 @@
+package registry
+
+import(
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/skypies/adsb"
+)
+
+// Trimmed down, but otherwise as the FAA publishes them (BOM, padding,
+// trailing commas).
+var faaMaster = "\uFEFFN-NUMBER,SERIAL NUMBER,MFR MDL CODE,ENG MFR MDL,YEAR MFR,TYPE REGISTRANT,NAME,STREET,MODE S CODE,MODE S CODE HEX,\n" +
+	"100  ,5334     ,7102802,41514,1940,1,JOHNSON HARRY W                ,PO BOX 1 ,50000001,A00001    ,\n" +
+	"10001,13-2     ,05614MX,17003,    ,5,SMITH RANDY                    ,1 MAIN ST,50000053,          ,\n" +
+	"1001A,JP-01    ,3980315,     ,2001,3,UNITED AIRLINES INC            ,         ,        ,          ,\n"
+
+var faaAcftref = "CODE   ,MFR                           ,MODEL               ,TYPE-ACFT,\n" +
+	"7102802,STINSON                       ,108-2               ,4,\n" +
+	"05614MX,BEECH                         ,A36                 ,4,\n"
+
+func TestReadFAA(t *testing.T) {
+	recs := []Record{}
+	n,skipped,err := ReadFAA(strings.NewReader(faaMaster), strings.NewReader(faaAcftref),
+		func(r Record) error { recs = append(recs, r); return nil })
+	if err != nil { t.Fatal(err) }
+	if n != 2 || skipped != 1 { t.Fatalf("read %d, skipped %d; wanted 2, 1", n, skipped) }
+
+	if r := recs[0]; r.Icao24 != "A00001" || r.Registration != "N100" || r.Manufacturer != "STINSON" ||
+		r.Model != "108-2" || r.Year != 1940 || r.Owner != "JOHNSON HARRY W" {
+		t.Errorf("first record: %+v", r)
+	}
+	// No hex column, so it should be from the octal 50000053
+	if r := recs[1]; r.Icao24 != "A0002B" || r.Registration != "N10001" || r.Model != "A36" {
+		t.Errorf("second record: %+v", r)
+	}
+}
+
+func TestReadHexCSV(t *testing.T) {
+	tests := []struct{
+		in   string
+		want []Record
+	}{
+		{"a1b2c3,N12345,C172\nabc,G-ABCD\nzzzzzz,X\n", []Record{
+			{Icao24:"A1B2C3", Registration:"N12345", EquipmentType:"C172", Source:"t"},
+			{Icao24:"000ABC", Registration:"G-ABCD", Source:"t"},
+		}},
+		{"'icao24','registration','manufacturername','model','typecode','operatoricao','owner','built'\n" +
+			"'a835af','N628TS','Boeing','737-8H4','B738','SWA','Southwest','2012-03-01'\n" +
+			"'a835b0','','','','','','',''\n", nil},
+		{"icao24,registration,manufacturername,model,typecode,operatoricao,owner,built\n" +
+			"a835af,N628TS,Boeing,737-8H4,B738,swa,Southwest,2012-03-01\n" +
+			"a835b0,,,,,,,\n", []Record{
+			{Icao24:"A835AF", Registration:"N628TS", Manufacturer:"Boeing", Model:"737-8H4",
+				EquipmentType:"B738", CallsignPrefix:"SWA", Owner:"Southwest", Year:2012, Source:"t"},
+		}},
+	}
+
+	for i,test := range tests {
+		recs := []Record{}
+		_,_,err := ReadHexCSV(strings.NewReader(test.in), "t", func(r Record) error {
+			recs = append(recs, r); return nil
+		})
+		if test.want == nil {
+			if err == nil { t.Errorf("[%d] expected an error, got %v", i, recs) }
+			continue
+		}
+		if err != nil { t.Errorf("[%d] %v", i, err); continue }
+		if len(recs) != len(test.want) { t.Errorf("[%d] got %v, wanted %v", i, recs, test.want); continue }
+		for j := range recs {
+			if recs[j] != test.want[j] { t.Errorf("[%d/%d] got %+v, wanted %+v", i, j, recs[j], test.want[j]) }
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "reg.db")
+
+	build := func(recs ...Record) int {
+		n,err := Build(file, []string{"test"}, func(put func(Record) error) error {
+			for _,r := range recs {
+				if err := put(r); err != nil { return err }
+			}
+			return nil
+		})
+		if err != nil { t.Fatal(err) }
+		return n
+	}
+
+	n := build(Record{Icao24:"A00001", Registration:"N100", Model:"108-2"},
+		Record{Icao24:"A00002", Registration:"N200", EquipmentType:"C172"},
+		Record{Icao24:"A00001", Registration:"N101", Model:"108-3"}) // Replaces the first
+	if n != 2 { t.Errorf("Build: %d records, wanted 2", n) }
+
+	ix,err := Open(file)
+	if err != nil { t.Fatal(err) }
+	if ix.Len() != 2 { t.Errorf("Len %d, wanted 2", ix.Len()) }
+	if built,srcs := ix.Meta(); built.IsZero() || len(srcs) != 1 { t.Errorf("Meta: %v, %v", built, srcs) }
+
+	if af := ix.Airframe("A00001"); af == nil || af.Registration != "N101" || af.EquipmentType != "108-3" {
+		t.Errorf("A00001: %+v", af)
+	}
+	if af := ix.Airframe("A00002"); af == nil || af.EquipmentType != "C172" {
+		t.Errorf("A00002: %+v", af)
+	}
+	if af := ix.Airframe(adsb.IcaoId("FFFFFF")); af != nil { t.Errorf("FFFFFF: %+v", af) }
+
+	// A rebuild replaces the file; the open index still sees the old one.
+	build(Record{Icao24:"B00001", Registration:"N300"})
+	if ix.Airframe("A00001") == nil { t.Errorf("open index lost its records") }
+	ix.Close()
+
+	ix,err = Open(file)
+	if err != nil { t.Fatal(err) }
+	defer ix.Close()
+	if ix.Len() != 1 || ix.Airframe("A00001") != nil { t.Errorf("rebuilt index has %d records", ix.Len()) }
+}
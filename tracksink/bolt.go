@@ -0,0 +1,75 @@
+package tracksink
+
+import(
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/skypies/adsb"
+	fdb "github.com/skypies/flightdb"
+)
+
+// Fixed width, so that keys sort into time order
+const boltKeyFormat = "2006-01-02T15:04:05.000000000Z"
+
+// BoltSink stores fragments in a local BoltDB file. There is a bucket per
+// aircraft, keyed on the timestamp of each fragment's first point, so
+// iterating over a bucket returns that aircraft's fragments in time order.
+// With a Lookup, the aircraft's airframe & schedule are stored alongside.
+type BoltSink struct {
+	db     *bolt.DB
+	Lookup Lookup
+}
+
+func NewBoltSink(filename string) (*BoltSink, error) {
+	db,err := bolt.Open(filename, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil { return nil, fmt.Errorf("tracksink: bolt open %q: %v", filename, err) }
+	return &BoltSink{db:db}, nil
+}
+
+func (s *BoltSink)AddTrackFragment(frag *fdb.TrackFragment, perf map[string]time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error { return s.put(tx, frag) })
+}
+
+// AddTrackFragments writes the whole batch in one transaction.
+func (s *BoltSink)AddTrackFragments(frags []*fdb.TrackFragment) []error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _,frag := range frags {
+			if err := s.put(tx, frag); err != nil { return err }
+		}
+		return nil
+	})
+	return sameError(len(frags), err)
+}
+
+func (s *BoltSink)put(tx *bolt.Tx, frag *fdb.TrackFragment) error {
+	if len(frag.Track) == 0 { return nil }
+
+	data,err := json.Marshal(enrich(frag, s.Lookup))
+	if err != nil { return err }
+	key := []byte(frag.Track[0].TimestampUTC.UTC().Format(boltKeyFormat))
+
+	b,err := tx.CreateBucketIfNotExists([]byte(frag.IcaoId))
+	if err != nil { return err }
+	return b.Put(key, data)
+}
+
+func (s *BoltSink)Close() error { return s.db.Close() }
+
+// Fragments returns all the fragments stored for the aircraft, in time order.
+func (s *BoltSink)Fragments(icao adsb.IcaoId) ([]*fdb.TrackFragment, error) {
+	ret := []*fdb.TrackFragment{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(icao))
+		if b == nil { return nil }
+		return b.ForEach(func(k, v []byte) error {
+			frag := fdb.TrackFragment{}
+			if err := json.Unmarshal(v, &frag); err != nil { return err }
+			ret = append(ret, &frag)
+			return nil
+		})
+	})
+	return ret, err
+}
@@ -0,0 +1,44 @@
+package tracksink
+
+import(
+	"context"
+	"time"
+
+	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/flightdb/fgae"
+	"github.com/skypies/flightdb/ref"
+	dsprovider "github.com/skypies/util/gcp/ds"
+)
+
+// DatastoreSink writes fragments into the flight database, gluing them
+// onto any existing flight.
+type DatastoreSink struct {
+	Provider dsprovider.DatastoreProvider
+
+	// If set, the flight gets the aircraft's airframe (if it doesn't have
+	// one already). fgae doesn't do anything with schedules.
+	Lookup   Lookup
+}
+
+func NewDatastoreSink(p dsprovider.DatastoreProvider) *DatastoreSink {
+	return &DatastoreSink{Provider:p}
+}
+
+func (s *DatastoreSink)AddTrackFragment(frag *fdb.TrackFragment, perf map[string]time.Time) error {
+	if perf == nil { perf = map[string]time.Time{} }
+
+	// fgae wants a whole cache, but only ever looks up this one aircraft
+	var airframes *ref.AirframeCache
+	if s.Lookup != nil {
+		if af := s.Lookup.Airframe(frag.IcaoId); af != nil {
+			cache := ref.BlankAirframeCache()
+			cache.Map[string(frag.IcaoId)] = af
+			airframes = &cache
+		}
+	}
+
+	db := fgae.New(context.Background(), s.Provider)
+	return db.AddTrackFragment(frag, airframes, nil, perf)
+}
+
+func (s *DatastoreSink)Close() error { return nil }
@@ -0,0 +1,55 @@
+package tracksink
+
+import(
+	"sync"
+	"time"
+
+	"github.com/skypies/adsb"
+	fdb "github.com/skypies/flightdb"
+)
+
+// MemorySink keeps every fragment it is given, grouped by aircraft. It is
+// mostly for tests.
+type MemorySink struct {
+	sync.Mutex
+	Frags map[adsb.IcaoId][]*fdb.TrackFragment
+}
+
+func NewMemorySink() *MemorySink {
+	return &MemorySink{Frags: map[adsb.IcaoId][]*fdb.TrackFragment{}}
+}
+
+func (s *MemorySink)AddTrackFragment(frag *fdb.TrackFragment, perf map[string]time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	s.Frags[frag.IcaoId] = append(s.Frags[frag.IcaoId], frag)
+	return nil
+}
+
+func (s *MemorySink)AddTrackFragments(frags []*fdb.TrackFragment) []error {
+	s.Lock()
+	defer s.Unlock()
+	for _,frag := range frags {
+		s.Frags[frag.IcaoId] = append(s.Frags[frag.IcaoId], frag)
+	}
+	return make([]error, len(frags))
+}
+
+func (s *MemorySink)Close() error { return nil }
+
+// Fragments returns the fragments received for the aircraft, in the order
+// they arrived.
+func (s *MemorySink)Fragments(icao adsb.IcaoId) ([]*fdb.TrackFragment, error) {
+	s.Lock()
+	defer s.Unlock()
+	return append([]*fdb.TrackFragment{}, s.Frags[icao]...), nil
+}
+
+// NumFragments returns the total number of fragments held.
+func (s *MemorySink)NumFragments() int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for _,frags := range s.Frags { n += len(frags) }
+	return n
+}
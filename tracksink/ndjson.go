@@ -0,0 +1,53 @@
+package tracksink
+
+import(
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	fdb "github.com/skypies/flightdb"
+)
+
+// NDJSONSink appends each fragment as a single line of JSON to a file,
+// which makes it easy to eyeball, grep, or load into other tools. With a
+// Lookup, each line also has the aircraft's Airframe & Schedule.
+type NDJSONSink struct {
+	sync.Mutex
+	f      *os.File
+	enc    *json.Encoder
+	Lookup Lookup
+}
+
+func NewNDJSONSink(filename string) (*NDJSONSink, error) {
+	f,err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil { return nil, err }
+	return &NDJSONSink{f:f, enc:json.NewEncoder(f)}, nil
+}
+
+func (s *NDJSONSink)AddTrackFragment(frag *fdb.TrackFragment, perf map[string]time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.enc.Encode(enrich(frag, s.Lookup)) // Encode appends the newline
+}
+
+// AddTrackFragments writes the whole batch with a single write.
+func (s *NDJSONSink)AddTrackFragments(frags []*fdb.TrackFragment) []error {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _,frag := range frags {
+		if err := enc.Encode(enrich(frag, s.Lookup)); err != nil { return sameError(len(frags), err) }
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	_,err := s.f.Write(buf.Bytes())
+	return sameError(len(frags), err)
+}
+
+func (s *NDJSONSink)Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.f.Close()
+}
@@ -0,0 +1,400 @@
+package tracksink
+
+import(
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	fdb "github.com/skypies/flightdb"
+)
+
+// ReliableSink wraps another sink, and tries hard not to lose fragments:
+//  - if the sink is a BatchSink, writes from concurrent callers (which will
+//    be for different aircraft) are gathered up into batches
+//  - failed writes are retried, with jittered exponential backoff, unless
+//    the error was marked with Permanent. Each caller does its own retries
+//    (resubmitting to the batcher), so one failing write doesn't hold up
+//    anybody else's
+//  - a circuit breaker stops us hammering a store that is failing; while
+//    it's open, writes fail fast
+//  - with a SpillDir, fragments that can't be written go to disk instead,
+//    and are written out (in order) once the store recovers. Once anything
+//    has spilled, all new writes queue up behind it, so fragments for an
+//    aircraft are never written out of order.
+// The Datastore sink isn't a BatchSink (each write is a transaction on a
+// single flight), so it only gets the retries, the breaker and the spill.
+type ReliableSink struct {
+	inner   TrackSink
+	batcher BatchSink // nil if inner can't do batches
+	opts    ReliableOptions
+
+	reqs    chan *writeReq
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	brk     breaker
+	spill   *spillQueue // nil, unless opts.SpillDir
+
+	mu      sync.Mutex
+	stats   ReliableStats
+}
+
+// ReliableOptions configure a ReliableSink; zero values get the defaults.
+type ReliableOptions struct {
+	BatchSize        int           // Max frags per batch; keep it below the number of callers (default 8)
+	BatchDelay       time.Duration // Max time to wait for a batch to fill (default 50ms)
+	Retries          int           // After the first attempt (default 3; negative for none)
+	Backoff          time.Duration // Before the first retry; doubles each time (default 100ms)
+	MaxBackoff       time.Duration // (default 5s)
+	BreakerThreshold int           // Consecutive failures that open the breaker (default 5)
+	BreakerCooldown  time.Duration // How long it stays open before a trial write (default 30s)
+	SpillDir         string        // If empty, fragments we can't write are errors
+	SpillRetry       time.Duration // How often to try writing out spilled frags (default 5s)
+}
+
+// ReliableStats are running totals, for monitoring.
+type ReliableStats struct {
+	Writes       int64 // Fragments written to the inner sink
+	Batches      int64
+	Retries      int64
+	Failures     int64 // Fragments we gave up on (and didn't spill)
+	Spilled      int64
+	Unspilled    int64 // Spilled fragments since written to the inner sink
+	BreakerTrips int64
+	BreakerOpen  bool
+	SpillPending int
+}
+
+var ErrCircuitOpen = errors.New("tracksink: circuit breaker is open")
+var ErrClosed = errors.New("tracksink: sink is closed")
+
+// {{{ Permanent
+
+type permanentError struct{ error }
+
+func (e permanentError)Unwrap() error { return e.error }
+
+// Permanent marks an error as not worth retrying.
+func Permanent(err error) error { return permanentError{err} }
+
+// IsPermanent reports whether the error was marked with Permanent.
+func IsPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// }}}
+// {{{ NewReliableSink
+
+func NewReliableSink(inner TrackSink, opts ReliableOptions) (*ReliableSink, error) {
+	if opts.BatchSize <= 0 { opts.BatchSize = 8 }
+	if opts.BatchDelay <= 0 { opts.BatchDelay = 50 * time.Millisecond }
+	if opts.Retries < 0 { opts.Retries = 0 } else if opts.Retries == 0 { opts.Retries = 3 }
+	if opts.Backoff <= 0 { opts.Backoff = 100 * time.Millisecond }
+	if opts.MaxBackoff <= 0 { opts.MaxBackoff = 5 * time.Second }
+	if opts.BreakerThreshold <= 0 { opts.BreakerThreshold = 5 }
+	if opts.BreakerCooldown <= 0 { opts.BreakerCooldown = 30 * time.Second }
+	if opts.SpillRetry <= 0 { opts.SpillRetry = 5 * time.Second }
+
+	s := &ReliableSink{
+		inner: inner,
+		opts:  opts,
+		reqs:  make(chan *writeReq),
+		done:  make(chan struct{}),
+		brk:   breaker{threshold:opts.BreakerThreshold, cooldown:opts.BreakerCooldown},
+	}
+
+	if opts.SpillDir != "" {
+		q,err := openSpillQueue(opts.SpillDir)
+		if err != nil { return nil, err }
+		s.spill = q
+		s.wg.Add(1)
+		go s.unspill()
+	}
+	if b,ok := inner.(BatchSink); ok {
+		s.batcher = b
+		s.wg.Add(1)
+		go s.batch()
+	}
+	return s, nil
+}
+
+// }}}
+// {{{ s.AddTrackFragment
+
+type writeReq struct {
+	frag   *fdb.TrackFragment
+	perf   map[string]time.Time
+	result chan error
+}
+
+func (s *ReliableSink)AddTrackFragment(frag *fdb.TrackFragment, perf map[string]time.Time) error {
+	if s.spill != nil && s.spill.Len() > 0 {
+		return s.push([]*fdb.TrackFragment{frag}) // Get in line behind the others
+	}
+	return s.fallback(frag, s.write(frag, perf))
+}
+
+// attempt makes a single attempt at writing the fragment, via the batcher
+// if there is one.
+func (s *ReliableSink)attempt(frag *fdb.TrackFragment, perf map[string]time.Time) error {
+	if s.batcher != nil {
+		req := &writeReq{frag:frag, perf:perf, result:make(chan error, 1)}
+		select {
+		case s.reqs <- req:
+			return <-req.result
+		case <-s.done:
+			return ErrClosed
+		}
+	}
+
+	s.count(func(st *ReliableStats) { st.Batches++ })
+	err := s.inner.AddTrackFragment(frag, perf)
+	s.record([]error{err})
+	return err
+}
+
+// }}}
+// {{{ s.batch
+
+// batch gathers up concurrent writes, and writes them in batches. It makes
+// a single attempt at each batch; retrying is up to the callers. A BatchSink
+// doesn't get the perf maps, so each one is stamped with the start and end
+// of its batch (01_start, 06_persist).
+func (s *ReliableSink)batch() {
+	defer s.wg.Done()
+
+	for {
+		var first *writeReq
+		select {
+		case first = <-s.reqs:
+		case <-s.done:
+			return
+		}
+
+		batch := []*writeReq{first}
+		timeout := time.After(s.opts.BatchDelay)
+	fill:
+		for len(batch) < s.opts.BatchSize {
+			select {
+			case req := <-s.reqs:
+				batch = append(batch, req)
+			case <-timeout:
+				break fill
+			}
+		}
+
+		frags := []*fdb.TrackFragment{}
+		for _,req := range batch { frags = append(frags, req.frag) }
+		s.count(func(st *ReliableStats) { st.Batches++ })
+		tStart := time.Now()
+		errs := s.batcher.AddTrackFragments(frags)
+		tEnd := time.Now()
+		s.record(errs)
+		for i,req := range batch {
+			if req.perf != nil { req.perf["01_start"],req.perf["06_persist"] = tStart, tEnd }
+			req.result <- errs[i]
+		}
+	}
+}
+
+// }}}
+// {{{ s.write
+
+// write makes as many attempts at writing the fragment as it's allowed,
+// and returns the final error.
+func (s *ReliableSink)write(frag *fdb.TrackFragment, perf map[string]time.Time) error {
+	var err error
+	for attempt := 0; attempt <= s.opts.Retries; attempt++ {
+		if attempt > 0 {
+			s.count(func(st *ReliableStats) { st.Retries++ })
+			s.sleep(attempt)
+		}
+		if !s.brk.allow() { return ErrCircuitOpen }
+		if err = s.attempt(frag, perf); err == nil || IsPermanent(err) || err == ErrClosed { break }
+	}
+	return err
+}
+
+// record notes the outcome of a write to the inner sink, for the stats
+// and the breaker. Permanent errors are the fragment's fault, not the
+// sink's.
+func (s *ReliableSink)record(errs []error) {
+	ok := true
+	for _,err := range errs {
+		if err == nil {
+			s.count(func(st *ReliableStats) { st.Writes++ })
+		} else if !IsPermanent(err) {
+			ok = false
+		}
+	}
+	if s.brk.record(ok) {
+		s.count(func(st *ReliableStats) { st.BreakerTrips++ })
+	}
+}
+
+// Full jitter; see https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+func (s *ReliableSink)sleep(attempt int) {
+	d := s.opts.Backoff << uint(attempt-1)
+	if d <= 0 || d > s.opts.MaxBackoff { d = s.opts.MaxBackoff }
+	select {
+	case <-time.After(time.Duration(rand.Int63n(int64(d)) + 1)):
+	case <-s.done:
+	}
+}
+
+// }}}
+// {{{ s.fallback, s.push
+
+// fallback spills the fragment if it couldn't be written, and it can.
+func (s *ReliableSink)fallback(frag *fdb.TrackFragment, err error) error {
+	if err == nil { return nil }
+	if s.spill == nil || IsPermanent(err) {
+		s.count(func(st *ReliableStats) { st.Failures++ })
+		return err
+	}
+	if s.push([]*fdb.TrackFragment{frag}) != nil { return err }
+	return nil
+}
+
+func (s *ReliableSink)push(frags []*fdb.TrackFragment) error {
+	if err := s.spill.Push(frags); err != nil {
+		s.count(func(st *ReliableStats) { st.Failures += int64(len(frags)) })
+		return err
+	}
+	s.count(func(st *ReliableStats) { st.Spilled += int64(len(frags)) })
+	return nil
+}
+
+// }}}
+// {{{ s.unspill
+
+// unspill periodically tries to write out the spilled fragments, oldest
+// first. If a write fails, it waits and tries again from there.
+func (s *ReliableSink)unspill() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-time.After(s.opts.SpillRetry):
+		case <-s.done:
+			return
+		}
+
+		for s.spill.Len() > 0 && s.brk.allow() {
+			file,frags,err := s.spill.Peek()
+			if err != nil || file == "" { break }
+
+			n := 0
+			for _,frag := range frags {
+				err = s.inner.AddTrackFragment(frag, nil)
+				if IsPermanent(err) {
+					s.count(func(st *ReliableStats) { st.Failures++ })
+				} else if err != nil {
+					break
+				} else {
+					s.count(func(st *ReliableStats) { st.Writes++; st.Unspilled++ })
+				}
+				n++
+			}
+			if s.brk.record(err == nil || IsPermanent(err)) {
+				s.count(func(st *ReliableStats) { st.BreakerTrips++ })
+			}
+			if n > 0 {
+				if err := s.spill.Pop(file, frags, n); err != nil { break }
+			}
+			if n < len(frags) { break }
+		}
+	}
+}
+
+// }}}
+// {{{ s.Stats, s.Close
+
+func (s *ReliableSink)count(f func(st *ReliableStats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(&s.stats)
+}
+
+func (s *ReliableSink)Stats() ReliableStats {
+	s.mu.Lock()
+	st := s.stats
+	s.mu.Unlock()
+
+	st.BreakerOpen = s.brk.isOpen()
+	if s.spill != nil { st.SpillPending = s.spill.Len() }
+	return st
+}
+
+// Close stops the batcher and the unspiller, and closes the inner sink.
+// Anything still spilled stays on disk, for next time.
+func (s *ReliableSink)Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return s.inner.Close()
+}
+
+// }}}
+// {{{ breaker
+
+// breaker is a circuit breaker. It opens after threshold consecutive
+// failures; once the cooldown has passed, it lets a single trial through
+// (half-open), which closes it again if it works.
+type breaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+
+	failures  int
+	openUntil time.Time // Zero if closed
+	trial     bool      // Half-open, with a trial in flight
+}
+
+func (b *breaker)allow() bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.openUntil.IsZero() { return true }
+	if time.Now().Before(b.openUntil) || b.trial { return false }
+	b.trial = true
+	return true
+}
+
+// record notes the outcome of an attempt; it returns true if it tripped
+// the breaker.
+func (b *breaker)record(ok bool) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	wasTrial := b.trial
+	b.trial = false
+	if ok {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return false
+	}
+
+	b.failures++
+	if wasTrial || (b.openUntil.IsZero() && b.failures >= b.threshold) {
+		b.openUntil = time.Now().Add(b.cooldown)
+		return true
+	}
+	return false
+}
+
+func (b *breaker)isOpen() bool {
+	b.Lock()
+	defer b.Unlock()
+	return !b.openUntil.IsZero()
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,210 @@
+package tracksink
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skypies/adsb"
+	fdb "github.com/skypies/flightdb"
+)
+
+// flakySink fails the first `failures` writes, or every write while down.
+// It isn't a BatchSink; wrap it in a batchingFlakySink for that.
+type flakySink struct {
+	sync.Mutex
+	mem      *MemorySink
+	failures int
+	down     bool
+	err      error
+	attempts int
+	batches  []int // Sizes of the batches, if batching
+}
+
+func newFlakySink(failures int) *flakySink {
+	return &flakySink{mem:NewMemorySink(), failures:failures, err:errors.New("flaky")}
+}
+
+func (s *flakySink)Close() error { return nil }
+func (s *flakySink)NumFragments() int { return s.mem.NumFragments() }
+func (s *flakySink)Fragments(icao adsb.IcaoId) ([]*fdb.TrackFragment, error) { return s.mem.Fragments(icao) }
+
+func (s *flakySink)fail() bool {
+	s.Lock()
+	defer s.Unlock()
+	s.attempts++
+	if s.down { return true }
+	if s.failures > 0 { s.failures--; return true }
+	return false
+}
+
+func (s *flakySink)setDown(down bool) { s.Lock(); s.down = down; s.Unlock() }
+
+func (s *flakySink)AddTrackFragment(frag *fdb.TrackFragment, perf map[string]time.Time) error {
+	if s.fail() { return s.err }
+	return s.mem.AddTrackFragment(frag, perf)
+}
+
+// batchingFlakySink is a BatchSink
+type batchingFlakySink struct{ *flakySink }
+
+func (s batchingFlakySink)AddTrackFragments(frags []*fdb.TrackFragment) []error {
+	s.Lock()
+	s.batches = append(s.batches, len(frags))
+	s.Unlock()
+	if s.fail() { return sameError(len(frags), s.err) }
+	return s.mem.AddTrackFragments(frags)
+}
+
+var fastOpts = ReliableOptions{Backoff:time.Millisecond, BreakerCooldown:20*time.Millisecond,
+	SpillRetry:10*time.Millisecond}
+
+func TestReliableBatching(t *testing.T) {
+	inner := batchingFlakySink{newFlakySink(0)}
+	s,err := NewReliableSink(inner, ReliableOptions{BatchSize:10, BatchDelay:100*time.Millisecond})
+	if err != nil { t.Fatal(err) }
+
+	wg := sync.WaitGroup{}
+	for i:=0; i<30; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := s.AddTrackFragment(frag(fmt.Sprintf("A%05d", i), t0, 2), nil); err != nil {
+				t.Errorf("write %d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	s.Close()
+
+	if n := inner.NumFragments(); n != 30 { t.Errorf("expected 30 frags, got %d", n) }
+	if len(inner.batches) > 6 { t.Errorf("expected a few big batches, got %v", inner.batches) }
+	for _,n := range inner.batches {
+		if n > 10 { t.Errorf("batch of %d is bigger than BatchSize", n) }
+	}
+}
+
+// pickySink is a BatchSink that fails every fragment for one aircraft.
+type pickySink struct {
+	*MemorySink
+	bad adsb.IcaoId
+}
+
+func (s pickySink)AddTrackFragments(frags []*fdb.TrackFragment) []error {
+	errs := make([]error, len(frags))
+	for i,frag := range frags {
+		if frag.IcaoId == s.bad {
+			errs[i] = errors.New("picky")
+		} else {
+			errs[i] = s.MemorySink.AddTrackFragment(frag, nil)
+		}
+	}
+	return errs
+}
+
+// A write that's backing off between retries mustn't hold up the others.
+func TestReliableRetriesDontBlock(t *testing.T) {
+	inner := pickySink{NewMemorySink(), "BAD000"}
+	s,_ := NewReliableSink(inner, ReliableOptions{BatchSize:4, BatchDelay:time.Millisecond,
+		Backoff:time.Second, MaxBackoff:time.Second, BreakerThreshold:100})
+	defer s.Close()
+
+	failed := make(chan error)
+	go func() { failed <- s.AddTrackFragment(frag("BAD000", t0, 2), nil) }()
+	time.Sleep(10 * time.Millisecond) // Let it fail once, and start backing off
+
+	tStart := time.Now()
+	for i:=0; i<5; i++ {
+		if err := s.AddTrackFragment(frag(fmt.Sprintf("A%05d", i), t0, 2), nil); err != nil {
+			t.Errorf("write %d: %v", i, err)
+		}
+	}
+	if took := time.Since(tStart); took > 500*time.Millisecond {
+		t.Errorf("writes were held up by the retries: took %s", took)
+	}
+	if inner.NumFragments() != 5 { t.Errorf("expected 5 frags, got %d", inner.NumFragments()) }
+
+	select {
+	case err := <-failed:
+		t.Errorf("bad write gave up too soon: %v", err)
+	default:
+	}
+}
+
+func TestReliableRetries(t *testing.T) {
+	inner := newFlakySink(2)
+	s,_ := NewReliableSink(inner, fastOpts)
+	if err := s.AddTrackFragment(frag("A81BD0", t0, 2), nil); err != nil {
+		t.Errorf("expected retries to succeed, got %v", err)
+	}
+	if st := s.Stats(); st.Retries != 2 || st.Writes != 1 { t.Errorf("stats: %+v", st) }
+
+	// Permanent errors are not retried
+	inner.err = Permanent(errors.New("no"))
+	inner.failures = 1
+	inner.attempts = 0
+	if err := s.AddTrackFragment(frag("A81BD0", t0, 2), nil); err == nil || inner.attempts != 1 {
+		t.Errorf("permanent error: %v, after %d attempts", err, inner.attempts)
+	}
+	s.Close()
+}
+
+func TestReliableBreaker(t *testing.T) {
+	inner := newFlakySink(0)
+	inner.setDown(true)
+	s,_ := NewReliableSink(inner, ReliableOptions{Retries:-1, BreakerThreshold:3,
+		BreakerCooldown:50*time.Millisecond})
+	defer s.Close()
+
+	for i:=0; i<3; i++ { s.AddTrackFragment(frag("A81BD0", t0, 2), nil) }
+	if st := s.Stats(); !st.BreakerOpen || st.BreakerTrips != 1 { t.Fatalf("breaker didn't trip: %+v", st) }
+	if err := s.AddTrackFragment(frag("A81BD0", t0, 2), nil); err != ErrCircuitOpen {
+		t.Errorf("expected fast failure, got %v", err)
+	}
+	if inner.attempts != 3 { t.Errorf("open breaker let writes through: %d attempts", inner.attempts) }
+
+	// After the cooldown, one trial write closes it again
+	inner.setDown(false)
+	time.Sleep(60 * time.Millisecond)
+	if err := s.AddTrackFragment(frag("A81BD0", t0, 2), nil); err != nil { t.Errorf("trial write: %v", err) }
+	if s.Stats().BreakerOpen { t.Errorf("breaker still open") }
+}
+
+func TestReliableSpill(t *testing.T) {
+	dir := t.TempDir()
+	inner := newFlakySink(0)
+	inner.setDown(true)
+	opts := fastOpts
+	opts.SpillDir = dir
+	opts.SpillRetry = time.Hour // We'll drive it by hand, via a restart
+	s,_ := NewReliableSink(inner, opts)
+
+	// These all fail, so spill; later ones queue up behind them, even once the sink is back
+	for i:=0; i<3; i++ {
+		if err := s.AddTrackFragment(frag("A81BD0", t0.Add(time.Duration(i)*time.Minute), i+1), nil); err != nil {
+			t.Errorf("write %d: expected a spill, got %v", i, err)
+		}
+	}
+	inner.setDown(false)
+	s.AddTrackFragment(frag("A81BD0", t0.Add(3*time.Minute), 4), nil)
+	if st := s.Stats(); st.Spilled != 4 || st.SpillPending != 4 || inner.NumFragments() != 0 {
+		t.Fatalf("stats: %+v; %d frags in sink", st, inner.NumFragments())
+	}
+	s.Close()
+
+	// Restart; the spill should get written out, in order
+	opts.SpillRetry = 10 * time.Millisecond
+	s,err := NewReliableSink(inner, opts)
+	if err != nil { t.Fatal(err) }
+	defer s.Close()
+	for i:=0; i<100 && s.Stats().SpillPending > 0; i++ { time.Sleep(10 * time.Millisecond) }
+
+	frags,_ := inner.Fragments("A81BD0")
+	if len(frags) != 4 { t.Fatalf("expected 4 frags, got %d (%+v)", len(frags), s.Stats()) }
+	for i,f := range frags {
+		if len(f.Track) != i+1 { t.Errorf("frag %d out of order: %d points", i, len(f.Track)) }
+	}
+	if st := s.Stats(); st.Unspilled != 4 { t.Errorf("stats: %+v", st) }
+}
@@ -0,0 +1,120 @@
+package tracksink
+
+import(
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	fdb "github.com/skypies/flightdb"
+)
+
+// spillQueue is a FIFO of fragments on disk, for when the real sink is
+// down. Each batch goes into its own file of newline-delimited JSON, named
+// so that the files sort into the order they were written. Files left over
+// from a previous run are picked up again.
+type spillQueue struct {
+	sync.Mutex
+	dir     string
+	seq     int64
+	files   []string // Oldest first
+	pending int      // Fragments, over all the files
+}
+
+func openSpillQueue(dir string) (*spillQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil { return nil, err }
+	files,err := filepath.Glob(filepath.Join(dir, "spill-*.ndjson"))
+	if err != nil { return nil, err }
+	sort.Strings(files)
+
+	q := &spillQueue{dir:dir, files:files}
+	for _,file := range files {
+		frags,err := readSpillFile(file)
+		if err != nil { return nil, err }
+		q.pending += len(frags)
+		fmt.Sscanf(filepath.Base(file), "spill-%d.ndjson", &q.seq)
+	}
+	return q, nil
+}
+
+// Len returns the number of fragments waiting on disk.
+func (q *spillQueue)Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.pending
+}
+
+// Push appends fragments to the end of the queue; once it returns, they're
+// safely on disk.
+func (q *spillQueue)Push(frags []*fdb.TrackFragment) error {
+	q.Lock()
+	defer q.Unlock()
+
+	q.seq++
+	file := filepath.Join(q.dir, fmt.Sprintf("spill-%020d.ndjson", q.seq))
+	if err := writeSpillFile(file, frags); err != nil { return err }
+	q.files = append(q.files, file)
+	q.pending += len(frags)
+	return nil
+}
+
+// Peek returns the fragments in the oldest file.
+func (q *spillQueue)Peek() (string, []*fdb.TrackFragment, error) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.files) == 0 { return "", nil, nil }
+	frags,err := readSpillFile(q.files[0])
+	return q.files[0], frags, err
+}
+
+// Pop removes the first n fragments of the oldest file (as returned by
+// Peek); the file goes once they're all gone.
+func (q *spillQueue)Pop(file string, frags []*fdb.TrackFragment, n int) error {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.files) == 0 || q.files[0] != file { return fmt.Errorf("spill: %s is not the head", file) }
+
+	if n < len(frags) {
+		// Rewrite what's left, atomically
+		tmp := file + ".tmp"
+		if err := writeSpillFile(tmp, frags[n:]); err != nil { return err }
+		if err := os.Rename(tmp, file); err != nil { return err }
+	} else {
+		if err := os.Remove(file); err != nil { return err }
+		q.files = q.files[1:]
+	}
+	q.pending -= n
+	return nil
+}
+
+func writeSpillFile(file string, frags []*fdb.TrackFragment) error {
+	f,err := os.Create(file)
+	if err != nil { return err }
+	enc := json.NewEncoder(f)
+	for _,frag := range frags {
+		if err := enc.Encode(frag); err != nil { f.Close(); return err }
+	}
+	if err := f.Sync(); err != nil { f.Close(); return err }
+	return f.Close()
+}
+
+func readSpillFile(file string) ([]*fdb.TrackFragment, error) {
+	f,err := os.Open(file)
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	frags := []*fdb.TrackFragment{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		frag := fdb.TrackFragment{}
+		if err := json.Unmarshal(scanner.Bytes(), &frag); err != nil {
+			return nil, fmt.Errorf("spill: %s: %v", file, err)
+		}
+		frags = append(frags, &frag)
+	}
+	return frags, scanner.Err()
+}
@@ -0,0 +1,129 @@
+// Package tracksink abstracts away where the consolidator writes its track
+// fragments. In prod they go to Datastore (via flightdb/fgae); but a
+// consolidator can also run fully self-hosted, writing to a local BoltDB
+// file or to newline-delimited JSON, and tests can use an in-memory sink.
+package tracksink
+
+import(
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/skypies/adsb"
+	fdb "github.com/skypies/flightdb"
+)
+
+// A TrackSink persists fragments of track. Implementations must be safe
+// for concurrent use, as the consolidator runs many DB workers; but callers
+// promise not to write two fragments for the same aircraft concurrently.
+type TrackSink interface {
+	// The perf map is optional; sinks may record the times at which they hit
+	// each stage of the write (see fgae.AddTrackFragment for the stage names).
+	AddTrackFragment(frag *fdb.TrackFragment, perf map[string]time.Time) error
+	Close() error
+}
+
+// A BatchSink can write fragments for many different aircraft in one go,
+// which is much cheaper than one at a time for some stores. The returned
+// slice has an error (or nil) for each fragment. ReliableSink batches up
+// writes to sinks that implement this (and fills in the perf maps for
+// them).
+type BatchSink interface {
+	TrackSink
+	AddTrackFragments(frags []*fdb.TrackFragment) []error
+}
+
+// A Lookup finds reference data for an aircraft; *enrich.Enricher is one.
+// Sinks that have somewhere to put it store it along with the fragment.
+type Lookup interface {
+	Airframe(icao adsb.IcaoId) *fdb.Airframe
+	Schedule(icao adsb.IcaoId, callsign string) *fdb.Schedule
+}
+
+// SetLookup gives the sink a Lookup, if it's the kind of sink that can
+// use one.
+func SetLookup(s TrackSink, l Lookup) {
+	switch s := s.(type) {
+	case *DatastoreSink: s.Lookup = l
+	case *BoltSink:      s.Lookup = l
+	case *NDJSONSink:    s.Lookup = l
+	}
+}
+
+// enrichedFragment is how the JSON-based sinks store a fragment with its
+// reference data; it still unmarshals into a plain fdb.TrackFragment.
+type enrichedFragment struct {
+	*fdb.TrackFragment
+	Airframe *fdb.Airframe `json:",omitempty"`
+	Schedule *fdb.Schedule `json:",omitempty"`
+}
+
+func enrich(frag *fdb.TrackFragment, l Lookup) interface{} {
+	if l == nil { return frag }
+	return enrichedFragment{
+		TrackFragment: frag,
+		Airframe:      l.Airframe(frag.IcaoId),
+		Schedule:      l.Schedule(frag.IcaoId, frag.Callsign),
+	}
+}
+
+// sameError is for batches that succeed or fail as a whole.
+func sameError(n int, err error) []error {
+	errs := make([]error, n)
+	for i := range errs { errs[i] = err }
+	return errs
+}
+
+// {{{ New
+
+// New builds a sink from a spec string. The Datastore sink needs more
+// setup than fits in a string, so use NewDatastoreSink for that.
+//   discard           - drop everything on the floor (the old dry-run behaviour)
+//   memory            - keep everything in memory
+//   bolt:FILENAME     - a local BoltDB file
+//   ndjson:FILENAME   - append newline-delimited JSON to a file
+func New(spec string) (TrackSink, error) {
+	kind,arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind,arg = spec[:i], spec[i+1:]
+	}
+
+	switch kind {
+	case "discard":
+		return Discard{}, nil
+	case "memory":
+		return NewMemorySink(), nil
+	case "bolt":
+		if arg == "" { return nil, fmt.Errorf("tracksink: bolt needs a filename") }
+		return NewBoltSink(arg)
+	case "ndjson":
+		if arg == "" { return nil, fmt.Errorf("tracksink: ndjson needs a filename") }
+		return NewNDJSONSink(arg)
+	default:
+		return nil, fmt.Errorf("tracksink: unknown sink spec %q", spec)
+	}
+}
+
+// }}}
+// {{{ Discard
+
+// Discard is a sink that does nothing.
+type Discard struct {}
+
+func (Discard)AddTrackFragment(frag *fdb.TrackFragment, perf map[string]time.Time) error {
+	return nil
+}
+func (Discard)AddTrackFragments(frags []*fdb.TrackFragment) []error {
+	return make([]error, len(frags))
+}
+func (Discard)Close() error { return nil }
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,138 @@
+// go test -v github.com/skypies/pi/tracksink
+package tracksink
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/skypies/adsb"
+	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/geo"
+)
+
+func frag(icao string, t time.Time, n int) *fdb.TrackFragment {
+	msgs := []*adsb.CompositeMsg{}
+	for i:=0; i<n; i++ {
+		m := adsb.CompositeMsg{Msg: adsb.Msg{
+			Type: "MSG",
+			Icao24: adsb.IcaoId(icao),
+			Callsign: "ABC123",
+			GeneratedTimestampUTC: t.Add(time.Duration(i) * time.Second),
+			Position: geo.Latlong{Lat:37.0 + float64(i)*0.01, Long:-122.0},
+			Altitude: 10000,
+		}}
+		msgs = append(msgs, &m)
+	}
+	return fdb.MessagesToTrackFragment(msgs)
+}
+
+var t0 = time.Date(2015, 12, 25, 8, 0, 0, 0, time.UTC)
+
+func TestMemorySink(t *testing.T) {
+	s := NewMemorySink()
+	s.AddTrackFragment(frag("A81BD0", t0, 3), nil)
+	s.AddTrackFragment(frag("A81BD0", t0.Add(time.Minute), 2), nil)
+	s.AddTrackFragment(frag("A81BD1", t0, 1), nil)
+
+	if n := s.NumFragments(); n != 3 {
+		t.Errorf("expected 3 frags, got %d", n)
+	}
+	if frags,_ := s.Fragments("A81BD0"); len(frags) != 2 || len(frags[1].Track) != 2 {
+		t.Errorf("bad frags for A81BD0: %v", frags)
+	}
+}
+
+func TestBoltSink(t *testing.T) {
+	s,err := New("bolt:" + filepath.Join(t.TempDir(), "frags.db"))
+	if err != nil { t.Fatal(err) }
+	defer s.Close()
+
+	// Write out of order; should read back in time order
+	for _,offset := range []int{2, 0, 1} {
+		f := frag("A81BD0", t0.Add(time.Duration(offset) * time.Minute), offset+1)
+		if err := s.AddTrackFragment(f, nil); err != nil { t.Fatal(err) }
+	}
+
+	frags,err := s.(*BoltSink).Fragments("A81BD0")
+	if err != nil { t.Fatal(err) }
+	if len(frags) != 3 { t.Fatalf("expected 3 frags, got %d", len(frags)) }
+	for i,f := range frags {
+		if len(f.Track) != i+1 {
+			t.Errorf("frag %d: expected %d points, got %d", i, i+1, len(f.Track))
+		}
+		if f.IcaoId != "A81BD0" || f.DataSystem != fdb.DSADSB {
+			t.Errorf("frag %d: bad round trip: %s", i, f)
+		}
+	}
+
+	if frags,_ := s.(*BoltSink).Fragments("FFFFFF"); len(frags) != 0 {
+		t.Errorf("expected nothing for unknown aircraft, got %d", len(frags))
+	}
+}
+
+func TestNDJSONSink(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "frags.ndjson")
+	s,err := New("ndjson:" + filename)
+	if err != nil { t.Fatal(err) }
+	s.AddTrackFragment(frag("A81BD0", t0, 3), nil)
+	s.AddTrackFragment(frag("A81BD1", t0, 2), nil)
+	if err := s.Close(); err != nil { t.Fatal(err) }
+
+	f,err := os.Open(filename)
+	if err != nil { t.Fatal(err) }
+	defer f.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		frag := fdb.TrackFragment{}
+		if err := json.Unmarshal(scanner.Bytes(), &frag); err != nil {
+			t.Errorf("line %d: %v", n, err)
+		}
+		n++
+	}
+	if n != 2 { t.Errorf("expected 2 lines, got %d", n) }
+}
+
+func TestBadSpecs(t *testing.T) {
+	for _,spec := range []string{"", "bolt", "ndjson:", "sqlite:foo.db"} {
+		if _,err := New(spec); err == nil {
+			t.Errorf("spec %q: expected an error", spec)
+		}
+	}
+}
+
+type stubLookup struct{}
+
+func (stubLookup)Airframe(icao adsb.IcaoId) *fdb.Airframe {
+	return &fdb.Airframe{Icao24:string(icao), Registration:"N12345"}
+}
+func (stubLookup)Schedule(icao adsb.IcaoId, callsign string) *fdb.Schedule { return nil }
+
+func TestLookup(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "frags.ndjson")
+	s,err := New("ndjson:" + filename)
+	if err != nil { t.Fatal(err) }
+	SetLookup(s, stubLookup{})
+	s.AddTrackFragment(frag("A81BD0", t0, 3), nil)
+	s.Close()
+
+	data,err := os.ReadFile(filename)
+	if err != nil { t.Fatal(err) }
+	rec := struct {
+		fdb.TrackFragment
+		Airframe *fdb.Airframe
+		Schedule *fdb.Schedule
+	}{}
+	if err := json.Unmarshal(data, &rec); err != nil { t.Fatal(err) }
+	if rec.IcaoId != "A81BD0" || len(rec.Track) != 3 {
+		t.Errorf("fragment didn't survive: %s", rec.TrackFragment)
+	}
+	if rec.Airframe == nil || rec.Airframe.Registration != "N12345" || rec.Schedule != nil {
+		t.Errorf("bad enrichment: %v, %v", rec.Airframe, rec.Schedule)
+	}
+}
@@ -0,0 +1,160 @@
+package vitals
+
+// Rendering a registry, for humans and for Prometheus.
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+import(
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// {{{ labelString
+
+func labelString(names, values []string, extra ...string) string {
+	strs := []string{}
+	for i,n := range names {
+		strs = append(strs, fmt.Sprintf("%s=%q", n, values[i]))
+	}
+	for i:=0; i+1<len(extra); i+=2 {
+		strs = append(strs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(strs) == 0 { return "" }
+	return "{" + strings.Join(strs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):  return "+Inf"
+	case math.IsInf(v, -1): return "-Inf"
+	case math.IsNaN(v):     return "NaN"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// }}}
+// {{{ r.WritePrometheus
+
+// WritePrometheus writes out every metric, in the text exposition format.
+func (r *Registry)WritePrometheus(w io.Writer) error {
+	b := &strings.Builder{}
+	for _,f := range r.sortedFamilies() {
+		all := f.sortedSeries()
+		if len(all) == 0 { continue }
+
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _,s := range all {
+			if f.kind != kindHistogram {
+				fmt.Fprintf(b, "%s%s %s\n", f.name, labelString(f.labelNames, s.labelValues),
+					formatValue(s.value()))
+				continue
+			}
+
+			s.mu.Lock()
+			for i,le := range f.buckets {
+				fmt.Fprintf(b, "%s_bucket%s %d\n", f.name,
+					labelString(f.labelNames, s.labelValues, "le", formatValue(le)), s.counts[i])
+			}
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name,
+				labelString(f.labelNames, s.labelValues, "le", "+Inf"), s.count)
+			fmt.Fprintf(b, "%s_sum%s %s\n", f.name, labelString(f.labelNames, s.labelValues),
+				formatValue(s.sum))
+			fmt.Fprintf(b, "%s_count%s %d\n", f.name, labelString(f.labelNames, s.labelValues),
+				s.count)
+			s.mu.Unlock()
+		}
+	}
+	_,err := io.WriteString(w, b.String())
+	return err
+}
+
+// }}}
+// {{{ r.String
+
+// String summarizes all the metrics, one line per series; histograms show
+// their count, mean, and (bucket-rounded) percentiles.
+func (r *Registry)String() string {
+	str := ""
+	for _,f := range r.sortedFamilies() {
+		for _,s := range f.sortedSeries() {
+			name := f.name + labelString(f.labelNames, s.labelValues)
+			if f.kind != kindHistogram {
+				str += fmt.Sprintf("  %-60s %s\n", name, formatValue(s.value()))
+				continue
+			}
+			h := &Histogram{s, f.buckets}
+			n,sum := h.Count()
+			if n == 0 {
+				str += fmt.Sprintf("  %-60s (empty)\n", name)
+				continue
+			}
+			str += fmt.Sprintf("  %-60s n=%d, mean=%.1f, p50<=%s, p90<=%s, p99<=%s\n", name, n,
+				sum/float64(n), formatValue(h.Quantile(0.5)), formatValue(h.Quantile(0.9)),
+				formatValue(h.Quantile(0.99)))
+		}
+	}
+	return str
+}
+
+// }}}
+// {{{ r.Snapshot
+
+// Sample is one series, for serializing as JSON. Values that aren't
+// finite (e.g. a histogram percentile in the overflow bucket) are nil.
+type Sample struct {
+	Name   string            `json:"name"`
+	Kind   string            `json:"kind"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  *float64          `json:"value,omitempty"` // Counters and gauges
+
+	Count  int64             `json:"count,omitempty"` // Histograms
+	Sum    float64           `json:"sum,omitempty"`
+	P50    *float64          `json:"p50,omitempty"`
+	P90    *float64          `json:"p90,omitempty"`
+	P99    *float64          `json:"p99,omitempty"`
+}
+
+func finite(v float64) *float64 {
+	if math.IsInf(v, 0) || math.IsNaN(v) { return nil }
+	return &v
+}
+
+// Snapshot returns every series, sorted by name and then labels. If
+// keep is not nil, only the series it returns true for are included.
+func (r *Registry)Snapshot(keep func(name string, labels map[string]string) bool) []Sample {
+	ret := []Sample{}
+	for _,f := range r.sortedFamilies() {
+		for _,s := range f.sortedSeries() {
+			sample := Sample{Name:f.name, Kind:f.kind}
+			if len(f.labelNames) > 0 {
+				sample.Labels = map[string]string{}
+				for i,n := range f.labelNames { sample.Labels[n] = s.labelValues[i] }
+			}
+			if keep != nil && !keep(sample.Name, sample.Labels) { continue }
+
+			if f.kind != kindHistogram {
+				sample.Value = finite(s.value())
+			} else {
+				h := &Histogram{s, f.buckets}
+				sample.Count,sample.Sum = h.Count()
+				sample.P50 = finite(h.Quantile(0.5))
+				sample.P90 = finite(h.Quantile(0.9))
+				sample.P99 = finite(h.Quantile(0.99))
+			}
+			ret = append(ret, sample)
+		}
+	}
+	return ret
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,327 @@
+// Package vitals is a small registry of typed metrics - counters, gauges
+// and histograms, optionally with labels - that are safe to update from
+// any goroutine. The registry can render itself as text for a status page,
+// or in the Prometheus text exposition format.
+//
+//   var nBundles = vitals.NewCounter("app_bundles_total", "Bundles received.")
+//   var bundleSize = vitals.NewHistogram("app_bundle_size_messages", "Messages per bundle.",
+//     vitals.CountBuckets)
+//   var perReceiver = vitals.NewCounterVec("app_receiver_bundles_total", "Bundles, per receiver.",
+//     "receiver")
+//
+//   nBundles.Inc()
+//   bundleSize.Observe(float64(len(msgs)))
+//   perReceiver.With(msgs[0].ReceiverName).Inc()
+package vitals
+
+import(
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Bucket upper bounds, for timings in milliseconds and for sizes.
+var MillisBuckets = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+var CountBuckets = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+const(
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+// {{{ Registry{}
+
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+// Default is the registry used by the package level constructors.
+var Default = NewRegistry()
+
+// register returns the named family, creating it if needed. Registering
+// the same name as two different kinds of metric is a programming error.
+func (r *Registry)register(name, help, kind string, buckets []float64, labelNames []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f,exists := r.families[name]; exists {
+		if f.kind != kind || len(f.labelNames) != len(labelNames) {
+			panic(fmt.Sprintf("vitals: %s registered twice, as different kinds of metric", name))
+		}
+		return f
+	}
+	f := &family{
+		name: name,
+		help: help,
+		kind: kind,
+		buckets: buckets,
+		labelNames: labelNames,
+		series: map[string]*series{},
+	}
+	r.families[name] = f
+	return f
+}
+
+// sortedFamilies returns the families, sorted by name.
+func (r *Registry)sortedFamilies() []*family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := []*family{}
+	for _,f := range r.families { ret = append(ret, f) }
+	sort.Slice(ret, func(i,j int) bool { return ret[i].name < ret[j].name })
+	return ret
+}
+
+// Reset zeroes every counter, gauge and histogram. Values computed by
+// a func (see SetFunc) are left alone.
+func (r *Registry)Reset() {
+	for _,f := range r.sortedFamilies() {
+		for _,s := range f.sortedSeries() {
+			s.reset()
+		}
+	}
+}
+
+// }}}
+// {{{ family{}, series{}
+
+type family struct {
+	name       string
+	help       string
+	kind       string
+	buckets    []float64
+	labelNames []string
+
+	mu         sync.Mutex
+	series     map[string]*series
+}
+
+func (f *family)with(labelValues []string) *series {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("vitals: %s wants %d label values, got %d", f.name, len(f.labelNames),
+			len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s,exists := f.series[key]; exists { return s }
+
+	s := &series{labelValues: append([]string{}, labelValues...)}
+	if f.kind == kindHistogram {
+		s.counts = make([]int64, len(f.buckets))
+	}
+	f.series[key] = s
+	return s
+}
+
+func (f *family)sortedSeries() []*series {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := []string{}
+	for k,_ := range f.series { keys = append(keys, k) }
+	sort.Strings(keys)
+	ret := []*series{}
+	for _,k := range keys { ret = append(ret, f.series[k]) }
+	return ret
+}
+
+// A series is a single value (or histogram), for one set of label values.
+type series struct {
+	labelValues []string
+	bits        uint64 // a float64, accessed atomically
+
+	mu          sync.Mutex
+	fn          func() float64 // if set, computes the value
+	counts      []int64        // histograms only; counts[i] is #values <= buckets[i]
+	count       int64
+	sum         float64
+}
+
+func (s *series)add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&s.bits)
+		new := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&s.bits, old, new) { return }
+	}
+}
+
+func (s *series)set(v float64) {
+	atomic.StoreUint64(&s.bits, math.Float64bits(v))
+}
+
+func (s *series)value() float64 {
+	s.mu.Lock()
+	fn := s.fn
+	s.mu.Unlock()
+	if fn != nil { return fn() }
+	return math.Float64frombits(atomic.LoadUint64(&s.bits))
+}
+
+func (s *series)setFunc(fn func() float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fn = fn
+}
+
+func (s *series)reset() {
+	s.set(0)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i,_ := range s.counts { s.counts[i] = 0 }
+	s.count, s.sum = 0, 0
+}
+
+// }}}
+
+// {{{ Counter, CounterVec
+
+// A Counter only goes up (until Reset).
+type Counter struct{ s *series }
+
+func (c *Counter)Inc()            { c.s.add(1) }
+func (c *Counter)Add(n int64)     { c.s.add(float64(n)) }
+func (c *Counter)Value() int64    { return int64(c.s.value()) }
+
+// SetFunc is for counters that are maintained elsewhere; the func is
+// called whenever the value is needed.
+func (c *Counter)SetFunc(fn func() int64) {
+	c.s.setFunc(func() float64 { return float64(fn()) })
+}
+
+type CounterVec struct{ f *family }
+
+func (v *CounterVec)With(labelValues ...string) *Counter { return &Counter{v.f.with(labelValues)} }
+
+// Each calls f for every series, in order of label values.
+func (v *CounterVec)Each(f func(labelValues []string, c *Counter)) {
+	for _,s := range v.f.sortedSeries() { f(s.labelValues, &Counter{s}) }
+}
+
+func (r *Registry)NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{r.register(name, help, kindCounter, nil, labelNames)}
+}
+func (r *Registry)NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).With()
+}
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labelNames...)
+}
+func NewCounter(name, help string) *Counter { return Default.NewCounter(name, help) }
+
+// }}}
+// {{{ Gauge, GaugeVec
+
+// A Gauge goes up and down.
+type Gauge struct{ s *series }
+
+func (g *Gauge)Set(v float64)     { g.s.set(v) }
+func (g *Gauge)Add(delta float64) { g.s.add(delta) }
+func (g *Gauge)Value() float64    { return g.s.value() }
+
+// SetFunc makes the gauge compute its value on demand (e.g. an age).
+func (g *Gauge)SetFunc(fn func() float64) { g.s.setFunc(fn) }
+
+type GaugeVec struct{ f *family }
+
+func (v *GaugeVec)With(labelValues ...string) *Gauge { return &Gauge{v.f.with(labelValues)} }
+
+func (v *GaugeVec)Each(f func(labelValues []string, g *Gauge)) {
+	for _,s := range v.f.sortedSeries() { f(s.labelValues, &Gauge{s}) }
+}
+
+func (r *Registry)NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{r.register(name, help, kindGauge, nil, labelNames)}
+}
+func (r *Registry)NewGauge(name, help string) *Gauge {
+	return r.NewGaugeVec(name, help).With()
+}
+
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return Default.NewGaugeVec(name, help, labelNames...)
+}
+func NewGauge(name, help string) *Gauge { return Default.NewGauge(name, help) }
+
+// }}}
+// {{{ Histogram, HistogramVec
+
+// A Histogram counts values into buckets. Unlike util/metrics, it never
+// rotates; Prometheus does its own windowing.
+type Histogram struct{
+	s       *series
+	buckets []float64
+}
+
+func (h *Histogram)Observe(v float64) {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	h.s.count++
+	h.s.sum += v
+	for i,le := range h.buckets {
+		if v <= le { h.s.counts[i]++ }
+	}
+}
+
+// Count returns the number of values observed, and their sum.
+func (h *Histogram)Count() (int64, float64) {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	return h.s.count, h.s.sum
+}
+
+// Quantile returns the upper bound of the bucket holding the q'th
+// quantile; +Inf if it's beyond the last bucket, and NaN if it's empty.
+func (h *Histogram)Quantile(q float64) float64 {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	if h.s.count == 0 { return math.NaN() }
+	rank := int64(math.Ceil(q * float64(h.s.count)))
+	for i,n := range h.s.counts {
+		if n >= rank { return h.buckets[i] }
+	}
+	return math.Inf(1)
+}
+
+type HistogramVec struct{ f *family }
+
+func (v *HistogramVec)With(labelValues ...string) *Histogram {
+	return &Histogram{v.f.with(labelValues), v.f.buckets}
+}
+
+func (v *HistogramVec)Each(f func(labelValues []string, h *Histogram)) {
+	for _,s := range v.f.sortedSeries() { f(s.labelValues, &Histogram{s, v.f.buckets}) }
+}
+
+func (r *Registry)NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return &HistogramVec{r.register(name, help, kindHistogram, buckets, labelNames)}
+}
+func (r *Registry)NewHistogram(name, help string, buckets []float64) *Histogram {
+	return r.NewHistogramVec(name, help, buckets).With()
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labelNames...)
+}
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return Default.NewHistogram(name, help, buckets)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
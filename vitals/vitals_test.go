@@ -0,0 +1,103 @@
+// go test -v github.com/skypies/pi/vitals
+package vitals
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "A counter.")
+	v := r.NewCounterVec("test_labelled_total", "A labelled counter.", "who")
+
+	wg := sync.WaitGroup{}
+	for i:=0; i<10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j:=0; j<100; j++ {
+				c.Inc()
+				v.With("bob").Add(2)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if c.Value() != 1000 { t.Errorf("counter: %d", c.Value()) }
+	if n := v.With("bob").Value(); n != 2000 { t.Errorf("labelled counter: %d", n) }
+	if n := v.With("alice").Value(); n != 0 { t.Errorf("new series: %d", n) }
+
+	// Registering again gets you the same metric
+	if r.NewCounter("test_total", "A counter.").Value() != 1000 {
+		t.Errorf("re-registration gave a new counter")
+	}
+
+	r.Reset()
+	if c.Value() != 0 { t.Errorf("after reset, counter: %d", c.Value()) }
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("test_millis", "A histogram.", []float64{1, 10, 100})
+	if !math.IsNaN(h.Quantile(0.5)) { t.Errorf("empty histogram has a median") }
+
+	for _,v := range []float64{0.5, 5, 5, 5, 50, 500} {
+		h.Observe(v)
+	}
+	if n,sum := h.Count(); n != 6 || sum != 565.5 { t.Errorf("count %d, sum %f", n, sum) }
+	if q := h.Quantile(0.5); q != 10 { t.Errorf("p50 %f", q) }
+	if q := h.Quantile(0.99); !math.IsInf(q, 1) { t.Errorf("p99 %f", q) }
+}
+
+func TestPrometheus(t *testing.T) {
+	r := NewRegistry()
+	r.NewGaugeVec("test_temp", "A gauge.", "room").With("kitchen").Set(21.5)
+	r.NewGauge("test_func", "A func gauge.").SetFunc(func() float64 { return 42 })
+	r.NewHistogramVec("test_sizes", "A histogram.", []float64{1, 10}, "kind").With("a").Observe(3)
+	r.NewCounter("test_unused_total", "Never touched, but registered.")
+
+	b := &strings.Builder{}
+	r.WritePrometheus(b)
+	expected := `# HELP test_func A func gauge.
+# TYPE test_func gauge
+test_func 42
+# HELP test_sizes A histogram.
+# TYPE test_sizes histogram
+test_sizes_bucket{kind="a",le="1"} 0
+test_sizes_bucket{kind="a",le="10"} 1
+test_sizes_bucket{kind="a",le="+Inf"} 1
+test_sizes_sum{kind="a"} 3
+test_sizes_count{kind="a"} 1
+# HELP test_temp A gauge.
+# TYPE test_temp gauge
+test_temp{room="kitchen"} 21.5
+# HELP test_unused_total Never touched, but registered.
+# TYPE test_unused_total counter
+test_unused_total 0
+`
+	if b.String() != expected {
+		t.Errorf("prometheus output:-\n%s\n-- expected:-\n%s", b.String(), expected)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "A counter.", "who").With("bob").Add(3)
+	r.NewCounterVec("test_total", "A counter.", "who").With("alice").Inc()
+	r.NewHistogram("test_millis", "A histogram.", []float64{1, 10}).Observe(50)
+
+	all := r.Snapshot(nil)
+	if len(all) != 3 { t.Fatalf("snapshot had %d samples: %v", len(all), all) }
+	if h := all[0]; h.Name != "test_millis" || h.Count != 1 || h.Sum != 50 || h.P50 != nil {
+		t.Errorf("histogram sample: %+v", h) // p50 is in the overflow bucket, so nil
+	}
+	if c := all[1]; c.Labels["who"] != "alice" || *c.Value != 1 {
+		t.Errorf("counter sample: %+v", c)
+	}
+
+	bob := r.Snapshot(func(name string, labels map[string]string) bool { return labels["who"] == "bob" })
+	if len(bob) != 1 || *bob[0].Value != 3 { t.Errorf("filtered snapshot: %v", bob) }
+}